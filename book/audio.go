@@ -0,0 +1,925 @@
+package book
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// audioCacheSize is how many audio files Audiobooks keeps on disk.
+const audioCacheSize = 4
+
+// audioFolderPrefix starts the IDs of the audiobooks that are folders of MP3
+// files, which are followed by the path of the folder, encoded.
+const audioFolderPrefix = "audiobook:"
+
+// id3Length is how much of the start of an MP3 file is read for its tags,
+// enough for the text frames, which come before the cover.
+const id3Length = 256 << 10
+
+// mp4MaxBox is the size of the largest MP4 box that is read into memory.
+const mp4MaxBox = 16 << 20
+
+// mp4MaxChapters is the most chapters read from the chapter track of an M4B
+// file.
+const mp4MaxChapters = 10000
+
+// audioTypes are the content types of audiobooks and their tracks, by
+// extension.
+var audioTypes = map[string]string{".m4b": "audio/mp4", ".mp3": "audio/mpeg"}
+
+// mp4Containers are the MP4 boxes holding the boxes audiobooks are read from.
+var mp4Containers = map[string]bool{
+	"": true, "moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true,
+	"udta": true, "tref": true, "meta": true, "ilst": true,
+	"\xa9nam": true, "\xa9alb": true, "\xa9ART": true, "aART": true,
+}
+
+// isAudioName reports whether name is that of an audiobook or of one of the
+// MP3 files an audiobook is made of.
+func isAudioName(name string) bool {
+	return AudioType(name) != ""
+}
+
+// AudioType returns the content type of the audio file called name, or an
+// empty string if it is not one.
+func AudioType(name string) string {
+	return audioTypes[strings.ToLower(path.Ext(name))]
+}
+
+// sniffAudio reports whether head is the start of an MP4 file, for ".m4b",
+// or of an MP3 file, with tags or without.
+func sniffAudio(ext string, head []byte) bool {
+	if ext == ".m4b" {
+		return len(head) >= 8 && string(head[4:8]) == "ftyp"
+	}
+
+	return bytes.HasPrefix(head, []byte("ID3")) || len(head) >= 2 && head[0] == 0xff && head[1]&0xe0 == 0xe0
+}
+
+// GroupAudiobooks replaces the MP3 files in each folder of books, listed from
+// dir, with a single audiobook made of them, listed where the first of them
+// was. Its ID stands for the folder, see Audiobooks.
+func GroupAudiobooks(dir string, books []Book) (grouped []Book) {
+	index := map[string]int{}
+	for _, b := range books {
+		if !b.IsAudio || !strings.EqualFold(path.Ext(b.Name), ".mp3") {
+			grouped = append(grouped, b)
+			continue
+		}
+
+		if i, ok := index[b.Dir]; ok {
+			grouped[i].Tracks++
+			continue
+		}
+
+		folder := path.Join(dir, b.Dir)
+		name := path.Base(folder)
+		if name == "/" || name == "." {
+			name = "Audiobook"
+		}
+
+		index[b.Dir] = len(grouped)
+		grouped = append(grouped, Book{
+			ID:      audioFolderPrefix + base64.RawURLEncoding.EncodeToString([]byte(folder)),
+			Name:    name,
+			IsAudio: true,
+			Tracks:  1,
+			Dir:     b.Dir,
+			Source:  b.Source,
+		})
+	}
+
+	return
+}
+
+// Audiobook is what the player needs to know about an audiobook. Chapters
+// are in order and start Start seconds into their track, numbered from 0.
+type Audiobook struct {
+	Title    string         `json:"title"`
+	Authors  []string       `json:"authors,omitempty"`
+	Tracks   []AudioTrack   `json:"tracks"`
+	Chapters []AudioChapter `json:"chapters"`
+}
+
+type AudioTrack struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	// Duration is in seconds, and 0 if it is only known once played.
+	Duration float64 `json:"duration,omitempty"`
+}
+
+type AudioChapter struct {
+	Title string  `json:"title"`
+	Track int     `json:"track"`
+	Start float64 `json:"start"`
+}
+
+// Audiobooks serves the audiobooks of a repository: M4B files, with their
+// chapters read from the Nero or QuickTime chapter lists in them, and folders
+// of MP3 files, with a chapter for each file in natural order of their names.
+//
+// Audio is served from files so that players can seek in it. Files that the
+// repository does not download as a file are downloaded once and kept in a
+// temporary folder, for the last few played.
+type Audiobooks struct {
+	repo Repository
+	// root is the folder of the library, which audiobook folders must be
+	// in, and excluded are the folders below it that are not part of it.
+	root     string
+	excluded []string
+
+	lock sync.Mutex
+	// dir is created when the first file is downloaded.
+	dir   string
+	files map[string]*audioFile
+	// recent lists the IDs of the files, least recently used first.
+	recent []string
+}
+
+type audioFile struct {
+	// lock is held while the file is downloaded, so that it is only
+	// downloaded once however many ranges of it are asked for.
+	lock     sync.Mutex
+	loaded   bool
+	book     Book
+	revision string
+	path     string
+}
+
+func NewAudiobooks(repo Repository, root string, excluded ...string) (audiobooks *Audiobooks) {
+	audiobooks = new(Audiobooks)
+	audiobooks.repo = repo
+	audiobooks.root = cleanDir(root)
+	for _, dir := range excluded {
+		if dir != "" {
+			audiobooks.excluded = append(audiobooks.excluded, cleanDir(dir))
+		}
+	}
+	audiobooks.files = map[string]*audioFile{}
+
+	return
+}
+
+// Describe returns the tracks and chapters of the audiobook ID. It checks
+// that an M4B file on disk is the latest revision, downloading it again if
+// not.
+func (audiobooks *Audiobooks) Describe(ctx context.Context, ID string) (audiobook Audiobook, err error) {
+	if strings.HasPrefix(ID, audioFolderPrefix) {
+		return audiobooks.describeFolder(ctx, ID)
+	}
+
+	var book Book
+	var file *os.File
+	if book, file, err = audiobooks.open(ctx, ID, true); err != nil {
+		return
+	}
+	defer file.Close()
+
+	audiobook.Title = strings.TrimSuffix(book.Name, path.Ext(book.Name))
+	track := AudioTrack{ID: ID, Title: audiobook.Title}
+
+	if strings.EqualFold(path.Ext(book.Name), ".mp3") {
+		tags := readID3(file)
+		if tags.title != "" {
+			audiobook.Title, track.Title = tags.title, tags.title
+		}
+		audiobook.Authors = tags.authors
+	} else {
+		var info os.FileInfo
+		if info, err = file.Stat(); err != nil {
+			return
+		}
+
+		var m mp4Info
+		if m, err = readMP4(file, info.Size()); err != nil {
+			err = wrap(ErrInvalid, fmt.Errorf("reading audiobook %s: %v", ID, err))
+			return
+		}
+
+		if m.title != "" {
+			audiobook.Title, track.Title = m.title, m.title
+		}
+		audiobook.Authors = m.authors
+		audiobook.Chapters = m.chapters
+		track.Duration = m.duration
+	}
+
+	audiobook.Tracks = []AudioTrack{track}
+	if len(audiobook.Chapters) == 0 {
+		audiobook.Chapters = []AudioChapter{{Title: audiobook.Title}}
+	}
+
+	return
+}
+
+// describeFolder lists the MP3 files of the audiobook folder ID, titled by
+// their names, and takes the title and authors of the audiobook from the
+// tags of the first.
+func (audiobooks *Audiobooks) describeFolder(ctx context.Context, ID string) (audiobook Audiobook, err error) {
+	var folder []byte
+	if folder, err = base64.RawURLEncoding.DecodeString(strings.TrimPrefix(ID, audioFolderPrefix)); err != nil {
+		err = wrap(ErrNotFound, fmt.Errorf("invalid audiobook id %s: %v", ID, err))
+		return
+	}
+	dir := cleanDir(string(folder))
+	if !audiobooks.inLibrary(dir) {
+		err = wrap(ErrNotFound, fmt.Errorf("%s is not a folder of the library", folder))
+		return
+	}
+
+	var books []Book
+	if books, err = audiobooks.repo.List(ctx, dir); err != nil {
+		return
+	}
+
+	var tracks []Book
+	for _, b := range books {
+		if b.IsAudio && strings.EqualFold(path.Ext(b.Name), ".mp3") {
+			tracks = append(tracks, b)
+		}
+	}
+	if len(tracks) == 0 {
+		err = wrap(ErrNotFound, fmt.Errorf("%s has no MP3 files", dir))
+		return
+	}
+
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return naturalLess(strings.ToLower(tracks[i].Name), strings.ToLower(tracks[j].Name))
+	})
+
+	audiobook.Title = path.Base(dir)
+	for i, b := range tracks {
+		title := strings.TrimSuffix(b.Name, path.Ext(b.Name))
+		audiobook.Tracks = append(audiobook.Tracks, AudioTrack{ID: b.ID, Title: title})
+		audiobook.Chapters = append(audiobook.Chapters, AudioChapter{Title: title, Track: i})
+	}
+
+	// Only the start of the first file is needed, so it is not kept.
+	var data io.ReadCloser
+	if _, data, err = audiobooks.repo.Download(ctx, tracks[0].ID); err != nil {
+		return
+	}
+	defer data.Close()
+
+	var head []byte
+	if head, err = ioutil.ReadAll(io.LimitReader(data, id3Length)); err != nil {
+		return
+	}
+
+	tags := readID3(bytes.NewReader(head))
+	if tags.album != "" {
+		audiobook.Title = tags.album
+	}
+	audiobook.Authors = tags.authors
+
+	return
+}
+
+// inLibrary reports whether the canonical folder dir is the root of the
+// library or below it, and not in one of the excluded folders.
+func (audiobooks *Audiobooks) inLibrary(dir string) bool {
+	if dir != audiobooks.root && !isBelow(audiobooks.root, dir) {
+		return false
+	}
+
+	for _, excluded := range audiobooks.excluded {
+		if dir == excluded || isBelow(excluded, dir) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Open returns the audio file ID, an M4B file or one of the MP3 files of an
+// audiobook, ready to be read from anywhere. The caller closes the file.
+func (audiobooks *Audiobooks) Open(ctx context.Context, ID string) (book Book, file *os.File, err error) {
+	return audiobooks.open(ctx, ID, false)
+}
+
+// open returns the audio file ID, downloading it if it is not on disk, or if
+// check is set and it has changed.
+func (audiobooks *Audiobooks) open(ctx context.Context, ID string, check bool) (
+	book Book, file *os.File, err error,
+) {
+	audiobooks.lock.Lock()
+	entry, ok := audiobooks.files[ID]
+	if !ok {
+		entry = new(audioFile)
+		audiobooks.files[ID] = entry
+	}
+	audiobooks.use(ID)
+	audiobooks.lock.Unlock()
+
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+
+	if entry.loaded && !check {
+		file, err = os.Open(entry.path)
+		return entry.book, file, err
+	}
+
+	// Only download the file again if it changed, or if there is no other
+	// way to tell.
+	if entry.loaded {
+		var current Book
+		if current, err = Stat(ctx, audiobooks.repo, ID); err == nil && current.Revision != "" &&
+			current.Revision == entry.revision {
+			file, err = os.Open(entry.path)
+			return entry.book, file, err
+		} else if err != nil && !errors.Is(err, errNoStat) {
+			return
+		}
+		err = nil
+	}
+
+	var data io.ReadCloser
+	if book, data, err = audiobooks.repo.Download(ctx, ID); err != nil {
+		return
+	}
+
+	if !book.IsAudio {
+		data.Close()
+		err = wrap(ErrInvalid, fmt.Errorf("%s is not an audiobook", book.Name))
+		return
+	}
+
+	// Local files are served as they are.
+	if f, ok := data.(*os.File); ok {
+		return book, f, nil
+	}
+	defer data.Close()
+
+	if !entry.loaded || entry.revision != book.Revision {
+		entry.remove()
+		if err = audiobooks.load(ctx, entry, data); err != nil {
+			entry.remove()
+			return
+		}
+		entry.book = book
+		entry.revision = book.Revision
+	}
+
+	file, err = os.Open(entry.path)
+	return entry.book, file, err
+}
+
+// use marks ID as the most recently used file, and forgets the least
+// recently used one if there are too many. The caller holds the lock.
+func (audiobooks *Audiobooks) use(ID string) {
+	for i, recent := range audiobooks.recent {
+		if recent == ID {
+			audiobooks.recent = append(audiobooks.recent[:i], audiobooks.recent[i+1:]...)
+			break
+		}
+	}
+	audiobooks.recent = append(audiobooks.recent, ID)
+
+	if len(audiobooks.recent) <= audioCacheSize {
+		return
+	}
+
+	oldest := audiobooks.recent[0]
+	audiobooks.recent = audiobooks.recent[1:]
+
+	entry := audiobooks.files[oldest]
+	delete(audiobooks.files, oldest)
+
+	// Files already being played stay readable, as they are only unlinked.
+	go func() {
+		entry.lock.Lock()
+		defer entry.lock.Unlock()
+
+		entry.remove()
+	}()
+}
+
+// load downloads data into a file of its own. The caller holds the lock of
+// the file.
+func (audiobooks *Audiobooks) load(ctx context.Context, entry *audioFile, data io.Reader) (err error) {
+	audiobooks.lock.Lock()
+	if audiobooks.dir == "" {
+		audiobooks.dir, err = ioutil.TempDir("", "audiobooks")
+	}
+	dir := audiobooks.dir
+	audiobooks.lock.Unlock()
+	if err != nil {
+		return
+	}
+
+	var file *os.File
+	if file, err = ioutil.TempFile(dir, "audio"); err != nil {
+		return
+	}
+	entry.path = file.Name()
+
+	_, err = io.Copy(file, data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return
+	}
+
+	entry.loaded = true
+	return
+}
+
+// remove deletes the file. The caller holds its lock.
+func (entry *audioFile) remove() {
+	if entry.path != "" {
+		os.Remove(entry.path)
+	}
+
+	entry.loaded = false
+	entry.book = Book{}
+	entry.revision = ""
+	entry.path = ""
+}
+
+// id3Tags are the tags of an MP3 file that matter for audiobooks.
+type id3Tags struct {
+	title   string
+	album   string
+	authors []string
+}
+
+// readID3 reads the ID3v2 tags at the start of an MP3 file. Files without
+// tags, or with tags it does not understand, have none.
+func readID3(r io.Reader) (tags id3Tags) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:3]) != "ID3" {
+		return
+	}
+
+	version, flags := header[3], header[5]
+	data := make([]byte, minInt(syncsafe(header[6:10]), id3Length))
+	n, _ := io.ReadFull(r, data)
+	data = data[:n]
+
+	// Unsynchronised tags and extended headers are rare enough to give up
+	// on the first and skip the second.
+	if flags&0x80 != 0 && version < 4 {
+		return
+	}
+	if flags&0x40 != 0 && len(data) >= 4 {
+		if version == 3 {
+			data = data[minInt(len(data), 4+int(binary.BigEndian.Uint32(data))):]
+		} else {
+			data = data[minInt(len(data), syncsafe(data[:4])):]
+		}
+	}
+
+	idLength, headerLength := 4, 10
+	if version == 2 {
+		idLength, headerLength = 3, 6
+	}
+
+	var artist, albumArtist string
+	for len(data) >= headerLength && data[0] != 0 {
+		id := string(data[:idLength])
+		var size int
+		switch version {
+		case 2:
+			size = int(data[3])<<16 | int(data[4])<<8 | int(data[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(data[4:8]))
+		default:
+			size = syncsafe(data[4:8])
+		}
+		if size < 0 || size > len(data)-headerLength {
+			break
+		}
+
+		frame := data[headerLength : headerLength+size]
+		data = data[headerLength+size:]
+
+		switch id {
+		case "TIT2", "TT2":
+			tags.title = id3Text(frame)
+		case "TALB", "TAL":
+			tags.album = id3Text(frame)
+		case "TPE1", "TP1":
+			artist = id3Text(frame)
+		case "TPE2", "TP2":
+			albumArtist = id3Text(frame)
+		}
+	}
+
+	if albumArtist != "" {
+		artist = albumArtist
+	}
+	if artist != "" {
+		tags.authors = []string{artist}
+	}
+
+	return
+}
+
+// syncsafe decodes an ID3v2 size, of which only the low seven bits of each
+// byte count.
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// id3Text decodes the first value of an ID3v2 text frame, which starts with
+// the encoding of its text.
+func id3Text(frame []byte) (text string) {
+	if len(frame) == 0 {
+		return ""
+	}
+
+	switch frame[0] {
+	case 0:
+		text = decodeWindows1252(frame[1:])
+	case 1:
+		text = decodeText(frame[1:])
+	case 2:
+		text = decodeUTF16(frame[1:], true)
+	default:
+		text = strings.ToValidUTF8(string(frame[1:]), "\ufffd")
+	}
+
+	return strings.TrimSpace(strings.SplitN(text, "\x00", 2)[0])
+}
+
+// mp4Info is what an M4B file says about the audiobook in it.
+type mp4Info struct {
+	title    string
+	authors  []string
+	duration float64
+	chapters []AudioChapter
+}
+
+// mp4Box is a box of an MP4 file, with where its content is.
+type mp4Box struct {
+	kind   string
+	offset int64
+	size   int64
+}
+
+// readMP4 reads the metadata of the M4B file r, of size bytes. Chapters are
+// taken from the QuickTime chapter track, which Apple writes, and otherwise
+// from the Nero chapter list, which most other tools write.
+func readMP4(r io.ReaderAt, size int64) (info mp4Info, err error) {
+	root := mp4Box{offset: 0, size: size}
+
+	var moov mp4Box
+	var ok bool
+	if moov, ok, err = mp4Find(r, root, "moov"); err != nil {
+		return
+	} else if !ok {
+		err = fmt.Errorf("no movie box")
+		return
+	}
+
+	var data []byte
+	if data, err = mp4Content(r, moov, "mvhd"); err != nil {
+		return
+	}
+	if timescale, duration := mp4Times(data); timescale > 0 {
+		info.duration = float64(duration) / float64(timescale)
+	}
+
+	names := map[string]string{}
+	for _, kind := range []string{"\xa9nam", "\xa9alb", "\xa9ART", "aART"} {
+		if data, err = mp4Content(r, moov, "udta", "meta", "ilst", kind, "data"); err != nil {
+			return
+		}
+		// The value follows its type and locale.
+		if len(data) > 8 {
+			names[kind] = strings.TrimSpace(strings.ToValidUTF8(string(data[8:]), "\ufffd"))
+		}
+	}
+
+	info.title = names["\xa9alb"]
+	if names["\xa9nam"] != "" {
+		info.title = names["\xa9nam"]
+	}
+	if author := names["aART"]; author != "" {
+		info.authors = []string{author}
+	} else if author = names["\xa9ART"]; author != "" {
+		info.authors = []string{author}
+	}
+
+	if info.chapters, err = mp4ChapterTrack(r, moov); err != nil || len(info.chapters) > 0 {
+		return
+	}
+
+	if data, err = mp4Content(r, moov, "udta", "chpl"); err != nil {
+		return
+	}
+	info.chapters = neroChapters(data)
+
+	return
+}
+
+// mp4Children returns the boxes in parent.
+func mp4Children(r io.ReaderAt, parent mp4Box) (boxes []mp4Box, err error) {
+	offset, end := parent.offset, parent.offset+parent.size
+
+	// The meta box of MP4 files has a version before its boxes, while that
+	// of QuickTime files does not.
+	if parent.kind == "meta" {
+		head := make([]byte, 8)
+		if _, err = r.ReadAt(head, offset); err != nil {
+			return
+		}
+		if string(head[4:8]) != "hdlr" {
+			offset += 4
+		}
+	}
+
+	header := make([]byte, 16)
+	for offset+8 <= end {
+		if _, err = r.ReadAt(header[:8], offset); err != nil {
+			return
+		}
+
+		size, kind, headerSize := int64(binary.BigEndian.Uint32(header)), string(header[4:8]), int64(8)
+		switch size {
+		case 0:
+			size = end - offset
+		case 1:
+			if _, err = r.ReadAt(header[8:16], offset+8); err != nil {
+				return
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(header[8:16])), 16
+		}
+		if size < headerSize || size > end-offset {
+			return nil, fmt.Errorf("box %q does not fit in its parent", kind)
+		}
+
+		boxes = append(boxes, mp4Box{kind: kind, offset: offset + headerSize, size: size - headerSize})
+		offset += size
+	}
+
+	return
+}
+
+// mp4Find returns the box at the given path below parent.
+func mp4Find(r io.ReaderAt, parent mp4Box, path ...string) (box mp4Box, ok bool, err error) {
+	box = parent
+	for _, kind := range path {
+		if !mp4Containers[box.kind] {
+			return box, false, nil
+		}
+
+		var children []mp4Box
+		if children, err = mp4Children(r, box); err != nil {
+			return
+		}
+
+		ok = false
+		for _, child := range children {
+			if child.kind == kind {
+				box, ok = child, true
+				break
+			}
+		}
+		if !ok {
+			return
+		}
+	}
+
+	return box, true, nil
+}
+
+// mp4Content returns the content of the box at the given path below parent,
+// or nothing if there is no such box.
+func mp4Content(r io.ReaderAt, parent mp4Box, path ...string) (data []byte, err error) {
+	box, ok, err := mp4Find(r, parent, path...)
+	if err != nil || !ok {
+		return
+	}
+	if box.size > mp4MaxBox {
+		return nil, fmt.Errorf("box %q is too large", box.kind)
+	}
+
+	data = make([]byte, box.size)
+	_, err = r.ReadAt(data, box.offset)
+	return
+}
+
+// mp4Times reads the timescale and duration of a movie or media header box.
+func mp4Times(header []byte) (timescale uint32, duration uint64) {
+	switch {
+	case len(header) >= 32 && header[0] == 1:
+		return binary.BigEndian.Uint32(header[20:24]), binary.BigEndian.Uint64(header[24:32])
+	case len(header) >= 20:
+		return binary.BigEndian.Uint32(header[12:16]), uint64(binary.BigEndian.Uint32(header[16:20]))
+	}
+
+	return 0, 0
+}
+
+// mp4ChapterTrack reads the chapters in the text track that the track
+// references as its chapters.
+func mp4ChapterTrack(r io.ReaderAt, moov mp4Box) (chapters []AudioChapter, err error) {
+	var boxes []mp4Box
+	if boxes, err = mp4Children(r, moov); err != nil {
+		return
+	}
+
+	tracks := map[uint32]mp4Box{}
+	var chapterID uint32
+	for _, box := range boxes {
+		if box.kind != "trak" {
+			continue
+		}
+
+		var header, refs []byte
+		if header, err = mp4Content(r, box, "tkhd"); err != nil {
+			return
+		}
+		if len(header) >= 24 && header[0] == 1 {
+			tracks[binary.BigEndian.Uint32(header[20:24])] = box
+		} else if len(header) >= 16 {
+			tracks[binary.BigEndian.Uint32(header[12:16])] = box
+		}
+
+		if refs, err = mp4Content(r, box, "tref", "chap"); err != nil {
+			return
+		}
+		if len(refs) >= 4 && chapterID == 0 {
+			chapterID = binary.BigEndian.Uint32(refs)
+		}
+	}
+
+	track, ok := tracks[chapterID]
+	if !ok {
+		return
+	}
+
+	var mdhd, stts, stsz, stsc, stco []byte
+	if mdhd, err = mp4Content(r, track, "mdia", "mdhd"); err != nil {
+		return
+	}
+	timescale, _ := mp4Times(mdhd)
+	if timescale == 0 {
+		return
+	}
+
+	stbl, _, err := mp4Find(r, track, "mdia", "minf", "stbl")
+	if err != nil {
+		return
+	}
+	for _, table := range []struct {
+		data *[]byte
+		kind string
+	}{{&stts, "stts"}, {&stsz, "stsz"}, {&stsc, "stsc"}, {&stco, "stco"}} {
+		if *table.data, err = mp4Content(r, stbl, table.kind); err != nil {
+			return
+		}
+	}
+
+	// Chunks are at 32 bit offsets, or 64 bit ones in large files.
+	var offsets []int64
+	if len(stco) >= 8 {
+		for i := 0; i < int(binary.BigEndian.Uint32(stco[4:8])) && 12+4*i <= len(stco); i++ {
+			offsets = append(offsets, int64(binary.BigEndian.Uint32(stco[8+4*i:])))
+		}
+	} else {
+		var co64 []byte
+		if co64, err = mp4Content(r, stbl, "co64"); err != nil {
+			return
+		}
+		for i := 0; len(co64) >= 8 && i < int(binary.BigEndian.Uint32(co64[4:8])) && 16+8*i <= len(co64); i++ {
+			offsets = append(offsets, int64(binary.BigEndian.Uint64(co64[8+8*i:])))
+		}
+	}
+
+	// Samples all have the same size, or each their own. There is a sample
+	// for each chapter, so there are not many.
+	var sizes []int64
+	if len(stsz) >= 12 {
+		size, count := binary.BigEndian.Uint32(stsz[4:8]), int(binary.BigEndian.Uint32(stsz[8:12]))
+		for i := 0; i < count && i < mp4MaxChapters; i++ {
+			if size != 0 {
+				sizes = append(sizes, int64(size))
+			} else if 16+4*i <= len(stsz) {
+				sizes = append(sizes, int64(binary.BigEndian.Uint32(stsz[12+4*i:])))
+			}
+		}
+	}
+
+	// Each run of chunks, up to where the next starts, has as many samples
+	// in each chunk.
+	var sampleOffsets []int64
+	runs := 0
+	if len(stsc) >= 8 {
+		runs = minInt(int(binary.BigEndian.Uint32(stsc[4:8])), (len(stsc)-8)/12)
+	}
+	for i := 0; i < runs; i++ {
+		entry := stsc[8+12*i:]
+		first, perChunk := int(binary.BigEndian.Uint32(entry)), int(binary.BigEndian.Uint32(entry[4:]))
+		last := len(offsets)
+		if i+1 < runs {
+			last = int(binary.BigEndian.Uint32(stsc[20+12*i:])) - 1
+		}
+
+		for chunk := first - 1; chunk >= 0 && chunk < last && chunk < len(offsets); chunk++ {
+			offset := offsets[chunk]
+			for j := 0; j < perChunk && len(sampleOffsets) < len(sizes); j++ {
+				sampleOffsets = append(sampleOffsets, offset)
+				offset += sizes[len(sampleOffsets)-1]
+			}
+		}
+	}
+
+	// Each sample is a title, lasting as long as the time table says.
+	var start uint64
+	sample := 0
+	for i := 0; len(stts) >= 8 && i < int(binary.BigEndian.Uint32(stts[4:8])) && 16+8*i <= len(stts); i++ {
+		count, delta := int(binary.BigEndian.Uint32(stts[8+8*i:])), uint64(binary.BigEndian.Uint32(stts[12+8*i:]))
+		for j := 0; j < count && sample < len(sampleOffsets); j++ {
+			title := make([]byte, minInt(int(sizes[sample]), 1024))
+			if _, err = r.ReadAt(title, sampleOffsets[sample]); err != nil {
+				return nil, err
+			}
+			if len(title) >= 2 {
+				title = title[2:minInt(len(title), 2+int(binary.BigEndian.Uint16(title)))]
+			}
+
+			chapters = append(chapters, AudioChapter{
+				Title: chapterTitle(title, len(chapters)),
+				Start: float64(start) / float64(timescale),
+			})
+			start += delta
+			sample++
+		}
+	}
+
+	return
+}
+
+// neroChapters reads the chapters in a Nero chapter list: a version, with
+// four more reserved bytes in version 1, the number of chapters and, for
+// each, its start in units of 100ns and its title.
+func neroChapters(chpl []byte) (chapters []AudioChapter) {
+	if len(chpl) < 5 {
+		return
+	}
+
+	data := chpl[4:]
+	if chpl[0] == 1 {
+		if len(data) < 5 {
+			return
+		}
+		data = data[4:]
+	}
+
+	count := int(data[0])
+	data = data[1:]
+	for i := 0; i < count && len(data) >= 9; i++ {
+		start, length := binary.BigEndian.Uint64(data), int(data[8])
+		if len(data) < 9+length {
+			break
+		}
+
+		chapters = append(chapters, AudioChapter{
+			Title: chapterTitle(data[9:9+length], len(chapters)),
+			Start: float64(start) / 1e7,
+		})
+		data = data[9+length:]
+	}
+
+	return
+}
+
+// chapterTitle returns the title of the chapter with the given index,
+// which is made up for chapters without one.
+func chapterTitle(title []byte, index int) string {
+	if !utf8.Valid(title) {
+		title = []byte(decodeWindows1252(title))
+	}
+	if t := strings.TrimSpace(string(title)); t != "" {
+		return t
+	}
+
+	return fmt.Sprintf("Chapter %d", index+1)
+}
+
+// minInt is the smaller of a and b.
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
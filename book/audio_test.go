@@ -0,0 +1,207 @@
+package book
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func audioFolderID(folder string) string {
+	return audioFolderPrefix + base64.RawURLEncoding.EncodeToString([]byte(folder))
+}
+
+func TestAudiobooksDescribeFolderStaysInLibrary(t *testing.T) {
+	repo := NewMemoryRepository()
+	track := []byte("ID3\x03\x00\x00\x00\x00\x00\x00")
+	for _, p := range []string{
+		"/books/Tale/02.mp3", "/books/Tale/01.mp3", "/books/Attic/01.mp3",
+		"/trash/Tale/01.mp3", "/history/01.mp3", "/other/01.mp3",
+	} {
+		repo.put(p, track)
+	}
+
+	audiobooks := NewAudiobooks(repo, "/books", "/books/Attic", "/trash", "/history")
+	ctx := context.Background()
+
+	audiobook, err := audiobooks.Describe(ctx, audioFolderID("/books/Tale"))
+	if err != nil {
+		t.Fatalf("Describe of a folder of the library: %v", err)
+	}
+	if audiobook.Title != "Tale" || len(audiobook.Tracks) != 2 || audiobook.Tracks[0].Title != "01" {
+		t.Errorf("Describe = %+v, want Tale with tracks 01 and 02", audiobook)
+	}
+
+	for _, folder := range []string{
+		"/books/Attic", "/trash/Tale", "/history", "/other", "/books/../other", "/", "/booksTale",
+	} {
+		if _, err := audiobooks.Describe(ctx, audioFolderID(folder)); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Describe of %s: %v, want ErrNotFound", folder, err)
+		}
+	}
+}
+
+// id3Frame returns an ID3v2.3 or v2.4 text frame of fewer than 128 bytes,
+// in ISO-8859-1 or, with encoding 3, UTF-8.
+func id3Frame(id string, encoding byte, text string) []byte {
+	frame := append([]byte(id), 0, 0, 0, byte(len(text)+1), 0, 0, encoding)
+	return append(frame, text...)
+}
+
+// id3Tag returns an ID3v2 tag of the given version holding frames.
+func id3Tag(version byte, frames ...[]byte) []byte {
+	data := bytes.Join(frames, nil)
+	size := len(data)
+	tag := []byte{'I', 'D', '3', version, 0, 0, byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	return append(tag, data...)
+}
+
+func TestReadID3(t *testing.T) {
+	v22 := append([]byte("TT2"), 0, 0, 6, 0)
+	v22 = append(v22, "Intro"...)
+
+	for _, test := range []struct {
+		name string
+		data []byte
+		want id3Tags
+	}{
+		{"ID3v2.3", id3Tag(3, id3Frame("TIT2", 0, "Intro"), id3Frame("TALB", 0, "Tales"), id3Frame("TPE1", 0, "Reader"), id3Frame("TPE2", 0, "Jane Roe")),
+			id3Tags{title: "Intro", album: "Tales", authors: []string{"Jane Roe"}}},
+		{"ID3v2.4", id3Tag(4, id3Frame("TPE1", 0, "Jane Roe"), id3Frame("TIT2", 3, "Préface")),
+			id3Tags{title: "Préface", authors: []string{"Jane Roe"}}},
+		{"ID3v2.2", id3Tag(2, v22), id3Tags{title: "Intro"}},
+		{"no tag", []byte("\xff\xfb\x90\x00"), id3Tags{}},
+		{"a frame larger than the tag", id3Tag(3, []byte("TIT2\x00\x00\x10\x00\x00\x00\x00Intro")), id3Tags{}},
+	} {
+		if got := readID3(bytes.NewReader(append(test.data, make([]byte, 16)...))); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tags of %s = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+// mp4 returns a box of the given kind holding content.
+func mp4(kind string, content ...[]byte) []byte {
+	data := bytes.Join(content, nil)
+	box := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(box, uint32(8+len(data)))
+	copy(box[4:], kind)
+	return append(box, data...)
+}
+
+// u32 returns the numbers as big-endian 32 bit words.
+func u32(numbers ...int) []byte {
+	data := make([]byte, 4*len(numbers))
+	for i, n := range numbers {
+		binary.BigEndian.PutUint32(data[4*i:], uint32(n))
+	}
+	return data
+}
+
+// mp4Text returns an iTunes metadata item holding text.
+func mp4Text(kind string, text string) []byte {
+	return mp4(kind, mp4("data", u32(1, 0), []byte(text)))
+}
+
+// testM4B returns an audiobook of 90 seconds with the given chapter titles
+// starting every 30 seconds in a chapter track, or in a Nero chapter list if
+// nero is set.
+func testM4B(titles []string, nero bool) []byte {
+	ftyp := mp4("ftyp", []byte("M4B "), u32(0))
+
+	var samples, sizes []byte
+	for _, title := range titles {
+		sample := append([]byte{0, byte(len(title))}, title...)
+		samples = append(samples, sample...)
+		sizes = append(sizes, u32(len(sample))...)
+	}
+	mdat := mp4("mdat", samples)
+	first := len(ftyp) + 8
+
+	meta := mp4("meta", u32(0), mp4("hdlr", u32(0, 0), []byte("mdirappl"), u32(0, 0, 0), []byte{0}),
+		mp4("ilst", mp4Text("\xa9nam", "Tales"), mp4Text("\xa9ART", "Reader"), mp4Text("aART", "Jane Roe")))
+
+	var udta, traks []byte
+	if nero {
+		// Version 1, with reserved bytes, and starts in units of 100ns.
+		chpl := append(u32(0x01000000, 0), byte(len(titles)))
+		for i, title := range titles {
+			chpl = append(chpl, u32(0, i*30e7)...)
+			chpl = append(append(chpl, byte(len(title))), title...)
+		}
+		udta = mp4("udta", meta, mp4("chpl", chpl))
+	} else {
+		udta = mp4("udta", meta)
+		audio := mp4("trak", mp4("tkhd", u32(0, 0, 0, 1)), mp4("tref", mp4("chap", u32(2))))
+		text := mp4("trak", mp4("tkhd", u32(0, 0, 0, 2)),
+			mp4("mdia", mp4("mdhd", u32(0, 0, 0, 1000, 90000)),
+				mp4("minf", mp4("stbl",
+					mp4("stts", u32(0, 1, len(titles), 30000)),
+					mp4("stsz", u32(0, 0, len(titles)), sizes),
+					mp4("stsc", u32(0, 1, 1, len(titles), 1)),
+					mp4("stco", u32(0, 1, first)),
+				))))
+		traks = append(audio, text...)
+	}
+
+	moov := mp4("moov", mp4("mvhd", u32(0, 0, 0, 1000, 90000)), traks, udta)
+	return bytes.Join([][]byte{ftyp, mdat, moov}, nil)
+}
+
+func TestReadMP4(t *testing.T) {
+	titles := []string{"Opening", "", "Ending"}
+	want := []AudioChapter{{Title: "Opening"}, {Title: "Chapter 2", Start: 30}, {Title: "Ending", Start: 60}}
+
+	for _, nero := range []bool{false, true} {
+		data := testM4B(titles, nero)
+		info, err := readMP4(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("readMP4 with nero %v: %v", nero, err)
+		}
+
+		if info.title != "Tales" || !reflect.DeepEqual(info.authors, []string{"Jane Roe"}) || info.duration != 90 {
+			t.Errorf("info with nero %v = %q by %q, %vs", nero, info.title, info.authors, info.duration)
+		}
+		if !reflect.DeepEqual(info.chapters, want) {
+			t.Errorf("chapters with nero %v = %+v, want %+v", nero, info.chapters, want)
+		}
+	}
+
+	truncated := testM4B(titles, false)
+	truncated = truncated[:len(truncated)-20]
+	if _, err := readMP4(bytes.NewReader(truncated), int64(len(truncated))); err == nil {
+		t.Errorf("reading a truncated file succeeded")
+	}
+}
+
+func TestAudiobooksDownloadOnlyNewRevisions(t *testing.T) {
+	upstream := &countingRepository{MemoryRepository: NewMemoryRepository()}
+	upstream.put("/books/tales.m4b", testM4B([]string{"Opening"}, true))
+	audiobooks := NewAudiobooks(upstream, "/books")
+	ID := memoryID("/books/tales.m4b")
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := audiobooks.Describe(ctx, ID); err != nil {
+			t.Fatal(err)
+		}
+		_, file, err := audiobooks.Open(ctx, ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+	if upstream.downloads != 1 {
+		t.Errorf("%d downloads of an unchanged audiobook, want 1", upstream.downloads)
+	}
+
+	upstream.put("/books/tales.m4b", testM4B([]string{"Opening", "Ending"}, true))
+	if audiobook, err := audiobooks.Describe(ctx, ID); err != nil || len(audiobook.Chapters) != 2 {
+		t.Errorf("Describe after a new revision = %+v, %v, want 2 chapters", audiobook, err)
+	}
+	if upstream.downloads != 2 {
+		t.Errorf("%d downloads after a new revision, want 2", upstream.downloads)
+	}
+}
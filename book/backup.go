@@ -0,0 +1,268 @@
+package book
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupFormat is the version of the archives WriteBackup writes. Archives of
+// newer versions are refused by ReadBackup.
+const backupFormat = 1
+
+const (
+	backupManifestName = "manifest.json"
+	backupBooksName    = "books.json"
+	backupHistoryName  = "history.json"
+)
+
+// Backup is everything the reader knows about a library that is not in the
+// book files themselves.
+type Backup struct {
+	Manifest BackupManifest
+	// Books lists the library, with Dir relative to the book folder.
+	Books   []Book
+	History []BackupHistory
+}
+
+// BackupManifest describes a backup archive.
+type BackupManifest struct {
+	Format    int       `json:"format"`
+	Created   time.Time `json:"created"`
+	BookPath  string    `json:"book_path"`
+	Books     int       `json:"books"`
+	Histories int       `json:"histories"`
+}
+
+// BackupHistory is the history of one book. Path is where the book was in
+// the library, if it was there, so that the history can be matched to the
+// same book in another repository, where it has another ID.
+type BackupHistory struct {
+	ID      string `json:"id"`
+	Path    string `json:"path,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	Data    string `json:"data"`
+	Version string `json:"version"`
+}
+
+// RestoreChange is what RestoreBackup did, or would do, to the history of a
+// book: "add" a history it did not have, "update" one that differs, or
+// leave it "unchanged".
+type RestoreChange struct {
+	Action string `json:"action"`
+	// ID is the book the history is restored to, and BackupID the one it
+	// was saved for.
+	ID       string `json:"id"`
+	BackupID string `json:"backup_id"`
+	Path     string `json:"path,omitempty"`
+	Old      string `json:"old,omitempty"`
+	New      string `json:"new"`
+}
+
+// WriteBackup writes a zip archive of the books below bookPath and every
+// history to w: a manifest, the listing and the histories, each as JSON.
+// Histories are those history lists if it can, and those of the listed
+// books otherwise, including when a wrapper of a store that can not list
+// reports ErrCannotList. They are saved as history returns them, so an encrypted
+// history store yields a backup in plain text that can be restored
+// anywhere.
+func WriteBackup(
+	ctx context.Context, w io.Writer, repo Repository, history HistoryStore, bookPath string,
+) (manifest BackupManifest, err error) {
+	var books []Book
+	if books, err = ListRecursive(ctx, repo, bookPath); err != nil {
+		return
+	}
+
+	byID := map[string]Book{}
+	var IDs []string
+	for _, b := range books {
+		byID[b.ID] = b
+		IDs = append(IDs, b.ID)
+	}
+
+	if lister, ok := history.(HistoryLister); ok {
+		var listed []string
+		if listed, err = lister.ListHistory(ctx); err == nil {
+			IDs = listed
+		} else if errors.Is(err, ErrCannotList) {
+			err = nil
+		} else {
+			return
+		}
+	}
+
+	var histories []BackupHistory
+	for _, ID := range IDs {
+		var h History
+		if h, err = history.GetHistory(ctx, ID); err != nil {
+			err = fmt.Errorf("reading history of %s: %w", ID, err)
+			return
+		}
+
+		if h.Data == "" {
+			continue
+		}
+
+		entry := BackupHistory{ID: ID, Data: h.Data, Version: h.Version}
+		if b, ok := byID[ID]; ok {
+			entry.Path = path.Join(b.Dir, b.Name)
+			entry.Hash = b.Hash
+		}
+		histories = append(histories, entry)
+	}
+
+	manifest = BackupManifest{
+		Format:    backupFormat,
+		Created:   time.Now().UTC(),
+		BookPath:  bookPath,
+		Books:     len(books),
+		Histories: len(histories),
+	}
+
+	archive := zip.NewWriter(w)
+	for _, file := range []struct {
+		name string
+		v    interface{}
+	}{
+		{backupManifestName, manifest},
+		{backupBooksName, books},
+		{backupHistoryName, histories},
+	} {
+		var fw io.Writer
+		if fw, err = archive.Create(file.name); err != nil {
+			return
+		}
+
+		encoder := json.NewEncoder(fw)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(file.v); err != nil {
+			return
+		}
+	}
+
+	err = archive.Close()
+	return
+}
+
+// ReadBackup reads an archive written by WriteBackup.
+func ReadBackup(r io.ReaderAt, size int64) (backup Backup, err error) {
+	var archive *zip.Reader
+	if archive, err = zip.NewReader(r, size); err != nil {
+		err = wrap(ErrInvalid, fmt.Errorf("reading backup: %v", err))
+		return
+	}
+
+	for _, file := range []struct {
+		name string
+		v    interface{}
+	}{
+		{backupManifestName, &backup.Manifest},
+		{backupBooksName, &backup.Books},
+		{backupHistoryName, &backup.History},
+	} {
+		if err = readZipJSON(archive, file.name, file.v); err != nil {
+			err = wrap(ErrInvalid, fmt.Errorf("reading %s of backup: %v", file.name, err))
+			return
+		}
+
+		if file.name == backupManifestName && backup.Manifest.Format > backupFormat {
+			err = wrap(ErrInvalid, fmt.Errorf("backup has format %d, only up to %d is supported", backup.Manifest.Format, backupFormat))
+			return
+		}
+	}
+
+	return
+}
+
+func readZipJSON(archive *zip.Reader, name string, v interface{}) (err error) {
+	for _, f := range archive.File {
+		if f.Name != name {
+			continue
+		}
+
+		var r io.ReadCloser
+		if r, err = f.Open(); err != nil {
+			return
+		}
+		defer r.Close()
+
+		return json.NewDecoder(r).Decode(v)
+	}
+
+	return fmt.Errorf("%s is missing", name)
+}
+
+// RestoreBackup writes the histories of backup to history, replacing those
+// that differ. Each history goes to the book below bookPath at the same
+// path as when it was saved, or failing that with the same content hash, or
+// failing both to the ID it was saved for, so that a backup of one
+// repository can be restored to another. With dryRun set nothing is
+// written, and the changes are only reported.
+func RestoreBackup(
+	ctx context.Context, backup Backup, repo Repository, history HistoryStore,
+	bookPath string, dryRun bool,
+) (changes []RestoreChange, err error) {
+	var books []Book
+	if books, err = ListRecursive(ctx, repo, bookPath); err != nil {
+		return
+	}
+
+	byPath := map[string]string{}
+	byHash := map[string]string{}
+	for _, b := range books {
+		byPath[strings.ToLower(path.Join(b.Dir, b.Name))] = b.ID
+		if b.Hash != "" {
+			byHash[b.Hash] = b.ID
+		}
+	}
+
+	for _, entry := range backup.History {
+		change := RestoreChange{ID: entry.ID, BackupID: entry.ID, Path: entry.Path, New: entry.Data}
+		if ID, ok := byPath[strings.ToLower(entry.Path)]; ok && entry.Path != "" {
+			change.ID = ID
+		} else if ID, ok := byHash[entry.Hash]; ok && entry.Hash != "" {
+			change.ID = ID
+		}
+
+		var current History
+		if current, err = history.GetHistory(ctx, change.ID); err != nil {
+			err = fmt.Errorf("reading history of %s: %w", change.ID, err)
+			return
+		}
+
+		change.Old = current.Data
+		switch {
+		case current.Data == entry.Data:
+			change.Action = "unchanged"
+		case current.Version == "":
+			change.Action = "add"
+		default:
+			change.Action = "update"
+		}
+
+		if change.Action != "unchanged" && !dryRun {
+			if _, err = history.WriteHistory(ctx, change.ID, History{
+				Data: entry.Data, Version: current.Version,
+			}); err != nil {
+				err = fmt.Errorf("writing history of %s: %w", change.ID, err)
+				return
+			}
+		}
+
+		changes = append(changes, change)
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Action < changes[j].Action
+	})
+
+	return
+}
@@ -0,0 +1,52 @@
+package book
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+// unlistedHistoryStore hides that the store it wraps can list histories, as
+// the history of S3, WebDAV and SFTP can not.
+type unlistedHistoryStore struct {
+	HistoryStore
+}
+
+func TestWriteBackupThroughStoreThatCanNotList(t *testing.T) {
+	repo := NewMemoryRepository()
+	repo.put("/books/a.epub", []byte("first"))
+	repo.put("/books/b.epub", []byte("second"))
+	ctx := context.Background()
+
+	books, err := repo.List(ctx, "/books")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := unlistedHistoryStore{NewMemoryRepository()}
+	identified, err := NewIdentityRepository(repo, store, filepath.Join(t.TempDir(), "identity.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := identified.WriteHistory(ctx, books[0].ID, History{Data: "chapter 2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	manifest, err := WriteBackup(ctx, &archive, identified, identified, "/books")
+	if err != nil {
+		t.Fatalf("WriteBackup: %v", err)
+	}
+	if manifest.Books != 2 || manifest.Histories != 1 {
+		t.Errorf("manifest counts %d books and %d histories, want 2 and 1", manifest.Books, manifest.Histories)
+	}
+
+	backup, err := ReadBackup(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backup.History) != 1 || backup.History[0].ID != books[0].ID || backup.History[0].Data != "chapter 2" {
+		t.Errorf("backed up histories = %+v", backup.History)
+	}
+}
@@ -4,6 +4,42 @@ type Book struct {
 	ID    string
 	Name  string
 	IsPDF bool
+
+	// IsComic is set for comic archives, which are read page by page, see
+	// Comics.
+	IsComic bool
+
+	// IsAudio is set for audiobooks and the MP3 files they are made of,
+	// which are played, see Audiobooks.
+	IsAudio bool
+	// Tracks is the number of MP3 files of an audiobook that is a folder of
+	// them, see GroupAudiobooks.
+	Tracks int
+
+	// Revision changes whenever the content of the book changes.
+	Revision string
+
+	// Hash is the content hash of the book as Dropbox computes it, if known.
+	// Unlike the ID it stays the same when the book is copied, moved or
+	// uploaded again, see ContentHash.
+	Hash string
+
+	// Dir is the folder holding the book, relative to the folder that was
+	// listed and separated by slashes. It is empty for books directly in the
+	// listed folder.
+	Dir string
+
+	// Source is the name of the library the book comes from when several
+	// are merged by a CompositeRepository.
+	Source string
+
+	// Metadata, filled in by repositories that know more than the file name.
+	Title       string
+	Authors     []string
+	Series      string
+	SeriesIndex float64
+	Tags        []string
+	HasCover    bool
 }
 
 type History struct {
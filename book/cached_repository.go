@@ -0,0 +1,344 @@
+package book
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// CachedRepository is a read-through cache of book downloads in front of
+// another repository. Files are kept on disk keyed by book ID and revision,
+// evicted least recently used first once they exceed the size budget, and
+// dropped as soon as List reports a new revision for a book. If upstream can
+// describe books without downloading them, every download checks the
+// current revision first, so that a book changed upstream is never served
+// stale, including files cached before a restart. History is not cached.
+type CachedRepository struct {
+	Repository
+
+	dir     string
+	maxSize int64
+
+	lock sync.Mutex
+	// latest is the most recent listing of each book, used to find the
+	// revision to serve.
+	latest map[string]Book
+	// entries maps a cache key to its element in lru, most recent first.
+	entries  map[string]*list.Element
+	lru      *list.List
+	size     int64
+	inflight map[string]*cacheCall
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// cacheCall is a download in progress that other callers for the same book
+// wait on instead of starting their own.
+type cacheCall struct {
+	done chan struct{}
+	book Book
+	err  error
+}
+
+func NewCachedRepository(
+	upstream Repository, dir string, maxSize int64,
+) (repo *CachedRepository, err error) {
+	repo = new(CachedRepository)
+	repo.Repository = upstream
+	repo.dir = dir
+	repo.maxSize = maxSize
+	repo.latest = map[string]Book{}
+	repo.entries = map[string]*list.Element{}
+	repo.lru = list.New()
+	repo.inflight = map[string]*cacheCall{}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	// Pick up what is left over from a previous run, oldest first, so that
+	// the budget holds from the start.
+	var infos []os.FileInfo
+	if infos, err = ioutil.ReadDir(dir); err != nil {
+		return
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || len(info.Name()) != sha1.Size*2 {
+			os.Remove(filepath.Join(dir, info.Name()))
+			continue
+		}
+
+		repo.add(info.Name(), info.Size())
+	}
+
+	return
+}
+
+// List passes through to the upstream repository and drops cached files of
+// books whose revision has changed.
+func (repo *CachedRepository) List(ctx context.Context, path string) (books []Book, err error) {
+	if books, err = repo.Repository.List(ctx, path); err != nil {
+		return
+	}
+
+	repo.update(books)
+	return
+}
+
+// ListRecursive is List for the subfolders of path as well.
+func (repo *CachedRepository) ListRecursive(ctx context.Context, path string) (books []Book, err error) {
+	if books, err = ListRecursive(ctx, repo.Repository, path); err != nil {
+		return
+	}
+
+	repo.update(books)
+	return
+}
+
+// update records the latest listing of books.
+func (repo *CachedRepository) update(books []Book) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	for _, b := range books {
+		if old, ok := repo.latest[b.ID]; ok && old.Revision != b.Revision {
+			repo.remove(cacheKey(old.ID, old.Revision))
+		}
+		repo.latest[b.ID] = b
+	}
+}
+
+func (repo *CachedRepository) Download(ctx context.Context, ID string) (
+	book Book, data io.ReadCloser, err error,
+) {
+	if _, err = repo.Stat(ctx, ID); err != nil && !errors.Is(err, errNoStat) {
+		return
+	}
+	err = nil
+
+	repo.lock.Lock()
+	latest, known := repo.latest[ID]
+	if known && latest.Revision != "" {
+		if data, err = repo.open(cacheKey(ID, latest.Revision)); err == nil {
+			repo.lock.Unlock()
+			return latest, data, nil
+		}
+	}
+
+	// Without a known revision the upstream download decides which revision
+	// gets cached, so concurrent callers share it by ID alone.
+	flightKey := ID
+	if known {
+		flightKey = cacheKey(ID, latest.Revision)
+	}
+
+	call, waiting := repo.inflight[flightKey]
+	if !waiting {
+		call = &cacheCall{done: make(chan struct{})}
+		repo.inflight[flightKey] = call
+	}
+	repo.lock.Unlock()
+
+	if !waiting {
+		book, data, err = repo.fetch(ctx, ID)
+		call.book, call.err = book, err
+
+		repo.lock.Lock()
+		delete(repo.inflight, flightKey)
+		repo.lock.Unlock()
+		close(call.done)
+		return
+	}
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	}
+
+	if err = call.err; err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			// The client of the first caller went away, which says nothing
+			// about this one.
+			return repo.Repository.Download(ctx, ID)
+		}
+		return
+	}
+
+	repo.lock.Lock()
+	data, err = repo.open(cacheKey(ID, call.book.Revision))
+	repo.lock.Unlock()
+	if err != nil {
+		// The book could not be cached or was evicted already.
+		return repo.Repository.Download(ctx, ID)
+	}
+
+	return call.book, data, nil
+}
+
+// Stat asks upstream for the current revision of a book, and drops the
+// cached file of the book if the revision changed.
+func (repo *CachedRepository) Stat(ctx context.Context, ID string) (book Book, err error) {
+	if book, err = Stat(ctx, repo.Repository, ID); err != nil {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	latest, known := repo.latest[ID]
+	if !known {
+		repo.latest[ID] = book
+		return
+	}
+
+	if latest.Revision != book.Revision {
+		repo.remove(cacheKey(ID, latest.Revision))
+		latest.Revision = book.Revision
+	}
+	if book.Hash != "" {
+		latest.Hash = book.Hash
+	}
+	repo.latest[ID] = latest
+
+	return
+}
+
+// fetch downloads a book from upstream into the cache and returns it opened
+// from there. Books without a revision are not cached and are returned
+// straight from upstream.
+func (repo *CachedRepository) fetch(ctx context.Context, ID string) (
+	book Book, data io.ReadCloser, err error,
+) {
+	var upstream io.ReadCloser
+	if book, upstream, err = repo.Repository.Download(ctx, ID); err != nil {
+		return
+	}
+
+	if book.Revision == "" {
+		return book, upstream, nil
+	}
+
+	defer upstream.Close()
+
+	var tmp *os.File
+	if tmp, err = ioutil.TempFile(repo.dir, ".download"); err != nil {
+		return
+	}
+
+	var size int64
+	if size, err = io.Copy(tmp, upstream); err != nil {
+		err = transportError(ctx, err)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	key := cacheKey(ID, book.Revision)
+	path := filepath.Join(repo.dir, key)
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	repo.remove(key)
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	// Open before adding, as a book bigger than the whole budget is evicted
+	// right away.
+	if data, err = os.Open(path); err != nil {
+		os.Remove(path)
+		return
+	}
+
+	if old, ok := repo.latest[ID]; ok && old.Revision != book.Revision {
+		repo.remove(cacheKey(old.ID, old.Revision))
+	}
+	repo.latest[ID] = book
+
+	repo.add(key, size)
+	return
+}
+
+// open returns the cached file for key and marks it as recently used. The
+// caller must hold lock.
+func (repo *CachedRepository) open(key string) (data io.ReadCloser, err error) {
+	element, ok := repo.entries[key]
+	if !ok {
+		err = fmt.Errorf("%s is not cached", key)
+		return
+	}
+
+	if data, err = os.Open(filepath.Join(repo.dir, key)); err != nil {
+		repo.remove(key)
+		return
+	}
+
+	repo.lru.MoveToFront(element)
+	return
+}
+
+// add records a file in the cache and evicts the least recently used files
+// until the cache fits its budget again. A file that is open can safely be
+// evicted, readers keep their handle. The caller must hold lock.
+func (repo *CachedRepository) add(key string, size int64) {
+	repo.entries[key] = repo.lru.PushFront(&cacheEntry{key: key, size: size})
+	repo.size += size
+
+	for repo.size > repo.maxSize && repo.lru.Len() > 0 {
+		repo.remove(repo.lru.Back().Value.(*cacheEntry).key)
+	}
+}
+
+// remove deletes a file from the cache. The caller must hold lock.
+func (repo *CachedRepository) remove(key string) {
+	element, ok := repo.entries[key]
+	if !ok {
+		return
+	}
+
+	entry := element.Value.(*cacheEntry)
+	repo.lru.Remove(element)
+	delete(repo.entries, key)
+	repo.size -= entry.size
+	os.Remove(filepath.Join(repo.dir, key))
+}
+
+func (repo *CachedRepository) Cover(ctx context.Context, ID string) (data io.ReadCloser, err error) {
+	covers, ok := repo.Repository.(CoverRepository)
+	if !ok {
+		err = wrap(ErrNotFound, fmt.Errorf("covers are not supported"))
+		return
+	}
+
+	return covers.Cover(ctx, ID)
+}
+
+func cacheKey(ID string, revision string) string {
+	sum := sha1.Sum([]byte(ID + "\x00" + revision))
+	return hex.EncodeToString(sum[:])
+}
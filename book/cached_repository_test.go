@@ -0,0 +1,69 @@
+package book
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+func downloadString(t *testing.T, repo Repository, ID string) string {
+	t.Helper()
+
+	_, data, err := repo.Download(context.Background(), ID)
+	if err != nil {
+		t.Fatalf("Download(%s): %v", ID, err)
+	}
+	defer data.Close()
+
+	content, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatalf("reading %s: %v", ID, err)
+	}
+
+	return string(content)
+}
+
+func TestCachedRepositoryChecksRevisionOnHit(t *testing.T) {
+	upstream := NewMemoryRepository()
+	upstream.put("/books/a.epub", []byte("first"))
+
+	dir := t.TempDir()
+	repo, err := NewCachedRepository(upstream, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	books, err := repo.List(context.Background(), "/books")
+	if err != nil || len(books) != 1 {
+		t.Fatalf("List: %v, %v", books, err)
+	}
+	ID := books[0].ID
+
+	if got := downloadString(t, repo, ID); got != "first" {
+		t.Fatalf("first download = %q", got)
+	}
+
+	// Changed upstream without a listing in between.
+	upstream.put("/books/a.epub", []byte("second"))
+	if got := downloadString(t, repo, ID); got != "second" {
+		t.Errorf("download after an upstream change = %q, want second", got)
+	}
+
+	// A restart keeps the cached file, which is only served while its
+	// revision is current.
+	restarted, err := NewCachedRepository(upstream, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := downloadString(t, restarted, ID); got != "second" {
+		t.Errorf("download after a restart = %q, want second", got)
+	}
+	if len(restarted.entries) != 1 {
+		t.Errorf("%d files cached after a restart, want the one of the current revision", len(restarted.entries))
+	}
+
+	upstream.put("/books/a.epub", []byte("third"))
+	if got := downloadString(t, restarted, ID); got != "third" {
+		t.Errorf("download of a file changed while the server was down = %q, want third", got)
+	}
+}
@@ -0,0 +1,323 @@
+package book
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	// Registers the pure Go "sqlite" driver used to read metadata.db.
+	_ "modernc.org/sqlite"
+)
+
+// calibreFormats are the formats that can be opened by the reader, in order
+// of preference.
+var calibreFormats = []string{"EPUB", "PDF", "AZW3", "MOBI", "AZW", "FB2", "DOCX", "CBZ", "CBR", "CB7", "TXT", "MD", "M4B"}
+
+// CalibreRepository serves the books of a Calibre library. Books are read
+// from the library's metadata.db rather than from the folder layout, so each
+// book is listed once with its metadata and the best format available.
+// History is kept in historyPrefix inside the library directory.
+type CalibreRepository struct {
+	*LocalRepository
+
+	library string
+	db      *sql.DB
+}
+
+func NewCalibreRepository(
+	library string, historyPrefix string,
+) (repo *CalibreRepository, err error) {
+	repo = new(CalibreRepository)
+	repo.library = filepath.Clean(library)
+	repo.LocalRepository = NewLocalRepository(repo.library, historyPrefix)
+
+	dsn := (&url.URL{
+		Scheme:   "file",
+		Opaque:   filepath.ToSlash(filepath.Join(repo.library, "metadata.db")),
+		RawQuery: "mode=ro",
+	}).String()
+	if repo.db, err = sql.Open("sqlite", dsn); err != nil {
+		return
+	}
+
+	if err = repo.db.Ping(); err != nil {
+		repo.db.Close()
+		return
+	}
+
+	return
+}
+
+// List returns every book in the library. The path is ignored, as Calibre
+// decides where the files of a book live.
+func (repo *CalibreRepository) List(ctx context.Context, path string) (books []Book, err error) {
+	var rows *sql.Rows
+	if rows, err = repo.db.QueryContext(
+		ctx,
+		`SELECT id, title, has_cover, series_index, last_modified FROM books ORDER BY sort`,
+	); err != nil {
+		return
+	}
+
+	byID := map[int64]*Book{}
+	var order []int64
+	for rows.Next() {
+		var (
+			id          int64
+			b           Book
+			seriesIndex sql.NullFloat64
+		)
+		if err = rows.Scan(&id, &b.Title, &b.HasCover, &seriesIndex, &b.Revision); err != nil {
+			rows.Close()
+			return
+		}
+
+		b.ID = strconv.FormatInt(id, 10)
+		b.SeriesIndex = seriesIndex.Float64
+		byID[id] = &b
+		order = append(order, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if err = repo.eachLink(
+		ctx,
+		`SELECT l.book, a.name FROM books_authors_link l
+		JOIN authors a ON a.id = l.author ORDER BY l.id`,
+		func(b *Book, name string) { b.Authors = append(b.Authors, name) },
+		byID,
+	); err != nil {
+		return
+	}
+
+	if err = repo.eachLink(
+		ctx,
+		`SELECT l.book, t.name FROM books_tags_link l
+		JOIN tags t ON t.id = l.tag ORDER BY t.name`,
+		func(b *Book, name string) { b.Tags = append(b.Tags, name) },
+		byID,
+	); err != nil {
+		return
+	}
+
+	if err = repo.eachLink(
+		ctx,
+		`SELECT l.book, s.name FROM books_series_link l
+		JOIN series s ON s.id = l.series`,
+		func(b *Book, name string) { b.Series = name },
+		byID,
+	); err != nil {
+		return
+	}
+
+	formats := map[int64]map[string]string{}
+	if rows, err = repo.db.QueryContext(ctx, `SELECT book, format, name FROM data`); err != nil {
+		return
+	}
+
+	for rows.Next() {
+		var (
+			id           int64
+			format, name string
+		)
+		if err = rows.Scan(&id, &format, &name); err != nil {
+			rows.Close()
+			return
+		}
+
+		if formats[id] == nil {
+			formats[id] = map[string]string{}
+		}
+		formats[id][strings.ToUpper(format)] = name
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	for _, id := range order {
+		b := byID[id]
+		format, name, ok := bestCalibreFormat(formats[id])
+		if !ok {
+			continue
+		}
+
+		b.Name = name + "." + strings.ToLower(format)
+		b.IsPDF = format == "PDF"
+		b.IsComic = isComicName(b.Name)
+		b.IsAudio = isAudioName(b.Name)
+		books = append(books, *b)
+	}
+
+	return
+}
+
+// ListRecursive is the same as List, as a Calibre library has no folders of
+// its own.
+func (repo *CalibreRepository) ListRecursive(ctx context.Context, path string) (books []Book, err error) {
+	return repo.List(ctx, path)
+}
+
+// eachLink runs a query returning (book id, name) pairs and hands each name
+// to add together with the book it belongs to.
+func (repo *CalibreRepository) eachLink(
+	ctx context.Context, query string, add func(b *Book, name string), byID map[int64]*Book,
+) (err error) {
+	var rows *sql.Rows
+	if rows, err = repo.db.QueryContext(ctx, query); err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			id   int64
+			name string
+		)
+		if err = rows.Scan(&id, &name); err != nil {
+			return
+		}
+
+		if b, ok := byID[id]; ok {
+			add(b, name)
+		}
+	}
+
+	return rows.Err()
+}
+
+func (repo *CalibreRepository) Download(ctx context.Context, ID string) (
+	book Book, data io.ReadCloser, err error,
+) {
+	var dir string
+	if book, dir, err = repo.lookup(ctx, ID); err != nil {
+		return
+	}
+
+	if data, err = os.Open(filepath.Join(repo.library, filepath.FromSlash(dir), book.Name)); err != nil {
+		err = localError(err)
+	}
+	return
+}
+
+func (repo *CalibreRepository) Stat(ctx context.Context, ID string) (book Book, err error) {
+	book, _, err = repo.lookup(ctx, ID)
+	return
+}
+
+// Upload refuses to add books, as only Calibre itself can add them to the
+// library and its metadata.db.
+func (repo *CalibreRepository) Upload(
+	ctx context.Context, dir string, name string, data io.Reader,
+) (book Book, err error) {
+	err = wrap(ErrInvalid, fmt.Errorf("books can only be added to a calibre library with calibre"))
+	return
+}
+
+// Move refuses to move books, as Calibre decides where their files live.
+func (repo *CalibreRepository) Move(
+	ctx context.Context, ID string, dir string, name string,
+) (book Book, err error) {
+	err = wrap(ErrInvalid, fmt.Errorf("books in a calibre library can only be managed with calibre"))
+	return
+}
+
+// Cover returns the cover.jpg that Calibre keeps next to the book files.
+func (repo *CalibreRepository) Cover(ctx context.Context, ID string) (data io.ReadCloser, err error) {
+	var (
+		book Book
+		dir  string
+	)
+	if book, dir, err = repo.lookup(ctx, ID); err != nil {
+		return
+	}
+
+	if !book.HasCover {
+		err = wrap(ErrNotFound, fmt.Errorf("book %s has no cover", ID))
+		return
+	}
+
+	if data, err = os.Open(filepath.Join(repo.library, filepath.FromSlash(dir), "cover.jpg")); err != nil {
+		err = localError(err)
+	}
+	return
+}
+
+// lookup finds the book with the given Calibre id along with the directory,
+// relative to the library, that holds its files.
+func (repo *CalibreRepository) lookup(ctx context.Context, ID string) (book Book, dir string, err error) {
+	var id int64
+	if id, err = strconv.ParseInt(ID, 10, 64); err != nil {
+		err = wrap(ErrNotFound, fmt.Errorf("invalid book id %s: %v", ID, err))
+		return
+	}
+
+	if err = repo.db.QueryRowContext(
+		ctx,
+		`SELECT title, path, has_cover, last_modified FROM books WHERE id = ?`, id,
+	).Scan(&book.Title, &dir, &book.HasCover, &book.Revision); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = wrap(ErrNotFound, fmt.Errorf("book %s does not exist", ID))
+		}
+		return
+	}
+
+	if strings.Contains(dir, "..") {
+		err = wrap(ErrNotFound, fmt.Errorf("invalid path %s for book %s", dir, ID))
+		return
+	}
+
+	var rows *sql.Rows
+	if rows, err = repo.db.QueryContext(ctx, `SELECT format, name FROM data WHERE book = ?`, id); err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	formats := map[string]string{}
+	for rows.Next() {
+		var format, name string
+		if err = rows.Scan(&format, &name); err != nil {
+			return
+		}
+
+		formats[strings.ToUpper(format)] = name
+	}
+
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	format, name, ok := bestCalibreFormat(formats)
+	if !ok {
+		err = wrap(ErrNotFound, fmt.Errorf("book %s has no readable format", ID))
+		return
+	}
+
+	book.ID = ID
+	book.Name = name + "." + strings.ToLower(format)
+	book.IsPDF = format == "PDF"
+	book.IsComic = isComicName(book.Name)
+	book.IsAudio = isAudioName(book.Name)
+	return
+}
+
+func bestCalibreFormat(formats map[string]string) (format string, name string, ok bool) {
+	for _, format = range calibreFormats {
+		if name, ok = formats[format]; ok {
+			return
+		}
+	}
+
+	return "", "", false
+}
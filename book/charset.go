@@ -0,0 +1,194 @@
+package book
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// The characters of the bytes 0x80 to 0xff of the single byte encodings
+// books come in besides UTF-8, for want of a package with them.
+
+// windows1252 is the encoding of Windows in western Europe and America.
+var windows1252 = &[128]rune{
+	0x20ac, 0xfffd, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0xfffd, 0x017d, 0xfffd,
+	0xfffd, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0xfffd, 0x017e, 0x0178,
+	0x00a0, 0x00a1, 0x00a2, 0x00a3, 0x00a4, 0x00a5, 0x00a6, 0x00a7,
+	0x00a8, 0x00a9, 0x00aa, 0x00ab, 0x00ac, 0x00ad, 0x00ae, 0x00af,
+	0x00b0, 0x00b1, 0x00b2, 0x00b3, 0x00b4, 0x00b5, 0x00b6, 0x00b7,
+	0x00b8, 0x00b9, 0x00ba, 0x00bb, 0x00bc, 0x00bd, 0x00be, 0x00bf,
+	0x00c0, 0x00c1, 0x00c2, 0x00c3, 0x00c4, 0x00c5, 0x00c6, 0x00c7,
+	0x00c8, 0x00c9, 0x00ca, 0x00cb, 0x00cc, 0x00cd, 0x00ce, 0x00cf,
+	0x00d0, 0x00d1, 0x00d2, 0x00d3, 0x00d4, 0x00d5, 0x00d6, 0x00d7,
+	0x00d8, 0x00d9, 0x00da, 0x00db, 0x00dc, 0x00dd, 0x00de, 0x00df,
+	0x00e0, 0x00e1, 0x00e2, 0x00e3, 0x00e4, 0x00e5, 0x00e6, 0x00e7,
+	0x00e8, 0x00e9, 0x00ea, 0x00eb, 0x00ec, 0x00ed, 0x00ee, 0x00ef,
+	0x00f0, 0x00f1, 0x00f2, 0x00f3, 0x00f4, 0x00f5, 0x00f6, 0x00f7,
+	0x00f8, 0x00f9, 0x00fa, 0x00fb, 0x00fc, 0x00fd, 0x00fe, 0x00ff,
+}
+
+// windows1251 is the encoding of Windows for Cyrillic.
+var windows1251 = &[128]rune{
+	0x0402, 0x0403, 0x201a, 0x0453, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x20ac, 0x2030, 0x0409, 0x2039, 0x040a, 0x040c, 0x040b, 0x040f,
+	0x0452, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0xfffd, 0x2122, 0x0459, 0x203a, 0x045a, 0x045c, 0x045b, 0x045f,
+	0x00a0, 0x040e, 0x045e, 0x0408, 0x00a4, 0x0490, 0x00a6, 0x00a7,
+	0x0401, 0x00a9, 0x0404, 0x00ab, 0x00ac, 0x00ad, 0x00ae, 0x0407,
+	0x00b0, 0x00b1, 0x0406, 0x0456, 0x0491, 0x00b5, 0x00b6, 0x00b7,
+	0x0451, 0x2116, 0x0454, 0x00bb, 0x0458, 0x0405, 0x0455, 0x0457,
+	0x0410, 0x0411, 0x0412, 0x0413, 0x0414, 0x0415, 0x0416, 0x0417,
+	0x0418, 0x0419, 0x041a, 0x041b, 0x041c, 0x041d, 0x041e, 0x041f,
+	0x0420, 0x0421, 0x0422, 0x0423, 0x0424, 0x0425, 0x0426, 0x0427,
+	0x0428, 0x0429, 0x042a, 0x042b, 0x042c, 0x042d, 0x042e, 0x042f,
+	0x0430, 0x0431, 0x0432, 0x0433, 0x0434, 0x0435, 0x0436, 0x0437,
+	0x0438, 0x0439, 0x043a, 0x043b, 0x043c, 0x043d, 0x043e, 0x043f,
+	0x0440, 0x0441, 0x0442, 0x0443, 0x0444, 0x0445, 0x0446, 0x0447,
+	0x0448, 0x0449, 0x044a, 0x044b, 0x044c, 0x044d, 0x044e, 0x044f,
+}
+
+// koi8r is the older encoding of Russian on Unix.
+var koi8r = &[128]rune{
+	0x2500, 0x2502, 0x250c, 0x2510, 0x2514, 0x2518, 0x251c, 0x2524,
+	0x252c, 0x2534, 0x253c, 0x2580, 0x2584, 0x2588, 0x258c, 0x2590,
+	0x2591, 0x2592, 0x2593, 0x2320, 0x25a0, 0x2219, 0x221a, 0x2248,
+	0x2264, 0x2265, 0x00a0, 0x2321, 0x00b0, 0x00b2, 0x00b7, 0x00f7,
+	0x2550, 0x2551, 0x2552, 0x0451, 0x2553, 0x2554, 0x2555, 0x2556,
+	0x2557, 0x2558, 0x2559, 0x255a, 0x255b, 0x255c, 0x255d, 0x255e,
+	0x255f, 0x2560, 0x2561, 0x0401, 0x2562, 0x2563, 0x2564, 0x2565,
+	0x2566, 0x2567, 0x2568, 0x2569, 0x256a, 0x256b, 0x256c, 0x00a9,
+	0x044e, 0x0430, 0x0431, 0x0446, 0x0434, 0x0435, 0x0444, 0x0433,
+	0x0445, 0x0438, 0x0439, 0x043a, 0x043b, 0x043c, 0x043d, 0x043e,
+	0x043f, 0x044f, 0x0440, 0x0441, 0x0442, 0x0443, 0x0436, 0x0432,
+	0x044c, 0x044b, 0x0437, 0x0448, 0x044d, 0x0449, 0x0447, 0x044a,
+	0x042e, 0x0410, 0x0411, 0x0426, 0x0414, 0x0415, 0x0424, 0x0413,
+	0x0425, 0x0418, 0x0419, 0x041a, 0x041b, 0x041c, 0x041d, 0x041e,
+	0x041f, 0x042f, 0x0420, 0x0421, 0x0422, 0x0423, 0x0416, 0x0412,
+	0x042c, 0x042b, 0x0417, 0x0428, 0x042d, 0x0429, 0x0427, 0x042a,
+}
+
+// charsets maps the names of encodings to their characters. Latin-1 has
+// none, as its characters are the bytes.
+var charsets = map[string]*[128]rune{
+	"windows-1252": windows1252,
+	"cp1252":       windows1252,
+	"windows-1251": windows1251,
+	"cp1251":       windows1251,
+	"koi8-r":       koi8r,
+	"iso-8859-1":   nil,
+	"latin1":       nil,
+}
+
+// decodeCharset decodes text in the single byte encoding with the given
+// characters.
+func decodeCharset(text []byte, characters *[128]rune) string {
+	var out strings.Builder
+	out.Grow(len(text))
+	for _, b := range text {
+		if b >= 0x80 && characters != nil {
+			out.WriteRune(characters[b-0x80])
+		} else {
+			out.WriteRune(rune(b))
+		}
+	}
+
+	return out.String()
+}
+
+// decodeWindows1252 decodes text in Windows-1252, the encoding of most MOBI
+// books that are not in UTF-8, and of plain text from Windows.
+func decodeWindows1252(text []byte) string {
+	return decodeCharset(text, windows1252)
+}
+
+// charsetReader returns a reader of input decoded from the named encoding to
+// UTF-8, for xml.Decoder.
+func charsetReader(label string, input io.Reader) (io.Reader, error) {
+	label = strings.ToLower(strings.TrimSpace(label))
+	if label == "utf-8" || label == "utf8" || label == "us-ascii" {
+		return input, nil
+	}
+
+	characters, ok := charsets[label]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encoding %s", label)
+	}
+
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader([]byte(decodeCharset(data, characters))), nil
+}
+
+// decodeText decodes text of unknown encoding, such as a plain text book.
+// Text with a byte order mark is in the encoding it gives, and text that is
+// valid UTF-8 is taken to be in it. Anything else is in one of the single
+// byte encodings, told apart by guessCharset.
+func decodeText(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xef\xbb\xbf")):
+		return strings.ToValidUTF8(string(data[3:]), "\ufffd")
+	case bytes.HasPrefix(data, []byte("\xff\xfe")):
+		return decodeUTF16(data[2:], false)
+	case bytes.HasPrefix(data, []byte("\xfe\xff")):
+		return decodeUTF16(data[2:], true)
+	case utf8.Valid(data):
+		return string(data)
+	}
+
+	return decodeCharset(data, guessCharset(data))
+}
+
+func decodeUTF16(data []byte, bigEndian bool) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+
+	return string(utf16.Decode(units))
+}
+
+// guessCharset returns the single byte encoding text is most likely in.
+// Western text has the odd accented letter among ASCII ones, while Cyrillic
+// words are made of bytes above 0x7f only. Of the Cyrillic encodings,
+// Windows-1251 has the lower case letters in the upper half of its letters
+// and KOI8-R in the lower, and lower case letters are the most common.
+func guessCharset(text []byte) *[128]rune {
+	var high, runs int
+	for i, b := range text {
+		if b >= 0x80 {
+			high++
+			if i == 0 || text[i-1] < 0x80 {
+				runs++
+			}
+		}
+	}
+	if runs == 0 || high < 2*runs {
+		return windows1252
+	}
+
+	lower := 0
+	for _, b := range text {
+		if b >= 0xe0 {
+			lower++
+		} else if b >= 0xc0 {
+			lower--
+		}
+	}
+	if lower >= 0 {
+		return windows1251
+	}
+	return koi8r
+}
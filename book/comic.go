@@ -0,0 +1,542 @@
+package book
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// comicCacheSize is how many archives Comics keeps on disk.
+const comicCacheSize = 8
+
+// comicExtensions are the extensions of comic archives: zip, RAR and 7-Zip.
+var comicExtensions = []string{".cbz", ".cbr", ".cb7"}
+
+// comicImageTypes are the content types of the images that are pages of a
+// comic, by extension.
+var comicImageTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".bmp":  "image/bmp",
+}
+
+// comicArchivers name the archivers of comic archives, by extension.
+var comicArchivers = map[string]string{".cbz": "zip", ".cbr": "RAR", ".cb7": "7-Zip"}
+
+// comicExtractors are the programs RAR and 7-Zip archives are unpacked with,
+// in order of preference, as there is no Go package for either.
+var comicExtractors = []struct {
+	program string
+	formats []string
+	args    func(archive string, dir string) []string
+}{
+	{"bsdtar", []string{".cbr", ".cb7"}, func(archive string, dir string) []string {
+		return []string{"-x", "-f", archive, "-C", dir}
+	}},
+	{"unar", []string{".cbr", ".cb7"}, func(archive string, dir string) []string {
+		return []string{"-q", "-f", "-D", "-o", dir, archive}
+	}},
+	{"7z", []string{".cbr", ".cb7"}, func(archive string, dir string) []string {
+		return []string{"x", "-y", "-o" + dir, archive}
+	}},
+	{"unrar", []string{".cbr"}, func(archive string, dir string) []string {
+		return []string{"x", "-y", "-idq", archive, dir + string(filepath.Separator)}
+	}},
+}
+
+// isComicName reports whether name is that of a comic archive.
+func isComicName(name string) bool {
+	for _, ext := range comicExtensions {
+		if strings.Contains(name, ext) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// comicFormat returns the extension of the kind of archive starting with
+// head, or an empty string if it is none of them.
+func comicFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return ".cbz"
+	case bytes.HasPrefix(head, []byte("Rar!\x1a\x07")):
+		return ".cbr"
+	case bytes.HasPrefix(head, []byte("7z\xbc\xaf\x27\x1c")):
+		return ".cb7"
+	}
+
+	return ""
+}
+
+// Comics serves the pages of the comic archives of a repository. The pages
+// of an archive are the images in it, in natural order of their paths, so
+// that "page 2" comes before "page 10", and are numbered from 1.
+//
+// Archives are downloaded once and kept in a temporary folder, for the last
+// few comics read. Zip archives are read in place, RAR and 7-Zip archives
+// are unpacked with bsdtar, unar, 7z or unrar, whichever is installed. The
+// format is told from the content rather than the extension, as comics are
+// often packed with another archiver than their extension says.
+type Comics struct {
+	repo Repository
+
+	lock sync.Mutex
+	// dir is created when the first archive is downloaded.
+	dir      string
+	archives map[string]*comicArchive
+	// recent lists the IDs of the archives, least recently used first.
+	recent []string
+}
+
+type comicArchive struct {
+	// lock is held while the archive is downloaded, so that it is only
+	// downloaded once however many pages are asked for at the same time.
+	lock     sync.Mutex
+	loaded   bool
+	revision string
+	// path is the zip archive or the folder the archive was unpacked to.
+	path  string
+	isZip bool
+	pages []string
+}
+
+func NewComics(repo Repository) (comics *Comics) {
+	comics = new(Comics)
+	comics.repo = repo
+	comics.archives = map[string]*comicArchive{}
+
+	return
+}
+
+// Pages returns the number of pages of the comic ID. It checks that the
+// archive on disk is the latest revision, downloading it again if not.
+func (comics *Comics) Pages(ctx context.Context, ID string) (pages int, err error) {
+	var archive comicArchive
+	if archive, err = comics.archive(ctx, ID, true); err != nil {
+		return
+	}
+
+	return len(archive.pages), nil
+}
+
+// Page returns the image that is page number page of the comic ID, and its
+// content type.
+func (comics *Comics) Page(ctx context.Context, ID string, page int) (
+	data io.ReadCloser, contentType string, err error,
+) {
+	var archive comicArchive
+	if archive, err = comics.archive(ctx, ID, false); err != nil {
+		return
+	}
+
+	if page < 1 || page > len(archive.pages) {
+		err = wrap(ErrNotFound, fmt.Errorf("comic %s has no page %d", ID, page))
+		return
+	}
+
+	name := archive.pages[page-1]
+	contentType = comicImageTypes[strings.ToLower(path.Ext(name))]
+
+	if !archive.isZip {
+		data, err = os.Open(filepath.Join(archive.path, filepath.FromSlash(name)))
+		return
+	}
+
+	var reader *zip.ReadCloser
+	if reader, err = zip.OpenReader(archive.path); err != nil {
+		return
+	}
+
+	for _, f := range reader.File {
+		if f.Name != name {
+			continue
+		}
+
+		var entry io.ReadCloser
+		if entry, err = f.Open(); err != nil {
+			reader.Close()
+			return
+		}
+
+		data = &zipEntry{ReadCloser: entry, archive: reader}
+		return
+	}
+
+	reader.Close()
+	err = wrap(ErrNotFound, fmt.Errorf("comic %s has no page %d", ID, page))
+	return
+}
+
+// zipEntry closes the archive it was opened from with it.
+type zipEntry struct {
+	io.ReadCloser
+	archive io.Closer
+}
+
+func (entry *zipEntry) Close() error {
+	entry.ReadCloser.Close()
+	return entry.archive.Close()
+}
+
+// archive returns the archive of the comic ID, downloading it if it is not on
+// disk, or if check is set and it has changed.
+func (comics *Comics) archive(ctx context.Context, ID string, check bool) (archive comicArchive, err error) {
+	comics.lock.Lock()
+	entry, ok := comics.archives[ID]
+	if !ok {
+		entry = new(comicArchive)
+		comics.archives[ID] = entry
+	}
+	comics.use(ID)
+	dir := comics.dir
+	comics.lock.Unlock()
+
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+
+	if entry.loaded && !check {
+		return entry.copy(), nil
+	}
+
+	// Only download the archive again if it changed, or if there is no
+	// other way to tell.
+	if entry.loaded {
+		var current Book
+		if current, err = Stat(ctx, comics.repo, ID); err == nil && current.Revision != "" &&
+			current.Revision == entry.revision {
+			return entry.copy(), nil
+		} else if err != nil && !errors.Is(err, errNoStat) {
+			return
+		}
+		err = nil
+	}
+
+	if dir == "" {
+		if dir, err = comics.tempDir(); err != nil {
+			return
+		}
+	}
+
+	var book Book
+	var data io.ReadCloser
+	if book, data, err = comics.repo.Download(ctx, ID); err != nil {
+		return
+	}
+	defer data.Close()
+
+	if entry.loaded && entry.revision == book.Revision {
+		return entry.copy(), nil
+	}
+
+	if !book.IsComic {
+		err = wrap(ErrInvalid, fmt.Errorf("%s is not a comic", book.Name))
+		return
+	}
+
+	entry.remove()
+	if err = entry.load(ctx, dir, ID, data); err != nil {
+		entry.remove()
+		return
+	}
+	entry.revision = book.Revision
+
+	return entry.copy(), nil
+}
+
+// use marks ID as the most recently used archive, and forgets the least
+// recently used one if there are too many. The caller holds the lock.
+func (comics *Comics) use(ID string) {
+	for i, recent := range comics.recent {
+		if recent == ID {
+			comics.recent = append(comics.recent[:i], comics.recent[i+1:]...)
+			break
+		}
+	}
+	comics.recent = append(comics.recent, ID)
+
+	if len(comics.recent) <= comicCacheSize {
+		return
+	}
+
+	oldest := comics.recent[0]
+	comics.recent = comics.recent[1:]
+
+	entry := comics.archives[oldest]
+	delete(comics.archives, oldest)
+
+	// Pages already being read stay readable, as the files are only unlinked.
+	go func() {
+		entry.lock.Lock()
+		defer entry.lock.Unlock()
+
+		entry.remove()
+	}()
+}
+
+func (comics *Comics) tempDir() (dir string, err error) {
+	comics.lock.Lock()
+	defer comics.lock.Unlock()
+
+	if comics.dir == "" {
+		if comics.dir, err = ioutil.TempDir("", "comics"); err != nil {
+			return
+		}
+	}
+
+	return comics.dir, nil
+}
+
+// load downloads data into dir and finds the pages in it. The caller holds
+// the lock of the archive.
+func (entry *comicArchive) load(ctx context.Context, dir string, ID string, data io.Reader) (err error) {
+	// Every download gets a name of its own, so that it is not removed along
+	// with an earlier download of the same comic that was forgotten.
+	var file *os.File
+	if file, err = ioutil.TempFile(dir, "comic"); err != nil {
+		return
+	}
+	entry.path = file.Name()
+
+	_, err = io.Copy(file, data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return
+	}
+
+	var head []byte
+	if file, err = os.Open(entry.path); err != nil {
+		return
+	}
+	head = make([]byte, 8)
+	n, _ := io.ReadFull(file, head)
+	file.Close()
+
+	format := comicFormat(head[:n])
+	switch format {
+	case "":
+		return wrap(ErrInvalid, fmt.Errorf("comic %s is not a zip, RAR or 7-Zip archive", ID))
+	case ".cbz":
+		entry.isZip = true
+		if entry.pages, err = zipPages(entry.path); err != nil {
+			return wrap(ErrInvalid, fmt.Errorf("reading comic %s: %v", ID, err))
+		}
+	default:
+		archive := entry.path
+		entry.path += ".d"
+		defer os.Remove(archive)
+
+		if err = extractComic(ctx, archive, format, entry.path); err != nil {
+			return
+		}
+		if entry.pages, err = folderPages(entry.path); err != nil {
+			return
+		}
+	}
+
+	entry.loaded = true
+	return
+}
+
+// remove deletes the files of the archive. The caller holds its lock.
+func (entry *comicArchive) remove() {
+	if entry.path != "" {
+		os.RemoveAll(entry.path)
+	}
+
+	entry.loaded = false
+	entry.revision = ""
+	entry.path = ""
+	entry.isZip = false
+	entry.pages = nil
+}
+
+// copy returns what is needed to read pages, so that they can be read
+// without holding the lock of the archive.
+func (entry *comicArchive) copy() comicArchive {
+	return comicArchive{
+		loaded:   entry.loaded,
+		revision: entry.revision,
+		path:     entry.path,
+		isZip:    entry.isZip,
+		pages:    entry.pages,
+	}
+}
+
+func zipPages(archive string) (pages []string, err error) {
+	var reader *zip.ReadCloser
+	if reader, err = zip.OpenReader(archive); err != nil {
+		return
+	}
+	defer reader.Close()
+
+	for _, f := range reader.File {
+		if !f.FileInfo().IsDir() && isComicPage(f.Name) {
+			pages = append(pages, f.Name)
+		}
+	}
+	sortPages(pages)
+
+	return
+}
+
+// extractComic unpacks archive, a RAR or 7-Zip archive as format says, into
+// dir with the first program for it that is installed.
+func extractComic(ctx context.Context, archive string, format string, dir string) (err error) {
+	for _, extractor := range comicExtractors {
+		supported := false
+		for _, f := range extractor.formats {
+			supported = supported || f == format
+		}
+		if !supported {
+			continue
+		}
+
+		program, lookErr := exec.LookPath(extractor.program)
+		if lookErr != nil {
+			continue
+		}
+
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return
+		}
+
+		var output []byte
+		if output, err = exec.CommandContext(ctx, program, extractor.args(archive, dir)...).CombinedOutput(); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return wrap(ErrInvalid, fmt.Errorf(
+				"%s could not unpack the archive: %v: %s", extractor.program, err, strings.TrimSpace(string(output)),
+			))
+		}
+
+		return
+	}
+
+	var programs []string
+	for _, extractor := range comicExtractors {
+		for _, f := range extractor.formats {
+			if f == format {
+				programs = append(programs, extractor.program)
+			}
+		}
+	}
+
+	return wrap(ErrUnavailable, fmt.Errorf(
+		"no program to unpack %s archives with is installed, install one of %s",
+		comicArchivers[format], strings.Join(programs, ", "),
+	))
+}
+
+func folderPages(dir string) (pages []string, err error) {
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Links are left alone, so that an archive can not point outside of
+		// the folder.
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		if rel = filepath.ToSlash(rel); isComicPage(rel) {
+			pages = append(pages, rel)
+		}
+		return nil
+	})
+	sortPages(pages)
+
+	return
+}
+
+// isComicPage reports whether the file at p in an archive is a page: an
+// image, not hidden and not metadata added by macOS.
+func isComicPage(p string) bool {
+	for _, part := range strings.Split(p, "/") {
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return false
+		}
+	}
+
+	_, ok := comicImageTypes[strings.ToLower(path.Ext(p))]
+	return ok
+}
+
+func sortPages(pages []string) {
+	sort.SliceStable(pages, func(i, j int) bool {
+		return naturalLess(strings.ToLower(pages[i]), strings.ToLower(pages[j]))
+	})
+}
+
+// naturalLess compares a and b with runs of digits compared by their value,
+// so that "2" comes before "10".
+func naturalLess(a string, b string) bool {
+	for a != "" && b != "" {
+		aDigits, bDigits := digitPrefix(a), digitPrefix(b)
+		if aDigits == "" || bDigits == "" {
+			ra, aSize := utf8.DecodeRuneInString(a)
+			rb, bSize := utf8.DecodeRuneInString(b)
+			if ra != rb {
+				return ra < rb
+			}
+			a, b = a[aSize:], b[bSize:]
+			continue
+		}
+
+		// Compare the values without leading zeros, by length first as
+		// they may not fit a number.
+		aValue, bValue := strings.TrimLeft(aDigits, "0"), strings.TrimLeft(bDigits, "0")
+		if len(aValue) != len(bValue) {
+			return len(aValue) < len(bValue)
+		}
+		if aValue != bValue {
+			return aValue < bValue
+		}
+		if len(aDigits) != len(bDigits) {
+			return len(aDigits) < len(bDigits)
+		}
+		a, b = a[len(aDigits):], b[len(bDigits):]
+	}
+
+	return len(a) < len(b)
+}
+
+func digitPrefix(s string) string {
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return r > unicode.MaxASCII || !unicode.IsDigit(r)
+	})
+	if end < 0 {
+		return s
+	}
+
+	return s[:end]
+}
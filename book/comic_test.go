@@ -0,0 +1,108 @@
+package book
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+// testCBZ returns a zip holding files named after their content.
+func testCBZ(names ...string) []byte {
+	var archive bytes.Buffer
+	w := zip.NewWriter(&archive)
+	for _, name := range names {
+		f, _ := w.Create(name)
+		f.Write([]byte(name))
+	}
+	w.Close()
+
+	return archive.Bytes()
+}
+
+func comicPage(t *testing.T, comics *Comics, ID string, page int) (string, string) {
+	t.Helper()
+
+	data, contentType, err := comics.Page(context.Background(), ID, page)
+	if err != nil {
+		t.Fatalf("Page(%d): %v", page, err)
+	}
+	defer data.Close()
+
+	content, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content), contentType
+}
+
+func TestComicsPagesInNaturalOrder(t *testing.T) {
+	repo := NewMemoryRepository()
+	repo.put("/books/comic.cbz", testCBZ(
+		"Chapter 1/page10.jpg", "Chapter 1/page2.PNG", "ComicInfo.xml", "Chapter 1/page1.jpg",
+		"__MACOSX/Chapter 1/._page1.jpg", ".hidden.jpg", "Chapter 2/page1.webp", "notes.txt",
+	))
+	comics := NewComics(repo)
+	ID := memoryID("/books/comic.cbz")
+
+	pages, err := comics.Pages(context.Background(), ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages != 4 {
+		t.Fatalf("%d pages, want the 4 images", pages)
+	}
+
+	for i, want := range []struct{ name, contentType string }{
+		{"Chapter 1/page1.jpg", "image/jpeg"},
+		{"Chapter 1/page2.PNG", "image/png"},
+		{"Chapter 1/page10.jpg", "image/jpeg"},
+		{"Chapter 2/page1.webp", "image/webp"},
+	} {
+		if name, contentType := comicPage(t, comics, ID, i+1); name != want.name || contentType != want.contentType {
+			t.Errorf("page %d = %s as %s, want %s as %s", i+1, name, contentType, want.name, want.contentType)
+		}
+	}
+
+	if _, _, err := comics.Page(context.Background(), ID, 5); !errors.Is(err, ErrNotFound) {
+		t.Errorf("page past the end: %v, want ErrNotFound", err)
+	}
+}
+
+func TestComicsDownloadOnlyNewRevisions(t *testing.T) {
+	upstream := &countingRepository{MemoryRepository: NewMemoryRepository()}
+	upstream.put("/books/comic.cbz", testCBZ("1.jpg", "2.jpg"))
+	comics := NewComics(upstream)
+	ID := memoryID("/books/comic.cbz")
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := comics.Pages(ctx, ID); err != nil {
+			t.Fatal(err)
+		}
+		comicPage(t, comics, ID, 1)
+	}
+	if upstream.downloads != 1 {
+		t.Errorf("%d downloads of an unchanged comic, want 1", upstream.downloads)
+	}
+
+	upstream.put("/books/comic.cbz", testCBZ("1.jpg", "2.jpg", "3.jpg"))
+	if pages, err := comics.Pages(ctx, ID); err != nil || pages != 3 {
+		t.Errorf("Pages after a new revision = %d, %v, want 3", pages, err)
+	}
+	if upstream.downloads != 2 {
+		t.Errorf("%d downloads after a new revision, want 2", upstream.downloads)
+	}
+}
+
+func TestComicsRefuseOtherArchives(t *testing.T) {
+	repo := NewMemoryRepository()
+	repo.put("/books/comic.cbz", []byte("not an archive"))
+
+	if _, err := NewComics(repo).Pages(context.Background(), memoryID("/books/comic.cbz")); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Pages of a file that is no archive: %v, want ErrInvalid", err)
+	}
+}
@@ -0,0 +1,278 @@
+package book
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// compositeSeparator separates the source name from the ID of a book within
+// that source. Source names may not contain it; IDs may.
+const compositeSeparator = ":"
+
+// Source is a named library mounted into a CompositeRepository.
+type Source struct {
+	Name string
+	Repo Repository
+	// Path is the directory of Repo that the source is rooted at. Paths
+	// handed to the CompositeRepository are resolved below it.
+	Path string
+}
+
+// CompositeRepository merges several sources into one library. Book IDs are
+// qualified with the name of the source they come from, and all history is
+// stored in a single source.
+type CompositeRepository struct {
+	sources []Source
+	byName  map[string]Source
+	history Source
+	store   HistoryStore
+}
+
+func NewCompositeRepository(
+	sources []Source, historySource string,
+) (repo *CompositeRepository, err error) {
+	repo = new(CompositeRepository)
+	repo.byName = map[string]Source{}
+
+	for _, source := range sources {
+		if source.Name == "" || strings.Contains(source.Name, compositeSeparator) {
+			err = fmt.Errorf("invalid source name %q", source.Name)
+			return
+		}
+
+		if _, ok := repo.byName[source.Name]; ok {
+			err = fmt.Errorf("duplicate source %s", source.Name)
+			return
+		}
+
+		repo.sources = append(repo.sources, source)
+		repo.byName[source.Name] = source
+	}
+
+	var ok bool
+	if repo.history, ok = repo.byName[historySource]; !ok {
+		err = fmt.Errorf("unknown history source %q", historySource)
+		return
+	}
+
+	if repo.store, ok = repo.history.Repo.(HistoryStore); !ok {
+		err = fmt.Errorf("source %s can not store history", historySource)
+		return
+	}
+
+	return
+}
+
+func (repo *CompositeRepository) List(ctx context.Context, path string) (books []Book, err error) {
+	return repo.list(ctx, path, false)
+}
+
+// ListRecursive lists every source recursively where the source supports it.
+// Like List, it only fails with ErrNotFound if no source has the folder.
+func (repo *CompositeRepository) ListRecursive(ctx context.Context, path string) (books []Book, err error) {
+	return repo.list(ctx, path, true)
+}
+
+func (repo *CompositeRepository) list(
+	ctx context.Context, path string, recursive bool,
+) (books []Book, err error) {
+	found := false
+	for _, source := range repo.sources {
+		dir := source.resolve(path)
+
+		var list []Book
+		if recursive {
+			list, err = ListRecursive(ctx, source.Repo, dir)
+		} else {
+			list, err = source.Repo.List(ctx, dir)
+		}
+		if errors.Is(err, ErrNotFound) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			err = fmt.Errorf("listing %s: %w", source.Name, err)
+			return
+		}
+		found = true
+
+		for _, b := range list {
+			b.ID = source.Name + compositeSeparator + b.ID
+			b.Source = source.Name
+			books = append(books, b)
+		}
+	}
+
+	if !found {
+		err = wrap(ErrNotFound, fmt.Errorf("%s does not exist in any source", path))
+	}
+
+	return
+}
+
+func (repo *CompositeRepository) Download(ctx context.Context, ID string) (
+	book Book, data io.ReadCloser, err error,
+) {
+	var (
+		source Source
+		inner  string
+	)
+	if source, inner, err = repo.split(ID); err != nil {
+		return
+	}
+
+	if book, data, err = source.Repo.Download(ctx, inner); err != nil {
+		return
+	}
+
+	book.ID = ID
+	book.Source = source.Name
+	return
+}
+
+// Upload adds the book to dir in the first source.
+func (repo *CompositeRepository) Upload(
+	ctx context.Context, dir string, name string, data io.Reader,
+) (book Book, err error) {
+	source := repo.sources[0]
+	if book, err = source.Repo.Upload(ctx, source.resolve(dir), name, data); err != nil {
+		return
+	}
+
+	book.ID = source.Name + compositeSeparator + book.ID
+	book.Source = source.Name
+	return
+}
+
+// Move moves the book to dir within the source it comes from.
+func (repo *CompositeRepository) Move(
+	ctx context.Context, ID string, dir string, name string,
+) (book Book, err error) {
+	var (
+		source Source
+		inner  string
+	)
+	if source, inner, err = repo.split(ID); err != nil {
+		return
+	}
+
+	if book, err = source.Repo.Move(ctx, inner, source.resolve(dir), name); err != nil {
+		return
+	}
+
+	book.ID = source.Name + compositeSeparator + book.ID
+	book.Source = source.Name
+	return
+}
+
+func (repo *CompositeRepository) Stat(ctx context.Context, ID string) (book Book, err error) {
+	var (
+		source Source
+		inner  string
+	)
+	if source, inner, err = repo.split(ID); err != nil {
+		return
+	}
+
+	if book, err = Stat(ctx, source.Repo, inner); err != nil {
+		return
+	}
+
+	book.ID = ID
+	book.Source = source.Name
+	return
+}
+
+func (repo *CompositeRepository) Cover(ctx context.Context, ID string) (data io.ReadCloser, err error) {
+	var (
+		source Source
+		inner  string
+	)
+	if source, inner, err = repo.split(ID); err != nil {
+		return
+	}
+
+	covers, ok := source.Repo.(CoverRepository)
+	if !ok {
+		err = wrap(ErrNotFound, fmt.Errorf("source %s has no covers", source.Name))
+		return
+	}
+
+	return covers.Cover(ctx, inner)
+}
+
+func (repo *CompositeRepository) GetHistory(ctx context.Context, ID string) (history History, err error) {
+	return repo.store.GetHistory(ctx, repo.historyID(ID))
+}
+
+func (repo *CompositeRepository) WriteHistory(
+	ctx context.Context, ID string, history History,
+) (updated History, err error) {
+	return repo.store.WriteHistory(ctx, repo.historyID(ID), history)
+}
+
+// ListHistory lists the books the history source has a history for, if it
+// can, qualifying the IDs of its own books as historyID stores them
+// unqualified.
+func (repo *CompositeRepository) ListHistory(ctx context.Context) (IDs []string, err error) {
+	lister, ok := repo.store.(HistoryLister)
+	if !ok {
+		err = wrap(ErrCannotList, fmt.Errorf("source %s can not list histories", repo.history.Name))
+		return
+	}
+
+	var stored []string
+	if stored, err = lister.ListHistory(ctx); err != nil {
+		return
+	}
+
+	for _, ID := range stored {
+		if _, _, invalid := repo.split(ID); invalid != nil {
+			ID = repo.history.Name + compositeSeparator + ID
+		}
+		IDs = append(IDs, ID)
+	}
+
+	return
+}
+
+// historyID keeps the unqualified ID for books that live in the history
+// source itself, so that progress saved before the source was mounted into
+// a composite is still found.
+func (repo *CompositeRepository) historyID(ID string) string {
+	if prefix := repo.history.Name + compositeSeparator; strings.HasPrefix(ID, prefix) {
+		return strings.TrimPrefix(ID, prefix)
+	}
+
+	return ID
+}
+
+func (repo *CompositeRepository) split(ID string) (source Source, inner string, err error) {
+	parts := strings.SplitN(ID, compositeSeparator, 2)
+	if len(parts) != 2 {
+		err = wrap(ErrNotFound, fmt.Errorf("invalid book id %s", ID))
+		return
+	}
+
+	var ok bool
+	if source, ok = repo.byName[parts[0]]; !ok {
+		err = wrap(ErrNotFound, fmt.Errorf("unknown source %s in book id %s", parts[0], ID))
+		return
+	}
+
+	inner = parts[1]
+	return
+}
+
+// resolve returns the path in the source of p, a path of the composite.
+func (source Source) resolve(p string) string {
+	if source.Path == "" {
+		return p
+	}
+
+	return path.Join(source.Path, path.Clean("/"+p))
+}
@@ -0,0 +1,123 @@
+package book
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newTestCompositeRepository(t *testing.T) (repo *CompositeRepository, lib *MemoryRepository) {
+	t.Helper()
+
+	lib = NewMemoryRepository()
+	lib.put("/lib/books/x.epub", []byte("x"))
+	lib.put("/lib/books/sub/y.epub", []byte("y"))
+
+	other := NewMemoryRepository()
+	other.put("/books/z.epub", []byte("z"))
+
+	repo, err := NewCompositeRepository([]Source{
+		{Name: "lib", Repo: lib, Path: "/lib"},
+		{Name: "other", Repo: other},
+	}, "lib")
+	if err != nil {
+		t.Fatalf("NewCompositeRepository: %v", err)
+	}
+
+	return
+}
+
+func bookNames(books []Book) string {
+	var names []string
+	for _, b := range books {
+		names = append(names, b.Source+"/"+b.Name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+func TestCompositeListResolvesBelowSourcePath(t *testing.T) {
+	repo, _ := newTestCompositeRepository(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		path      string
+		recursive bool
+		want      string
+	}{
+		{"/books", false, "lib/x.epub,other/z.epub"},
+		{"/books", true, "lib/x.epub,lib/y.epub,other/z.epub"},
+		{"/books/sub", false, "lib/y.epub"},
+	}
+
+	for _, test := range tests {
+		var (
+			books []Book
+			err   error
+		)
+		if test.recursive {
+			books, err = repo.ListRecursive(ctx, test.path)
+		} else {
+			books, err = repo.List(ctx, test.path)
+		}
+		if err != nil {
+			t.Fatalf("listing %s: %v", test.path, err)
+		}
+
+		if got := bookNames(books); got != test.want {
+			t.Errorf("listing %s (recursive %v) = %s, want %s", test.path, test.recursive, got, test.want)
+		}
+	}
+
+	if _, err := repo.List(ctx, "/trash"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("listing a folder no source has: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestCompositeUploadUsesDir(t *testing.T) {
+	repo, lib := newTestCompositeRepository(t)
+	ctx := context.Background()
+
+	if _, err := repo.Upload(ctx, "/books/sub", "new.epub", strings.NewReader("new")); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+
+	if _, ok := lib.files["/lib/books/sub/new.epub"]; !ok {
+		t.Errorf("uploaded book is not in /lib/books/sub")
+	}
+}
+
+func TestCompositeListHistoryQualifiesIDs(t *testing.T) {
+	repo, _ := newTestCompositeRepository(t)
+	ctx := context.Background()
+
+	books, err := repo.ListRecursive(ctx, "/books")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range books {
+		if _, err := repo.WriteHistory(ctx, b.ID, History{Data: b.Name}); err != nil {
+			t.Fatalf("WriteHistory(%s): %v", b.ID, err)
+		}
+	}
+
+	IDs, err := repo.ListHistory(ctx)
+	if err != nil {
+		t.Fatalf("ListHistory: %v", err)
+	}
+
+	var want []string
+	for _, b := range books {
+		want = append(want, b.ID)
+	}
+	sort.Strings(IDs)
+	sort.Strings(want)
+
+	if strings.Join(IDs, ",") != strings.Join(want, ",") {
+		t.Errorf("ListHistory = %q, want %q", IDs, want)
+	}
+}
@@ -0,0 +1,551 @@
+package book
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// convertVersion changes whenever the converters change what they write,
+// so that books converted before are converted again.
+const convertVersion = 1
+
+// converter turns the book in r, of size bytes, into an EPUB.
+type converter func(r io.ReaderAt, size int64) (epubBook, error)
+
+// converters are the formats that are read by converting them to EPUB, by
+// extension. The first whose extension a name ends with is used.
+var converters = []struct {
+	ext     string
+	convert converter
+	// sniff reports whether a file starting with head is in the format.
+	sniff func(head []byte) bool
+}{
+	{".azw3", convertMOBI, sniffMOBI},
+	{".azw", convertMOBI, sniffMOBI},
+	{".mobi", convertMOBI, sniffMOBI},
+	{".fb2.zip", convertFB2Zip, sniffFB2Zip},
+	{".fb2", convertFB2, sniffFB2},
+	{".docx", convertDOCX, sniffDOCX},
+	{".txt", convertText, sniffText},
+	{".md", convertMarkdown, sniffText},
+	{".markdown", convertMarkdown, sniffText},
+}
+
+// isBookName reports whether name is that of a book the reader can open,
+// as it is or converted, or that can be played.
+func isBookName(name string) bool {
+	return strings.Contains(name, ".pdf") || strings.Contains(name, ".epub") || isComicName(name) ||
+		isAudioName(name) || convertedExt(name) != ""
+}
+
+// convertedExt returns the extension of name if it is that of a format that
+// is converted to EPUB, and an empty string otherwise.
+func convertedExt(name string) string {
+	lower := strings.ToLower(name)
+	for _, c := range converters {
+		if strings.HasSuffix(lower, c.ext) {
+			return c.ext
+		}
+	}
+
+	return ""
+}
+
+// convertedMetadata is what a conversion learnt about a book, kept next to
+// the EPUB.
+type convertedMetadata struct {
+	Title       string   `json:"title,omitempty"`
+	Authors     []string `json:"authors,omitempty"`
+	Series      string   `json:"series,omitempty"`
+	SeriesIndex float64  `json:"series_index,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Cover       string   `json:"cover,omitempty"`
+}
+
+// ConvertingRepository serves books in formats the reader can not open, such
+// as MOBI, as EPUBs, so that they open in the EPUB reader. Books are
+// converted when they are first downloaded and kept in dir by ID and
+// revision, so that each revision is only converted once. What a conversion
+// learns about a book, such as its title and cover, is added to listings.
+type ConvertingRepository struct {
+	Repository
+
+	dir string
+
+	lock sync.Mutex
+	// metadata maps the key of each conversion in dir to what it learnt.
+	metadata map[string]convertedMetadata
+	// inflight holds the conversions in progress, which others wait for
+	// instead of converting the same book again.
+	inflight map[string]chan struct{}
+	// names maps the IDs of the books listed to their names, to tell which
+	// need converting without asking upstream.
+	names map[string]string
+}
+
+func NewConvertingRepository(upstream Repository, dir string) (repo *ConvertingRepository, err error) {
+	repo = new(ConvertingRepository)
+	repo.Repository = upstream
+	repo.dir = dir
+	repo.metadata = map[string]convertedMetadata{}
+	repo.inflight = map[string]chan struct{}{}
+	repo.names = map[string]string{}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	var infos []os.FileInfo
+	if infos, err = ioutil.ReadDir(dir); err != nil {
+		return
+	}
+
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") {
+			// Left over from a conversion that was cut short.
+			os.Remove(filepath.Join(dir, info.Name()))
+			continue
+		}
+
+		key := strings.TrimSuffix(info.Name(), ".json")
+		if key == info.Name() {
+			continue
+		}
+
+		var data []byte
+		if data, err = ioutil.ReadFile(filepath.Join(dir, info.Name())); err != nil {
+			return
+		}
+
+		var metadata convertedMetadata
+		if json.Unmarshal(data, &metadata) == nil {
+			repo.metadata[key] = metadata
+		}
+	}
+
+	return
+}
+
+func (repo *ConvertingRepository) List(ctx context.Context, path string) (books []Book, err error) {
+	if books, err = repo.Repository.List(ctx, path); err == nil {
+		repo.describe(books)
+	}
+
+	return
+}
+
+func (repo *ConvertingRepository) ListRecursive(ctx context.Context, path string) (books []Book, err error) {
+	if books, err = ListRecursive(ctx, repo.Repository, path); err == nil {
+		repo.describe(books)
+	}
+
+	return
+}
+
+// describe adds what was learnt converting books to their listing.
+func (repo *ConvertingRepository) describe(books []Book) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	for i := range books {
+		repo.names[books[i].ID] = books[i].Name
+		if convertedExt(books[i].Name) == "" {
+			continue
+		}
+
+		if metadata, ok := repo.metadata[convertKey(books[i].ID, books[i].Revision)]; ok {
+			metadata.apply(&books[i])
+		}
+	}
+}
+
+func (metadata convertedMetadata) apply(book *Book) {
+	if book.Title == "" {
+		book.Title = metadata.Title
+	}
+	if len(book.Authors) == 0 {
+		book.Authors = metadata.Authors
+	}
+	if book.Series == "" {
+		book.Series = metadata.Series
+		book.SeriesIndex = metadata.SeriesIndex
+	}
+	if len(book.Tags) == 0 {
+		book.Tags = metadata.Tags
+	}
+	book.HasCover = book.HasCover || metadata.Cover != ""
+}
+
+// Download returns books in formats that are converted as EPUBs, named as
+// such, converting them first if this revision was not converted yet. If
+// upstream can describe books without downloading them, books that were
+// converted already are served without downloading them again. Books
+// without a revision are converted every time, as a change to them could
+// not be told apart. Books whose name is known not to need converting are
+// passed through as they are.
+func (repo *ConvertingRepository) Download(ctx context.Context, ID string) (
+	book Book, data io.ReadCloser, err error,
+) {
+	if name, ok := repo.name(ID); ok && convertedExt(name) == "" {
+		return repo.Repository.Download(ctx, ID)
+	}
+
+	var source io.ReadCloser
+	if book, err = Stat(ctx, repo.Repository, ID); errors.Is(err, errNoStat) {
+		book, source, err = repo.Repository.Download(ctx, ID)
+	}
+	if err != nil {
+		return
+	}
+
+	ext := convertedExt(book.Name)
+	if ext == "" {
+		if source == nil {
+			return repo.Repository.Download(ctx, ID)
+		}
+		return book, source, nil
+	}
+
+	defer func() {
+		if source != nil {
+			source.Close()
+		}
+	}()
+
+	// download returns the book to convert, downloading it if it was not
+	// downloaded yet.
+	download := func() (io.Reader, error) {
+		if source == nil {
+			var err error
+			if _, source, err = repo.Repository.Download(ctx, ID); err != nil {
+				return nil, err
+			}
+		}
+		return source, nil
+	}
+
+	name := book.Name[:len(book.Name)-len(ext)] + ".epub"
+
+	if book.Revision == "" {
+		var r io.Reader
+		if r, err = download(); err != nil {
+			return
+		}
+
+		var metadata convertedMetadata
+		if metadata, data, err = repo.convertOnce(ctx, book, ext, r); err != nil {
+			err = fmt.Errorf("converting %s to EPUB: %w", book.Name, err)
+			return
+		}
+
+		metadata.apply(&book)
+		book.Name = name
+		return
+	}
+
+	key := convertKey(ID, book.Revision)
+	if err = repo.ensureConverted(ctx, book, key, ext, download); err != nil {
+		err = fmt.Errorf("converting %s to EPUB: %w", book.Name, err)
+		return
+	}
+
+	repo.lock.Lock()
+	metadata := repo.metadata[key]
+	repo.lock.Unlock()
+
+	if data, err = os.Open(filepath.Join(repo.dir, key+".epub")); err != nil {
+		// Removed behind our back, convert it again next time.
+		repo.lock.Lock()
+		delete(repo.metadata, key)
+		repo.lock.Unlock()
+		return
+	}
+
+	metadata.apply(&book)
+	book.Name = name
+	return
+}
+
+// name returns the name of the book ID as it was last listed or, for
+// repositories whose IDs are paths, the ID itself if it has an extension.
+func (repo *ConvertingRepository) name(ID string) (name string, ok bool) {
+	repo.lock.Lock()
+	name, ok = repo.names[ID]
+	repo.lock.Unlock()
+
+	if !ok && path.Ext(ID) != "" {
+		return ID, true
+	}
+	return
+}
+
+// ensureConverted converts the book saved as key unless that was done
+// already, or waits for the conversion in progress.
+func (repo *ConvertingRepository) ensureConverted(
+	ctx context.Context, book Book, key string, ext string, download func() (io.Reader, error),
+) (err error) {
+	for {
+		repo.lock.Lock()
+		_, converted := repo.metadata[key]
+		wait, converting := repo.inflight[key]
+		if !converted && !converting {
+			repo.inflight[key] = make(chan struct{})
+		}
+		repo.lock.Unlock()
+
+		if converted {
+			return
+		}
+
+		if !converting {
+			return repo.convertInflight(ctx, book, key, ext, download)
+		}
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// convertInflight runs the conversion registered in inflight as key, and
+// always lets those waiting for it go once it is over.
+func (repo *ConvertingRepository) convertInflight(
+	ctx context.Context, book Book, key string, ext string, download func() (io.Reader, error),
+) (err error) {
+	var metadata convertedMetadata
+	defer func() {
+		repo.lock.Lock()
+		if err == nil {
+			repo.metadata[key] = metadata
+		}
+		close(repo.inflight[key])
+		delete(repo.inflight, key)
+		repo.lock.Unlock()
+	}()
+
+	var data io.Reader
+	if data, err = download(); err != nil {
+		return
+	}
+
+	metadata, err = repo.convert(ctx, book, key, ext, data)
+	return
+}
+
+// convert converts the book in source, saves it as key and drops the
+// conversions of other revisions of the book.
+func (repo *ConvertingRepository) convert(
+	ctx context.Context, source Book, key string, ext string, data io.Reader,
+) (metadata convertedMetadata, err error) {
+	var out *os.File
+	if out, err = ioutil.TempFile(repo.dir, ".epub"); err != nil {
+		return
+	}
+
+	metadata, err = repo.convertTo(ctx, source, "urn:bookbrowser:"+key, ext, data, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), filepath.Join(repo.dir, key+".epub"))
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return
+	}
+
+	var encoded []byte
+	if encoded, err = json.Marshal(metadata); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(filepath.Join(repo.dir, key+".json"), encoded, 0644); err != nil {
+		return
+	}
+
+	repo.forget(source.ID, key)
+	return
+}
+
+// convertOnce converts the book in source to a file that is removed once it
+// is closed.
+func (repo *ConvertingRepository) convertOnce(
+	ctx context.Context, source Book, ext string, data io.Reader,
+) (metadata convertedMetadata, converted io.ReadCloser, err error) {
+	var out *os.File
+	if out, err = ioutil.TempFile(repo.dir, ".once"); err != nil {
+		return
+	}
+
+	if metadata, err = repo.convertTo(ctx, source, "urn:bookbrowser:"+convertPrefix(source.ID), ext, data, out); err == nil {
+		_, err = out.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return
+	}
+
+	converted = &removedOnClose{File: out}
+	return
+}
+
+// convertTo converts the book in data to an EPUB written to out. A converter
+// that panics on a malformed book fails the conversion with ErrInvalid.
+func (repo *ConvertingRepository) convertTo(
+	ctx context.Context, source Book, identifier string, ext string, data io.Reader, out io.Writer,
+) (metadata convertedMetadata, err error) {
+	// The converters need to read the whole book in any order.
+	var tmp *os.File
+	if tmp, err = ioutil.TempFile(repo.dir, ".source"); err != nil {
+		return
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	var size int64
+	if size, err = io.Copy(tmp, data); err != nil {
+		err = transportError(ctx, err)
+		return
+	}
+
+	var book epubBook
+	if book, err = runConverter(ext, tmp, size); err != nil {
+		return
+	}
+
+	book.Identifier = identifier
+	if book.Title == "" {
+		book.Title = source.Name[:len(source.Name)-len(ext)]
+	}
+
+	if err = book.write(out, time.Now()); err != nil {
+		return
+	}
+
+	metadata = convertedMetadata{
+		Title:       book.Title,
+		Authors:     book.Authors,
+		Series:      book.Series,
+		SeriesIndex: book.SeriesIndex,
+		Tags:        book.Tags,
+		Cover:       book.Cover,
+	}
+	return
+}
+
+// runConverter converts the book in r with the converter for ext, turning a
+// panic of the converter into an error.
+func runConverter(ext string, r io.ReaderAt, size int64) (book epubBook, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = wrap(ErrInvalid, fmt.Errorf("malformed %s book: %v", ext, recovered))
+		}
+	}()
+
+	for _, c := range converters {
+		if c.ext == ext {
+			return c.convert(r, size)
+		}
+	}
+
+	err = fmt.Errorf("no converter for %s", ext)
+	return
+}
+
+// removedOnClose is a temporary file that is removed once it is closed.
+type removedOnClose struct {
+	*os.File
+}
+
+func (f *removedOnClose) Close() error {
+	err := f.File.Close()
+	os.Remove(f.File.Name())
+	return err
+}
+
+// forget removes the conversions of revisions of the book ID other than the
+// one saved as key.
+func (repo *ConvertingRepository) forget(ID string, key string) {
+	prefix := convertPrefix(ID)
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	for old := range repo.metadata {
+		if old != key && strings.HasPrefix(old, prefix) {
+			delete(repo.metadata, old)
+			os.Remove(filepath.Join(repo.dir, old+".epub"))
+			os.Remove(filepath.Join(repo.dir, old+".json"))
+		}
+	}
+}
+
+// Cover returns the cover of a converted book from the EPUB it was converted
+// to, and asks the upstream repository for the others.
+func (repo *ConvertingRepository) Cover(ctx context.Context, ID string) (data io.ReadCloser, err error) {
+	repo.lock.Lock()
+	prefix := convertPrefix(ID)
+	var key, cover string
+	for k, metadata := range repo.metadata {
+		if strings.HasPrefix(k, prefix) && metadata.Cover != "" {
+			key, cover = k, metadata.Cover
+		}
+	}
+	repo.lock.Unlock()
+
+	if cover != "" {
+		var archive *zip.ReadCloser
+		if archive, err = zip.OpenReader(filepath.Join(repo.dir, key+".epub")); err == nil {
+			for _, f := range archive.File {
+				if f.Name != "OEBPS/"+cover {
+					continue
+				}
+
+				var entry io.ReadCloser
+				if entry, err = f.Open(); err != nil {
+					break
+				}
+				return &zipEntry{ReadCloser: entry, archive: archive}, nil
+			}
+			archive.Close()
+		}
+	}
+
+	covers, ok := repo.Repository.(CoverRepository)
+	if !ok {
+		err = wrap(ErrNotFound, fmt.Errorf("covers are not supported"))
+		return
+	}
+
+	return covers.Cover(ctx, ID)
+}
+
+// convertKey returns the name a conversion of the given revision of a book
+// is kept under: the hash of the ID followed by that of the revision, so
+// that the conversions of a book can be found by the first half.
+func convertKey(ID string, revision string) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s\x00%d", revision, convertVersion)))
+	return convertPrefix(ID) + hex.EncodeToString(sum[:sha1.Size/2])
+}
+
+func convertPrefix(ID string) string {
+	sum := sha1.Sum([]byte(ID))
+	return hex.EncodeToString(sum[:sha1.Size/2])
+}
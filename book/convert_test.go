@@ -0,0 +1,169 @@
+package book
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingRepository counts downloads and stats, and hides revisions if
+// noRevision is set.
+type countingRepository struct {
+	*MemoryRepository
+	downloads  int32
+	stats      int32
+	noRevision bool
+}
+
+func (repo *countingRepository) Download(ctx context.Context, ID string) (Book, io.ReadCloser, error) {
+	atomic.AddInt32(&repo.downloads, 1)
+	book, data, err := repo.MemoryRepository.Download(ctx, ID)
+	if repo.noRevision {
+		book.Revision = ""
+	}
+	return book, data, err
+}
+
+func (repo *countingRepository) Stat(ctx context.Context, ID string) (Book, error) {
+	atomic.AddInt32(&repo.stats, 1)
+	book, err := repo.MemoryRepository.Stat(ctx, ID)
+	if repo.noRevision {
+		book.Revision = ""
+	}
+	return book, err
+}
+
+func newTestConvertingRepository(t *testing.T, upstream *countingRepository) *ConvertingRepository {
+	t.Helper()
+
+	repo, err := NewConvertingRepository(upstream, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return repo
+}
+
+func convertedText(t *testing.T, repo Repository, ID string) (Book, string) {
+	t.Helper()
+
+	book, data, err := repo.Download(context.Background(), ID)
+	if err != nil {
+		t.Fatalf("Download(%s): %v", ID, err)
+	}
+	defer data.Close()
+
+	content, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return book, string(content)
+}
+
+func TestConvertingRepositoryDownloadsOnlyToConvert(t *testing.T) {
+	upstream := &countingRepository{MemoryRepository: NewMemoryRepository()}
+	upstream.put("/books/notes.txt", []byte("Chapter 1\n\nSome text."))
+	repo := newTestConvertingRepository(t, upstream)
+	ID := memoryID("/books/notes.txt")
+
+	book, epub := convertedText(t, repo, ID)
+	if book.Name != "notes.epub" || !strings.HasPrefix(epub, "PK") {
+		t.Fatalf("first download is %s, not an EPUB", book.Name)
+	}
+
+	convertedText(t, repo, ID)
+	if upstream.downloads != 1 {
+		t.Errorf("%d upstream downloads for two opens of the same revision, want 1", upstream.downloads)
+	}
+
+	upstream.put("/books/notes.txt", []byte("Chapter 1\n\nOther text."))
+	convertedText(t, repo, ID)
+	if upstream.downloads != 2 {
+		t.Errorf("%d upstream downloads after a new revision, want 2", upstream.downloads)
+	}
+}
+
+func TestConvertingRepositoryPassesListedBooksThrough(t *testing.T) {
+	upstream := &countingRepository{MemoryRepository: NewMemoryRepository()}
+	upstream.put("/books/plain.epub", []byte("PK epub"))
+	upstream.put("/books/notes.txt", []byte("Some text."))
+	repo := newTestConvertingRepository(t, upstream)
+
+	if _, err := repo.List(context.Background(), "/books"); err != nil {
+		t.Fatal(err)
+	}
+
+	if book, content := convertedText(t, repo, memoryID("/books/plain.epub")); book.Name != "plain.epub" || content != "PK epub" {
+		t.Errorf("listed EPUB downloaded as %s %q", book.Name, content)
+	}
+	if upstream.stats != 0 {
+		t.Errorf("%d upstream stats for a listed EPUB, want none", upstream.stats)
+	}
+
+	if book, _ := convertedText(t, repo, memoryID("/books/notes.txt")); book.Name != "notes.epub" {
+		t.Errorf("listed text downloaded as %s, want notes.epub", book.Name)
+	}
+	if upstream.stats != 1 || upstream.downloads != 2 {
+		t.Errorf("%d stats and %d downloads, want 1 and 2", upstream.stats, upstream.downloads)
+	}
+}
+
+func TestConvertingRepositoryWithoutRevisions(t *testing.T) {
+	upstream := &countingRepository{MemoryRepository: NewMemoryRepository(), noRevision: true}
+	upstream.put("/books/notes.txt", []byte("first version"))
+	repo := newTestConvertingRepository(t, upstream)
+	ID := memoryID("/books/notes.txt")
+
+	_, first := convertedText(t, repo, ID)
+	upstream.put("/books/notes.txt", []byte("second version"))
+	_, second := convertedText(t, repo, ID)
+
+	if first == second {
+		t.Errorf("a book without revisions was not converted again after it changed")
+	}
+}
+
+func TestConvertingRepositoryRecoversFromPanics(t *testing.T) {
+	for i := range converters {
+		if c := &converters[i]; c.ext == ".txt" {
+			saved := c.convert
+			c.convert = func(r io.ReaderAt, size int64) (epubBook, error) {
+				panic("malformed")
+			}
+			defer func() { c.convert = saved }()
+		}
+	}
+
+	upstream := &countingRepository{MemoryRepository: NewMemoryRepository()}
+	upstream.put("/books/bad.txt", []byte("text"))
+	repo := newTestConvertingRepository(t, upstream)
+	ID := memoryID("/books/bad.txt")
+
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, _, err := repo.Download(context.Background(), ID)
+			done <- err
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("converting a malformed book succeeded")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("download hangs after a converter panicked")
+		}
+	}
+}
+
+func memoryID(p string) string {
+	return NewMemoryRepository().book(p, memoryFile{}, "").ID
+}
@@ -0,0 +1,731 @@
+package book
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// docxStyleSheet is the style sheet of books converted from Word documents.
+const docxStyleSheet = `table { border-collapse: collapse; margin: 1em 0; }
+td, th { border: 1px solid #888; padding: 0.2em 0.4em; vertical-align: top; }
+img { max-width: 100%; }
+.title { text-align: center; }
+aside { margin: 1em 0; }
+`
+
+// docxHeading matches the names of the styles of headings.
+var docxHeading = regexp.MustCompile(`^heading ?([1-9])$`)
+
+// docxFormats are the run properties of Word documents that are written as
+// HTML elements, in the order they are nested.
+var docxFormats = []struct {
+	property string
+	element  string
+}{
+	{"b", "strong"}, {"i", "em"}, {"u", "u"}, {"strike", "s"}, {"dstrike", "s"},
+}
+
+// docxStyle is what is taken from a paragraph style of a Word document.
+type docxStyle struct {
+	basedOn string
+	// level is that of headings, and 0 for other paragraphs.
+	level int
+	title bool
+	// numID is the numbering of lists, if the style is that of a list.
+	numID string
+}
+
+type docxRelationship struct {
+	kind string
+	// target is the name of the file in the document, or a URL if
+	// external is set.
+	target   string
+	external bool
+}
+
+// docxBlock is a paragraph, heading, table or piece of a list of a Word
+// document, written as HTML.
+type docxBlock struct {
+	// Level is that of a heading, and 0 for other blocks.
+	Level int
+	Title string
+	ID    string
+	HTML  string
+}
+
+// docxDocument is a Word document being converted.
+type docxDocument struct {
+	files map[string]*zip.File
+	rels  map[string]docxRelationship
+
+	styles map[string]docxStyle
+	// ordered maps the numberings of lists and their levels to whether the
+	// lists are numbered rather than bulleted.
+	ordered map[string]map[string]bool
+	// notes are the footnotes and endnotes, by their kind and ID as in
+	// "footnote-2", and noteOrder the ones referred to, in order.
+	notes     map[string]*xmlNode
+	noteOrder []string
+	// note is the note being written, if any.
+	note string
+
+	book epubBook
+	// title is the paragraph in the Title style, if any.
+	title string
+	// images maps the relationships of images to their resources.
+	images   map[string]string
+	headings int
+}
+
+// sniffDOCX reports whether head is the start of a zip, as Word documents
+// are.
+func sniffDOCX(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("PK\x03\x04"))
+}
+
+// convertDOCX converts a Word document to EPUB. Chapters start at the
+// headings of the highest level, or of the next if there is a single
+// heading of the highest, which is then the title. All headings are in the
+// table of contents. Footnotes and endnotes are gathered in a chapter of
+// notes linked from the text.
+func convertDOCX(r io.ReaderAt, size int64) (book epubBook, err error) {
+	var archive *zip.Reader
+	if archive, err = zip.NewReader(r, size); err != nil {
+		err = wrap(ErrInvalid, err)
+		return
+	}
+
+	d := docxDocument{
+		files:   map[string]*zip.File{},
+		styles:  map[string]docxStyle{},
+		ordered: map[string]map[string]bool{},
+		notes:   map[string]*xmlNode{},
+		images:  map[string]string{},
+	}
+	for _, f := range archive.File {
+		d.files[f.Name] = f
+	}
+
+	main := "word/document.xml"
+	for _, rel := range d.relationships("") {
+		if strings.HasSuffix(rel.kind, "/officeDocument") {
+			main = rel.target
+		}
+	}
+
+	body := d.parse(main).child("document").child("body")
+	if body == nil {
+		err = wrap(ErrInvalid, fmt.Errorf("not a Word document"))
+		return
+	}
+
+	d.rels = d.relationships(main)
+	for _, rel := range d.rels {
+		switch {
+		case rel.external:
+		case strings.HasSuffix(rel.kind, "/styles"):
+			d.readStyles(d.parse(rel.target))
+		case strings.HasSuffix(rel.kind, "/numbering"):
+			d.readNumbering(d.parse(rel.target))
+		case strings.HasSuffix(rel.kind, "/footnotes"):
+			d.readNotes(d.parse(rel.target), "footnote")
+		case strings.HasSuffix(rel.kind, "/endnotes"):
+			d.readNotes(d.parse(rel.target), "endnote")
+		}
+	}
+
+	d.book.Resources = append(d.book.Resources, epubResource{Name: "style.css", MediaType: "text/css", Data: []byte(docxStyleSheet)})
+	d.book.Styles = []string{"style.css"}
+	d.readProperties(d.parse("docProps/core.xml").child("coreProperties"))
+
+	blocks := d.blocks(body.Children)
+
+	levels := map[int]int{}
+	var present []int
+	for _, block := range blocks {
+		if block.Level > 0 {
+			if levels[block.Level] == 0 {
+				present = append(present, block.Level)
+			}
+			levels[block.Level]++
+		}
+	}
+	sort.Ints(present)
+
+	split := 0
+	if len(present) > 0 {
+		split = present[0]
+		if levels[split] == 1 && len(present) > 1 {
+			for _, block := range blocks {
+				if block.Level == split && d.title == "" {
+					d.title = block.Title
+				}
+			}
+			split = present[1]
+		}
+	}
+	if d.book.Title == "" {
+		d.book.Title = d.title
+	}
+
+	var parts []string
+	var part strings.Builder
+	count := 0
+	for _, block := range blocks {
+		if part.Len() > 0 && (block.Level > 0 && block.Level <= split || split == 0 && count >= textChapterParagraphs) {
+			parts = append(parts, part.String())
+			part.Reset()
+			count = 0
+		}
+
+		if block.Level > 0 && block.Level <= split+2 {
+			point := epubNavPoint{Title: block.Title, Level: block.Level - split + 1, Chapter: len(parts)}
+			if part.Len() > 0 {
+				point.Anchor = block.ID
+			}
+			d.book.Contents = append(d.book.Contents, point)
+		}
+
+		part.WriteString(block.HTML + "\n")
+		count++
+	}
+	if part.Len() > 0 || len(parts) == 0 {
+		parts = append(parts, part.String())
+	}
+
+	if len(d.noteOrder) > 0 {
+		parts = append(parts, d.notesHTML())
+	}
+
+	d.book.Chapters = chaptersFromHTML(parts, nil)
+	if len(d.noteOrder) > 0 {
+		notes := &d.book.Chapters[len(d.book.Chapters)-1]
+		notes.Auxiliary = true
+	}
+
+	return d.book, nil
+}
+
+// read returns the content of the file with the given name.
+func (d *docxDocument) read(name string) (data []byte, err error) {
+	f, ok := d.files[name]
+	if !ok {
+		err = wrap(ErrInvalid, fmt.Errorf("%s is missing", name))
+		return
+	}
+
+	var r io.ReadCloser
+	if r, err = f.Open(); err != nil {
+		return
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// parse returns the XML file with the given name as a tree, or nil if it is
+// missing or can not be read.
+func (d *docxDocument) parse(name string) *xmlNode {
+	data, err := d.read(name)
+	if err != nil {
+		return nil
+	}
+
+	document, err := parseXML(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	return document
+}
+
+// relationships returns the relationships of the file with the given name,
+// or of the whole document if name is empty, by their IDs.
+func (d *docxDocument) relationships(name string) map[string]docxRelationship {
+	dir, base := path.Split(name)
+	rels := map[string]docxRelationship{}
+	for _, node := range d.parse(dir + "_rels/" + base + ".rels").child("Relationships").children() {
+		if node.Name != "Relationship" {
+			continue
+		}
+
+		rel := docxRelationship{kind: node.attr("Type"), target: node.attr("Target")}
+		if rel.external = node.attr("TargetMode") == "External"; !rel.external {
+			if strings.HasPrefix(rel.target, "/") {
+				rel.target = path.Clean(rel.target[1:])
+			} else {
+				rel.target = path.Join(dir, rel.target)
+			}
+		}
+		rels[node.attr("Id")] = rel
+	}
+
+	return rels
+}
+
+// readProperties sets the metadata of the book from the core properties of
+// the document.
+func (d *docxDocument) readProperties(properties *xmlNode) {
+	d.book.Title = properties.child("title").text()
+	d.book.Description = properties.child("description").text()
+	d.book.Language = properties.child("language").text()
+
+	for _, author := range strings.Split(properties.child("creator").text(), ";") {
+		if author = strings.TrimSpace(author); author != "" {
+			d.book.Authors = append(d.book.Authors, author)
+		}
+	}
+
+	for _, tag := range strings.FieldsFunc(properties.child("keywords").text(), func(r rune) bool {
+		return r == ',' || r == ';'
+	}) {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			d.book.Tags = append(d.book.Tags, tag)
+		}
+	}
+}
+
+// readStyles reads the paragraph styles of the document.
+func (d *docxDocument) readStyles(styles *xmlNode) {
+	for _, node := range styles.child("styles").children() {
+		if node.Name != "style" || node.attr("type") != "paragraph" {
+			continue
+		}
+
+		properties := node.child("pPr")
+		style := docxStyle{
+			basedOn: node.child("basedOn").attr("val"),
+			numID:   properties.child("numPr").child("numId").attr("val"),
+		}
+
+		name := strings.ToLower(node.child("name").attr("val"))
+		if match := docxHeading.FindStringSubmatch(name); match != nil {
+			style.level, _ = strconv.Atoi(match[1])
+		}
+		if level, err := strconv.Atoi(properties.child("outlineLvl").attr("val")); err == nil && level < 9 {
+			style.level = level + 1
+		}
+		style.title = name == "title"
+
+		d.styles[node.attr("styleId")] = style
+	}
+}
+
+// style returns the paragraph style with the given ID, with what it does
+// not set taken from the styles it is based on.
+func (d *docxDocument) style(id string) (style docxStyle) {
+	for i := 0; i < 10 && id != ""; i++ {
+		base, ok := d.styles[id]
+		if !ok {
+			break
+		}
+
+		if style.level == 0 && !style.title {
+			style.level, style.title = base.level, base.title
+		}
+		if style.numID == "" {
+			style.numID = base.numID
+		}
+		id = base.basedOn
+	}
+
+	return
+}
+
+// readNumbering reads whether the levels of each numbering of lists are
+// numbered or bulleted.
+func (d *docxDocument) readNumbering(numbering *xmlNode) {
+	abstract := map[string]map[string]bool{}
+	for _, node := range numbering.child("numbering").children() {
+		if node.Name != "abstractNum" {
+			continue
+		}
+
+		levels := map[string]bool{}
+		for _, level := range node.Children {
+			if level.Name == "lvl" {
+				format := level.child("numFmt").attr("val")
+				levels[level.attr("ilvl")] = format != "" && format != "bullet" && format != "none"
+			}
+		}
+		abstract[node.attr("abstractNumId")] = levels
+	}
+
+	for _, node := range numbering.child("numbering").children() {
+		if node.Name == "num" {
+			d.ordered[node.attr("numId")] = abstract[node.child("abstractNumId").attr("val")]
+		}
+	}
+}
+
+// readNotes reads the footnotes or endnotes of the document.
+func (d *docxDocument) readNotes(notes *xmlNode, kind string) {
+	for _, node := range notes.child(kind + "s").children() {
+		if node.Name == kind && node.attr("type") != "separator" && node.attr("type") != "continuationSeparator" {
+			d.notes[kind+"-"+node.attr("id")] = node
+		}
+	}
+}
+
+// blocks writes the paragraphs and tables in nodes, with the paragraphs
+// that are items of lists put in lists.
+func (d *docxDocument) blocks(nodes []*xmlNode) (blocks []docxBlock) {
+	// lists are the elements of the lists that are open, nested in order.
+	var lists []string
+	closeLists := func(depth int) {
+		for len(lists) > depth {
+			blocks = append(blocks, docxBlock{HTML: "</li></" + lists[len(lists)-1] + ">"})
+			lists = lists[:len(lists)-1]
+		}
+	}
+
+	var walk func(nodes []*xmlNode)
+	walk = func(nodes []*xmlNode) {
+		for _, node := range nodes {
+			switch node.Name {
+			case "p":
+				if depth, ordered, ok := d.listItem(node); ok {
+					element := "ul"
+					if ordered {
+						element = "ol"
+					}
+
+					closeLists(depth)
+					if len(lists) == depth && lists[depth-1] != element {
+						closeLists(depth - 1)
+					} else if len(lists) == depth {
+						blocks = append(blocks, docxBlock{HTML: "</li>"})
+					}
+					for len(lists) < depth {
+						blocks = append(blocks, docxBlock{HTML: "<" + element + ">"})
+						lists = append(lists, element)
+					}
+
+					blocks = append(blocks, docxBlock{HTML: "<li>" + d.inline(node)})
+					continue
+				}
+
+				closeLists(0)
+				if block := d.paragraph(node); block.HTML != "" {
+					blocks = append(blocks, block)
+				}
+			case "tbl":
+				closeLists(0)
+				blocks = append(blocks, docxBlock{HTML: d.table(node)})
+			case "sdt":
+				walk(node.child("sdtContent").children())
+			case "customXml", "ins", "moveTo":
+				walk(node.Children)
+			}
+		}
+	}
+	walk(nodes)
+	closeLists(0)
+
+	return
+}
+
+// listItem returns the depth of the list paragraph is an item of, from 1,
+// and whether the list is numbered, or false if it is not in a list.
+func (d *docxDocument) listItem(paragraph *xmlNode) (depth int, ordered bool, ok bool) {
+	properties := paragraph.child("pPr")
+	numID := d.style(properties.child("pStyle").attr("val")).numID
+	level := "0"
+	if numbering := properties.child("numPr"); numbering != nil {
+		if id := numbering.child("numId").attr("val"); id != "" {
+			numID = id
+		}
+		if ilvl := numbering.child("ilvl").attr("val"); ilvl != "" {
+			level = ilvl
+		}
+	}
+	if numID == "" || numID == "0" {
+		return
+	}
+
+	depth, _ = strconv.Atoi(level)
+	if depth < 0 || depth > 8 {
+		depth = 0
+	}
+
+	return depth + 1, d.ordered[numID][level], true
+}
+
+// paragraph writes a paragraph that is not in a list, as a heading if its
+// style or outline level says it is one. Paragraphs with nothing in them
+// are written as nothing.
+func (d *docxDocument) paragraph(paragraph *xmlNode) (block docxBlock) {
+	properties := paragraph.child("pPr")
+	style := d.style(properties.child("pStyle").attr("val"))
+	if level, err := strconv.Atoi(properties.child("outlineLvl").attr("val")); err == nil {
+		style.level = 0
+		if level < 9 {
+			style.level = level + 1
+		}
+	}
+
+	content := d.inline(paragraph)
+	if content == "" {
+		return
+	}
+
+	align := ""
+	switch properties.child("jc").attr("val") {
+	case "center":
+		align = ` style="text-align: center;"`
+	case "right", "end":
+		align = ` style="text-align: right;"`
+	case "both", "distribute":
+		align = ` style="text-align: justify;"`
+	}
+
+	title := htmlText(content)
+	switch {
+	case style.title:
+		if d.title == "" {
+			d.title = title
+		}
+		block.HTML = fmt.Sprintf(`<h1 class="title">%s</h1>`, content)
+	case style.level > 0 && title != "" && d.note == "":
+		d.headings++
+		block.Level, block.Title, block.ID = style.level, title, fmt.Sprintf("heading-%d", d.headings)
+
+		element := fmt.Sprintf("h%d", style.level)
+		if style.level > 6 {
+			element = "h6"
+		}
+		block.HTML = fmt.Sprintf(`<%s id="%s"%s>%s</%s>`, element, block.ID, align, content, element)
+	default:
+		block.HTML = fmt.Sprintf(`<p%s>%s</p>`, align, content)
+	}
+
+	return
+}
+
+// inline writes the runs, links and bookmarks of a paragraph.
+func (d *docxDocument) inline(node *xmlNode) string {
+	if node == nil {
+		return ""
+	}
+
+	var out strings.Builder
+	for _, child := range node.Children {
+		switch child.Name {
+		case "r":
+			out.WriteString(d.run(child))
+		case "hyperlink":
+			href := ""
+			if anchor := child.attr("anchor"); anchor != "" {
+				href = "#" + anchor
+			} else if rel, ok := d.rels[child.attr("id")]; ok && rel.external {
+				href = rel.target
+			}
+
+			if content := d.inline(child); href != "" {
+				fmt.Fprintf(&out, `<a href="%s">%s</a>`, xhtmlEscape(href), content)
+			} else {
+				out.WriteString(content)
+			}
+		case "bookmarkStart":
+			if name := child.attr("name"); name != "" && name != "_GoBack" {
+				fmt.Fprintf(&out, `<a id="%s"></a>`, xhtmlEscape(name))
+			}
+		case "sdt":
+			out.WriteString(d.inline(child.child("sdtContent")))
+		case "ins", "smartTag", "customXml", "fldSimple", "moveTo", "dir", "bdo":
+			out.WriteString(d.inline(child))
+		}
+	}
+
+	return out.String()
+}
+
+// run writes a run of text with the same formatting, and the images, breaks
+// and references to notes in it.
+func (d *docxDocument) run(run *xmlNode) string {
+	var content strings.Builder
+	for _, child := range run.Children {
+		switch child.Name {
+		case "t":
+			for _, text := range child.Children {
+				content.WriteString(xhtmlEscape(text.Text))
+			}
+		case "tab":
+			content.WriteString(" ")
+		case "br", "cr":
+			if child.attr("type") != "page" && child.attr("type") != "column" {
+				content.WriteString("<br/>")
+			}
+		case "noBreakHyphen":
+			content.WriteString("‑")
+		case "drawing", "pict", "object":
+			content.WriteString(d.image(child))
+		case "footnoteReference", "endnoteReference":
+			content.WriteString(d.noteReference(strings.TrimSuffix(child.Name, "Reference") + "-" + child.attr("id")))
+		case "footnoteRef", "endnoteRef":
+			// The number of a note at its start, linked back to where the
+			// note is referred to.
+			for i, key := range d.noteOrder {
+				if key == d.note {
+					fmt.Fprintf(&content, `<a href="#ref-%s">%d.</a>`, key, i+1)
+				}
+			}
+		}
+	}
+	if content.Len() == 0 {
+		return ""
+	}
+
+	properties := run.child("rPr")
+	var open, close string
+	on := func(property *xmlNode) bool {
+		value := property.attr("val")
+		return property != nil && value != "0" && value != "false" && value != "off"
+	}
+	for _, format := range docxFormats {
+		if on(properties.child(format.property)) {
+			open += "<" + format.element + ">"
+			close = "</" + format.element + ">" + close
+		}
+	}
+	switch properties.child("vertAlign").attr("val") {
+	case "superscript":
+		open, close = open+"<sup>", "</sup>"+close
+	case "subscript":
+		open, close = open+"<sub>", "</sub>"+close
+	}
+
+	return open + content.String() + close
+}
+
+// noteReference writes a link to the note with the given key, numbered in
+// the order notes are referred to.
+func (d *docxDocument) noteReference(key string) string {
+	if _, ok := d.notes[key]; !ok {
+		return ""
+	}
+
+	number := 0
+	for i, other := range d.noteOrder {
+		if other == key {
+			number = i + 1
+		}
+	}
+	if number == 0 {
+		d.noteOrder = append(d.noteOrder, key)
+		number = len(d.noteOrder)
+	}
+
+	return fmt.Sprintf(`<a epub:type="noteref" href="#%s" id="ref-%s"><sup>%d</sup></a>`, key, key, number)
+}
+
+// notesHTML writes the notes referred to as the chapter of notes. Notes may
+// refer to other notes, which are added to the end.
+func (d *docxDocument) notesHTML() string {
+	var out strings.Builder
+	out.WriteString("<h1>Notes</h1>\n")
+	for i := 0; i < len(d.noteOrder); i++ {
+		d.note = d.noteOrder[i]
+
+		fmt.Fprintf(&out, `<aside epub:type="footnote" id="%s">`+"\n", d.note)
+		for _, block := range d.blocks(d.notes[d.note].Children) {
+			out.WriteString(block.HTML + "\n")
+		}
+		out.WriteString("</aside>\n")
+	}
+	d.note = ""
+
+	return out.String()
+}
+
+// image writes the image of a drawing, if it is one the reader can show.
+func (d *docxDocument) image(drawing *xmlNode) string {
+	var id, alt string
+	var walk func(node *xmlNode)
+	walk = func(node *xmlNode) {
+		switch node.Name {
+		case "blip":
+			if id == "" {
+				id = node.attr("embed")
+			}
+		case "imagedata":
+			if id == "" {
+				id = node.attr("id")
+			}
+		case "docPr":
+			alt = node.attr("descr")
+		}
+		for _, child := range node.Children {
+			walk(child)
+		}
+	}
+	walk(drawing)
+
+	name, ok := d.images[id]
+	if !ok {
+		d.images[id] = ""
+		if rel, found := d.rels[id]; found && !rel.external {
+			if data, err := d.read(rel.target); err == nil {
+				if ext, mediaType := imageType(data); ext != "" {
+					name = "images/" + strings.TrimSuffix(path.Base(rel.target), path.Ext(rel.target)) + ext
+					d.images[id] = name
+					d.book.Resources = append(d.book.Resources, epubResource{Name: name, MediaType: mediaType, Data: data})
+				}
+			}
+		}
+	}
+	if name == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(`<img src="%s" alt="%s"/>`, xhtmlEscape(name), xhtmlEscape(alt))
+}
+
+// table writes a table. Cells merged with the ones above them are written
+// empty.
+func (d *docxDocument) table(table *xmlNode) string {
+	var out strings.Builder
+	out.WriteString("<table>\n")
+	for _, row := range table.Children {
+		if row.Name != "tr" {
+			continue
+		}
+
+		element := "td"
+		if row.child("trPr").child("tblHeader") != nil {
+			element = "th"
+		}
+
+		out.WriteString("<tr>")
+		for _, cell := range row.Children {
+			if cell.Name != "tc" {
+				continue
+			}
+
+			properties := cell.child("tcPr")
+			span := ""
+			if columns, err := strconv.Atoi(properties.child("gridSpan").attr("val")); err == nil && columns > 1 {
+				span = fmt.Sprintf(` colspan="%d"`, columns)
+			}
+
+			content := ""
+			if merge := properties.child("vMerge"); merge == nil || merge.attr("val") == "restart" {
+				for _, block := range d.blocks(cell.Children) {
+					content += block.HTML + "\n"
+				}
+			}
+			fmt.Fprintf(&out, "<%s%s>%s</%s>", element, span, content, element)
+		}
+		out.WriteString("</tr>\n")
+	}
+	out.WriteString("</table>")
+
+	return out.String()
+}
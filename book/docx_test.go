@@ -0,0 +1,162 @@
+package book
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const docxNamespaces = `xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main" ` +
+	`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships" ` +
+	`xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" ` +
+	`xmlns:wp="http://schemas.openxmlformats.org/drawingml/2006/wordprocessingDrawing" ` +
+	`xmlns:pic="http://schemas.openxmlformats.org/drawingml/2006/picture"`
+
+// testDOCX returns a Word document with the given body.
+func testDOCX(body string) []byte {
+	relationships := "http://schemas.openxmlformats.org/officeDocument/2006/relationships/"
+	files := []struct{ name, content string }{
+		{"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="` + relationships + `officeDocument" Target="word/document.xml"/>
+</Relationships>`},
+		{"word/_rels/document.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="` + relationships + `styles" Target="styles.xml"/>
+<Relationship Id="rId2" Type="` + relationships + `numbering" Target="numbering.xml"/>
+<Relationship Id="rId3" Type="` + relationships + `footnotes" Target="footnotes.xml"/>
+<Relationship Id="rId4" Type="` + relationships + `image" Target="media/image1.png"/>
+<Relationship Id="rId5" Type="` + relationships + `hyperlink" Target="http://example.com" TargetMode="External"/>
+</Relationships>`},
+		{"word/styles.xml", `<w:styles ` + docxNamespaces + `>
+<w:style w:type="paragraph" w:styleId="Title"><w:name w:val="Title"/></w:style>
+<w:style w:type="paragraph" w:styleId="Heading1"><w:name w:val="heading 1"/></w:style>
+<w:style w:type="paragraph" w:styleId="Heading2"><w:name w:val="heading 2"/></w:style>
+</w:styles>`},
+		{"word/numbering.xml", `<w:numbering ` + docxNamespaces + `>
+<w:abstractNum w:abstractNumId="0"><w:lvl w:ilvl="0"><w:numFmt w:val="decimal"/></w:lvl><w:lvl w:ilvl="1"><w:numFmt w:val="bullet"/></w:lvl></w:abstractNum>
+<w:num w:numId="1"><w:abstractNumId w:val="0"/></w:num>
+</w:numbering>`},
+		{"word/footnotes.xml", `<w:footnotes ` + docxNamespaces + `>
+<w:footnote w:type="separator" w:id="0"><w:p><w:r><w:separator/></w:r></w:p></w:footnote>
+<w:footnote w:id="1"><w:p><w:r><w:t>A note.</w:t></w:r></w:p></w:footnote>
+</w:footnotes>`},
+		{"word/media/image1.png", string(pngPixel)},
+		{"docProps/core.xml", `<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:title>Report</dc:title><dc:creator>Jane Roe; John Doe</dc:creator><dc:language>en</dc:language>
+</cp:coreProperties>`},
+		{"word/document.xml", `<w:document ` + docxNamespaces + `><w:body>` + body + `</w:body></w:document>`},
+	}
+
+	var archive bytes.Buffer
+	w := zip.NewWriter(&archive)
+	for _, file := range files {
+		f, _ := w.Create(file.name)
+		f.Write([]byte(file.content))
+	}
+	w.Close()
+
+	return archive.Bytes()
+}
+
+func docxParagraph(style string, runs string) string {
+	return `<w:p><w:pPr><w:pStyle w:val="` + style + `"/></w:pPr>` + runs + `</w:p>`
+}
+
+func docxText(text string) string {
+	return `<w:r><w:t xml:space="preserve">` + text + `</w:t></w:r>`
+}
+
+func TestConvertDOCX(t *testing.T) {
+	data := testDOCX(
+		docxParagraph("Heading1", docxText("One")) +
+			docxParagraph("", docxText("Plain, ")+`<w:r><w:rPr><w:b/><w:i/></w:rPr><w:t>bold italic</w:t></w:r>`+
+				`<w:r><w:footnoteReference w:id="1"/></w:r>`) +
+			`<w:p><w:pPr><w:numPr><w:ilvl w:val="0"/><w:numId w:val="1"/></w:numPr></w:pPr>` + docxText("first") + `</w:p>` +
+			`<w:p><w:pPr><w:numPr><w:ilvl w:val="1"/><w:numId w:val="1"/></w:numPr></w:pPr>` + docxText("nested") + `</w:p>` +
+			docxParagraph("Heading1", docxText("Two")) +
+			docxParagraph("Heading2", docxText("Two and a half")) +
+			`<w:tbl><w:tr><w:tc><w:p>` + docxText("cell") + `</w:p></w:tc></w:tr></w:tbl>` +
+			`<w:p><w:r><w:drawing><wp:inline><wp:docPr id="1" descr="pixel"/><a:graphic><a:graphicData><pic:pic><pic:blipFill>` +
+			`<a:blip r:embed="rId4"/></pic:blipFill></pic:pic></a:graphicData></a:graphic></wp:inline></w:drawing></w:r></w:p>` +
+			`<w:p><w:hyperlink r:id="rId5">` + docxText("a link") + `</w:hyperlink></w:p>`,
+	)
+
+	book, err := convertDOCX(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if book.Title != "Report" || strings.Join(book.Authors, ", ") != "Jane Roe, John Doe" || book.Language != "en" {
+		t.Errorf("metadata = %q by %q in %q, want it from the core properties", book.Title, book.Authors, book.Language)
+	}
+
+	if len(book.Chapters) != 3 || book.Chapters[0].Title != "One" || book.Chapters[1].Title != "Two" {
+		t.Fatalf("chapters = %+v, want One, Two and the notes", book.Chapters)
+	}
+	for _, want := range []string{
+		"<strong><em>bold italic</em></strong>",
+		`<a epub:type="noteref" href="chapter3.xhtml#footnote-1" id="ref-footnote-1"><sup>1</sup></a>`,
+		"<ol>\n<li>first\n<ul>\n<li>nested\n</li></ul>\n</li></ol>",
+	} {
+		if !strings.Contains(book.Chapters[0].Body, want) {
+			t.Errorf("first chapter has no %s: %s", want, book.Chapters[0].Body)
+		}
+	}
+	for _, want := range []string{
+		"<td><p>cell</p>", `<img src="images/image1.png" alt="pixel"/>`, `<a href="http://example.com">a link</a>`,
+	} {
+		if !strings.Contains(book.Chapters[1].Body, want) {
+			t.Errorf("second chapter has no %s: %s", want, book.Chapters[1].Body)
+		}
+	}
+	if notes := book.Chapters[2]; !notes.Auxiliary || !strings.Contains(notes.Body, "<p>A note.</p>") {
+		t.Errorf("notes chapter = %+v", notes)
+	}
+
+	if len(book.Contents) != 3 || book.Contents[2].Level != 2 || book.Contents[2].Anchor != "heading-3" {
+		t.Errorf("contents = %+v, want the second level heading inside the second chapter", book.Contents)
+	}
+	if !hasResource(book, "images/image1.png", "image/png") {
+		t.Errorf("resources = %v, want the image", book.Resources)
+	}
+}
+
+func TestConvertDOCXSingleTitle(t *testing.T) {
+	data := testDOCX(
+		docxParagraph("Heading1", docxText("Guide")) +
+			docxParagraph("Heading2", docxText("Start")) + docxParagraph("", docxText("First.")) +
+			docxParagraph("Heading2", docxText("End")) + docxParagraph("", docxText("Last.")),
+	)
+
+	book, err := convertDOCX(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(book.Chapters); n < 2 || book.Chapters[n-2].Title != "Start" || book.Chapters[n-1].Title != "End" {
+		t.Errorf("chapters = %+v, want them split at the second level", book.Chapters)
+	}
+}
+
+func TestConvertDOCXInvalid(t *testing.T) {
+	var archive bytes.Buffer
+	w := zip.NewWriter(&archive)
+	f, _ := w.Create("notes.txt")
+	f.Write([]byte("not a document"))
+	w.Close()
+
+	if _, err := convertDOCX(bytes.NewReader(archive.Bytes()), int64(archive.Len())); !errors.Is(err, ErrInvalid) {
+		t.Errorf("converting a zip that is not a Word document: %v, want ErrInvalid", err)
+	}
+}
+
+func hasResource(book epubBook, name string, mediaType string) bool {
+	for _, resource := range book.Resources {
+		if resource.Name == name && resource.MediaType == mediaType {
+			return true
+		}
+	}
+
+	return false
+}
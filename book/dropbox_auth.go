@@ -0,0 +1,243 @@
+package book
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// dropboxAuthTimeout is how long a user has to approve access on Dropbox
+// before the authorization has to be started again.
+const dropboxAuthTimeout = 10 * time.Minute
+
+var dropboxEndpoint = oauth2.Endpoint{
+	AuthURL:  "https://www.dropbox.com/oauth2/authorize",
+	TokenURL: "https://api.dropboxapi.com/oauth2/token",
+}
+
+// DropboxAuth connects to Dropbox with the OAuth2 authorization code flow
+// and PKCE, so that no app secret is needed, and hands out short-lived
+// access tokens refreshed as needed. The refresh token is kept in file so
+// that the authorization survives restarts. Starting an authorization takes
+// a setup token, which is used up once Dropbox is connected, so that only
+// whoever can read it from the server log can link an account.
+type DropboxAuth struct {
+	config oauth2.Config
+	file   string
+
+	lock sync.Mutex
+	// setupToken is empty once an authorization has completed.
+	setupToken string
+	// tokens is nil until Dropbox has been connected.
+	tokens oauth2.TokenSource
+	// pending maps the state of each authorization in progress to it.
+	pending map[string]dropboxAuthorization
+}
+
+type dropboxAuthorization struct {
+	verifier    string
+	redirectURL string
+	expires     time.Time
+}
+
+func NewDropboxAuth(appKey string, file string) (auth *DropboxAuth, err error) {
+	auth = new(DropboxAuth)
+	auth.config = oauth2.Config{
+		ClientID: appKey,
+		Endpoint: dropboxEndpoint,
+	}
+	auth.file = file
+	auth.pending = map[string]dropboxAuthorization{}
+	if auth.setupToken, err = randomString(16); err != nil {
+		return
+	}
+
+	var data []byte
+	if data, err = ioutil.ReadFile(file); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	var token oauth2.Token
+	if err = json.Unmarshal(data, &token); err != nil {
+		err = fmt.Errorf("reading dropbox token %s: %v", file, err)
+		return
+	}
+
+	auth.tokens = auth.config.TokenSource(context.Background(), &token)
+	return
+}
+
+// Connected reports whether Dropbox has been authorized.
+func (auth *DropboxAuth) Connected() bool {
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+
+	return auth.tokens != nil
+}
+
+// SetupToken returns the token that starting an authorization takes, or an
+// empty string if it was used up.
+func (auth *DropboxAuth) SetupToken() string {
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+
+	return auth.setupToken
+}
+
+// ValidSetupToken reports whether token is the setup token.
+func (auth *DropboxAuth) ValidSetupToken(token string) bool {
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+
+	return auth.setupToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(auth.setupToken)) == 1
+}
+
+// AuthCodeURL starts an authorization if setupToken is valid and returns the
+// Dropbox page that asks the user for access, which sends them back to
+// redirectURL.
+func (auth *DropboxAuth) AuthCodeURL(setupToken string, redirectURL string) (authURL string, err error) {
+	if !auth.ValidSetupToken(setupToken) {
+		err = wrap(ErrUnauthorized, fmt.Errorf("missing or used up dropbox setup token, see the server log"))
+		return
+	}
+
+	var state, verifier string
+	if state, err = randomString(16); err != nil {
+		return
+	}
+	if verifier, err = randomString(32); err != nil {
+		return
+	}
+
+	auth.lock.Lock()
+	now := time.Now()
+	for s, pending := range auth.pending {
+		if now.After(pending.expires) {
+			delete(auth.pending, s)
+		}
+	}
+	auth.pending[state] = dropboxAuthorization{
+		verifier:    verifier,
+		redirectURL: redirectURL,
+		expires:     now.Add(dropboxAuthTimeout),
+	}
+	auth.lock.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	config := auth.config
+	config.RedirectURL = redirectURL
+	authURL = config.AuthCodeURL(
+		state,
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		// Without it Dropbox issues no refresh token.
+		oauth2.SetAuthURLParam("token_access_type", "offline"),
+	)
+
+	return
+}
+
+// Complete finishes the authorization identified by state by exchanging code
+// for tokens, and saves the refresh token.
+func (auth *DropboxAuth) Complete(ctx context.Context, state string, code string) (err error) {
+	auth.lock.Lock()
+	pending, ok := auth.pending[state]
+	delete(auth.pending, state)
+	auth.lock.Unlock()
+
+	if !ok || time.Now().After(pending.expires) {
+		err = wrap(ErrUnauthorized, fmt.Errorf("unknown or expired dropbox authorization, please start again"))
+		return
+	}
+
+	config := auth.config
+	config.RedirectURL = pending.redirectURL
+
+	var token *oauth2.Token
+	if token, err = config.Exchange(
+		ctx, code, oauth2.SetAuthURLParam("code_verifier", pending.verifier),
+	); err != nil {
+		err = dropboxAuthError(ctx, err)
+		return
+	}
+
+	if token.RefreshToken == "" {
+		err = fmt.Errorf("dropbox issued no refresh token")
+		return
+	}
+
+	var data []byte
+	if data, err = json.Marshal(token); err != nil {
+		return
+	}
+
+	if err = writeFileAtomic(auth.file, data); err != nil {
+		return
+	}
+
+	auth.lock.Lock()
+	auth.tokens = auth.config.TokenSource(context.Background(), token)
+	auth.setupToken = ""
+	auth.pending = map[string]dropboxAuthorization{}
+	auth.lock.Unlock()
+
+	return
+}
+
+// Token returns a valid access token, refreshing it if it expired.
+func (auth *DropboxAuth) Token() (token *oauth2.Token, err error) {
+	auth.lock.Lock()
+	tokens := auth.tokens
+	auth.lock.Unlock()
+
+	if tokens == nil {
+		err = wrap(ErrUnauthorized, fmt.Errorf("dropbox is not connected, visit /setup/dropbox"))
+		return
+	}
+
+	if token, err = tokens.Token(); err != nil {
+		err = dropboxAuthError(context.Background(), err)
+	}
+
+	return
+}
+
+// dropboxAuthError marks err from the token endpoint with the matching error
+// from errors.go. Dropbox refuses revoked refresh tokens and bad codes with
+// an error response, anything else is a transport problem.
+func dropboxAuthError(ctx context.Context, err error) error {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		if retrieveErr.Response.StatusCode >= 500 {
+			return wrap(ErrUnavailable, err)
+		}
+		return wrap(ErrUnauthorized, err)
+	}
+
+	return transportError(ctx, err)
+}
+
+// randomString returns n random bytes encoded to be safe in URLs.
+func randomString(n int) (s string, err error) {
+	b := make([]byte, n)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
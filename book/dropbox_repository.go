@@ -2,27 +2,33 @@ package book
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"net/http"
 	"strings"
+	"time"
 
 	dbx "github.com/dropbox/dropbox-sdk-go-unofficial/dropbox"
 	dropbox "github.com/dropbox/dropbox-sdk-go-unofficial/dropbox/files"
+	"golang.org/x/oauth2"
 )
 
+// DropboxRepository serves books and history from Dropbox. Every request
+// asks tokens for an access token, so that a DropboxAuth can refresh
+// short-lived tokens behind its back.
 type DropboxRepository struct {
-	client        dropbox.Client
+	config        dbx.Config
+	tokens        oauth2.TokenSource
 	historyPrefix string
 }
 
 func NewDropboxRepository(
-	token string, historyPrefix string,
+	tokens oauth2.TokenSource, historyPrefix string,
 ) (repo *DropboxRepository) {
 	repo = new(DropboxRepository)
-	repo.client = dropbox.New(dbx.Config{
-		Token: token,
-	})
+	repo.tokens = tokens
 
 	repo.historyPrefix = historyPrefix
 	if repo.historyPrefix == "" {
@@ -32,10 +38,90 @@ func NewDropboxRepository(
 	return
 }
 
-func (repo *DropboxRepository) List(path string) (books []Book, err error) {
+// client returns a Dropbox client whose requests are cancelled with ctx, as
+// the SDK has no other way of passing a context along, and carry a current
+// access token.
+func (repo *DropboxRepository) client(ctx context.Context) dropbox.Client {
+	config := repo.config
+	config.Client = &http.Client{
+		Transport: contextTransport{ctx: ctx, tokens: repo.tokens},
+	}
+
+	return dropbox.New(config)
+}
+
+type contextTransport struct {
+	ctx    context.Context
+	tokens oauth2.TokenSource
+}
+
+// RoundTrip adds the access token to every request except those to the
+// notify host, whose longpoll route is unauthenticated and rejects calls
+// that carry an Authorization header.
+func (t contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.WithContext(t.ctx)
+	if strings.HasPrefix(req.URL.Host, "notify.") {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+
+	token, err := t.tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header = req.Header.Clone()
+	token.SetAuthHeader(req)
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// dropboxError marks err with the matching error from errors.go. The SDK
+// reports most failures through the summary of an API error, such as
+// "path/not_found/.." or "expired_access_token/..".
+func dropboxError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	summary := err.Error()
+	switch {
+	case strings.Contains(summary, "not_found"):
+		return wrap(ErrNotFound, err)
+	case strings.Contains(summary, "conflict"):
+		return wrap(ErrConflict, err)
+	case strings.Contains(summary, "access_token"),
+		strings.Contains(summary, "missing_scope"),
+		strings.Contains(summary, "invalid_account_type"):
+		return wrap(ErrUnauthorized, err)
+	case strings.Contains(summary, "too_many"),
+		strings.Contains(summary, "internal_error"):
+		return wrap(ErrUnavailable, err)
+	}
+
+	return transportError(ctx, err)
+}
+
+func (repo *DropboxRepository) List(ctx context.Context, path string) (books []Book, err error) {
+	return repo.list(ctx, path, false)
+}
+
+// ListRecursive lists path and its subfolders with a single recursive
+// listing, which Dropbox pages through like any other.
+func (repo *DropboxRepository) ListRecursive(ctx context.Context, path string) (books []Book, err error) {
+	return repo.list(ctx, path, true)
+}
+
+func (repo *DropboxRepository) list(
+	ctx context.Context, path string, recursive bool,
+) (books []Book, err error) {
+	defer func() { err = dropboxError(ctx, err) }()
+
+	client := repo.client(ctx)
+
 	var res *dropbox.ListFolderResult
-	if res, err = repo.client.ListFolder(&dropbox.ListFolderArg{
-		Path: path,
+	if res, err = client.ListFolder(&dropbox.ListFolderArg{
+		Path:      path,
+		Recursive: recursive,
 	}); err != nil {
 		return
 	}
@@ -47,11 +133,16 @@ func (repo *DropboxRepository) List(path string) (books []Book, err error) {
 				continue
 			}
 
-			if strings.Contains(meta.Name, ".pdf") || strings.Contains(meta.Name, ".epub") {
+			if isBookName(meta.Name) {
 				books = append(books, Book{
-					ID:    meta.Id,
-					Name:  meta.Name,
-					IsPDF: strings.Contains(meta.Name, ".pdf"),
+					ID:       meta.Id,
+					Name:     meta.Name,
+					IsPDF:    strings.Contains(meta.Name, ".pdf"),
+					IsComic:  isComicName(meta.Name),
+					IsAudio:  isAudioName(meta.Name),
+					Revision: meta.Rev,
+					Hash:     meta.ContentHash,
+					Dir:      relativeDir(path, meta.PathDisplay),
 				})
 			}
 		}
@@ -60,7 +151,7 @@ func (repo *DropboxRepository) List(path string) (books []Book, err error) {
 			break
 		}
 
-		if res, err = repo.client.ListFolderContinue(
+		if res, err = client.ListFolderContinue(
 			&dropbox.ListFolderContinueArg{
 				Cursor: res.Cursor,
 			}); err != nil {
@@ -71,53 +162,333 @@ func (repo *DropboxRepository) List(path string) (books []Book, err error) {
 	return
 }
 
-func (repo *DropboxRepository) Download(path string) (
+// dropboxLongpollTimeout is how long, in seconds, Watch waits for changes.
+const dropboxLongpollTimeout = 60
+
+// Watch follows a recursive listing of path through its cursor, using a
+// longpoll to learn about changes as soon as they happen.
+func (repo *DropboxRepository) Watch(
+	ctx context.Context, path string, cursor string,
+) (changes []Change, next string, err error) {
+	defer func() { err = dropboxError(ctx, err) }()
+
+	client := repo.client(ctx)
+
+	var res *dropbox.ListFolderResult
+	if cursor == "" {
+		if res, err = client.ListFolder(&dropbox.ListFolderArg{
+			Path:      path,
+			Recursive: true,
+		}); err != nil {
+			return
+		}
+	} else {
+		var poll *dropbox.ListFolderLongpollResult
+		if poll, err = client.ListFolderLongpoll(&dropbox.ListFolderLongpollArg{
+			Cursor:  cursor,
+			Timeout: dropboxLongpollTimeout,
+		}); err != nil {
+			err = dropboxResetError(err)
+			return
+		}
+
+		if poll.Backoff > 0 {
+			defer func() {
+				select {
+				case <-time.After(time.Duration(poll.Backoff) * time.Second):
+				case <-ctx.Done():
+				}
+			}()
+		}
+
+		if !poll.Changes {
+			return nil, cursor, nil
+		}
+
+		if res, err = client.ListFolderContinue(&dropbox.ListFolderContinueArg{
+			Cursor: cursor,
+		}); err != nil {
+			err = dropboxResetError(err)
+			return
+		}
+	}
+
+	for {
+		for _, item := range res.Entries {
+			switch meta := item.(type) {
+			case *dropbox.FileMetadata:
+				if isBookName(meta.Name) {
+					changes = append(changes, Change{
+						Path: meta.PathLower,
+						Book: &Book{
+							ID:       meta.Id,
+							Name:     meta.Name,
+							IsPDF:    strings.Contains(meta.Name, ".pdf"),
+							IsComic:  isComicName(meta.Name),
+							IsAudio:  isAudioName(meta.Name),
+							Revision: meta.Rev,
+							Hash:     meta.ContentHash,
+							Dir:      relativeDir(path, meta.PathDisplay),
+						},
+					})
+				}
+			case *dropbox.DeletedMetadata:
+				changes = append(changes, Change{Path: meta.PathLower})
+			}
+		}
+
+		if !res.HasMore {
+			break
+		}
+
+		if res, err = client.ListFolderContinue(
+			&dropbox.ListFolderContinueArg{
+				Cursor: res.Cursor,
+			}); err != nil {
+			err = dropboxResetError(err)
+			return
+		}
+	}
+
+	next = res.Cursor
+	return
+}
+
+// dropboxResetError turns the error Dropbox returns for an expired cursor
+// into ErrCursorReset.
+func dropboxResetError(err error) error {
+	if strings.HasPrefix(err.Error(), "reset/") {
+		return wrap(ErrCursorReset, err)
+	}
+
+	return err
+}
+
+func (repo *DropboxRepository) Download(ctx context.Context, path string) (
 	book Book, data io.ReadCloser, err error,
 ) {
+	defer func() { err = dropboxError(ctx, err) }()
+
 	var meta *dropbox.FileMetadata
-	if meta, data, err = repo.client.Download(&dropbox.DownloadArg{
+	if meta, data, err = repo.client(ctx).Download(&dropbox.DownloadArg{
 		Path: path,
 	}); err != nil {
 		return
 	}
 
+	book = dropboxBook(meta)
+
+	return
+}
+
+func (repo *DropboxRepository) Stat(ctx context.Context, path string) (book Book, err error) {
+	defer func() { err = dropboxError(ctx, err) }()
+
+	var res dropbox.IsMetadata
+	if res, err = repo.client(ctx).GetMetadata(dropbox.NewGetMetadataArg(path)); err != nil {
+		return
+	}
+
+	meta, ok := res.(*dropbox.FileMetadata)
+	if !ok {
+		err = wrap(ErrNotFound, fmt.Errorf("%s is not a file", path))
+		return
+	}
+
+	return dropboxBook(meta), nil
+}
+
+func dropboxBook(meta *dropbox.FileMetadata) Book {
+	return Book{
+		ID:       meta.Id,
+		Name:     meta.Name,
+		IsPDF:    strings.Contains(meta.Name, ".pdf"),
+		IsComic:  isComicName(meta.Name),
+		IsAudio:  isAudioName(meta.Name),
+		Revision: meta.Rev,
+		Hash:     meta.ContentHash,
+	}
+}
+
+// Upload sends small books in one request and larger ones through an upload
+// session, one chunk at a time. Dropbox renames the book if the name is taken.
+func (repo *DropboxRepository) Upload(
+	ctx context.Context, dir string, name string, data io.Reader,
+) (book Book, err error) {
+	defer func() { err = dropboxError(ctx, err) }()
+
+	client := repo.client(ctx)
+	commit := &dropbox.CommitInfo{
+		Path: strings.TrimSuffix(dir, "/") + "/" + name,
+		Mode: &dropbox.WriteMode{
+			Tagged: dbx.Tagged{
+				Tag: dropbox.WriteModeAdd,
+			},
+		},
+		Autorename: true,
+	}
+
+	buf := make([]byte, uploadChunkSize)
+	n, last, err := readChunk(data, buf)
+	if err != nil {
+		err = transportError(ctx, err)
+		return
+	}
+
+	var meta *dropbox.FileMetadata
+	if last {
+		if meta, err = client.Upload(commit, bytes.NewReader(buf[:n])); err != nil {
+			return
+		}
+	} else {
+		var session *dropbox.UploadSessionStartResult
+		if session, err = client.UploadSessionStart(
+			&dropbox.UploadSessionStartArg{}, bytes.NewReader(buf[:n]),
+		); err != nil {
+			return
+		}
+
+		cursor := &dropbox.UploadSessionCursor{
+			SessionId: session.SessionId,
+			Offset:    uint64(n),
+		}
+
+		for !last {
+			if n, last, err = readChunk(data, buf); err != nil {
+				err = transportError(ctx, err)
+				return
+			}
+
+			if last {
+				break
+			}
+
+			if err = client.UploadSessionAppendV2(
+				&dropbox.UploadSessionAppendArg{Cursor: cursor}, bytes.NewReader(buf[:n]),
+			); err != nil {
+				return
+			}
+
+			cursor.Offset += uint64(n)
+		}
+
+		if meta, err = client.UploadSessionFinish(
+			&dropbox.UploadSessionFinishArg{Cursor: cursor, Commit: commit}, bytes.NewReader(buf[:n]),
+		); err != nil {
+			return
+		}
+	}
+
+	book = Book{
+		ID:       meta.Id,
+		Name:     meta.Name,
+		IsPDF:    strings.Contains(meta.Name, ".pdf"),
+		IsComic:  isComicName(meta.Name),
+		IsAudio:  isAudioName(meta.Name),
+		Revision: meta.Rev,
+		Hash:     meta.ContentHash,
+	}
+
+	return
+}
+
+func (repo *DropboxRepository) Move(
+	ctx context.Context, ID string, dir string, name string,
+) (book Book, err error) {
+	defer func() { err = dropboxError(ctx, err) }()
+
+	var res *dropbox.RelocationResult
+	if res, err = repo.client(ctx).MoveV2(&dropbox.RelocationArg{
+		RelocationPath: dropbox.RelocationPath{
+			FromPath: ID,
+			ToPath:   strings.TrimSuffix(dir, "/") + "/" + name,
+		},
+	}); err != nil {
+		return
+	}
+
+	meta, ok := res.Metadata.(*dropbox.FileMetadata)
+	if !ok {
+		err = wrap(ErrNotFound, fmt.Errorf("%s is not a file", ID))
+		return
+	}
+
 	book = Book{
-		ID:   meta.Id,
-		Name: meta.Name,
+		ID:       meta.Id,
+		Name:     meta.Name,
+		IsPDF:    strings.Contains(meta.Name, ".pdf"),
+		IsComic:  isComicName(meta.Name),
+		IsAudio:  isAudioName(meta.Name),
+		Revision: meta.Rev,
+		Hash:     meta.ContentHash,
 	}
 
 	return
 }
 
-func (repo *DropboxRepository) GetHistory(ID string) (history History, err error) {
-	if err = func() (err error) {
-		var (
-			data io.ReadCloser
-			meta *dropbox.FileMetadata
-		)
-		if meta, data, err = repo.client.Download(&dropbox.DownloadArg{
-			Path: fmt.Sprintf("%s/%s", repo.historyPrefix, ID),
-		}); err != nil {
-			return
+func (repo *DropboxRepository) GetHistory(ctx context.Context, ID string) (history History, err error) {
+	var (
+		data io.ReadCloser
+		meta *dropbox.FileMetadata
+	)
+	if meta, data, err = repo.client(ctx).Download(&dropbox.DownloadArg{
+		Path: fmt.Sprintf("%s/%s", repo.historyPrefix, ID),
+	}); err != nil {
+		if err = dropboxError(ctx, err); errors.Is(err, ErrNotFound) {
+			err = nil
 		}
+		return
+	}
+
+	defer data.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err = buf.ReadFrom(data); err != nil {
+		err = transportError(ctx, err)
+		return
+	}
+
+	history.Data = buf.String()
+	history.Version = meta.Rev
+	return
+}
+
+func (repo *DropboxRepository) ListHistory(ctx context.Context) (IDs []string, err error) {
+	defer func() { err = dropboxError(ctx, err) }()
 
-		defer data.Close()
+	client := repo.client(ctx)
 
-		buf := new(bytes.Buffer)
-		buf.ReadFrom(data)
-		history.Data = buf.String()
-		history.Version = meta.Rev
+	var res *dropbox.ListFolderResult
+	if res, err = client.ListFolder(&dropbox.ListFolderArg{
+		Path: repo.historyPrefix,
+	}); err != nil {
 		return
-	}(); err != nil {
-		log.Printf("could not load old data for %s, err: %v", ID, err)
-		err = nil
+	}
+
+	for {
+		for _, item := range res.Entries {
+			if meta, ok := item.(*dropbox.FileMetadata); ok {
+				IDs = append(IDs, meta.Name)
+			}
+		}
+
+		if !res.HasMore {
+			break
+		}
+
+		if res, err = client.ListFolderContinue(
+			&dropbox.ListFolderContinueArg{
+				Cursor: res.Cursor,
+			}); err != nil {
+			return
+		}
 	}
 
 	return
 }
 
 func (repo *DropboxRepository) WriteHistory(
-	ID string, history History,
+	ctx context.Context, ID string, history History,
 ) (updated History, err error) {
 	var mode *dropbox.WriteMode
 	if history.Version == "" {
@@ -137,10 +508,12 @@ func (repo *DropboxRepository) WriteHistory(
 
 	var meta *dropbox.FileMetadata
 	if meta, err = repo.upload(
+		ctx,
 		ID,
 		strings.NewReader(history.Data),
 		mode,
 	); err != nil {
+		err = dropboxError(ctx, err)
 		return
 	}
 
@@ -150,9 +523,9 @@ func (repo *DropboxRepository) WriteHistory(
 }
 
 func (repo *DropboxRepository) upload(
-	ID string, data io.Reader, mode *dropbox.WriteMode,
+	ctx context.Context, ID string, data io.Reader, mode *dropbox.WriteMode,
 ) (meta *dropbox.FileMetadata, err error) {
-	meta, err = repo.client.Upload(&dropbox.CommitInfo{
+	meta, err = repo.client(ctx).Upload(&dropbox.CommitInfo{
 		Mute:           true,
 		StrictConflict: true,
 		Mode:           mode,
@@ -0,0 +1,299 @@
+package book
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// encryptedPrefix marks history data that is an encrypted envelope rather
+// than plain text.
+const encryptedPrefix = "encrypted:"
+
+// envelopeVersion is the version of the envelope EncryptedHistoryStore
+// writes. Envelopes of other versions are refused rather than misread.
+const envelopeVersion = 1
+
+// scrypt parameters for deriving keys from passphrases.
+const (
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptKeySize = 32
+)
+
+// envelope is what EncryptedHistoryStore stores in place of the data of a
+// history. The key is derived from a passphrase and Salt, and identified by
+// Key, so that the keys of other passphrases are skipped rather than tried
+// on the data. Finding the right passphrase still derives the key of each
+// one before it, once for every salt.
+type envelope struct {
+	Version int    `json:"version"`
+	Key     string `json:"key"`
+	Salt    string `json:"salt"`
+	Nonce   string `json:"nonce"`
+	Data    string `json:"data"`
+}
+
+// EncryptedHistoryStore encrypts the data of every history with AES-GCM
+// before it reaches the underlying store, with a key derived from a
+// passphrase with scrypt, and decrypts it again when it is read. Versions
+// are those of the underlying store, so conflicts are detected as before.
+//
+// Histories are always written with the first passphrase. The others are
+// only used to read histories written before the passphrase was changed,
+// which are encrypted with the first one the next time they are written.
+// Plain text histories are refused, as anyone who can write to the storage
+// could plant them, unless acceptPlain is set to migrate the histories
+// written before encryption was turned on. They are then read as they are,
+// and encrypted the same way.
+type EncryptedHistoryStore struct {
+	history     HistoryStore
+	passphrases []string
+	acceptPlain bool
+
+	lock sync.Mutex
+	// salt is used for everything this store writes, so that the key is
+	// only derived once. It is kept in a file across restarts, if there is
+	// one, so that histories written before are read without deriving
+	// another key.
+	salt []byte
+	// keys caches derived keys by passphrase and salt.
+	keys map[string][]byte
+}
+
+func NewEncryptedHistoryStore(
+	history HistoryStore, passphrases []string, saltFile string, acceptPlain bool,
+) (store *EncryptedHistoryStore, err error) {
+	if len(passphrases) == 0 || passphrases[0] == "" {
+		err = fmt.Errorf("no passphrase to encrypt history with")
+		return
+	}
+
+	store = new(EncryptedHistoryStore)
+	store.history = history
+	store.passphrases = passphrases
+	store.acceptPlain = acceptPlain
+	store.keys = map[string][]byte{}
+
+	if store.salt, err = loadSalt(saltFile); err != nil {
+		return
+	}
+
+	// Derive the key for writing up front, so that a slow derivation shows
+	// at startup rather than on the first page turn.
+	_, _, err = store.key(passphrases[0], store.salt)
+	return
+}
+
+func (store *EncryptedHistoryStore) GetHistory(ctx context.Context, ID string) (history History, err error) {
+	if history, err = store.history.GetHistory(ctx, ID); err != nil {
+		return
+	}
+
+	if history.Data, err = store.decrypt(ID, history.Data); err != nil {
+		err = fmt.Errorf("history of %s: %w", ID, err)
+	}
+
+	return
+}
+
+func (store *EncryptedHistoryStore) WriteHistory(
+	ctx context.Context, ID string, history History,
+) (updated History, err error) {
+	plain := history.Data
+	if history.Data, err = store.encrypt(ID, plain); err != nil {
+		return
+	}
+
+	if updated, err = store.history.WriteHistory(ctx, ID, history); err != nil {
+		return
+	}
+
+	updated.Data = plain
+	return
+}
+
+// ListHistory passes through to the underlying store, if it can list.
+func (store *EncryptedHistoryStore) ListHistory(ctx context.Context) (IDs []string, err error) {
+	lister, ok := store.history.(HistoryLister)
+	if !ok {
+		err = wrap(ErrCannotList, fmt.Errorf("history store can not list histories"))
+		return
+	}
+
+	return lister.ListHistory(ctx)
+}
+
+func (store *EncryptedHistoryStore) encrypt(ID string, plain string) (data string, err error) {
+	var key []byte
+	var keyID string
+	if key, keyID, err = store.key(store.passphrases[0], store.salt); err != nil {
+		return
+	}
+
+	var aead cipher.AEAD
+	if aead, err = newAEAD(key); err != nil {
+		return
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+
+	var sealed []byte
+	if sealed, err = json.Marshal(envelope{
+		Version: envelopeVersion,
+		Key:     keyID,
+		Salt:    base64.StdEncoding.EncodeToString(store.salt),
+		Nonce:   base64.StdEncoding.EncodeToString(nonce),
+		Data:    base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, []byte(plain), additionalData(ID, keyID))),
+	}); err != nil {
+		return
+	}
+
+	return encryptedPrefix + string(sealed), nil
+}
+
+func (store *EncryptedHistoryStore) decrypt(ID string, data string) (plain string, err error) {
+	if data == "" {
+		return
+	}
+	if !strings.HasPrefix(data, encryptedPrefix) {
+		if store.acceptPlain {
+			// Written before encryption was turned on.
+			return data, nil
+		}
+
+		err = wrap(ErrUnauthorized, fmt.Errorf("history is not encrypted"))
+		return
+	}
+
+	var sealed envelope
+	if err = json.Unmarshal([]byte(strings.TrimPrefix(data, encryptedPrefix)), &sealed); err != nil {
+		err = fmt.Errorf("reading encrypted history: %v", err)
+		return
+	}
+
+	if sealed.Version != envelopeVersion {
+		err = fmt.Errorf("encrypted history has unknown version %d", sealed.Version)
+		return
+	}
+
+	var salt, nonce, ciphertext []byte
+	if salt, err = base64.StdEncoding.DecodeString(sealed.Salt); err != nil {
+		return
+	}
+	if nonce, err = base64.StdEncoding.DecodeString(sealed.Nonce); err != nil {
+		return
+	}
+	if ciphertext, err = base64.StdEncoding.DecodeString(sealed.Data); err != nil {
+		return
+	}
+
+	for _, passphrase := range store.passphrases {
+		key, keyID, keyErr := store.key(passphrase, salt)
+		if keyErr != nil {
+			return "", keyErr
+		}
+		if keyID != sealed.Key {
+			continue
+		}
+
+		var aead cipher.AEAD
+		if aead, err = newAEAD(key); err != nil {
+			return
+		}
+
+		var opened []byte
+		if opened, err = aead.Open(nil, nonce, ciphertext, additionalData(ID, keyID)); err != nil {
+			err = wrap(ErrUnauthorized, fmt.Errorf("encrypted history was tampered with: %v", err))
+			return
+		}
+
+		return string(opened), nil
+	}
+
+	err = wrap(ErrUnauthorized, fmt.Errorf("history is encrypted with a passphrase that is not configured"))
+	return
+}
+
+// loadSalt reads the salt kept in file, or makes a new one and keeps it
+// there. Without a file, the salt is new every time.
+func loadSalt(file string) (salt []byte, err error) {
+	if file != "" {
+		var data []byte
+		if data, err = ioutil.ReadFile(file); err == nil {
+			if salt, err = hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(salt) < 16 {
+				err = fmt.Errorf("salt in %s is too short", file)
+			}
+			return
+		} else if !os.IsNotExist(err) {
+			return
+		}
+	}
+
+	salt = make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return
+	}
+
+	if file != "" {
+		err = ioutil.WriteFile(file, []byte(hex.EncodeToString(salt)+"\n"), 0600)
+	}
+	return
+}
+
+// key derives the key for passphrase and salt, and its ID.
+func (store *EncryptedHistoryStore) key(passphrase string, salt []byte) (key []byte, keyID string, err error) {
+	cacheKey := passphrase + "\x00" + string(salt)
+
+	store.lock.Lock()
+	key, ok := store.keys[cacheKey]
+	store.lock.Unlock()
+
+	if !ok {
+		if key, err = scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, scryptKeySize); err != nil {
+			return
+		}
+
+		store.lock.Lock()
+		store.keys[cacheKey] = key
+		store.lock.Unlock()
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("bookbrowser history key id"))
+	keyID = hex.EncodeToString(mac.Sum(nil)[:8])
+
+	return
+}
+
+// additionalData binds an envelope to the book and key it was written for, so
+// that it can not be passed off as the history of another book.
+func additionalData(ID string, keyID string) []byte {
+	return []byte(keyID + "\x00" + ID)
+}
+
+func newAEAD(key []byte) (aead cipher.AEAD, err error) {
+	var block cipher.Block
+	if block, err = aes.NewCipher(key); err != nil {
+		return
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,160 @@
+package book
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestEncryptedHistoryStore(
+	t *testing.T, history HistoryStore, passphrases []string, saltFile string, acceptPlain bool,
+) *EncryptedHistoryStore {
+	t.Helper()
+
+	store, err := NewEncryptedHistoryStore(history, passphrases, saltFile, acceptPlain)
+	if err != nil {
+		t.Fatalf("NewEncryptedHistoryStore: %v", err)
+	}
+
+	return store
+}
+
+func TestEncryptedHistoryRoundTrip(t *testing.T) {
+	underlying := NewMemoryRepository()
+	store := newTestEncryptedHistoryStore(t, underlying, []string{"secret"}, "", false)
+	ctx := context.Background()
+
+	written, err := store.WriteHistory(ctx, "book", History{Data: "chapter 4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written.Data != "chapter 4" {
+		t.Errorf("WriteHistory returned %q, want the plain text", written.Data)
+	}
+
+	stored, _ := underlying.GetHistory(ctx, "book")
+	if !strings.HasPrefix(stored.Data, encryptedPrefix) || strings.Contains(stored.Data, "chapter 4") {
+		t.Errorf("stored history is not encrypted: %s", stored.Data)
+	}
+
+	read, err := store.GetHistory(ctx, "book")
+	if err != nil || read.Data != "chapter 4" || read.Version != written.Version {
+		t.Errorf("GetHistory = %+v, %v, want what was written", read, err)
+	}
+
+	if _, err := store.WriteHistory(ctx, "book", History{Data: "stale"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("write based on an outdated version: %v, want ErrConflict", err)
+	}
+
+	if empty, err := store.GetHistory(ctx, "other"); err != nil || empty.Data != "" {
+		t.Errorf("history of a book without one = %+v, %v", empty, err)
+	}
+}
+
+func TestEncryptedHistoryRotation(t *testing.T) {
+	underlying := NewMemoryRepository()
+	ctx := context.Background()
+
+	old := newTestEncryptedHistoryStore(t, underlying, []string{"old"}, "", false)
+	if _, err := old.WriteHistory(ctx, "book", History{Data: "chapter 1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := newTestEncryptedHistoryStore(t, underlying, []string{"new", "old"}, "", false)
+	read, err := rotated.GetHistory(ctx, "book")
+	if err != nil || read.Data != "chapter 1" {
+		t.Fatalf("reading with the old passphrase = %+v, %v", read, err)
+	}
+	if _, err := rotated.WriteHistory(ctx, "book", History{Data: "chapter 2", Version: read.Version}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := old.GetHistory(ctx, "book"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("reading a history rewritten with the new passphrase with the old one: %v, want ErrUnauthorized", err)
+	}
+
+	current := newTestEncryptedHistoryStore(t, underlying, []string{"new"}, "", false)
+	if read, err := current.GetHistory(ctx, "book"); err != nil || read.Data != "chapter 2" {
+		t.Errorf("reading with the new passphrase alone = %+v, %v", read, err)
+	}
+}
+
+func TestEncryptedHistoryRefusesTamperedData(t *testing.T) {
+	underlying := NewMemoryRepository()
+	store := newTestEncryptedHistoryStore(t, underlying, []string{"secret"}, "", false)
+	ctx := context.Background()
+
+	if _, err := store.WriteHistory(ctx, "a", History{Data: "chapter 1"}); err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := underlying.GetHistory(ctx, "a")
+
+	// The envelope of a is valid, but not as the history of b.
+	if _, err := underlying.WriteHistory(ctx, "b", History{Data: sealed.Data}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetHistory(ctx, "b"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("reading the history of a stored for b: %v, want ErrUnauthorized", err)
+	}
+
+	i := strings.Index(sealed.Data, `"data":"`) + len(`"data":"`)
+	tampered := []byte(sealed.Data)
+	if tampered[i] == 'A' {
+		tampered[i] = 'B'
+	} else {
+		tampered[i] = 'A'
+	}
+	if _, err := underlying.WriteHistory(ctx, "a", History{Data: string(tampered), Version: sealed.Version}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetHistory(ctx, "a"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("reading a tampered history: %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestEncryptedHistoryPlainText(t *testing.T) {
+	underlying := NewMemoryRepository()
+	ctx := context.Background()
+	if _, err := underlying.WriteHistory(ctx, "book", History{Data: "planted"}); err != nil {
+		t.Fatal(err)
+	}
+
+	store := newTestEncryptedHistoryStore(t, underlying, []string{"secret"}, "", false)
+	if _, err := store.GetHistory(ctx, "book"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("reading a plain text history: %v, want ErrUnauthorized", err)
+	}
+
+	migrating := newTestEncryptedHistoryStore(t, underlying, []string{"secret"}, "", true)
+	read, err := migrating.GetHistory(ctx, "book")
+	if err != nil || read.Data != "planted" {
+		t.Fatalf("reading a plain text history while migrating = %+v, %v", read, err)
+	}
+	if _, err := migrating.WriteHistory(ctx, "book", History{Data: "migrated", Version: read.Version}); err != nil {
+		t.Fatal(err)
+	}
+
+	if read, err := store.GetHistory(ctx, "book"); err != nil || read.Data != "migrated" {
+		t.Errorf("reading a migrated history = %+v, %v", read, err)
+	}
+}
+
+func TestEncryptedHistoryKeepsSalt(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "salt")
+
+	first := newTestEncryptedHistoryStore(t, NewMemoryRepository(), []string{"secret"}, file, false)
+	saved, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("salt was not kept: %v", err)
+	}
+
+	second := newTestEncryptedHistoryStore(t, NewMemoryRepository(), []string{"secret"}, file, false)
+	if string(first.salt) != string(second.salt) {
+		t.Errorf("salt changed across restarts")
+	}
+	if again, _ := ioutil.ReadFile(file); string(again) != string(saved) {
+		t.Errorf("salt file was rewritten")
+	}
+}
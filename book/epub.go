@@ -0,0 +1,324 @@
+package book
+
+import (
+	"archive/zip"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"time"
+)
+
+// epubBook is a book put together from chapters of XHTML, as the samples and
+// books converted from other formats are, to be written as an EPUB 3 with a
+// navigation document and an NCX for older readers.
+type epubBook struct {
+	Identifier  string
+	Title       string
+	Authors     []string
+	Language    string
+	Description string
+	Series      string
+	SeriesIndex float64
+	Tags        []string
+
+	Chapters  []epubChapter
+	Resources []epubResource
+	// Contents is the table of contents. If it is empty, it lists the
+	// chapters that have a title.
+	Contents []epubNavPoint
+	// Cover is the name of the resource that is the cover image, if any.
+	Cover string
+	// Styles are the names of the style sheets every chapter uses.
+	Styles []string
+}
+
+type epubChapter struct {
+	Title string
+	// Level is the depth of the chapter in the table of contents made from
+	// the chapters, from 1.
+	Level int
+	// Body is the XHTML inside the body of the chapter.
+	Body string
+	// Auxiliary chapters, such as notes, are left out of the reading order
+	// and only reached through links.
+	Auxiliary bool
+}
+
+type epubNavPoint struct {
+	Title string
+	Level int
+	// Chapter is the index of the chapter the entry points to, and Anchor
+	// the ID of an element in it, if not its start.
+	Chapter int
+	Anchor  string
+}
+
+// epubResource is a file used by the chapters, such as an image. Name is
+// relative to the chapters.
+type epubResource struct {
+	Name      string
+	MediaType string
+	Data      []byte
+}
+
+// epubChapterName returns the name of the file of the chapter with the
+// given index, relative to the other chapters, for links between them.
+func epubChapterName(chapter int) string {
+	return fmt.Sprintf("chapter%d.xhtml", chapter+1)
+}
+
+// zipHeader returns the header of a file in a zip written by the reader.
+// The time is set in the MS-DOS fields only, as setting Modified adds an
+// extra field to the header, which must not come between the mimetype of an
+// EPUB and its name.
+func zipHeader(name string, method uint16, modified time.Time) *zip.FileHeader {
+	return &zip.FileHeader{
+		Name:         name,
+		Method:       method,
+		ModifiedDate: uint16((modified.Year()-1980)<<9 | int(modified.Month())<<5 | modified.Day()),
+		ModifiedTime: uint16(modified.Hour()<<11 | modified.Minute()<<5 | modified.Second()/2),
+	}
+}
+
+// write writes the book to w as an EPUB, with every file dated modified.
+// Files are written in a fixed order, so that the same book always gives the
+// same EPUB.
+func (book *epubBook) write(w io.Writer, modified time.Time) (err error) {
+	archive := zip.NewWriter(w)
+
+	// The mimetype comes first and uncompressed, see Validate.
+	var fw io.Writer
+	if fw, err = archive.CreateHeader(zipHeader(epubMimetypeName, zip.Store, modified)); err != nil {
+		return
+	}
+	if _, err = fw.Write([]byte(epubMediaType)); err != nil {
+		return
+	}
+
+	language := book.Language
+	if language == "" {
+		language = "und"
+	}
+
+	var styles strings.Builder
+	for _, style := range book.Styles {
+		fmt.Fprintf(&styles, `<link rel="stylesheet" type="text/css" href="%s"/>`+"\n", html.EscapeString(style))
+	}
+
+	type file struct {
+		name string
+		data []byte
+	}
+	var files []file
+
+	var manifest, spine strings.Builder
+	for i, chapter := range book.Chapters {
+		name := epubChapterName(i)
+		title := chapter.Title
+		if title == "" {
+			title = book.Title
+		}
+
+		files = append(files, file{"OEBPS/" + name, []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" xml:lang="%s">
+<head><title>%s</title>
+%s</head>
+<body>
+%s
+</body>
+</html>
+`, html.EscapeString(language), html.EscapeString(title), styles.String(), chapter.Body))})
+
+		fmt.Fprintf(&manifest, `<item id="c%d" href="%s" media-type="application/xhtml+xml"/>`+"\n", i+1, name)
+		if chapter.Auxiliary {
+			fmt.Fprintf(&spine, `<itemref idref="c%d" linear="no"/>`+"\n", i+1)
+		} else {
+			fmt.Fprintf(&spine, `<itemref idref="c%d"/>`+"\n", i+1)
+		}
+	}
+
+	for i, resource := range book.Resources {
+		properties := ""
+		if resource.Name == book.Cover {
+			properties = ` properties="cover-image"`
+		}
+		fmt.Fprintf(&manifest, `<item id="r%d" href="%s" media-type="%s"%s/>`+"\n",
+			i+1, html.EscapeString(resource.Name), resource.MediaType, properties)
+
+		files = append(files, file{"OEBPS/" + resource.Name, resource.Data})
+	}
+
+	var metadata strings.Builder
+	fmt.Fprintf(&metadata, "<dc:identifier id=\"id\">%s</dc:identifier>\n", html.EscapeString(book.Identifier))
+	fmt.Fprintf(&metadata, "<dc:title>%s</dc:title>\n", html.EscapeString(book.Title))
+	for _, author := range book.Authors {
+		fmt.Fprintf(&metadata, "<dc:creator>%s</dc:creator>\n", html.EscapeString(author))
+	}
+	fmt.Fprintf(&metadata, "<dc:language>%s</dc:language>\n", html.EscapeString(language))
+	if book.Description != "" {
+		fmt.Fprintf(&metadata, "<dc:description>%s</dc:description>\n", html.EscapeString(book.Description))
+	}
+	for _, tag := range book.Tags {
+		fmt.Fprintf(&metadata, "<dc:subject>%s</dc:subject>\n", html.EscapeString(tag))
+	}
+	if book.Series != "" {
+		fmt.Fprintf(&metadata, "<meta property=\"belongs-to-collection\" id=\"series\">%s</meta>\n", html.EscapeString(book.Series))
+		fmt.Fprintf(&metadata, "<meta refines=\"#series\" property=\"collection-type\">series</meta>\n")
+		if book.SeriesIndex != 0 {
+			fmt.Fprintf(&metadata, "<meta refines=\"#series\" property=\"group-position\">%g</meta>\n", book.SeriesIndex)
+		}
+	}
+	if book.Cover != "" {
+		// For readers that predate the cover-image property.
+		for i, resource := range book.Resources {
+			if resource.Name == book.Cover {
+				fmt.Fprintf(&metadata, "<meta name=\"cover\" content=\"r%d\"/>\n", i+1)
+			}
+		}
+	}
+	fmt.Fprintf(&metadata, "<meta property=\"dcterms:modified\">%s</meta>\n", modified.UTC().Format(time.RFC3339))
+
+	contents := book.Contents
+	if len(contents) == 0 {
+		for i, chapter := range book.Chapters {
+			if chapter.Title != "" {
+				contents = append(contents, epubNavPoint{Title: chapter.Title, Level: chapter.Level, Chapter: i})
+			}
+		}
+	}
+	if len(contents) == 0 && len(book.Chapters) > 0 {
+		contents = []epubNavPoint{{Title: book.Title}}
+	}
+
+	files = append([]file{
+		{"META-INF/container.xml", []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+<rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>
+`)},
+		{"OEBPS/content.opf", []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+<metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+%s</metadata>
+<manifest>
+<item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+<item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+%s</manifest>
+<spine toc="ncx">
+%s</spine>
+</package>
+`, metadata.String(), manifest.String(), spine.String()))},
+		{"OEBPS/nav.xhtml", []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>%s</title></head>
+<body><nav epub:type="toc">%s</nav></body>
+</html>
+`, html.EscapeString(book.Title), navList(contents)))},
+		{"OEBPS/toc.ncx", []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+<head><meta name="dtb:uid" content="%s"/></head>
+<docTitle><text>%s</text></docTitle>
+<navMap>
+%s</navMap>
+</ncx>
+`, html.EscapeString(book.Identifier), html.EscapeString(book.Title), navMap(contents)))},
+	}, files...)
+
+	for _, f := range files {
+		method := uint16(zip.Deflate)
+		if strings.HasPrefix(f.name, "OEBPS/") && !strings.HasSuffix(f.name, ".xhtml") &&
+			!strings.HasSuffix(f.name, ".css") && !strings.HasSuffix(f.name, ".opf") && !strings.HasSuffix(f.name, ".ncx") {
+			// Images are compressed already.
+			method = zip.Store
+		}
+
+		if fw, err = archive.CreateHeader(zipHeader(f.name, method, modified)); err != nil {
+			return
+		}
+		if _, err = fw.Write(f.data); err != nil {
+			return
+		}
+	}
+
+	return archive.Close()
+}
+
+// href returns the link to the entry from the navigation files.
+func (point epubNavPoint) href() string {
+	href := epubChapterName(point.Chapter)
+	if point.Anchor != "" {
+		href += "#" + point.Anchor
+	}
+
+	return html.EscapeString(href)
+}
+
+// navLevels returns the level of each entry of contents, so that no entry is
+// more than one level deeper than the one before it.
+func navLevels(contents []epubNavPoint) (levels []int) {
+	previous := 0
+	for _, point := range contents {
+		level := point.Level
+		if level < 1 {
+			level = 1
+		}
+		if level > previous+1 {
+			level = previous + 1
+		}
+
+		levels = append(levels, level)
+		previous = level
+	}
+
+	return
+}
+
+// navList writes contents as the nested lists of a navigation document.
+func navList(contents []epubNavPoint) string {
+	var list strings.Builder
+	depth := 0
+	for i, level := range navLevels(contents) {
+		if level > depth {
+			list.WriteString("\n<ol>\n")
+		} else {
+			list.WriteString("</li>\n")
+			for ; depth > level; depth-- {
+				list.WriteString("</ol></li>\n")
+			}
+		}
+		depth = level
+
+		fmt.Fprintf(&list, `<li><a href="%s">%s</a>`, contents[i].href(), html.EscapeString(contents[i].Title))
+	}
+
+	for ; depth > 0; depth-- {
+		list.WriteString("</li>\n</ol>")
+		if depth > 1 {
+			list.WriteString("\n")
+		}
+	}
+
+	return list.String()
+}
+
+// navMap writes contents as the nested points of an NCX.
+func navMap(contents []epubNavPoint) string {
+	var points strings.Builder
+	depth := 0
+	for i, level := range navLevels(contents) {
+		for ; depth >= level; depth-- {
+			points.WriteString("</navPoint>\n")
+		}
+		depth = level
+
+		fmt.Fprintf(&points, `<navPoint id="n%d" playOrder="%d"><navLabel><text>%s</text></navLabel><content src="%s"/>`+"\n",
+			i+1, i+1, html.EscapeString(contents[i].Title), contents[i].href())
+	}
+
+	for ; depth > 0; depth-- {
+		points.WriteString("</navPoint>\n")
+	}
+
+	return points.String()
+}
@@ -0,0 +1,85 @@
+package book
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Errors returned by repositories and history stores, possibly wrapped with
+// more detail. Use errors.Is to check for them.
+var (
+	// ErrNotFound means the book or file asked for does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict means a history was written based on an outdated version.
+	ErrConflict = errors.New("conflict")
+	// ErrUnauthorized means the storage backend rejected the credentials.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrUnavailable means the storage backend could not be reached or is
+	// temporarily refusing requests.
+	ErrUnavailable = errors.New("unavailable")
+	// ErrInvalid means an uploaded file is not a book that can be read.
+	ErrInvalid = errors.New("invalid book")
+	// ErrCursorReset means a cursor passed to Watch has expired and the
+	// folder has to be listed from scratch.
+	ErrCursorReset = errors.New("cursor reset")
+	// ErrCannotList means a history store that wraps another can not list
+	// histories because the store underneath can not.
+	ErrCannotList = errors.New("can not list histories")
+)
+
+// statusError marks err, caused by a failed HTTP response, with the error
+// above matching the status code of the response.
+func statusError(code int, err error) error {
+	switch {
+	case code == http.StatusNotFound:
+		return wrap(ErrNotFound, err)
+	case code == http.StatusConflict || code == http.StatusPreconditionFailed:
+		return wrap(ErrConflict, err)
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return wrap(ErrUnauthorized, err)
+	case code == http.StatusTooManyRequests || code >= 500:
+		return wrap(ErrUnavailable, err)
+	}
+
+	return err
+}
+
+// transportError wraps a failure to talk to a backend at all, keeping
+// cancellation by the caller recognisable.
+func transportError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return wrap(ErrUnavailable, err)
+	}
+
+	return err
+}
+
+func wrap(kind error, err error) error {
+	return &wrappedError{kind: kind, err: err}
+}
+
+// wrappedError attaches one of the errors above to a more specific error
+// while keeping the message of the latter.
+type wrappedError struct {
+	kind error
+	err  error
+}
+
+func (e *wrappedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *wrappedError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *wrappedError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,506 @@
+package book
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// fb2Style is the style sheet of books converted from FB2, for the parts of
+// FB2 that have no HTML element of their own.
+const fb2Style = `.title, .subtitle { text-align: center; font-weight: bold; }
+.empty-line { margin: 0; height: 1em; }
+.epigraph { margin: 1em 0 1em 30%; font-style: italic; }
+.text-author { text-align: right; font-style: italic; }
+.poem { margin: 1em 2em; }
+.stanza { margin: 1em 0; }
+.verse { margin: 0; text-indent: 0; }
+.image { text-align: center; }
+.image img { max-width: 100%; }
+aside { margin: 1em 0; }
+`
+
+// fb2Inline are the elements that hold text, inside which images are
+// inline rather than blocks of their own.
+var fb2Inline = map[string]bool{
+	"p": true, "v": true, "subtitle": true, "text-author": true, "th": true, "td": true,
+}
+
+// sniffFB2 reports whether head is the start of an FB2 book, which is XML
+// that is rarely more specific about itself this early.
+func sniffFB2(head []byte) bool {
+	head = bytes.TrimSpace(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")))
+	return bytes.HasPrefix(head, []byte("<?xml")) || bytes.Contains(head, []byte("<FictionBook"))
+}
+
+// sniffFB2Zip reports whether head is the start of a zip, as FB2 books are
+// often shared in one.
+func sniffFB2Zip(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("PK\x03\x04"))
+}
+
+// convertFB2 converts an FB2 book to EPUB.
+func convertFB2(r io.ReaderAt, size int64) (epubBook, error) {
+	return readFB2(io.NewSectionReader(r, 0, size))
+}
+
+// convertFB2Zip converts the first FB2 book in a zip to EPUB.
+func convertFB2Zip(r io.ReaderAt, size int64) (book epubBook, err error) {
+	var archive *zip.Reader
+	if archive, err = zip.NewReader(r, size); err != nil {
+		err = wrap(ErrInvalid, err)
+		return
+	}
+
+	for _, f := range archive.File {
+		if !strings.HasSuffix(strings.ToLower(f.Name), ".fb2") {
+			continue
+		}
+
+		var entry io.ReadCloser
+		if entry, err = f.Open(); err != nil {
+			err = wrap(ErrInvalid, err)
+			return
+		}
+		defer entry.Close()
+
+		return readFB2(entry)
+	}
+
+	err = wrap(ErrInvalid, fmt.Errorf("the archive holds no FB2 book"))
+	return
+}
+
+// readFB2 converts the FB2 book read from r to EPUB. The first body of the
+// book is its text, each top-level section of which becomes a chapter, with
+// nested sections in the table of contents. Other bodies hold the notes,
+// which become footnotes linked from the text. Images are kept in binary
+// elements as base64.
+func readFB2(r io.Reader) (book epubBook, err error) {
+	var root *xmlNode
+	if root, err = parseFB2(r); err != nil {
+		return
+	}
+
+	c := fb2Converter{images: map[string]string{}, ids: map[string]int{}}
+	c.book.Resources = append(c.book.Resources, epubResource{Name: "style.css", MediaType: "text/css", Data: []byte(fb2Style)})
+	c.book.Styles = []string{"style.css"}
+
+	for _, node := range root.Children {
+		if node.Name == "binary" {
+			c.binary(node)
+		}
+	}
+
+	if info := root.child("description").child("title-info"); info != nil {
+		c.titleInfo(info)
+	}
+
+	// The chapters are laid out first, so that links can be pointed to the
+	// chapters they lead to while writing them.
+	type chapter struct {
+		nodes     []*xmlNode
+		title     string
+		auxiliary bool
+	}
+	var chapters []chapter
+
+	main := true
+	for _, body := range root.Children {
+		if body.Name != "body" {
+			continue
+		}
+
+		if !main || body.Attrs["name"] == "notes" || body.Attrs["name"] == "comments" {
+			title := body.child("title").text()
+			if title == "" {
+				title = "Notes"
+			}
+			chapters = append(chapters, chapter{nodes: body.Children, title: title, auxiliary: true})
+			continue
+		}
+		main = false
+
+		var lead []*xmlNode
+		for _, node := range body.Children {
+			if node.Name == "section" {
+				chapters = append(chapters, chapter{nodes: []*xmlNode{node}, title: node.child("title").text()})
+			} else if node.Name != "" || strings.TrimSpace(node.Text) != "" {
+				lead = append(lead, node)
+			}
+		}
+		if len(lead) > 0 {
+			chapters = append([]chapter{{nodes: lead}}, chapters...)
+		}
+	}
+
+	if main {
+		err = wrap(ErrInvalid, fmt.Errorf("the book has no body"))
+		return
+	}
+
+	for i, chapter := range chapters {
+		for _, node := range chapter.nodes {
+			c.index(node, i)
+		}
+	}
+
+	for i, chapter := range chapters {
+		c.chapter = i
+		c.notes = chapter.auxiliary
+
+		var body strings.Builder
+		if chapter.auxiliary {
+			fmt.Fprintf(&body, "<h1>%s</h1>\n", xhtmlEscape(chapter.title))
+		}
+		for _, node := range chapter.nodes {
+			if chapter.auxiliary && node.Name == "title" {
+				continue
+			}
+			c.render(&body, node, 0)
+		}
+
+		c.book.Chapters = append(c.book.Chapters, epubChapter{
+			Title: chapter.title, Level: 1, Body: body.String(), Auxiliary: chapter.auxiliary,
+		})
+	}
+
+	return c.book, nil
+}
+
+// parseFB2 reads the FB2 document in r into a tree and returns its root.
+func parseFB2(r io.Reader) (root *xmlNode, err error) {
+	if root, err = parseXML(r); err != nil {
+		err = wrap(ErrInvalid, fmt.Errorf("reading FB2: %w", err))
+		return
+	}
+
+	if root = root.child("FictionBook"); root == nil {
+		err = wrap(ErrInvalid, fmt.Errorf("not an FB2 book"))
+	}
+	return
+}
+
+// fb2Converter writes the chapters of an FB2 book.
+type fb2Converter struct {
+	book epubBook
+	// images maps the IDs of the binary elements that are images to their
+	// resources.
+	images map[string]string
+	// ids maps the IDs of elements to the chapters they are in.
+	ids map[string]int
+	// chapter is the index of the chapter being written, and notes whether
+	// it holds notes.
+	chapter int
+	notes   bool
+	// inline is set while writing elements that hold text.
+	inline bool
+	// anchors counts the anchors added to sections without an ID.
+	anchors int
+}
+
+// binary adds the image in node, if it is one, to the resources.
+func (c *fb2Converter) binary(node *xmlNode) {
+	id := node.Attrs["id"]
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(node.text()), ""))
+	if err != nil || id == "" {
+		return
+	}
+
+	ext, mediaType := imageType(data)
+	if ext == "" {
+		return
+	}
+
+	base := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, id)
+	name := "images/" + strings.TrimSuffix(base, ext) + ext
+	for i := 1; c.hasResource(name); i++ {
+		name = fmt.Sprintf("images/%s-%d%s", strings.TrimSuffix(base, ext), i, ext)
+	}
+
+	c.images[id] = name
+	c.book.Resources = append(c.book.Resources, epubResource{Name: name, MediaType: mediaType, Data: data})
+}
+
+func (c *fb2Converter) hasResource(name string) bool {
+	for _, resource := range c.book.Resources {
+		if resource.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// titleInfo sets the metadata of the book from its title-info element.
+func (c *fb2Converter) titleInfo(info *xmlNode) {
+	c.book.Title = info.child("book-title").text()
+	c.book.Language = info.child("lang").text()
+	c.book.Description = info.child("annotation").text()
+
+	for _, node := range info.Children {
+		switch node.Name {
+		case "author":
+			var names []string
+			for _, part := range []string{"first-name", "middle-name", "last-name"} {
+				if name := node.child(part).text(); name != "" {
+					names = append(names, name)
+				}
+			}
+			if len(names) == 0 {
+				names = append(names, node.child("nickname").text())
+			}
+			if author := strings.Join(names, " "); author != "" {
+				c.book.Authors = append(c.book.Authors, author)
+			}
+		case "genre":
+			if genre := node.text(); genre != "" {
+				c.book.Tags = append(c.book.Tags, genre)
+			}
+		case "sequence":
+			if c.book.Series == "" {
+				c.book.Series = strings.TrimSpace(node.Attrs["name"])
+				c.book.SeriesIndex, _ = strconv.ParseFloat(strings.TrimSpace(node.Attrs["number"]), 64)
+			}
+		case "coverpage":
+			if image := node.child("image"); image != nil && c.book.Cover == "" {
+				c.book.Cover = c.images[strings.TrimPrefix(image.Attrs["href"], "#")]
+			}
+		}
+	}
+}
+
+// index records the chapter of node and the elements in it that have an ID.
+func (c *fb2Converter) index(node *xmlNode, chapter int) {
+	if id := node.Attrs["id"]; id != "" {
+		if _, ok := c.ids[id]; !ok {
+			c.ids[id] = chapter
+		}
+	}
+
+	for _, child := range node.Children {
+		c.index(child, chapter)
+	}
+}
+
+// render writes node as XHTML. depth is the number of sections node is in.
+func (c *fb2Converter) render(out *strings.Builder, node *xmlNode, depth int) {
+	switch node.Name {
+	case "":
+		out.WriteString(xhtmlEscape(node.Text))
+	case "section":
+		c.section(out, node, depth+1)
+	case "title":
+		if depth == 0 && !c.notes {
+			c.title(out, node, "<h1>", "</h1>")
+		} else {
+			c.title(out, node, `<p class="title">`, "</p>")
+		}
+	case "empty-line":
+		out.WriteString(`<p class="empty-line"></p>` + "\n")
+	case "image":
+		c.image(out, node)
+	case "a":
+		c.link(out, node, depth)
+	case "p", "table", "tr", "th", "td", "sub", "sup", "code", "strong":
+		c.element(out, node.Name, "", node, depth)
+	case "emphasis":
+		c.element(out, "em", "", node, depth)
+	case "strikethrough":
+		c.element(out, "s", "", node, depth)
+	case "style":
+		c.element(out, "span", "", node, depth)
+	case "cite":
+		c.element(out, "blockquote", "", node, depth)
+	case "epigraph":
+		c.element(out, "blockquote", "epigraph", node, depth)
+	case "subtitle", "text-author", "date":
+		c.element(out, "p", node.Name, node, depth)
+	case "poem", "stanza", "annotation":
+		c.element(out, "div", node.Name, node, depth)
+	case "v":
+		c.element(out, "p", "verse", node, depth)
+	default:
+		c.children(out, node, depth)
+	}
+}
+
+func (c *fb2Converter) children(out *strings.Builder, node *xmlNode, depth int) {
+	for _, child := range node.Children {
+		c.render(out, child, depth)
+	}
+}
+
+// element writes node as the given XHTML element.
+func (c *fb2Converter) element(out *strings.Builder, name string, class string, node *xmlNode, depth int) {
+	out.WriteString("<" + name)
+	if class != "" {
+		fmt.Fprintf(out, ` class="%s"`, class)
+	}
+	if id := node.Attrs["id"]; id != "" {
+		fmt.Fprintf(out, ` id="%s"`, xhtmlEscape(id))
+	}
+	for _, attr := range []string{"colspan", "rowspan"} {
+		if value, err := strconv.Atoi(node.Attrs[attr]); err == nil && value > 0 {
+			fmt.Fprintf(out, ` %s="%d"`, attr, value)
+		}
+	}
+	if align := node.Attrs["align"]; align == "left" || align == "right" || align == "center" {
+		fmt.Fprintf(out, ` style="text-align: %s;"`, align)
+	}
+	out.WriteString(">")
+
+	inline := c.inline
+	c.inline = c.inline || fb2Inline[node.Name]
+	c.children(out, node, depth)
+	c.inline = inline
+
+	out.WriteString("</" + name + ">")
+	if !inline {
+		out.WriteString("\n")
+	}
+}
+
+// section writes a section, which is a footnote in the notes and otherwise
+// a part of the book with its title in the table of contents.
+func (c *fb2Converter) section(out *strings.Builder, node *xmlNode, depth int) {
+	id := node.Attrs["id"]
+	if c.notes {
+		if id == "" {
+			c.children(out, node, depth)
+			return
+		}
+
+		fmt.Fprintf(out, `<aside epub:type="footnote" id="%s">`+"\n", xhtmlEscape(id))
+		for _, child := range node.Children {
+			if child.Name == "title" {
+				fmt.Fprintf(out, "<p><strong>%s</strong></p>\n", xhtmlEscape(child.text()))
+			} else {
+				c.render(out, child, depth)
+			}
+		}
+		out.WriteString("</aside>\n")
+		return
+	}
+
+	title := node.child("title")
+	if title.text() != "" && depth > 1 && id == "" {
+		c.anchors++
+		id = fmt.Sprintf("section-%d", c.anchors)
+	}
+
+	if title.text() != "" {
+		point := epubNavPoint{Title: title.text(), Level: depth, Chapter: c.chapter}
+		if depth > 1 {
+			point.Anchor = id
+		}
+		c.book.Contents = append(c.book.Contents, point)
+	}
+
+	if id != "" {
+		fmt.Fprintf(out, `<section id="%s">`+"\n", xhtmlEscape(id))
+	} else {
+		out.WriteString("<section>\n")
+	}
+
+	level := depth
+	if level > 6 {
+		level = 6
+	}
+	for _, child := range node.Children {
+		if child == title {
+			c.title(out, child, fmt.Sprintf("<h%d>", level), fmt.Sprintf("</h%d>", level))
+		} else {
+			c.render(out, child, depth)
+		}
+	}
+	out.WriteString("</section>\n")
+}
+
+// title writes a title between open and close, with its paragraphs on lines
+// of their own.
+func (c *fb2Converter) title(out *strings.Builder, node *xmlNode, open string, close string) {
+	out.WriteString(open)
+
+	inline := c.inline
+	c.inline = true
+	first := true
+	for _, child := range node.Children {
+		if child.Name != "p" {
+			continue
+		}
+		if !first {
+			out.WriteString("<br/>")
+		}
+		first = false
+		c.children(out, child, 0)
+	}
+	c.inline = inline
+
+	out.WriteString(close + "\n")
+}
+
+// image writes an image, as a block of its own unless it is in text.
+func (c *fb2Converter) image(out *strings.Builder, node *xmlNode) {
+	name := c.images[strings.TrimPrefix(node.Attrs["href"], "#")]
+	if name == "" {
+		return
+	}
+
+	alt := node.Attrs["alt"]
+	if alt == "" {
+		alt = node.Attrs["title"]
+	}
+	img := fmt.Sprintf(`<img src="%s" alt="%s"/>`, xhtmlEscape(name), xhtmlEscape(alt))
+
+	if c.inline {
+		out.WriteString(img)
+		return
+	}
+
+	out.WriteString(`<div class="image"`)
+	if id := node.Attrs["id"]; id != "" {
+		fmt.Fprintf(out, ` id="%s"`, xhtmlEscape(id))
+	}
+	out.WriteString(">" + img + "</div>\n")
+}
+
+// link writes a link, pointing links within the book to the chapters they
+// lead to and marking links to notes as such.
+func (c *fb2Converter) link(out *strings.Builder, node *xmlNode, depth int) {
+	href := node.Attrs["href"]
+	if strings.HasPrefix(href, "#") {
+		if chapter, ok := c.ids[href[1:]]; ok {
+			href = epubChapterName(chapter) + href
+		} else {
+			href = ""
+		}
+	} else if !safeLink(href) {
+		href = ""
+	}
+
+	if href == "" {
+		c.children(out, node, depth)
+		return
+	}
+
+	fmt.Fprintf(out, `<a href="%s"`, xhtmlEscape(href))
+	if node.Attrs["type"] == "note" {
+		out.WriteString(` epub:type="noteref"`)
+	}
+	if id := node.Attrs["id"]; id != "" {
+		fmt.Fprintf(out, ` id="%s"`, xhtmlEscape(id))
+	}
+	out.WriteString(">")
+	c.children(out, node, depth)
+	out.WriteString("</a>")
+}
@@ -0,0 +1,89 @@
+package book
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// pngPixel is the smallest PNG image.
+var pngPixel, _ = base64.StdEncoding.DecodeString(
+	"iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg==",
+)
+
+var testFB2 = `<?xml version="1.0" encoding="windows-1251"?>
+<FictionBook xmlns="http://www.gribuni.com/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+<description><title-info>
+<genre>sf</genre>
+<author><first-name>Ivan</first-name><last-name>Petrov</last-name></author>
+<book-title>` + "\xcf\xf0\xe8\xe2\xe5\xf2" + `</book-title>
+<sequence name="Stars" number="2"/>
+<coverpage><image l:href="#cover.png"/></coverpage>
+<lang>ru</lang>
+</title-info></description>
+<body>
+<section><title><p>One</p></title><p>Text<a l:href="#n1" type="note">1</a>.</p>
+<section><title><p>One and a half</p></title><p>More.</p></section>
+</section>
+<section><title><p>Two</p></title><p>End.</p><image l:href="#cover.png"/></section>
+</body>
+<body name="notes"><title><p>Notes</p></title>
+<section id="n1"><title><p>1</p></title><p>A note.</p></section>
+</body>
+<binary id="cover.png" content-type="image/png">` + base64.StdEncoding.EncodeToString(pngPixel) + `</binary>
+</FictionBook>`
+
+func TestConvertFB2(t *testing.T) {
+	book, err := convertFB2(strings.NewReader(testFB2), int64(len(testFB2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if book.Title != "Привет" || strings.Join(book.Authors, ", ") != "Ivan Petrov" || book.Language != "ru" {
+		t.Errorf("metadata = %q by %q in %q, want the title decoded from windows-1251", book.Title, book.Authors, book.Language)
+	}
+	if book.Series != "Stars" || book.SeriesIndex != 2 || book.Cover != "images/cover.png" {
+		t.Errorf("series %q %v and cover %q", book.Series, book.SeriesIndex, book.Cover)
+	}
+
+	if len(book.Chapters) != 3 || book.Chapters[0].Title != "One" || book.Chapters[1].Title != "Two" {
+		t.Fatalf("chapters = %+v, want One, Two and the notes", book.Chapters)
+	}
+	if !book.Chapters[2].Auxiliary || !strings.Contains(book.Chapters[2].Body, `<aside epub:type="footnote" id="n1">`) {
+		t.Errorf("notes chapter = %+v", book.Chapters[2])
+	}
+	if !strings.Contains(book.Chapters[0].Body, `<a href="chapter3.xhtml#n1" epub:type="noteref">1</a>`) {
+		t.Errorf("note reference does not link to the notes chapter: %s", book.Chapters[0].Body)
+	}
+	if !strings.Contains(book.Chapters[1].Body, `<img src="images/cover.png" alt=""/>`) {
+		t.Errorf("image is missing: %s", book.Chapters[1].Body)
+	}
+
+	if len(book.Contents) != 3 || book.Contents[1].Title != "One and a half" || book.Contents[1].Level != 2 {
+		t.Errorf("contents = %+v, want the nested section at level 2", book.Contents)
+	}
+
+	invalid := "<?xml version=\"1.0\"?><html/>"
+	if _, err := convertFB2(strings.NewReader(invalid), int64(len(invalid))); !errors.Is(err, ErrInvalid) {
+		t.Errorf("converting XML that is not FB2: %v, want ErrInvalid", err)
+	}
+}
+
+func TestConvertFB2Zip(t *testing.T) {
+	var archive bytes.Buffer
+	w := zip.NewWriter(&archive)
+	f, _ := w.Create("book.fb2")
+	f.Write([]byte(testFB2))
+	w.Close()
+
+	book, err := convertFB2Zip(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if book.Title != "Привет" {
+		t.Errorf("title = %q", book.Title)
+	}
+}
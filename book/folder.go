@@ -0,0 +1,86 @@
+package book
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Folder is a subfolder of a listed folder.
+type Folder struct {
+	Name string
+	// Path is relative to the listed folder.
+	Path string
+	// Count is the number of books in the folder and all of its subfolders.
+	Count int
+}
+
+// ListRecursive lists path and all of its subfolders if repo supports it, and
+// only path otherwise.
+func ListRecursive(ctx context.Context, repo Repository, path string) (books []Book, err error) {
+	if recursive, ok := repo.(RecursiveRepository); ok {
+		return recursive.ListRecursive(ctx, path)
+	}
+
+	return repo.List(ctx, path)
+}
+
+// Split separates books listed recursively into those directly in the listed
+// folder and the subfolders holding the rest, sorted by name.
+func Split(books []Book) (folders []Folder, direct []Book) {
+	byName := map[string]*Folder{}
+	for _, b := range books {
+		if b.Dir == "" {
+			direct = append(direct, b)
+			continue
+		}
+
+		name := strings.SplitN(b.Dir, "/", 2)[0]
+		folder, ok := byName[name]
+		if !ok {
+			folder = &Folder{Name: name, Path: name}
+			byName[name] = folder
+		}
+		folder.Count++
+	}
+
+	for _, folder := range byName {
+		folders = append(folders, *folder)
+	}
+
+	sort.Slice(folders, func(i, j int) bool {
+		return strings.ToLower(folders[i].Name) < strings.ToLower(folders[j].Name)
+	})
+
+	return
+}
+
+// relativeDir returns the folder of the file at p relative to root, both
+// separated by slashes, or an empty string if p is not below root.
+func relativeDir(root string, p string) string {
+	dir, _ := relativePath(root, path.Dir("/"+strings.Trim(p, "/")))
+	return dir
+}
+
+// relativePath returns p relative to root, both separated by slashes. Case
+// is ignored when matching root, as not every backend preserves it.
+func relativePath(root string, p string) (rel string, ok bool) {
+	p = "/" + strings.Trim(p, "/")
+	root = "/" + strings.Trim(root, "/")
+
+	if root == "/" {
+		return strings.Trim(p, "/"), true
+	}
+
+	if len(p) < len(root) || !strings.EqualFold(p[:len(root)], root) {
+		return "", false
+	}
+
+	rest := p[len(root):]
+	if rest != "" && rest[0] != '/' {
+		return "", false
+	}
+
+	return strings.Trim(rest, "/"), true
+}
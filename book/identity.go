@@ -0,0 +1,546 @@
+package book
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// contentHashBlockSize is the size of the blocks hashed separately by
+// ContentHash.
+const contentHashBlockSize = 4 << 20
+
+// ContentHash computes the hash Dropbox reports for a file: the SHA-256 of
+// the concatenated SHA-256 sums of each 4 MB block. Using the same algorithm
+// everywhere makes the hash of a book comparable across backends.
+func ContentHash(data io.Reader) (sum string, err error) {
+	h := newContentHasher()
+	if _, err = io.Copy(h, data); err != nil {
+		return
+	}
+
+	return h.Sum(), nil
+}
+
+type contentHasher struct {
+	blocks hash.Hash
+	block  hash.Hash
+	filled int
+}
+
+func newContentHasher() *contentHasher {
+	return &contentHasher{blocks: sha256.New(), block: sha256.New()}
+}
+
+func (h *contentHasher) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if left := contentHashBlockSize - h.filled; len(chunk) > left {
+			chunk = chunk[:left]
+		}
+
+		h.block.Write(chunk)
+		h.filled += len(chunk)
+		n += len(chunk)
+		p = p[len(chunk):]
+
+		if h.filled == contentHashBlockSize {
+			h.blocks.Write(h.block.Sum(nil))
+			h.block.Reset()
+			h.filled = 0
+		}
+	}
+
+	return
+}
+
+func (h *contentHasher) Sum() string {
+	if h.filled > 0 {
+		h.blocks.Write(h.block.Sum(nil))
+		h.block.Reset()
+		h.filled = 0
+	}
+
+	return hex.EncodeToString(h.blocks.Sum(nil))
+}
+
+// IdentityRepository recognises the same book under different IDs, by its
+// content hash or, failing that, by its title and first author, so that
+// the reading position of a book survives it being copied, moved or
+// uploaded again. It learns the identity of books from listings, and hashes
+// books on the fly as they are downloaded or uploaded for backends that do
+// not report a hash. Getting the history of a book that has none falls back
+// to the history of another book with the same identity. Books that are no
+// longer listed in their folder are forgotten. If file is not empty, what
+// was learnt is saved there so that it survives restarts.
+type IdentityRepository struct {
+	Repository
+
+	history HistoryStore
+	file    string
+
+	lock sync.Mutex
+	// keys maps a book ID to its identity keys, most specific first.
+	keys map[string][]string
+	// ids maps an identity key to the IDs of the books that have it.
+	ids map[string][]string
+	// dirs maps a book ID to the folder it was last listed in, if known.
+	dirs map[string]string
+}
+
+// identity is what is saved about each book.
+type identity struct {
+	Dir  string   `json:"dir,omitempty"`
+	Keys []string `json:"keys"`
+}
+
+func NewIdentityRepository(
+	upstream Repository, history HistoryStore, file string,
+) (repo *IdentityRepository, err error) {
+	repo = new(IdentityRepository)
+	repo.Repository = upstream
+	repo.history = history
+	repo.file = file
+	repo.keys = map[string][]string{}
+	repo.ids = map[string][]string{}
+	repo.dirs = map[string]string{}
+
+	if file == "" {
+		return
+	}
+
+	var data []byte
+	if data, err = ioutil.ReadFile(file); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	var saved map[string]identity
+	if err = json.Unmarshal(data, &saved); err != nil {
+		// Files written before folders were kept only hold the keys.
+		var keys map[string][]string
+		if json.Unmarshal(data, &keys) != nil {
+			return
+		}
+
+		err = nil
+		saved = map[string]identity{}
+		for ID, k := range keys {
+			saved[ID] = identity{Keys: k}
+		}
+	}
+
+	for ID, entry := range saved {
+		// Keys that identityKeys no longer returns would match books that
+		// are not the same.
+		var keys []string
+		for _, key := range entry.Keys {
+			if validIdentityKey(key) {
+				keys = append(keys, key)
+			}
+		}
+
+		repo.learn(ID, keys)
+		if entry.Dir != "" && len(repo.keys[ID]) > 0 {
+			repo.dirs[ID] = entry.Dir
+		}
+	}
+
+	return
+}
+
+func (repo *IdentityRepository) List(ctx context.Context, dir string) (books []Book, err error) {
+	if books, err = repo.Repository.List(ctx, dir); err == nil {
+		repo.listed(dir, false, books)
+	}
+
+	return
+}
+
+func (repo *IdentityRepository) ListRecursive(ctx context.Context, dir string) (books []Book, err error) {
+	if books, err = ListRecursive(ctx, repo.Repository, dir); err == nil {
+		// Without a recursive listing only dir itself was listed.
+		_, recursive := repo.Repository.(RecursiveRepository)
+		repo.listed(dir, recursive, books)
+	}
+
+	return
+}
+
+// Download hashes the book as it is read if its hash is not known yet.
+func (repo *IdentityRepository) Download(ctx context.Context, ID string) (
+	book Book, data io.ReadCloser, err error,
+) {
+	if book, data, err = repo.Repository.Download(ctx, ID); err != nil {
+		return
+	}
+
+	if book.Hash != "" {
+		repo.update(book)
+		return
+	}
+
+	// Audio files are played from where the player seeks to rather than read
+	// through, and are left as files so that Audiobooks need not copy them.
+	if _, ok := data.(*os.File); ok && book.IsAudio {
+		repo.update(book)
+		return
+	}
+
+	data = &hashingReader{ReadCloser: data, hasher: newContentHasher(), done: func(sum string) {
+		book.Hash = sum
+		repo.update(book)
+	}}
+
+	return
+}
+
+func (repo *IdentityRepository) Upload(
+	ctx context.Context, dir string, name string, data io.Reader,
+) (book Book, err error) {
+	h := newContentHasher()
+	if book, err = repo.Repository.Upload(ctx, dir, name, io.TeeReader(data, h)); err != nil {
+		return
+	}
+
+	if book.Hash == "" {
+		book.Hash = h.Sum()
+	}
+	repo.update(book)
+	repo.locate(book.ID, dir)
+
+	return
+}
+
+// Move carries the identity of the book over to its new ID.
+func (repo *IdentityRepository) Move(
+	ctx context.Context, ID string, dir string, name string,
+) (book Book, err error) {
+	if book, err = repo.Repository.Move(ctx, ID, dir, name); err != nil {
+		return
+	}
+
+	repo.lock.Lock()
+	keys := repo.keys[ID]
+	repo.forget(ID)
+	repo.learn(book.ID, keys)
+	repo.lock.Unlock()
+
+	repo.update(book)
+	repo.locate(book.ID, dir)
+
+	return
+}
+
+func (repo *IdentityRepository) Stat(ctx context.Context, ID string) (book Book, err error) {
+	return Stat(ctx, repo.Repository, ID)
+}
+
+func (repo *IdentityRepository) Cover(ctx context.Context, ID string) (data io.ReadCloser, err error) {
+	covers, ok := repo.Repository.(CoverRepository)
+	if !ok {
+		err = wrap(ErrNotFound, fmt.Errorf("covers are not supported"))
+		return
+	}
+
+	return covers.Cover(ctx, ID)
+}
+
+// GetHistory returns the history of the book with the given ID, or, if it
+// has none, the history of the first other book with the same identity that
+// has one. The version is always that of the given ID, so that the next
+// write goes there.
+func (repo *IdentityRepository) GetHistory(ctx context.Context, ID string) (history History, err error) {
+	if history, err = repo.history.GetHistory(ctx, ID); err != nil || history.Data != "" {
+		return
+	}
+
+	for _, other := range repo.matches(ID) {
+		var found History
+		if found, err = repo.history.GetHistory(ctx, other); err != nil {
+			return
+		}
+
+		if found.Data != "" {
+			history.Data = found.Data
+			return
+		}
+	}
+
+	return
+}
+
+func (repo *IdentityRepository) WriteHistory(
+	ctx context.Context, ID string, history History,
+) (updated History, err error) {
+	return repo.history.WriteHistory(ctx, ID, history)
+}
+
+// ListHistory passes through to the underlying store, if it can list, so
+// that histories found through the identity of a book are not listed.
+func (repo *IdentityRepository) ListHistory(ctx context.Context) (IDs []string, err error) {
+	lister, ok := repo.history.(HistoryLister)
+	if !ok {
+		err = wrap(ErrCannotList, fmt.Errorf("history store can not list histories"))
+		return
+	}
+
+	return lister.ListHistory(ctx)
+}
+
+// matches returns the other IDs that share an identity key with ID, those
+// sharing the most specific key first.
+func (repo *IdentityRepository) matches(ID string) (IDs []string) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	seen := map[string]bool{ID: true}
+	for _, key := range repo.keys[ID] {
+		for _, other := range repo.ids[key] {
+			if !seen[other] {
+				seen[other] = true
+				IDs = append(IDs, other)
+			}
+		}
+	}
+
+	return
+}
+
+// listed learns the identity of the books listed in dir, and below it if
+// recursive, and forgets the books that were listed there before but are
+// gone.
+func (repo *IdentityRepository) listed(dir string, recursive bool, books []Book) {
+	dir = cleanDir(dir)
+
+	repo.lock.Lock()
+	present := map[string]bool{}
+	changed := false
+	for _, b := range books {
+		present[b.ID] = true
+		if repo.learn(b.ID, identityKeys(b)) {
+			changed = true
+		}
+
+		if _, known := repo.keys[b.ID]; !known {
+			continue
+		}
+
+		if bookDir := path.Join(dir, b.Dir); repo.dirs[b.ID] != bookDir {
+			repo.dirs[b.ID] = bookDir
+			changed = true
+		}
+	}
+
+	for ID, bookDir := range repo.dirs {
+		if present[ID] {
+			continue
+		}
+
+		if bookDir == dir || (recursive && isBelow(dir, bookDir)) {
+			repo.forget(ID)
+			changed = true
+		}
+	}
+	repo.lock.Unlock()
+
+	if changed {
+		repo.save()
+	}
+}
+
+// locate records that the book with the given ID is in dir.
+func (repo *IdentityRepository) locate(ID string, dir string) {
+	repo.lock.Lock()
+	if _, known := repo.keys[ID]; known {
+		repo.dirs[ID] = cleanDir(dir)
+	}
+	repo.lock.Unlock()
+
+	repo.save()
+}
+
+// forget drops everything known about ID. The caller holds the lock.
+func (repo *IdentityRepository) forget(ID string) {
+	for _, key := range repo.keys[ID] {
+		others := repo.ids[key][:0]
+		for _, other := range repo.ids[key] {
+			if other != ID {
+				others = append(others, other)
+			}
+		}
+
+		if len(others) == 0 {
+			delete(repo.ids, key)
+		} else {
+			repo.ids[key] = others
+		}
+	}
+
+	delete(repo.keys, ID)
+	delete(repo.dirs, ID)
+}
+
+// update learns the identity of books and saves it if anything is new.
+func (repo *IdentityRepository) update(books ...Book) {
+	changed := false
+	for _, b := range books {
+		if repo.learnAll(b.ID, identityKeys(b)) {
+			changed = true
+		}
+	}
+
+	if changed {
+		repo.save()
+	}
+}
+
+func (repo *IdentityRepository) learnAll(ID string, keys []string) (changed bool) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	return repo.learn(ID, keys)
+}
+
+// learn adds keys to the identity of ID. The caller holds the lock.
+func (repo *IdentityRepository) learn(ID string, keys []string) (changed bool) {
+	for _, key := range keys {
+		known := false
+		for _, k := range repo.keys[ID] {
+			if k == key {
+				known = true
+				break
+			}
+		}
+		if known {
+			continue
+		}
+
+		repo.keys[ID] = append(repo.keys[ID], key)
+		repo.ids[key] = append(repo.ids[key], ID)
+		changed = true
+	}
+
+	if changed {
+		// Hashes identify a book better than its metadata.
+		sort.SliceStable(repo.keys[ID], func(i, j int) bool {
+			return strings.HasPrefix(repo.keys[ID][i], "hash:") && !strings.HasPrefix(repo.keys[ID][j], "hash:")
+		})
+	}
+
+	return
+}
+
+func (repo *IdentityRepository) save() {
+	if repo.file == "" {
+		return
+	}
+
+	repo.lock.Lock()
+	saved := make(map[string]identity, len(repo.keys))
+	for ID, keys := range repo.keys {
+		saved[ID] = identity{Dir: repo.dirs[ID], Keys: keys}
+	}
+	data, err := json.Marshal(saved)
+	repo.lock.Unlock()
+
+	if err == nil {
+		err = writeFileAtomic(repo.file, data)
+	}
+	if err != nil {
+		log.Printf("error saving book identities to %s: %v\n", repo.file, err)
+	}
+}
+
+// identityKeys returns the keys identifying book: its content hash if known,
+// and its normalised title and first author if it has both. File names are
+// not used, as different books often share them, such as "Volume 1.cbz" in
+// two series.
+func identityKeys(book Book) (keys []string) {
+	if book.Hash != "" {
+		keys = append(keys, "hash:"+book.Hash)
+	}
+
+	if len(book.Authors) == 0 {
+		return
+	}
+
+	title, author := normalise(book.Title), normalise(book.Authors[0])
+	if title == "" || author == "" {
+		return
+	}
+
+	format := "epub"
+	if book.IsPDF {
+		format = "pdf"
+	} else if book.IsComic {
+		format = "comic"
+	} else if book.IsAudio {
+		format = "audio"
+	}
+
+	return append(keys, "meta:"+format+"|"+title+"|"+author)
+}
+
+// validIdentityKey reports whether key could have been returned by
+// identityKeys.
+func validIdentityKey(key string) bool {
+	if strings.HasPrefix(key, "hash:") {
+		return len(key) > len("hash:")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(key, "meta:"), "|")
+	return strings.HasPrefix(key, "meta:") && len(parts) == 3 && parts[1] != "" && parts[2] != ""
+}
+
+// cleanDir returns the canonical form of the folder dir.
+func cleanDir(dir string) string {
+	return path.Clean("/" + dir)
+}
+
+// isBelow reports whether the canonical folder dir is below parent.
+func isBelow(parent string, dir string) bool {
+	return parent == "/" || strings.HasPrefix(dir, parent+"/")
+}
+
+// normalise reduces s to lower case words of letters and digits, so that
+// differences in case, punctuation and spacing do not matter.
+func normalise(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+// hashingReader hashes what is read through it and reports the hash once
+// everything has been read.
+type hashingReader struct {
+	io.ReadCloser
+	hasher *contentHasher
+	done   func(sum string)
+}
+
+func (r *hashingReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(p)
+	r.hasher.Write(p[:n])
+
+	if err == io.EOF && r.done != nil {
+		r.done(r.hasher.Sum())
+		r.done = nil
+	}
+
+	return
+}
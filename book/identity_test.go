@@ -0,0 +1,258 @@
+package book
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// listingRepository lists fixed books per folder, recursively if asked.
+type listingRepository struct {
+	books map[string][]Book
+}
+
+func (repo *listingRepository) List(ctx context.Context, dir string) ([]Book, error) {
+	var books []Book
+	for _, b := range repo.books[dir] {
+		if b.Dir == "" {
+			books = append(books, b)
+		}
+	}
+	return books, nil
+}
+
+func (repo *listingRepository) ListRecursive(ctx context.Context, dir string) ([]Book, error) {
+	return repo.books[dir], nil
+}
+
+func (repo *listingRepository) Download(ctx context.Context, ID string) (Book, io.ReadCloser, error) {
+	return Book{ID: ID}, ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+func (repo *listingRepository) Upload(ctx context.Context, dir string, name string, data io.Reader) (Book, error) {
+	return Book{ID: dir + "/" + name, Name: name}, nil
+}
+
+func (repo *listingRepository) Move(ctx context.Context, ID string, dir string, name string) (Book, error) {
+	return Book{ID: dir + "/" + name, Name: name}, nil
+}
+
+func newTestIdentityRepository(t *testing.T, books map[string][]Book, file string) (
+	*IdentityRepository, *MemoryRepository,
+) {
+	t.Helper()
+
+	history := NewMemoryRepository()
+	repo, err := NewIdentityRepository(&listingRepository{books: books}, history, file)
+	if err != nil {
+		t.Fatalf("NewIdentityRepository: %v", err)
+	}
+
+	return repo, history
+}
+
+func writeTestHistory(t *testing.T, store HistoryStore, ID string, data string) {
+	t.Helper()
+
+	if _, err := store.WriteHistory(context.Background(), ID, History{Data: data}); err != nil {
+		t.Fatalf("WriteHistory(%s): %v", ID, err)
+	}
+}
+
+func historyData(t *testing.T, repo *IdentityRepository, ID string) string {
+	t.Helper()
+
+	history, err := repo.GetHistory(context.Background(), ID)
+	if err != nil {
+		t.Fatalf("GetHistory(%s): %v", ID, err)
+	}
+
+	return history.Data
+}
+
+func TestIdentityKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		book Book
+		want []string
+	}{
+		{"hash", Book{Name: "a.epub", Hash: "abc"}, []string{"hash:abc"}},
+		{"title and author", Book{Name: "a.epub", Title: "The Hobbit", Authors: []string{"J. R. R. Tolkien"}},
+			[]string{"meta:epub|the hobbit|j r r tolkien"}},
+		{"title only", Book{Name: "a.epub", Title: "The Hobbit"}, nil},
+		{"file name only", Book{Name: "Volume 1.cbz", IsComic: true}, nil},
+		{"author only", Book{Name: "a.pdf", IsPDF: true, Authors: []string{"Someone"}}, nil},
+	}
+
+	for _, test := range tests {
+		got := identityKeys(test.book)
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: identityKeys = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestIdentitySharesHistoryByHash(t *testing.T) {
+	repo, history := newTestIdentityRepository(t, map[string][]Book{
+		"/books": {
+			{ID: "a", Name: "a.epub", Hash: "same"},
+			{ID: "b", Name: "copy of a.epub", Hash: "same"},
+		},
+	}, "")
+
+	if _, err := repo.List(context.Background(), "/books"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestHistory(t, history, "a", "position")
+
+	if got := historyData(t, repo, "b"); got != "position" {
+		t.Errorf("history of b = %q, want the history of a", got)
+	}
+}
+
+func TestIdentityDoesNotMatchFileNames(t *testing.T) {
+	repo, history := newTestIdentityRepository(t, map[string][]Book{
+		"/books": {
+			{ID: "one", Name: "Volume 1.cbz", IsComic: true, Dir: "Series One"},
+			{ID: "two", Name: "Volume 1.cbz", IsComic: true, Dir: "Series Two"},
+			{ID: "three", Name: "book.epub", Title: "Untitled", Dir: "x"},
+			{ID: "four", Name: "book.epub", Title: "Untitled", Dir: "y"},
+		},
+	}, "")
+
+	if _, err := repo.ListRecursive(context.Background(), "/books"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestHistory(t, history, "one", "page 12")
+	writeTestHistory(t, history, "three", "chapter 2")
+
+	if got := historyData(t, repo, "two"); got != "" {
+		t.Errorf("history of two = %q, want none", got)
+	}
+	if got := historyData(t, repo, "four"); got != "" {
+		t.Errorf("history of four = %q, want none", got)
+	}
+}
+
+func TestIdentityMatchesTitleAndAuthor(t *testing.T) {
+	repo, history := newTestIdentityRepository(t, map[string][]Book{
+		"/books": {
+			{ID: "a", Name: "hobbit.epub", Title: "The Hobbit", Authors: []string{"Tolkien"}},
+			{ID: "b", Name: "The Hobbit (1).epub", Title: "the hobbit!", Authors: []string{"TOLKIEN"}},
+			{ID: "c", Name: "hobbit.pdf", IsPDF: true, Title: "The Hobbit", Authors: []string{"Tolkien"}},
+		},
+	}, "")
+
+	if _, err := repo.List(context.Background(), "/books"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestHistory(t, history, "a", "chapter 3")
+
+	if got := historyData(t, repo, "b"); got != "chapter 3" {
+		t.Errorf("history of b = %q, want the history of a", got)
+	}
+	if got := historyData(t, repo, "c"); got != "" {
+		t.Errorf("history of c = %q, want none for another format", got)
+	}
+}
+
+func TestIdentityForgetsBooksNoLongerListed(t *testing.T) {
+	books := map[string][]Book{
+		"/books": {
+			{ID: "a", Name: "a.epub", Hash: "same"},
+			{ID: "b", Name: "b.epub", Hash: "same", Dir: "sub"},
+		},
+	}
+	repo, history := newTestIdentityRepository(t, books, "")
+
+	if _, err := repo.ListRecursive(context.Background(), "/books"); err != nil {
+		t.Fatal(err)
+	}
+	writeTestHistory(t, history, "b", "position")
+
+	books["/books"] = books["/books"][:1]
+	if _, err := repo.ListRecursive(context.Background(), "/books"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := repo.keys["b"]; ok {
+		t.Errorf("b is still known after it was deleted")
+	}
+	if got := historyData(t, repo, "a"); got != "" {
+		t.Errorf("history of a = %q, want none once b is gone", got)
+	}
+}
+
+func TestIdentityListKeepsBooksInSubfolders(t *testing.T) {
+	books := map[string][]Book{
+		"/books": {
+			{ID: "a", Name: "a.epub", Hash: "same"},
+			{ID: "b", Name: "b.epub", Hash: "same", Dir: "sub"},
+		},
+	}
+	repo, _ := newTestIdentityRepository(t, books, "")
+
+	if _, err := repo.ListRecursive(context.Background(), "/books"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.List(context.Background(), "/books"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := repo.keys["b"]; !ok {
+		t.Errorf("b was forgotten by a listing of its parent folder")
+	}
+}
+
+func TestIdentityLoadsOldFilesWithoutFileNameKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "identities.json")
+	data, _ := json.Marshal(map[string][]string{
+		"one": {"meta:comic|volume 1|"},
+		"two": {"meta:comic|volume 1|"},
+		"a":   {"hash:same", "meta:epub|the hobbit|tolkien"},
+		"b":   {"hash:same"},
+	})
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, history := newTestIdentityRepository(t, nil, file)
+	writeTestHistory(t, history, "one", "page 12")
+	writeTestHistory(t, history, "a", "chapter 3")
+
+	if got := historyData(t, repo, "two"); got != "" {
+		t.Errorf("history of two = %q, want none", got)
+	}
+	if got := historyData(t, repo, "b"); got != "chapter 3" {
+		t.Errorf("history of b = %q, want the history of a", got)
+	}
+}
+
+func TestIdentitySavesFolders(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "identities.json")
+	books := map[string][]Book{
+		"/books": {{ID: "a", Name: "a.epub", Hash: "h", Dir: "sub"}},
+	}
+
+	repo, _ := newTestIdentityRepository(t, books, file)
+	if _, err := repo.ListRecursive(context.Background(), "/books"); err != nil {
+		t.Fatal(err)
+	}
+
+	books["/books"] = nil
+	reloaded, _ := newTestIdentityRepository(t, books, file)
+	if reloaded.dirs["a"] != "/books/sub" {
+		t.Fatalf("folder of a = %q after a restart, want /books/sub", reloaded.dirs["a"])
+	}
+
+	if _, err := reloaded.ListRecursive(context.Background(), "/books"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.keys["a"]; ok {
+		t.Errorf("a is still known after it was deleted")
+	}
+}
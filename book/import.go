@@ -0,0 +1,455 @@
+package book
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf16"
+)
+
+// importMaxSize is the largest book Import fetches.
+var importMaxSize int64 = 200 << 20
+
+const (
+	// importMaxRedirects is how many redirects Import follows.
+	importMaxRedirects = 5
+	// importTimeout bounds the whole fetch, however slowly the data comes.
+	importTimeout = 5 * time.Minute
+	// importMaxName is the length in characters names made from metadata are
+	// cut to.
+	importMaxName = 100
+)
+
+// errLocalAddress is returned for URLs that point into the local network.
+var errLocalAddress = wrap(ErrInvalid, errors.New("refusing to fetch from a local address"))
+
+// importDenied are the networks Import refuses to connect to: private,
+// shared, loopback, link-local, multicast and reserved addresses, and those
+// set aside for documentation and benchmarks.
+var importDenied = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15",
+	"198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4",
+	"::/96", "::1/128", "100::/64", "64:ff9b:1::/48", "2001:db8::/32", "fc00::/7",
+	"fe80::/10", "ff00::/8",
+)
+
+var (
+	// nat64Prefix is the well-known prefix IPv4 addresses are translated
+	// into, in its last four bytes.
+	nat64Prefix = parseNetworks("64:ff9b::/96")[0]
+	// sixToFourPrefix is the 6to4 prefix, followed by an IPv4 address.
+	sixToFourPrefix = parseNetworks("2002::/16")[0]
+)
+
+func parseNetworks(cidrs ...string) (networks []*net.IPNet) {
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return
+}
+
+// localAddress reports whether ip is in one of the denied networks, looking
+// through the IPv4 addresses mapped, translated or tunnelled into IPv6 ones.
+func localAddress(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if nat64Prefix.Contains(ip) {
+		ip = ip[12:16]
+	} else if sixToFourPrefix.Contains(ip) {
+		ip = ip[2:6]
+	}
+
+	for _, network := range importDenied {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// importClient fetches books for Import. It only connects to public
+// addresses, so that the server can not be used to reach services that are
+// not meant to be reachable from outside, and follows a limited number of
+// redirects.
+var importClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 30 * time.Second,
+			Control: func(network string, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+
+				if ip := net.ParseIP(host); ip == nil || localAddress(ip) {
+					return errLocalAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= importMaxRedirects {
+			return wrap(ErrInvalid, fmt.Errorf("stopped after %d redirects", importMaxRedirects))
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return wrap(ErrInvalid, fmt.Errorf("refusing to follow a redirect to %s", req.URL))
+		}
+		return nil
+	},
+}
+
+// Import fetches the EPUB or PDF at rawURL and uploads it to the folder dir
+// of repo. The format is recognised from the content, whatever the server
+// claims it is, and the book is named from its title and author if it has
+// them, and from the URL otherwise.
+func Import(ctx context.Context, repo Repository, rawURL string, dir string) (book Book, err error) {
+	var u *url.URL
+	if u, err = url.Parse(strings.TrimSpace(rawURL)); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		err = wrap(ErrInvalid, fmt.Errorf("%q is not a web address", rawURL))
+		return
+	}
+
+	fetchCtx, cancel := context.WithTimeout(ctx, importTimeout)
+	defer cancel()
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(fetchCtx, http.MethodGet, u.String(), nil); err != nil {
+		return
+	}
+	req.Header.Set("Accept", "application/epub+zip, application/pdf;q=0.9, */*;q=0.1")
+	req.Header.Set("User-Agent", "BookBrowser")
+
+	var res *http.Response
+	if res, err = importClient.Do(req); err != nil {
+		err = importError(ctx, err)
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		err = fmt.Errorf("fetching %s: %s", u, res.Status)
+		switch {
+		case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+			err = wrap(ErrNotFound, err)
+		case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+			err = wrap(ErrUnavailable, err)
+		default:
+			err = wrap(ErrInvalid, err)
+		}
+		return
+	}
+
+	if res.ContentLength > importMaxSize {
+		err = wrap(ErrInvalid, fmt.Errorf("%s is larger than %d MB", u, importMaxSize>>20))
+		return
+	}
+
+	// The whole book is needed to read the metadata of an EPUB, which is at
+	// the end of the zip.
+	var file *os.File
+	if file, err = ioutil.TempFile("", "import"); err != nil {
+		return
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	var size int64
+	if size, err = io.Copy(file, io.LimitReader(res.Body, importMaxSize+1)); err != nil {
+		err = importError(ctx, err)
+		return
+	}
+	if size > importMaxSize {
+		err = wrap(ErrInvalid, fmt.Errorf("%s is larger than %d MB", u, importMaxSize>>20))
+		return
+	}
+
+	head := make([]byte, sniffLength)
+	n, _ := file.ReadAt(head, 0)
+
+	ext := sniff(head[:n])
+	if ext == "" {
+		mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		if mediaType == "text/html" {
+			err = wrap(ErrInvalid, fmt.Errorf("%s is a web page, not a link to an EPUB or PDF", u))
+		} else {
+			err = wrap(ErrInvalid, fmt.Errorf("%s is neither an EPUB nor a PDF", u))
+		}
+		return
+	}
+
+	var title, author string
+	if ext == ".epub" {
+		title, author = epubMetadata(file, size)
+	} else {
+		title, author = pdfMetadata(file, size)
+	}
+
+	name := importName(title, author)
+	if name == "" {
+		name = importName(remoteName(res), "")
+	}
+	if name == "" {
+		name = "download"
+	}
+	name += ext
+
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	return repo.Upload(ctx, dir, name, file)
+}
+
+// importError marks a failure to fetch a book, keeping the refusal of local
+// addresses recognisable.
+func importError(ctx context.Context, err error) error {
+	if errors.Is(err, ErrInvalid) {
+		return err
+	}
+
+	if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+		return wrap(ErrUnavailable, fmt.Errorf("fetching took longer than %s: %w", importTimeout, err))
+	}
+
+	return transportError(ctx, err)
+}
+
+// remoteName returns the file name the server suggests, or the last part of
+// the URL, without its extension.
+func remoteName(res *http.Response) string {
+	name := ""
+	if _, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+
+	if name == "" {
+		name = path.Base(res.Request.URL.Path)
+		if name == "/" || name == "." {
+			name = ""
+		}
+	}
+
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// importName makes a file name without extension out of title and author.
+func importName(title string, author string) string {
+	name := title
+	if name != "" && author != "" {
+		name += " - " + author
+	}
+
+	// Drop what file systems and URLs choke on.
+	name = strings.Join(strings.FieldsFunc(name, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r)
+	}), " ")
+	name = strings.TrimLeft(name, ". ")
+
+	if runes := []rune(name); len(runes) > importMaxName {
+		name = strings.TrimSpace(string(runes[:importMaxName]))
+	}
+
+	return name
+}
+
+// epubMetadata returns the title and first author of the EPUB in r.
+func epubMetadata(r io.ReaderAt, size int64) (title string, author string) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return
+	}
+
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if readZipXML(archive, "META-INF/container.xml", &container) != nil || len(container.Rootfiles) == 0 {
+		return
+	}
+
+	var pkg struct {
+		Titles   []string `xml:"metadata>title"`
+		Creators []string `xml:"metadata>creator"`
+	}
+	if readZipXML(archive, container.Rootfiles[0].FullPath, &pkg) != nil {
+		return
+	}
+
+	if len(pkg.Titles) > 0 {
+		title = strings.TrimSpace(pkg.Titles[0])
+	}
+	if len(pkg.Creators) > 0 {
+		author = strings.TrimSpace(pkg.Creators[0])
+	}
+
+	return
+}
+
+func readZipXML(archive *zip.Reader, name string, v interface{}) (err error) {
+	for _, f := range archive.File {
+		if f.Name != name {
+			continue
+		}
+
+		var r io.ReadCloser
+		if r, err = f.Open(); err != nil {
+			return
+		}
+		defer r.Close()
+
+		return xml.NewDecoder(io.LimitReader(r, 1<<20)).Decode(v)
+	}
+
+	return os.ErrNotExist
+}
+
+// pdfInfoWindow is how much of the start and the end of a PDF is searched for
+// its document information, which is usually found in one or the other.
+const pdfInfoWindow = 1 << 20
+
+var pdfInfoKey = regexp.MustCompile(`/(Title|Author)\s*(\(|<)`)
+
+// pdfMetadata returns the title and author from the document information of
+// the PDF in r, if they can be found without parsing the whole file.
+func pdfMetadata(r io.ReaderAt, size int64) (title string, author string) {
+	windows := []int64{0}
+	if size > pdfInfoWindow {
+		windows = append(windows, size-pdfInfoWindow)
+	}
+
+	for _, offset := range windows {
+		data := make([]byte, pdfInfoWindow)
+		n, _ := r.ReadAt(data, offset)
+		data = data[:n]
+
+		for _, match := range pdfInfoKey.FindAllSubmatchIndex(data, -1) {
+			value := pdfString(data[match[4]:])
+			switch string(data[match[2]:match[3]]) {
+			case "Title":
+				if title == "" {
+					title = value
+				}
+			case "Author":
+				if author == "" {
+					author = value
+				}
+			}
+		}
+
+		if title != "" {
+			return
+		}
+	}
+
+	return
+}
+
+// pdfString decodes the literal or hex string data starts with.
+func pdfString(data []byte) string {
+	var raw []byte
+	if data[0] == '<' {
+		end := bytes.IndexByte(data, '>')
+		if end < 0 {
+			return ""
+		}
+
+		digits := bytes.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return -1
+			}
+			return r
+		}, data[1:end])
+		if len(digits)%2 == 1 {
+			digits = append(digits, '0')
+		}
+
+		raw = make([]byte, len(digits)/2)
+		if _, err := hex.Decode(raw, digits); err != nil {
+			return ""
+		}
+	} else {
+		depth := 0
+	literal:
+		for i := 1; i < len(data); i++ {
+			switch c := data[i]; c {
+			case '(':
+				depth++
+				raw = append(raw, c)
+			case ')':
+				if depth == 0 {
+					break literal
+				}
+				depth--
+				raw = append(raw, c)
+			case '\\':
+				if i++; i == len(data) {
+					break literal
+				}
+				switch e := data[i]; {
+				case e == 'n':
+					raw = append(raw, '\n')
+				case e == 'r':
+					raw = append(raw, '\r')
+				case e == 't':
+					raw = append(raw, '\t')
+				case e >= '0' && e <= '7':
+					v := 0
+					for j := 0; j < 3 && i < len(data) && data[i] >= '0' && data[i] <= '7'; j++ {
+						v = v*8 + int(data[i]-'0')
+						i++
+					}
+					i--
+					raw = append(raw, byte(v))
+				default:
+					raw = append(raw, e)
+				}
+			default:
+				raw = append(raw, c)
+			}
+		}
+	}
+
+	// Text strings are either UTF-16 with a byte order mark or, close enough,
+	// Latin-1.
+	if len(raw) >= 2 && raw[0] == 0xfe && raw[1] == 0xff {
+		units := make([]uint16, (len(raw)-2)/2)
+		for i := range units {
+			units[i] = uint16(raw[2+2*i])<<8 | uint16(raw[3+2*i])
+		}
+		return strings.TrimSpace(string(utf16.Decode(units)))
+	}
+
+	runes := make([]rune, len(raw))
+	for i, b := range raw {
+		runes[i] = rune(b)
+	}
+	return strings.TrimSpace(string(runes))
+}
@@ -0,0 +1,182 @@
+package book
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testEPUB returns an EPUB whose package document holds metadata.
+func testEPUB(metadata string) []byte {
+	var archive bytes.Buffer
+	w := zip.NewWriter(&archive)
+
+	f, _ := w.CreateHeader(&zip.FileHeader{Name: epubMimetypeName, Method: zip.Store})
+	f.Write([]byte(epubMediaType))
+
+	f, _ = w.Create("META-INF/container.xml")
+	f.Write([]byte(`<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`))
+
+	f, _ = w.Create("OEBPS/content.opf")
+	f.Write([]byte(`<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" xmlns:dc="http://purl.org/dc/elements/1.1/" version="3.0">
+  <metadata>` + metadata + `</metadata>
+</package>`))
+
+	w.Close()
+	return archive.Bytes()
+}
+
+// allowLocalImports lets Import fetch from test servers for the rest of t.
+func allowLocalImports(t *testing.T) {
+	denied := importDenied
+	importDenied = nil
+	t.Cleanup(func() { importDenied = denied })
+}
+
+func TestLocalAddress(t *testing.T) {
+	for address, want := range map[string]bool{
+		"93.184.216.34":        false,
+		"2606:4700::6810:85e5": false,
+		"64:ff9b::5db8:d822":   false,
+		"10.1.2.3":             true,
+		"172.20.0.1":           true,
+		"192.168.1.1":          true,
+		"127.0.0.1":            true,
+		"169.254.169.254":      true,
+		"100.64.0.1":           true,
+		"100.127.255.254":      true,
+		"198.18.0.1":           true,
+		"198.19.255.255":       true,
+		"0.0.0.0":              true,
+		"255.255.255.255":      true,
+		"::":                   true,
+		"::1":                  true,
+		"::ffff:127.0.0.1":     true,
+		"::127.0.0.1":          true,
+		"fe80::1":              true,
+		"fd00::1":              true,
+		"ff02::1":              true,
+		"64:ff9b::a9fe:a9fe":   true,
+		"64:ff9b::192.168.0.1": true,
+		"64:ff9b:1::1":         true,
+		"2002:a00:1::1":        true,
+		"2002:7f00:1::":        true,
+		"2002:5db8:d822::1":    false,
+		"2001:db8::1":          true,
+	} {
+		if got := localAddress(net.ParseIP(address)); got != want {
+			t.Errorf("localAddress(%s) = %t, want %t", address, got, want)
+		}
+	}
+}
+
+func TestImportRefusesLocalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testEPUB(""))
+	}))
+	defer server.Close()
+
+	_, err := Import(context.Background(), NewMemoryRepository(), server.URL+"/book.epub", "/")
+	if !errors.Is(err, ErrInvalid) {
+		t.Errorf("Import from %s: %v, want ErrInvalid", server.URL, err)
+	}
+}
+
+func TestImportNamesFromMetadata(t *testing.T) {
+	allowLocalImports(t)
+
+	pdf := []byte("%PDF-1.4\n1 0 obj\n<< /Title (The \\(Second\\) Book) /Author <FEFF00C9006D0069006C0065> >>\nendobj\n%%EOF\n")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/epub":
+			w.Write(testEPUB(`<dc:title> Tales: Old/New </dc:title><dc:creator>Ann Author</dc:creator><dc:creator>Bob</dc:creator>`))
+		case "/pdf":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(pdf)
+		case "/bare":
+			w.Header().Set("Content-Disposition", `attachment; filename="From Server.epub"`)
+			w.Write(testEPUB(""))
+		}
+	}))
+	defer server.Close()
+
+	repo := NewMemoryRepository()
+	for path, want := range map[string]string{
+		"/epub": "Tales Old New - Ann Author.epub",
+		"/pdf":  "The (Second) Book - Émile.pdf",
+		"/bare": "From Server.epub",
+	} {
+		book, err := Import(context.Background(), repo, server.URL+path, "/books")
+		if err != nil {
+			t.Errorf("Import(%s): %v", path, err)
+		} else if book.Name != want {
+			t.Errorf("Import(%s) named the book %q, want %q", path, book.Name, want)
+		}
+	}
+}
+
+func TestImportRejections(t *testing.T) {
+	allowLocalImports(t)
+
+	size := importMaxSize
+	importMaxSize = 1 << 10
+	defer func() { importMaxSize = size }()
+
+	server := httptest.NewServer(nil)
+	defer server.Close()
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, "<!DOCTYPE html><html><body>Download</body></html>")
+		case "/large":
+			w.Write(append([]byte("%PDF-1.4\n"), make([]byte, importMaxSize)...))
+		case "/streamed":
+			w.Header().Set("Content-Type", "application/pdf")
+			w.(http.Flusher).Flush()
+			w.Write(append([]byte("%PDF-1.4\n"), make([]byte, importMaxSize)...))
+		case "/missing":
+			http.NotFound(w, r)
+		default:
+			// Redirect forever.
+			var hops int
+			fmt.Sscanf(r.URL.Path, "/hop%d", &hops)
+			http.Redirect(w, r, fmt.Sprintf("/hop%d", hops+1), http.StatusFound)
+		}
+	})
+
+	repo := NewMemoryRepository()
+	for path, want := range map[string]struct {
+		kind    error
+		message string
+	}{
+		"/page":     {ErrInvalid, "web page"},
+		"/large":    {ErrInvalid, "larger than"},
+		"/streamed": {ErrInvalid, "larger than"},
+		"/hop0":     {ErrInvalid, "redirects"},
+		"/missing":  {ErrNotFound, "404"},
+	} {
+		_, err := Import(context.Background(), repo, server.URL+path, "/books")
+		if !errors.Is(err, want.kind) || !strings.Contains(err.Error(), want.message) {
+			t.Errorf("Import(%s): %v, want %v mentioning %q", path, err, want.kind, want.message)
+		}
+	}
+
+	if _, err := Import(context.Background(), repo, "file:///etc/passwd", "/books"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Import(file:///etc/passwd): %v, want ErrInvalid", err)
+	}
+	if books, _ := repo.List(context.Background(), "/books"); len(books) != 0 {
+		t.Errorf("rejected imports left %d books behind", len(books))
+	}
+}
@@ -0,0 +1,285 @@
+package book
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexMaxBackoff caps the wait between attempts after the upstream
+// repository failed to report changes.
+const indexMaxBackoff = 5 * time.Minute
+
+// IndexedRepository keeps a catalogue of every book below root in memory and
+// serves listings from it, so that browsing does not hit the upstream
+// repository at all. Run bootstraps the catalogue with one full listing and
+// then follows the changes reported by upstream. If file is not empty, the
+// catalogue is saved there so that a restart only catches up on changes.
+type IndexedRepository struct {
+	Repository
+
+	watcher WatchRepository
+	root    string
+	file    string
+
+	lock sync.RWMutex
+	// books maps the path of each change to the book it added.
+	books  map[string]Book
+	cursor string
+	ready  bool
+}
+
+// indexState is what is saved to file.
+type indexState struct {
+	Root   string          `json:"root"`
+	Cursor string          `json:"cursor"`
+	Books  map[string]Book `json:"books"`
+}
+
+func NewIndexedRepository(
+	upstream Repository, root string, file string,
+) (repo *IndexedRepository, err error) {
+	repo = new(IndexedRepository)
+	repo.Repository = upstream
+	repo.root = root
+	repo.file = file
+	repo.books = map[string]Book{}
+
+	var ok bool
+	if repo.watcher, ok = upstream.(WatchRepository); !ok {
+		err = fmt.Errorf("repository can not be watched for changes")
+		return
+	}
+
+	if file == "" {
+		return
+	}
+
+	var data []byte
+	if data, err = ioutil.ReadFile(file); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	var state indexState
+	if err = json.Unmarshal(data, &state); err != nil {
+		err = fmt.Errorf("reading index %s: %v", file, err)
+		return
+	}
+
+	// An index of another folder is of no use, start over.
+	if state.Root == root && state.Cursor != "" {
+		repo.books = state.Books
+		repo.cursor = state.Cursor
+		repo.ready = true
+	}
+
+	return
+}
+
+// Run keeps the catalogue up to date until ctx is done.
+func (repo *IndexedRepository) Run(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		repo.lock.RLock()
+		cursor := repo.cursor
+		repo.lock.RUnlock()
+
+		changes, next, err := repo.watcher.Watch(ctx, repo.root, cursor)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			if errors.Is(err, ErrCursorReset) {
+				log.Printf("index of %s expired, listing it again\n", repo.root)
+				repo.lock.Lock()
+				repo.cursor = ""
+				repo.lock.Unlock()
+				continue
+			}
+
+			log.Printf("error indexing %s, retrying in %s: %v\n", repo.root, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+			}
+
+			if backoff *= 2; backoff > indexMaxBackoff {
+				backoff = indexMaxBackoff
+			}
+			continue
+		}
+
+		backoff = time.Second
+		repo.apply(cursor == "", changes, next)
+
+		if cursor == "" || len(changes) > 0 {
+			if err = repo.save(); err != nil {
+				log.Printf("error saving index of %s: %v\n", repo.root, err)
+			}
+		}
+	}
+}
+
+// apply updates the catalogue with changes, replacing it if they come from
+// a full listing.
+func (repo *IndexedRepository) apply(full bool, changes []Change, cursor string) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if full {
+		repo.books = map[string]Book{}
+	}
+
+	for _, change := range changes {
+		if change.Book != nil {
+			repo.books[change.Path] = *change.Book
+			continue
+		}
+
+		delete(repo.books, change.Path)
+		for p := range repo.books {
+			if strings.HasPrefix(p, change.Path+"/") {
+				delete(repo.books, p)
+			}
+		}
+	}
+
+	repo.cursor = cursor
+	repo.ready = true
+}
+
+func (repo *IndexedRepository) save() (err error) {
+	if repo.file == "" {
+		return
+	}
+
+	repo.lock.RLock()
+	data, err := json.Marshal(indexState{
+		Root:   repo.root,
+		Cursor: repo.cursor,
+		Books:  repo.books,
+	})
+	repo.lock.RUnlock()
+	if err != nil {
+		return
+	}
+
+	return writeFileAtomic(repo.file, data)
+}
+
+// Upload adds the book to the catalogue right away rather than waiting for
+// upstream to report it.
+func (repo *IndexedRepository) Upload(
+	ctx context.Context, dir string, name string, data io.Reader,
+) (book Book, err error) {
+	if book, err = repo.Repository.Upload(ctx, dir, name, data); err != nil {
+		return
+	}
+
+	if sub, ok := relativePath(repo.root, dir); ok {
+		added := book
+		added.Dir = sub
+
+		repo.lock.Lock()
+		repo.books[strings.ToLower(strings.TrimSuffix(dir, "/")+"/"+book.Name)] = added
+		repo.lock.Unlock()
+	}
+
+	return
+}
+
+// Move updates the catalogue right away rather than waiting for upstream to
+// report the move.
+func (repo *IndexedRepository) Move(
+	ctx context.Context, ID string, dir string, name string,
+) (book Book, err error) {
+	if book, err = repo.Repository.Move(ctx, ID, dir, name); err != nil {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	for p, b := range repo.books {
+		if b.ID == ID {
+			delete(repo.books, p)
+		}
+	}
+
+	if sub, ok := relativePath(repo.root, dir); ok {
+		moved := book
+		moved.Dir = sub
+		repo.books[strings.ToLower(strings.TrimSuffix(dir, "/")+"/"+book.Name)] = moved
+	}
+
+	return
+}
+
+// Stat passes through to upstream, as the catalogue may lag behind it.
+func (repo *IndexedRepository) Stat(ctx context.Context, ID string) (book Book, err error) {
+	return Stat(ctx, repo.Repository, ID)
+}
+
+// List serves path from the catalogue once it is ready and path is indexed,
+// and passes through to upstream otherwise.
+func (repo *IndexedRepository) List(ctx context.Context, path string) (books []Book, err error) {
+	books, ok := repo.list(path, false)
+	if !ok {
+		return repo.Repository.List(ctx, path)
+	}
+
+	return
+}
+
+// ListRecursive is List for the subfolders of path as well.
+func (repo *IndexedRepository) ListRecursive(ctx context.Context, path string) (books []Book, err error) {
+	books, ok := repo.list(path, true)
+	if !ok {
+		return ListRecursive(ctx, repo.Repository, path)
+	}
+
+	return
+}
+
+func (repo *IndexedRepository) list(path string, recursive bool) (books []Book, ok bool) {
+	var sub string
+	if sub, ok = relativePath(repo.root, path); !ok {
+		return
+	}
+
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	if ok = repo.ready; !ok {
+		return
+	}
+
+	for _, b := range repo.books {
+		dir, below := relativePath(sub, b.Dir)
+		if !below || (dir != "" && !recursive) {
+			continue
+		}
+
+		b.Dir = dir
+		books = append(books, b)
+	}
+
+	sort.Slice(books, func(i, j int) bool {
+		return strings.ToLower(books[i].Name) < strings.ToLower(books[j].Name)
+	})
+
+	return
+}
@@ -0,0 +1,612 @@
+package book
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LocalRepository serves books and history from a directory on disk. All
+// paths handed to it (the book directory and the history prefix) are
+// resolved inside root, and book IDs are the URL safe encoding of the path
+// relative to root so that they can be used directly in routes.
+type LocalRepository struct {
+	root          string
+	historyPrefix string
+
+	// historyLock serialises the version check and rename in WriteHistory.
+	historyLock sync.Mutex
+	// moveLock serialises the existence check and rename in Move.
+	moveLock sync.Mutex
+}
+
+func NewLocalRepository(
+	root string, historyPrefix string,
+) (repo *LocalRepository) {
+	repo = new(LocalRepository)
+	repo.root = filepath.Clean(root)
+	if abs, err := filepath.Abs(root); err == nil {
+		repo.root = abs
+	}
+
+	repo.historyPrefix = historyPrefix
+	if repo.historyPrefix == "" {
+		repo.historyPrefix = "/history"
+	}
+
+	return
+}
+
+func (repo *LocalRepository) List(ctx context.Context, path string) (books []Book, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	var dir string
+	if dir, err = repo.resolve(path); err != nil {
+		return
+	}
+
+	var infos []os.FileInfo
+	if infos, err = ioutil.ReadDir(dir); err != nil {
+		err = localError(err)
+		return
+	}
+
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		name := info.Name()
+		if isBookName(name) {
+			books = append(books, Book{
+				ID:       repo.id(filepath.Join(dir, name)),
+				Name:     name,
+				IsPDF:    strings.Contains(name, ".pdf"),
+				IsComic:  isComicName(name),
+				IsAudio:  isAudioName(name),
+				Revision: fileRevision(info),
+			})
+		}
+	}
+
+	return
+}
+
+// ListRecursive walks path and its subfolders, skipping hidden ones.
+func (repo *LocalRepository) ListRecursive(ctx context.Context, path string) (books []Book, err error) {
+	var dir string
+	if dir, err = repo.resolve(path); err != nil {
+		return
+	}
+
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		name := info.Name()
+		if info.IsDir() {
+			if p != dir && strings.HasPrefix(name, ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		if isBookName(name) {
+			rel, _ := filepath.Rel(dir, filepath.Dir(p))
+			if rel == "." {
+				rel = ""
+			}
+
+			books = append(books, Book{
+				ID:       repo.id(p),
+				Name:     name,
+				IsPDF:    strings.Contains(name, ".pdf"),
+				IsComic:  isComicName(name),
+				IsAudio:  isAudioName(name),
+				Revision: fileRevision(info),
+				Dir:      filepath.ToSlash(rel),
+			})
+		}
+
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		err = localError(err)
+	}
+
+	return
+}
+
+func (repo *LocalRepository) Download(ctx context.Context, ID string) (
+	book Book, data io.ReadCloser, err error,
+) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	var path string
+	if path, err = repo.pathFromID(ID); err != nil {
+		return
+	}
+
+	var file *os.File
+	if file, err = os.Open(path); err != nil {
+		err = localError(err)
+		return
+	}
+
+	var info os.FileInfo
+	if info, err = file.Stat(); err != nil {
+		file.Close()
+		return
+	}
+
+	if book, err = localBook(ID, info); err != nil {
+		file.Close()
+		return
+	}
+	data = file
+
+	return
+}
+
+func (repo *LocalRepository) Stat(ctx context.Context, ID string) (book Book, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	var path string
+	if path, err = repo.pathFromID(ID); err != nil {
+		return
+	}
+
+	var info os.FileInfo
+	if info, err = os.Stat(path); err != nil {
+		err = localError(err)
+		return
+	}
+
+	return localBook(ID, info)
+}
+
+// localBook describes the file with the given ID and info.
+func localBook(ID string, info os.FileInfo) (book Book, err error) {
+	if !info.Mode().IsRegular() {
+		err = wrap(ErrNotFound, fmt.Errorf("%s is not a file", ID))
+		return
+	}
+
+	book = Book{
+		ID:       ID,
+		Name:     info.Name(),
+		IsPDF:    strings.Contains(info.Name(), ".pdf"),
+		IsComic:  isComicName(info.Name()),
+		IsAudio:  isAudioName(info.Name()),
+		Revision: fileRevision(info),
+	}
+
+	return
+}
+
+// Upload creates the book exclusively, so that an existing file is never
+// overwritten, and removes what was written if the upload fails.
+func (repo *LocalRepository) Upload(
+	ctx context.Context, dir string, name string, data io.Reader,
+) (book Book, err error) {
+	var resolved string
+	if resolved, err = repo.resolve(dir); err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(resolved, 0755); err != nil {
+		err = localError(err)
+		return
+	}
+
+	var file *os.File
+	for attempt := 0; attempt < uploadAttempts && file == nil; attempt++ {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		file, err = os.OpenFile(
+			filepath.Join(resolved, uploadName(name, attempt)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644,
+		)
+		if err != nil && !os.IsExist(err) {
+			err = localError(err)
+			return
+		}
+	}
+
+	if file == nil {
+		err = wrap(ErrConflict, fmt.Errorf("no free name for %s in %s", name, dir))
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			os.Remove(file.Name())
+		}
+	}()
+
+	_, err = io.Copy(file, data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return
+	}
+
+	var info os.FileInfo
+	if info, err = os.Stat(file.Name()); err != nil {
+		return
+	}
+
+	book = Book{
+		ID:       repo.id(file.Name()),
+		Name:     info.Name(),
+		IsPDF:    strings.Contains(info.Name(), ".pdf"),
+		IsComic:  isComicName(info.Name()),
+		IsAudio:  isAudioName(info.Name()),
+		Revision: fileRevision(info),
+	}
+
+	return
+}
+
+func (repo *LocalRepository) Move(
+	ctx context.Context, ID string, dir string, name string,
+) (book Book, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	var from, to string
+	if from, err = repo.pathFromID(ID); err != nil {
+		return
+	}
+
+	if to, err = repo.resolve(dir); err != nil {
+		return
+	}
+	to = filepath.Join(to, name)
+
+	repo.moveLock.Lock()
+	defer repo.moveLock.Unlock()
+
+	var info os.FileInfo
+	if info, err = os.Stat(from); err != nil {
+		err = localError(err)
+		return
+	} else if !info.Mode().IsRegular() {
+		err = wrap(ErrNotFound, fmt.Errorf("%s is not a file", ID))
+		return
+	}
+
+	// Rename replaces whatever is at the target, so check first.
+	if _, err = os.Lstat(to); err == nil {
+		err = wrap(ErrConflict, fmt.Errorf("%s already exists in %s", name, dir))
+		return
+	} else if !os.IsNotExist(err) {
+		err = localError(err)
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		err = localError(err)
+		return
+	}
+
+	if err = os.Rename(from, to); err != nil {
+		err = localError(err)
+		return
+	}
+
+	book = Book{
+		ID:       repo.id(to),
+		Name:     name,
+		IsPDF:    strings.Contains(name, ".pdf"),
+		IsComic:  isComicName(name),
+		IsAudio:  isAudioName(name),
+		Revision: fileRevision(info),
+	}
+
+	return
+}
+
+func (repo *LocalRepository) GetHistory(ctx context.Context, ID string) (history History, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	var path string
+	if path, err = repo.historyPath(ID); err != nil {
+		return
+	}
+
+	var file *os.File
+	if file, err = os.Open(path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		} else {
+			err = localError(err)
+		}
+		return
+	}
+	defer file.Close()
+
+	// Read the version from the same file as the data, as writes replace
+	// the file rather than change it.
+	var info os.FileInfo
+	if info, err = file.Stat(); err != nil {
+		return
+	}
+
+	var data []byte
+	if data, err = ioutil.ReadAll(file); err != nil {
+		return
+	}
+
+	history.Data = string(data)
+	history.Version = fileRevision(info)
+	return
+}
+
+func (repo *LocalRepository) WriteHistory(
+	ctx context.Context, ID string, history History,
+) (updated History, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	var path string
+	if path, err = repo.historyPath(ID); err != nil {
+		return
+	}
+
+	repo.historyLock.Lock()
+	defer repo.historyLock.Unlock()
+
+	// The version is the modification time and size of the file rather than
+	// a hash of its content, so that a writer that read an older history
+	// with the same content as the current one still conflicts.
+	var (
+		current string
+		old     os.FileInfo
+	)
+	if info, statErr := os.Stat(path); statErr == nil {
+		current, old = fileRevision(info), info
+	} else if !os.IsNotExist(statErr) {
+		err = localError(statErr)
+		return
+	}
+
+	if current != history.Version {
+		err = wrap(ErrConflict, fmt.Errorf(
+			"history conflict for %s: expected version %q, found %q",
+			ID, history.Version, current,
+		))
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+
+	if err = writeFileAtomic(path, []byte(history.Data)); err != nil {
+		return
+	}
+
+	var info os.FileInfo
+	if info, err = os.Stat(path); err != nil {
+		return
+	}
+
+	// Filesystems with coarse timestamps can give a quick rewrite of the
+	// same size the old version, so move it on.
+	if old != nil && fileRevision(info) == current {
+		later := old.ModTime().Add(time.Second)
+		if err = os.Chtimes(path, later, later); err != nil {
+			return
+		}
+		if info, err = os.Stat(path); err != nil {
+			return
+		}
+	}
+
+	updated.Data = history.Data
+	updated.Version = fileRevision(info)
+	return
+}
+
+func (repo *LocalRepository) ListHistory(ctx context.Context) (IDs []string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	var dir string
+	if dir, err = repo.resolve(repo.historyPrefix); err != nil {
+		return
+	}
+
+	var infos []os.FileInfo
+	if infos, err = ioutil.ReadDir(dir); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		} else {
+			err = localError(err)
+		}
+		return
+	}
+
+	for _, info := range infos {
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+			IDs = append(IDs, info.Name())
+		}
+	}
+
+	return
+}
+
+// resolve maps a repository path onto the filesystem, refusing anything that
+// would escape root, including through symbolic links.
+func (repo *LocalRepository) resolve(path string) (resolved string, err error) {
+	resolved = filepath.Join(repo.root, filepath.FromSlash(filepath.Clean("/"+path)))
+	if !isWithin(repo.root, resolved) {
+		err = wrap(ErrNotFound, fmt.Errorf("%s is outside of %s", path, repo.root))
+		return
+	}
+
+	var root, real string
+	if root, err = evalSymlinks(repo.root); err != nil {
+		return
+	}
+	if real, err = evalSymlinks(resolved); err != nil {
+		return
+	}
+
+	if !isWithin(root, real) {
+		err = wrap(ErrNotFound, fmt.Errorf("%s links outside of %s", path, repo.root))
+	}
+
+	return
+}
+
+// evalSymlinks returns the absolute path p refers to once symbolic links are
+// followed. Only the part of p that exists is evaluated, so that paths about
+// to be created can be checked too.
+func evalSymlinks(p string) (real string, err error) {
+	if p, err = filepath.Abs(p); err != nil {
+		return
+	}
+
+	rest := ""
+	for {
+		if real, err = filepath.EvalSymlinks(p); err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", localError(err)
+		}
+
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", localError(err)
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = parent
+	}
+}
+
+// isWithin reports whether the clean path p is root or below it.
+func isWithin(root string, p string) bool {
+	return p == root || strings.HasPrefix(p, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+}
+
+func (repo *LocalRepository) id(path string) string {
+	rel, err := filepath.Rel(repo.root, path)
+	if err != nil {
+		rel = path
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(filepath.ToSlash(rel)))
+}
+
+func (repo *LocalRepository) pathFromID(ID string) (path string, err error) {
+	var rel []byte
+	if rel, err = base64.RawURLEncoding.DecodeString(ID); err != nil {
+		err = wrap(ErrNotFound, fmt.Errorf("invalid book id %s: %v", ID, err))
+		return
+	}
+
+	return repo.resolve(string(rel))
+}
+
+func (repo *LocalRepository) historyPath(ID string) (path string, err error) {
+	if ID == "" || strings.ContainsAny(ID, `/\`) || ID == "." || ID == ".." {
+		err = wrap(ErrNotFound, fmt.Errorf("invalid book id %s", ID))
+		return
+	}
+
+	return repo.resolve(repo.historyPrefix + "/" + ID)
+}
+
+// localError marks errors from the os package with the matching error from
+// errors.go.
+func localError(err error) error {
+	switch {
+	case os.IsNotExist(err):
+		return wrap(ErrNotFound, err)
+	case os.IsPermission(err):
+		return wrap(ErrUnauthorized, err)
+	}
+
+	return err
+}
+
+// version is the local equivalent of a Dropbox rev: it changes whenever the
+// content of the history file changes.
+func version(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// fileRevision identifies a version of a book file by its modification time
+// and size.
+func fileRevision(info os.FileInfo) string {
+	return fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size())
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte) (err error) {
+	var tmp *os.File
+	if tmp, err = ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp"); err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return
+	}
+
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return
+	}
+
+	if err = tmp.Close(); err != nil {
+		return
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
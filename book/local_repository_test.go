@@ -0,0 +1,75 @@
+package book
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalHistoryStaleWriterConflicts(t *testing.T) {
+	repo := NewLocalRepository(t.TempDir(), "/history")
+	ctx := context.Background()
+
+	first, err := repo.WriteHistory(ctx, "book", History{Data: "page 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second reader holds first while the history moves on and back.
+	second, err := repo.WriteHistory(ctx, "book", History{Data: "page 2", Version: first.Version})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = repo.WriteHistory(ctx, "book", History{Data: "page 1", Version: second.Version}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = repo.WriteHistory(ctx, "book", History{Data: "page 9", Version: first.Version}); !errors.Is(err, ErrConflict) {
+		t.Errorf("write based on an outdated version with the same content: err = %v, want ErrConflict", err)
+	}
+
+	current, err := repo.GetHistory(ctx, "book")
+	if err != nil || current.Data != "page 1" {
+		t.Fatalf("GetHistory = %v, %v", current, err)
+	}
+	if _, err = repo.WriteHistory(ctx, "book", History{Data: "page 3", Version: current.Version}); err != nil {
+		t.Errorf("write based on the current version: %v", err)
+	}
+}
+
+func TestLocalResolveRefusesSymlinksOutOfRoot(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret.epub"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "books"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "books", "inside.epub"), []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "books", "link")); err != nil {
+		t.Skipf("symbolic links are not supported: %v", err)
+	}
+
+	repo := NewLocalRepository(root, "/history")
+	ctx := context.Background()
+	ID := func(p string) string { return base64.RawURLEncoding.EncodeToString([]byte(p)) }
+
+	if _, _, err := repo.Download(ctx, ID("books/link/secret.epub")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("download through a link out of root: err = %v, want ErrNotFound", err)
+	}
+	if _, err := repo.List(ctx, "/books/link"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("listing a link out of root: err = %v, want ErrNotFound", err)
+	}
+
+	_, data, err := repo.Download(ctx, ID("books/inside.epub"))
+	if err != nil {
+		t.Fatalf("download inside root: %v", err)
+	}
+	data.Close()
+}
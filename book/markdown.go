@@ -0,0 +1,359 @@
+package book
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var (
+	markdownHeading = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	markdownSetext  = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	markdownRule    = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	markdownFence   = regexp.MustCompile("^ {0,3}(```+|~~~+)")
+	markdownQuote   = regexp.MustCompile(`^ {0,3}> ?(.*)$`)
+	markdownItem    = regexp.MustCompile(`^[ \t]*([-*+]|\d{1,9}[.)])[ \t]+(.*)$`)
+	markdownCode    = regexp.MustCompile("`+([^`]+)`+")
+	markdownImage   = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink    = regexp.MustCompile(`\[([^\]]+)\]\([ \t]*([^)\s]+)[^)]*\)`)
+	markdownStrong  = regexp.MustCompile(`\*\*(\S(?:.*?\S)?)\*\*|__(\S(?:.*?\S)?)__`)
+	markdownEm      = regexp.MustCompile(`\*(\S(?:.*?\S)?)\*|\b_(\S(?:.*?\S)?)_\b`)
+	markdownField   = regexp.MustCompile(`^(\w+):[ \t]*(.*)$`)
+)
+
+// markdownEscapes are the characters Markdown lets be escaped with a
+// backslash, and the references they are written as.
+var markdownEscapes = strings.NewReplacer(
+	`\\`, "&#92;", `\*`, "&#42;", `\_`, "&#95;", `\#`, "&#35;", `\[`, "&#91;", `\]`, "&#93;",
+	`\(`, "&#40;", `\)`, "&#41;", `\!`, "&#33;", `\-`, "&#45;", `\+`, "&#43;", `\.`, "&#46;",
+)
+
+// markdownBlock is a heading, paragraph, list or other block of a Markdown
+// document, written as HTML.
+type markdownBlock struct {
+	// Level is that of a heading, and 0 for other blocks.
+	Level int
+	Title string
+	HTML  string
+}
+
+// convertMarkdown converts a Markdown book to EPUB. Chapters start at the
+// headings of the first level, or at those of the second if there is a
+// single heading of the first, which is then the title of the book. The
+// title, author and language may also be given in front matter.
+func convertMarkdown(r io.ReaderAt, size int64) (book epubBook, err error) {
+	var text string
+	if text, err = readText(r, size); err != nil {
+		return
+	}
+
+	lines := strings.Split(text, "\n")
+	if len(lines) > 0 && strings.TrimSpace(lines[0]) == "---" {
+		for i := 1; i < len(lines); i++ {
+			if line := strings.TrimSpace(lines[i]); line == "---" || line == "..." {
+				book.frontMatter(lines[1:i])
+				lines = lines[i+1:]
+				break
+			}
+		}
+	}
+
+	blocks := markdownBlocks(lines, map[string]int{})
+
+	levels := map[int]int{}
+	for _, block := range blocks {
+		levels[block.Level]++
+	}
+
+	split := 0
+	switch {
+	case levels[1] > 1:
+		split = 1
+	case levels[2] > 0:
+		split = 2
+		if levels[1] == 1 && book.Title == "" {
+			for _, block := range blocks {
+				if block.Level == 1 {
+					book.Title = block.Title
+				}
+			}
+		}
+	case levels[1] == 1:
+		split = 1
+	}
+
+	var parts []string
+	var part strings.Builder
+	count := 0
+	for _, block := range blocks {
+		if part.Len() > 0 && (block.Level > 0 && block.Level <= split || split == 0 && count == textChapterParagraphs) {
+			parts = append(parts, part.String())
+			part.Reset()
+			count = 0
+		}
+
+		part.WriteString(block.HTML + "\n")
+		count++
+	}
+	if part.Len() > 0 || len(parts) == 0 {
+		parts = append(parts, part.String())
+	}
+
+	book.Chapters = chaptersFromHTML(parts, nil)
+	return
+}
+
+// frontMatter sets the metadata of book from the fields of the front matter
+// of a Markdown document.
+func (book *epubBook) frontMatter(lines []string) {
+	for _, line := range lines {
+		match := markdownField.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+
+		value := strings.Trim(strings.TrimSpace(match[2]), `"'`)
+		if value == "" {
+			continue
+		}
+
+		switch strings.ToLower(match[1]) {
+		case "title":
+			book.Title = value
+		case "author":
+			book.Authors = append(book.Authors, value)
+		case "lang", "language":
+			book.Language = value
+		case "description":
+			book.Description = value
+		}
+	}
+}
+
+// markdownBlocks parses the lines of a Markdown document into blocks. ids
+// counts the IDs given to headings so far, to keep them unique.
+func markdownBlocks(lines []string, ids map[string]int) (blocks []markdownBlock) {
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			blocks = append(blocks, markdownBlock{HTML: "<p>" + markdownLines(paragraph) + "</p>"})
+			paragraph = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+
+		if fence := markdownFence.FindStringSubmatch(line); fence != nil {
+			flush()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence[1]); i++ {
+				code = append(code, html.EscapeString(lines[i]))
+			}
+			blocks = append(blocks, markdownBlock{HTML: "<pre><code>" + strings.Join(code, "\n") + "</code></pre>"})
+			continue
+		}
+
+		if heading := markdownHeading.FindStringSubmatch(line); heading != nil {
+			flush()
+			blocks = append(blocks, markdownHeadingBlock(len(heading[1]), heading[2], ids))
+			continue
+		}
+
+		if setext := markdownSetext.FindStringSubmatch(line); setext != nil && len(paragraph) > 0 {
+			level := 1
+			if setext[1][0] == '-' {
+				level = 2
+			}
+			blocks = append(blocks, markdownHeadingBlock(level, strings.Join(paragraph, " "), ids))
+			paragraph = nil
+			continue
+		}
+
+		if markdownRule.MatchString(line) {
+			flush()
+			blocks = append(blocks, markdownBlock{HTML: "<hr/>"})
+			continue
+		}
+
+		if markdownQuote.MatchString(line) {
+			flush()
+			var quoted []string
+			for ; i < len(lines) && markdownQuote.MatchString(lines[i]); i++ {
+				quoted = append(quoted, markdownQuote.FindStringSubmatch(lines[i])[1])
+			}
+			i--
+
+			var inner strings.Builder
+			for _, block := range markdownBlocks(quoted, ids) {
+				inner.WriteString(block.HTML + "\n")
+			}
+			blocks = append(blocks, markdownBlock{HTML: "<blockquote>\n" + inner.String() + "</blockquote>"})
+			continue
+		}
+
+		if markdownItem.MatchString(line) && len(paragraph) == 0 {
+			blocks = append(blocks, markdownList(lines, &i))
+			continue
+		}
+
+		if len(paragraph) == 0 && (strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t")) {
+			var code []string
+			for ; i < len(lines) && (strings.TrimSpace(lines[i]) == "" ||
+				strings.HasPrefix(lines[i], "    ") || strings.HasPrefix(lines[i], "\t")); i++ {
+				code = append(code, html.EscapeString(strings.TrimPrefix(strings.TrimPrefix(lines[i], "\t"), "    ")))
+			}
+			i--
+
+			for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			blocks = append(blocks, markdownBlock{HTML: "<pre><code>" + strings.Join(code, "\n") + "</code></pre>"})
+			continue
+		}
+
+		paragraph = append(paragraph, line)
+	}
+	flush()
+
+	return
+}
+
+// markdownList parses the list starting at lines[*i], leaving *i at its
+// last line. Nested lists are flattened into the list they are in.
+func markdownList(lines []string, i *int) markdownBlock {
+	ordered := !strings.ContainsAny(markdownItem.FindStringSubmatch(lines[*i])[1], "-*+")
+
+	var items [][]string
+	for ; *i < len(lines); *i++ {
+		line := lines[*i]
+		if item := markdownItem.FindStringSubmatch(line); item != nil && !markdownRule.MatchString(line) {
+			if ordered == strings.ContainsAny(item[1], "-*+") {
+				// A list of the other kind starts.
+				break
+			}
+			items = append(items, []string{item[2]})
+			continue
+		}
+
+		if strings.TrimSpace(line) == "" {
+			// A blank line ends the list unless another item follows.
+			if *i+1 < len(lines) && markdownItem.MatchString(lines[*i+1]) {
+				continue
+			}
+			break
+		}
+
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") && markdownLineStartsBlock(line) {
+			break
+		}
+		items[len(items)-1] = append(items[len(items)-1], strings.TrimSpace(line))
+	}
+	*i--
+
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+
+	var list strings.Builder
+	list.WriteString("<" + tag + ">\n")
+	for _, item := range items {
+		list.WriteString("<li>" + markdownLines(item) + "</li>\n")
+	}
+	list.WriteString("</" + tag + ">")
+
+	return markdownBlock{HTML: list.String()}
+}
+
+// markdownLineStartsBlock reports whether line starts a block other than a
+// paragraph.
+func markdownLineStartsBlock(line string) bool {
+	return markdownHeading.MatchString(line) || markdownFence.MatchString(line) ||
+		markdownRule.MatchString(line) || markdownQuote.MatchString(line)
+}
+
+// markdownHeadingBlock returns a heading with the given level and text, with
+// an ID made from its text for links to it.
+func markdownHeadingBlock(level int, text string, ids map[string]int) markdownBlock {
+	inline := markdownInline(strings.TrimSpace(text))
+
+	id := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_':
+			return unicode.ToLower(r)
+		case r == ' ' || r == '-':
+			return '-'
+		}
+		return -1
+	}, htmlText(inline))
+	if id == "" {
+		id = "section"
+	}
+	if ids[id]++; ids[id] > 1 {
+		id = fmt.Sprintf("%s-%d", id, ids[id]-1)
+	}
+
+	return markdownBlock{
+		Level: level,
+		Title: htmlText(inline),
+		HTML:  fmt.Sprintf(`<h%d id="%s">%s</h%d>`, level, id, inline, level),
+	}
+}
+
+// markdownLines writes the lines of a paragraph, keeping the line breaks of
+// lines that end in two spaces or a backslash.
+func markdownLines(lines []string) string {
+	var out strings.Builder
+	for i, line := range lines {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+
+		trimmed := strings.TrimSpace(line)
+		hardBreak := i < len(lines)-1 && (strings.HasSuffix(line, "  ") || strings.HasSuffix(trimmed, `\`))
+		if hardBreak {
+			trimmed = strings.TrimSuffix(trimmed, `\`)
+		}
+
+		out.WriteString(markdownInline(trimmed))
+		if hardBreak {
+			out.WriteString("<br/>")
+		}
+	}
+
+	return out.String()
+}
+
+// markdownInline writes the code, links, emphasis and escapes in text as
+// HTML. Images are left out, as the files they show are not in the book,
+// and only their description kept.
+func markdownInline(text string) string {
+	var out strings.Builder
+	last := 0
+	for _, match := range markdownCode.FindAllStringSubmatchIndex(text, -1) {
+		out.WriteString(markdownSpan(text[last:match[0]]))
+		out.WriteString("<code>" + html.EscapeString(text[match[2]:match[3]]) + "</code>")
+		last = match[1]
+	}
+	out.WriteString(markdownSpan(text[last:]))
+
+	return out.String()
+}
+
+func markdownSpan(text string) string {
+	text = markdownEscapes.Replace(html.EscapeString(text))
+	text = markdownImage.ReplaceAllString(text, "$1")
+	text = markdownLink.ReplaceAllString(text, `<a href="$2">$1</a>`)
+	text = markdownStrong.ReplaceAllString(text, "<strong>$1$2</strong>")
+	text = markdownEm.ReplaceAllString(text, "<em>$1$2</em>")
+	return text
+}
@@ -0,0 +1,371 @@
+package book
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryRepository keeps books and history in memory, for demos, screenshots
+// and development without any storage to connect to. Like a
+// LocalRepository, book IDs are the URL safe encoding of the path of the
+// book. Everything is lost when the process exits.
+type MemoryRepository struct {
+	lock sync.RWMutex
+	// files maps the path of each book to it.
+	files   map[string]memoryFile
+	history map[string]memoryHistory
+	// revisions counts writes, so that each one gets a new revision.
+	revisions int
+}
+
+// memoryHistory is a history with the revision of the write that saved it,
+// so that writing the same data again still makes a new version.
+type memoryHistory struct {
+	data     string
+	revision string
+}
+
+type memoryFile struct {
+	data     []byte
+	revision string
+}
+
+func NewMemoryRepository() (repo *MemoryRepository) {
+	repo = new(MemoryRepository)
+	repo.files = map[string]memoryFile{}
+	repo.history = map[string]memoryHistory{}
+
+	return
+}
+
+// SeedDirectory copies the books in dir and its subfolders on disk to the
+// folder root.
+func (repo *MemoryRepository) SeedDirectory(dir string, root string) (err error) {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name := info.Name()
+		if info.IsDir() {
+			if p != dir && strings.HasPrefix(name, ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !info.Mode().IsRegular() || !isBookName(name) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		repo.put(path.Join(root, filepath.ToSlash(rel)), data)
+		return nil
+	})
+}
+
+// SeedSamples adds the sample books built into the binary to the folder
+// root.
+func (repo *MemoryRepository) SeedSamples(root string) (err error) {
+	for _, sample := range sampleBooks {
+		var data []byte
+		if data, err = sample.build(); err != nil {
+			return
+		}
+
+		repo.put(path.Join(root, sample.path), data)
+	}
+
+	return
+}
+
+func (repo *MemoryRepository) List(ctx context.Context, path string) (books []Book, err error) {
+	return repo.list(ctx, path, false)
+}
+
+func (repo *MemoryRepository) ListRecursive(ctx context.Context, path string) (books []Book, err error) {
+	return repo.list(ctx, path, true)
+}
+
+func (repo *MemoryRepository) list(
+	ctx context.Context, dir string, recursive bool,
+) (books []Book, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	dir = memoryPath(dir)
+
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	found := dir == "/"
+	for p, file := range repo.files {
+		rel, ok := relativePath(dir, p)
+		if !ok || rel == "" {
+			continue
+		}
+		found = true
+
+		sub := relativeDir(dir, p)
+		if sub != "" && !recursive {
+			continue
+		}
+
+		books = append(books, repo.book(p, file, sub))
+	}
+
+	// Folders only exist as long as they hold books.
+	if !found {
+		err = wrap(ErrNotFound, fmt.Errorf("%s does not exist", dir))
+		return
+	}
+
+	sort.Slice(books, func(i, j int) bool {
+		return strings.ToLower(books[i].Name) < strings.ToLower(books[j].Name)
+	})
+
+	return
+}
+
+func (repo *MemoryRepository) Download(ctx context.Context, ID string) (
+	book Book, data io.ReadCloser, err error,
+) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	var p string
+	if p, err = memoryPathFromID(ID); err != nil {
+		return
+	}
+
+	repo.lock.RLock()
+	file, ok := repo.files[p]
+	repo.lock.RUnlock()
+
+	if !ok {
+		err = wrap(ErrNotFound, fmt.Errorf("%s does not exist", p))
+		return
+	}
+
+	// Data is never changed in place, only replaced, so it can be shared.
+	book = repo.book(p, file, "")
+	data = ioutil.NopCloser(bytes.NewReader(file.data))
+	return
+}
+
+func (repo *MemoryRepository) Stat(ctx context.Context, ID string) (book Book, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	var p string
+	if p, err = memoryPathFromID(ID); err != nil {
+		return
+	}
+
+	repo.lock.RLock()
+	file, ok := repo.files[p]
+	repo.lock.RUnlock()
+
+	if !ok {
+		err = wrap(ErrNotFound, fmt.Errorf("%s does not exist", p))
+		return
+	}
+
+	return repo.book(p, file, ""), nil
+}
+
+func (repo *MemoryRepository) Upload(
+	ctx context.Context, dir string, name string, data io.Reader,
+) (book Book, err error) {
+	var content []byte
+	if content, err = ioutil.ReadAll(data); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return
+	}
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	dir = memoryPath(dir)
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	for attempt := 0; attempt < uploadAttempts; attempt++ {
+		p := path.Join(dir, uploadName(name, attempt))
+		if _, taken := repo.files[p]; taken {
+			continue
+		}
+
+		book = repo.book(p, repo.store(p, content), "")
+		return
+	}
+
+	err = wrap(ErrConflict, fmt.Errorf("no free name for %s in %s", name, dir))
+	return
+}
+
+func (repo *MemoryRepository) Move(
+	ctx context.Context, ID string, dir string, name string,
+) (book Book, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	var from string
+	if from, err = memoryPathFromID(ID); err != nil {
+		return
+	}
+	to := path.Join(memoryPath(dir), name)
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	file, ok := repo.files[from]
+	if !ok {
+		err = wrap(ErrNotFound, fmt.Errorf("%s does not exist", from))
+		return
+	}
+
+	if _, taken := repo.files[to]; taken {
+		err = wrap(ErrConflict, fmt.Errorf("%s already exists in %s", name, dir))
+		return
+	}
+
+	delete(repo.files, from)
+	repo.files[to] = file
+
+	book = repo.book(to, file, "")
+	return
+}
+
+func (repo *MemoryRepository) GetHistory(ctx context.Context, ID string) (history History, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	repo.lock.RLock()
+	saved, ok := repo.history[ID]
+	repo.lock.RUnlock()
+
+	if ok {
+		history.Data = saved.data
+		history.Version = saved.revision
+	}
+
+	return
+}
+
+func (repo *MemoryRepository) WriteHistory(
+	ctx context.Context, ID string, history History,
+) (updated History, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	current := repo.history[ID].revision
+
+	if current != history.Version {
+		err = wrap(ErrConflict, fmt.Errorf(
+			"history conflict for %s: expected version %q, found %q",
+			ID, history.Version, current,
+		))
+		return
+	}
+
+	repo.revisions++
+	saved := memoryHistory{data: history.Data, revision: fmt.Sprintf("%x", repo.revisions)}
+	repo.history[ID] = saved
+
+	updated.Data = saved.data
+	updated.Version = saved.revision
+	return
+}
+
+func (repo *MemoryRepository) ListHistory(ctx context.Context) (IDs []string, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	for ID := range repo.history {
+		IDs = append(IDs, ID)
+	}
+	sort.Strings(IDs)
+
+	return
+}
+
+func (repo *MemoryRepository) put(p string, data []byte) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	repo.store(memoryPath(p), data)
+}
+
+// store saves data at p with a new revision. The caller holds the lock.
+func (repo *MemoryRepository) store(p string, data []byte) (file memoryFile) {
+	repo.revisions++
+	file = memoryFile{data: data, revision: fmt.Sprintf("%x-%x", repo.revisions, len(data))}
+	repo.files[p] = file
+
+	return
+}
+
+func (repo *MemoryRepository) book(p string, file memoryFile, dir string) Book {
+	name := path.Base(p)
+	return Book{
+		ID:       base64.RawURLEncoding.EncodeToString([]byte(strings.TrimPrefix(p, "/"))),
+		Name:     name,
+		IsPDF:    strings.Contains(name, ".pdf"),
+		IsComic:  isComicName(name),
+		IsAudio:  isAudioName(name),
+		Revision: file.revision,
+		Dir:      dir,
+	}
+}
+
+// memoryPath cleans p into an absolute path separated by slashes.
+func memoryPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func memoryPathFromID(ID string) (p string, err error) {
+	var rel []byte
+	if rel, err = base64.RawURLEncoding.DecodeString(ID); err != nil {
+		err = wrap(ErrNotFound, fmt.Errorf("invalid book id %s: %v", ID, err))
+		return
+	}
+
+	return memoryPath(string(rel)), nil
+}
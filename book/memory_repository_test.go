@@ -0,0 +1,38 @@
+package book
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMemoryHistoryStaleWriterConflicts(t *testing.T) {
+	repo := NewMemoryRepository()
+	ctx := context.Background()
+
+	first, err := repo.WriteHistory(ctx, "book", History{Data: "page 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second reader holds first while the history moves on and back.
+	second, err := repo.WriteHistory(ctx, "book", History{Data: "page 2", Version: first.Version})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = repo.WriteHistory(ctx, "book", History{Data: "page 1", Version: second.Version}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = repo.WriteHistory(ctx, "book", History{Data: "page 9", Version: first.Version}); !errors.Is(err, ErrConflict) {
+		t.Errorf("write based on an outdated version with the same content: err = %v, want ErrConflict", err)
+	}
+
+	current, err := repo.GetHistory(ctx, "book")
+	if err != nil || current.Data != "page 1" {
+		t.Fatalf("GetHistory = %v, %v", current, err)
+	}
+	if _, err = repo.WriteHistory(ctx, "book", History{Data: "page 3", Version: current.Version}); err != nil {
+		t.Errorf("write based on the current version: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package book
+
+import (
+	"context"
+	"fmt"
+)
+
+// MigrateHistory copies every history entry of from into to. Entries that
+// already exist in to are left alone, so a migration can be rerun safely.
+func MigrateHistory(
+	ctx context.Context,
+	from interface {
+		HistoryStore
+		HistoryLister
+	},
+	to HistoryStore,
+) (imported int, skipped int, err error) {
+	var IDs []string
+	if IDs, err = from.ListHistory(ctx); err != nil {
+		return
+	}
+
+	for _, ID := range IDs {
+		var history History
+		if history, err = from.GetHistory(ctx, ID); err != nil {
+			err = fmt.Errorf("reading history of %s: %w", ID, err)
+			return
+		}
+
+		if history.Data == "" {
+			skipped++
+			continue
+		}
+
+		var existing History
+		if existing, err = to.GetHistory(ctx, ID); err != nil {
+			err = fmt.Errorf("reading history of %s: %w", ID, err)
+			return
+		}
+
+		if existing.Version != "" {
+			skipped++
+			continue
+		}
+
+		if _, err = to.WriteHistory(ctx, ID, History{Data: history.Data}); err != nil {
+			err = fmt.Errorf("writing history of %s: %w", ID, err)
+			return
+		}
+
+		imported++
+	}
+
+	return
+}
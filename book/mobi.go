@@ -0,0 +1,592 @@
+package book
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Compression and encryption schemes of the text of MOBI books.
+const (
+	mobiNoCompression      = 1
+	mobiPalmDOCCompression = 2
+	mobiHuffCompression    = 17480
+)
+
+// EXTH record types read from MOBI books.
+const (
+	exthAuthor      = 100
+	exthDescription = 103
+	exthSubject     = 105
+	exthCoverOffset = 201
+	exthTitle       = 503
+	exthLanguage    = 524
+)
+
+// mobiMagic is the type and creator of a MOBI book in its Palm database
+// header.
+var mobiMagic = []byte("BOOKMOBI")
+
+// mobiEndOfImages are the records that follow the images of a MOBI book.
+var mobiEndOfImages = [][]byte{
+	[]byte("FLIS"), []byte("FCIS"), []byte("SRCS"), []byte("BOUN"),
+	[]byte("FDST"), []byte("DATP"), []byte("\xe9\x8e\r\n"),
+}
+
+var (
+	mobiPageBreak = regexp.MustCompile(`(?i)<mbp:pagebreak[^>]*>`)
+	mobiFilepos   = regexp.MustCompile(`(?i)\bfilepos\s*=\s*["']?0*(\d+)["']?`)
+	mobiRecindex  = regexp.MustCompile(`(?i)\brecindex\s*=\s*["']?0*(\d+)["']?`)
+	kf8FileStart  = regexp.MustCompile(`(?i)<html[\s>]`)
+	kf8Embed      = regexp.MustCompile(`kindle:embed:([0-9A-Va-v]+)(\?mime=[\w/+.-]+)?`)
+	htmlHeading   = regexp.MustCompile(`(?is)<h([1-3])[^>]*>(.*?)</h[1-3]>`)
+	htmlTag       = regexp.MustCompile(`(?s)<[^>]*>`)
+	htmlAnchor    = regexp.MustCompile(`(?i)\s(?:id|name)\s*=\s*["']?([^"'\s>]+)`)
+)
+
+// mobiBook is a MOBI book read into its records.
+type mobiBook struct {
+	records [][]byte
+}
+
+// sniffMOBI reports whether head is the start of a MOBI or AZW3 book.
+func sniffMOBI(head []byte) bool {
+	return len(head) >= 68 && bytes.Equal(head[60:68], mobiMagic)
+}
+
+// convertMOBI converts an unencrypted MOBI or AZW3 book to EPUB. MOBI books
+// are HTML split into pages, with links and images referring to positions in
+// the text and to records. AZW3 books are XHTML files and style sheets
+// stored as one text, and are split back into the files. Books holding both
+// formats are read in the older one, which is simpler and more faithful.
+func convertMOBI(r io.ReaderAt, size int64) (book epubBook, err error) {
+	var mobi mobiBook
+	if mobi, err = readPalmDatabase(r, size); err != nil {
+		return
+	}
+
+	header := mobi.records[0]
+	if len(header) < 132 || string(header[16:20]) != "MOBI" {
+		err = wrap(ErrInvalid, fmt.Errorf("not a MOBI book"))
+		return
+	}
+	exth := mobiEXTH(header)
+
+	if encryption := binary.BigEndian.Uint16(header[12:]); encryption != 0 {
+		err = wrap(ErrInvalid, fmt.Errorf("the book is protected with DRM"))
+		return
+	}
+
+	book.Title = mobiTitle(header, exth)
+	book.Authors = exth[exthAuthor]
+	book.Tags = exth[exthSubject]
+	if len(exth[exthDescription]) > 0 {
+		book.Description = htmlText(exth[exthDescription][0])
+	}
+	if len(exth[exthLanguage]) > 0 {
+		book.Language = exth[exthLanguage][0]
+	}
+
+	if binary.BigEndian.Uint32(header[36:]) == 8 {
+		return mobi.convertKF8(book, header, exth)
+	}
+	return mobi.convertMOBI6(book, header, exth)
+}
+
+// readPalmDatabase reads the records of the Palm database in r.
+func readPalmDatabase(r io.ReaderAt, size int64) (mobi mobiBook, err error) {
+	head := make([]byte, 78)
+	if _, err = r.ReadAt(head, 0); err != nil || !sniffMOBI(head) {
+		err = wrap(ErrInvalid, fmt.Errorf("not a MOBI book"))
+		return
+	}
+
+	count := int(binary.BigEndian.Uint16(head[76:]))
+	list := make([]byte, 8*count)
+	if _, err = r.ReadAt(list, 78); err != nil {
+		err = wrap(ErrInvalid, fmt.Errorf("reading the record list: %v", err))
+		return
+	}
+
+	offsets := make([]int64, count+1)
+	for i := 0; i < count; i++ {
+		offsets[i] = int64(binary.BigEndian.Uint32(list[8*i:]))
+	}
+	offsets[count] = size
+
+	data := make([]byte, size)
+	if _, err = r.ReadAt(data, 0); err != nil && err != io.EOF {
+		return
+	}
+	err = nil
+
+	for i := 0; i < count; i++ {
+		start, end := offsets[i], offsets[i+1]
+		if start > end || end > size {
+			err = wrap(ErrInvalid, fmt.Errorf("record %d is out of bounds", i))
+			return
+		}
+		mobi.records = append(mobi.records, data[start:end])
+	}
+
+	if len(mobi.records) == 0 {
+		err = wrap(ErrInvalid, fmt.Errorf("the book has no records"))
+	}
+
+	return
+}
+
+// mobiEXTH reads the EXTH header following the MOBI header in the first
+// record, if there is one, as the values of each type of record.
+func mobiEXTH(header []byte) (exth map[int][]string) {
+	exth = map[int][]string{}
+
+	if binary.BigEndian.Uint32(header[128:])&0x40 == 0 {
+		return
+	}
+
+	start := 16 + int(binary.BigEndian.Uint32(header[20:]))
+	if start+12 > len(header) || string(header[start:start+4]) != "EXTH" {
+		return
+	}
+
+	count := int(binary.BigEndian.Uint32(header[start+8:]))
+	offset := start + 12
+	for i := 0; i < count && offset+8 <= len(header); i++ {
+		kind := int(binary.BigEndian.Uint32(header[offset:]))
+		length := int(binary.BigEndian.Uint32(header[offset+4:]))
+		if length < 8 || offset+length > len(header) {
+			break
+		}
+
+		value := header[offset+8 : offset+length]
+		switch kind {
+		case exthCoverOffset:
+			if len(value) == 4 {
+				exth[kind] = append(exth[kind], strconv.Itoa(int(binary.BigEndian.Uint32(value))))
+			}
+		default:
+			exth[kind] = append(exth[kind], strings.TrimSpace(mobiString(header, value)))
+		}
+
+		offset += length
+	}
+
+	return
+}
+
+// mobiTitle returns the updated title from the EXTH header, or else the
+// full name from the MOBI header.
+func mobiTitle(header []byte, exth map[int][]string) string {
+	if len(exth[exthTitle]) > 0 && exth[exthTitle][0] != "" {
+		return exth[exthTitle][0]
+	}
+
+	offset := int(binary.BigEndian.Uint32(header[84:]))
+	length := int(binary.BigEndian.Uint32(header[88:]))
+	if offset+length > len(header) {
+		return ""
+	}
+
+	return strings.TrimSpace(mobiString(header, header[offset:offset+length]))
+}
+
+// mobiString decodes text in the encoding of the book the header is of.
+func mobiString(header []byte, text []byte) string {
+	if binary.BigEndian.Uint32(header[28:]) == 65001 {
+		return strings.ToValidUTF8(string(text), "�")
+	}
+
+	return decodeWindows1252(text)
+}
+
+// text returns the decompressed text of the book, of which header is the
+// first record.
+func (mobi mobiBook) text(header []byte) (text []byte, err error) {
+	compression := binary.BigEndian.Uint16(header[0:])
+	length := int(binary.BigEndian.Uint32(header[4:]))
+	count := int(binary.BigEndian.Uint16(header[8:]))
+
+	var extraFlags uint16
+	if headerLength := binary.BigEndian.Uint32(header[20:]); headerLength >= 0xe4 && len(header) >= 0xf4 {
+		extraFlags = binary.BigEndian.Uint16(header[0xf2:])
+	}
+
+	switch compression {
+	case mobiNoCompression, mobiPalmDOCCompression:
+	case mobiHuffCompression:
+		err = wrap(ErrInvalid, fmt.Errorf("books compressed with HUFF/CDIC are not supported"))
+		return
+	default:
+		err = wrap(ErrInvalid, fmt.Errorf("unknown compression %d", compression))
+		return
+	}
+
+	for i := 1; i <= count; i++ {
+		if i >= len(mobi.records) {
+			err = wrap(ErrInvalid, fmt.Errorf("text record %d is missing", i))
+			return
+		}
+
+		record := mobi.records[i]
+		record = record[:len(record)-trailingEntriesSize(record, extraFlags)]
+
+		if compression == mobiPalmDOCCompression {
+			text = palmDOCDecompress(text, record)
+		} else {
+			text = append(text, record...)
+		}
+	}
+
+	if length < len(text) {
+		text = text[:length]
+	}
+
+	return
+}
+
+// trailingEntriesSize returns the size of the entries appended to a text
+// record, which are not part of the text, as flags says there are.
+func trailingEntriesSize(record []byte, flags uint16) (size int) {
+	for bit := flags >> 1; bit != 0; bit >>= 1 {
+		if bit&1 == 0 {
+			continue
+		}
+
+		// The size of each entry is written backwards at its end, seven bits
+		// to a byte, with the high bit marking the first byte.
+		end := len(record) - size
+		value := 0
+		for i := end - 4; i < end; i++ {
+			if i < 0 {
+				continue
+			}
+			if record[i]&0x80 != 0 {
+				value = 0
+			}
+			value = value<<7 | int(record[i]&0x7f)
+		}
+
+		size += value
+		if size > len(record) {
+			return len(record)
+		}
+	}
+
+	if flags&1 != 0 && size < len(record) {
+		// The bytes of a character cut off by the end of the record.
+		size += int(record[len(record)-size-1]&0x3) + 1
+	}
+
+	if size > len(record) {
+		return len(record)
+	}
+
+	return
+}
+
+// palmDOCDecompress appends the decompressed data to text. PalmDOC
+// compression is LZ77 with a window of 2047 bytes, and with spaces folded
+// into the character following them.
+func palmDOCDecompress(text []byte, data []byte) []byte {
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == 0 || (c >= 0x09 && c <= 0x7f):
+			text = append(text, c)
+		case c >= 0x01 && c <= 0x08:
+			end := i + 1 + int(c)
+			if end > len(data) {
+				end = len(data)
+			}
+			text = append(text, data[i+1:end]...)
+			i = end - 1
+		case c >= 0xc0:
+			text = append(text, ' ', c^0x80)
+		default:
+			if i+1 >= len(data) {
+				return text
+			}
+			i++
+			pair := int(c)<<8 | int(data[i])
+			distance := (pair >> 3) & 0x7ff
+			length := pair&0x7 + 3
+			if distance == 0 || distance > len(text) {
+				continue
+			}
+
+			// The copy may overlap what it appends, so byte by byte.
+			start := len(text) - distance
+			for j := 0; j < length; j++ {
+				text = append(text, text[start+j])
+			}
+		}
+	}
+
+	return text
+}
+
+// images returns the image records of the book as resources, by their
+// index from the first image, and sets the cover of book from the EXTH
+// header.
+func (mobi mobiBook) images(book *epubBook, header []byte, exth map[int][]string) (images map[int]string) {
+	images = map[int]string{}
+
+	first := int(binary.BigEndian.Uint32(header[108:]))
+	if first <= 0 || first == 0xffffffff {
+		return
+	}
+
+	cover := -1
+	if len(exth[exthCoverOffset]) > 0 {
+		cover, _ = strconv.Atoi(exth[exthCoverOffset][0])
+	}
+
+	for i := first; i < len(mobi.records); i++ {
+		record := mobi.records[i]
+
+		end := false
+		for _, marker := range mobiEndOfImages {
+			end = end || bytes.HasPrefix(record, marker)
+		}
+		if end {
+			break
+		}
+
+		ext, mediaType := imageType(record)
+		if ext == "" {
+			continue
+		}
+
+		index := i - first
+		name := fmt.Sprintf("images/image%05d%s", index+1, ext)
+		images[index] = name
+		book.Resources = append(book.Resources, epubResource{Name: name, MediaType: mediaType, Data: record})
+
+		if index == cover {
+			book.Cover = name
+		}
+	}
+
+	return
+}
+
+// imageType returns the extension and media type of the image in data.
+func imageType(data []byte) (ext string, mediaType string) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return ".jpg", "image/jpeg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return ".png", "image/png"
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return ".gif", "image/gif"
+	case bytes.HasPrefix(data, []byte("BM")) && len(data) > 14:
+		return ".bmp", "image/bmp"
+	case bytes.HasPrefix(data, []byte("RIFF")) && len(data) > 12 && string(data[8:12]) == "WEBP":
+		return ".webp", "image/webp"
+	}
+
+	return "", ""
+}
+
+// convertMOBI6 converts a book in the original MOBI format: HTML with page
+// breaks between chapters, links to positions in the text given by filepos
+// attributes, and images referred to by their index.
+func (mobi mobiBook) convertMOBI6(book epubBook, header []byte, exth map[int][]string) (epubBook, error) {
+	text, err := mobi.text(header)
+	if err != nil {
+		return book, err
+	}
+
+	images := mobi.images(&book, header, exth)
+
+	// Mark the positions links point to before the text is split up, and
+	// move each into the tag it falls in.
+	positions := map[int]bool{}
+	for _, match := range mobiFilepos.FindAllSubmatch(text, -1) {
+		if position, err := strconv.Atoi(string(match[1])); err == nil && position <= len(text) {
+			positions[position] = true
+		}
+	}
+
+	var marked bytes.Buffer
+	for i := 0; i <= len(text); i++ {
+		if positions[i] {
+			at := i
+			if open := bytes.LastIndexByte(text[:i], '<'); open > bytes.LastIndexByte(text[:i], '>') {
+				at = open
+			}
+			anchor := fmt.Sprintf(`<a id="filepos%d"></a>`, i)
+			marked.Truncate(marked.Len() - (i - at))
+			marked.WriteString(anchor)
+			marked.Write(text[at:i])
+		}
+		if i < len(text) {
+			marked.WriteByte(text[i])
+		}
+	}
+
+	markup := mobiString(header, marked.Bytes())
+	markup = mobiFilepos.ReplaceAllStringFunc(markup, func(attr string) string {
+		return `href="#filepos` + mobiFilepos.FindStringSubmatch(attr)[1] + `"`
+	})
+	markup = mobiRecindex.ReplaceAllStringFunc(markup, func(attr string) string {
+		index, _ := strconv.Atoi(mobiRecindex.FindStringSubmatch(attr)[1])
+		return `src="` + images[index-1] + `"`
+	})
+
+	var parts []string
+	for _, part := range mobiPageBreak.Split(markup, -1) {
+		if strings.TrimSpace(htmlText(part)) != "" || strings.Contains(strings.ToLower(part), "<img") {
+			parts = append(parts, part)
+		}
+	}
+
+	book.Chapters = chaptersFromHTML(parts, nil)
+	return book, nil
+}
+
+// convertKF8 converts a book in the KF8 format of AZW3: XHTML files, style
+// sheets and images referred to with kindle: links.
+func (mobi mobiBook) convertKF8(book epubBook, header []byte, exth map[int][]string) (epubBook, error) {
+	text, err := mobi.text(header)
+	if err != nil {
+		return book, err
+	}
+
+	images := mobi.images(&book, header, exth)
+	embed := func(ref string) string {
+		match := kf8Embed.FindStringSubmatch(ref)
+		if match == nil {
+			return ""
+		}
+		index, err := strconv.ParseInt(match[1], 32, 64)
+		if err != nil {
+			return ""
+		}
+		return images[int(index)-1]
+	}
+
+	markup := mobiString(header, text)
+
+	// The text after the first flow holds the style sheets and other files
+	// the XHTML refers to, as the FDST record says.
+	flows := []string{markup}
+	if len(header) >= 0xc4 {
+		if fdst := int(binary.BigEndian.Uint32(header[0xc0:])); fdst > 0 && fdst < len(mobi.records) {
+			flows = kf8Flows(mobi.records[fdst], markup)
+		}
+	}
+
+	for i := 1; i < len(flows); i++ {
+		flow := strings.TrimSpace(flows[i])
+		if strings.HasPrefix(flow, "<") {
+			// SVG images, which are left out.
+			continue
+		}
+
+		name := fmt.Sprintf("styles/flow%04d.css", i)
+		css := kf8Embed.ReplaceAllStringFunc(flow, func(ref string) string {
+			if image := embed(ref); image != "" {
+				return "../" + image
+			}
+			return ""
+		})
+		book.Resources = append(book.Resources, epubResource{Name: name, MediaType: "text/css", Data: []byte(css)})
+		book.Styles = append(book.Styles, name)
+	}
+
+	// Each file starts with its html element.
+	var parts []string
+	starts := kf8FileStart.FindAllStringIndex(flows[0], -1)
+	for i, start := range starts {
+		end := len(flows[0])
+		if i+1 < len(starts) {
+			end = starts[i+1][0]
+		}
+		parts = append(parts, flows[0][start[0]:end])
+	}
+	if len(parts) == 0 {
+		parts = []string{flows[0]}
+	}
+
+	book.Chapters = chaptersFromHTML(parts, func(src string) string {
+		if strings.HasPrefix(src, "kindle:embed:") {
+			return embed(src)
+		}
+		return src
+	})
+	return book, nil
+}
+
+// kf8Flows splits text into the flows the FDST record lists.
+func kf8Flows(fdst []byte, text string) (flows []string) {
+	if len(fdst) < 12 || string(fdst[:4]) != "FDST" {
+		return []string{text}
+	}
+
+	offset := int(binary.BigEndian.Uint32(fdst[4:]))
+	count := int(binary.BigEndian.Uint32(fdst[8:]))
+	for i := 0; i < count && offset+8*i+8 <= len(fdst); i++ {
+		start := int(binary.BigEndian.Uint32(fdst[offset+8*i:]))
+		end := int(binary.BigEndian.Uint32(fdst[offset+8*i+4:]))
+		if start > end || end > len(text) {
+			break
+		}
+		flows = append(flows, text[start:end])
+	}
+
+	if len(flows) == 0 {
+		return []string{text}
+	}
+
+	return
+}
+
+// chaptersFromHTML turns each part of the HTML of a book into a chapter,
+// titled after its first heading, with links to anchors in other chapters
+// pointed to them.
+func chaptersFromHTML(parts []string, src func(string) string) (chapters []epubChapter) {
+	anchors := map[string]int{}
+	for i, part := range parts {
+		for _, match := range htmlAnchor.FindAllStringSubmatch(part, -1) {
+			if _, ok := anchors[match[1]]; !ok {
+				anchors[match[1]] = i
+			}
+		}
+	}
+
+	link := func(href string) string {
+		if strings.HasPrefix(href, "#") {
+			if chapter, ok := anchors[href[1:]]; ok {
+				return epubChapterName(chapter) + href
+			}
+			return ""
+		}
+		if strings.HasPrefix(href, "kindle:") || !safeLink(href) {
+			return ""
+		}
+		return href
+	}
+
+	for _, part := range parts {
+		chapter := epubChapter{Body: cleanHTML(part, link, src)}
+		if match := htmlHeading.FindStringSubmatch(part); match != nil {
+			chapter.Title = htmlText(match[2])
+		}
+		chapters = append(chapters, chapter)
+	}
+
+	return
+}
+
+// htmlText returns the text of markup, with tags dropped and white space
+// collapsed.
+func htmlText(markup string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(htmlTag.ReplaceAllString(markup, " "))), " ")
+}
@@ -0,0 +1,55 @@
+package book
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// MoveBook moves a book like Repository.Move and carries its history over
+// when the move changes its ID. If keepBoth is set, a name that is taken is
+// replaced by the next free one instead of failing with ErrConflict.
+func MoveBook(
+	ctx context.Context, repo Repository, history HistoryStore,
+	ID string, dir string, name string, keepBoth bool,
+) (book Book, err error) {
+	if name == "" || name != path.Base(name) || strings.HasPrefix(name, ".") {
+		err = wrap(ErrInvalid, fmt.Errorf("invalid file name %q", name))
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		book, err = repo.Move(ctx, ID, dir, uploadName(name, attempt))
+		if err == nil || !keepBoth || !errors.Is(err, ErrConflict) || attempt+1 == uploadAttempts {
+			break
+		}
+	}
+	if err != nil || book.ID == ID {
+		return
+	}
+
+	if err = moveHistory(ctx, history, ID, book.ID); err != nil {
+		err = fmt.Errorf("moved %s to %s but not its history: %w", ID, book.ID, err)
+	}
+
+	return
+}
+
+// moveHistory copies the history of from to to, replacing any history to
+// already has.
+func moveHistory(ctx context.Context, history HistoryStore, from string, to string) (err error) {
+	var old History
+	if old, err = history.GetHistory(ctx, from); err != nil || old.Data == "" {
+		return
+	}
+
+	var current History
+	if current, err = history.GetHistory(ctx, to); err != nil {
+		return
+	}
+
+	_, err = history.WriteHistory(ctx, to, History{Data: old.Data, Version: current.Version})
+	return
+}
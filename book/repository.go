@@ -1,12 +1,98 @@
 package book
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
 )
 
+// Repository is a library of books. Implementations return the errors in
+// errors.go where they apply and give up once ctx is done.
 type Repository interface {
-	List(path string) (books []Book, err error)
-	Download(path string) (book Book, data io.ReadCloser, err error)
-	GetHistory(ID string) (history History, err error)
-	WriteHistory(ID string, history History) (updated History, err error)
+	List(ctx context.Context, path string) (books []Book, err error)
+	Download(ctx context.Context, path string) (book Book, data io.ReadCloser, err error)
+	// Upload adds a book called name to the folder dir, picking another name
+	// if it is taken.
+	Upload(ctx context.Context, dir string, name string, data io.Reader) (book Book, err error)
+	// Move renames the book with the given ID to name and moves it to the
+	// folder dir, failing with ErrConflict if that name is taken.
+	Move(ctx context.Context, ID string, dir string, name string) (book Book, err error)
+}
+
+// HistoryStore keeps the reading position of each book. Writes must fail
+// with ErrConflict if the version of the given history is not the latest
+// one, so that two devices never silently overwrite each other. Getting the
+// history of a book that has none returns an empty history, not an error.
+type HistoryStore interface {
+	GetHistory(ctx context.Context, ID string) (history History, err error)
+	WriteHistory(ctx context.Context, ID string, history History) (updated History, err error)
+}
+
+// HistoryLister is implemented by history stores that can enumerate the
+// books they have a history for.
+type HistoryLister interface {
+	ListHistory(ctx context.Context) (IDs []string, err error)
+}
+
+// CoverRepository is implemented by repositories that can serve a cover
+// image for the books that have one.
+type CoverRepository interface {
+	Cover(ctx context.Context, ID string) (data io.ReadCloser, err error)
+}
+
+// StatRepository is implemented by repositories that can describe a book,
+// including its current revision, without downloading it.
+type StatRepository interface {
+	Stat(ctx context.Context, ID string) (book Book, err error)
+}
+
+// errNoStat is returned by Stat for repositories that can not describe a
+// book without downloading it.
+var errNoStat = errors.New("books can not be described without downloading them")
+
+// Stat describes the book with the given ID if repo supports it, and fails
+// with errNoStat otherwise.
+func Stat(ctx context.Context, repo Repository, ID string) (book Book, err error) {
+	if stat, ok := repo.(StatRepository); ok {
+		return stat.Stat(ctx, ID)
+	}
+
+	err = errNoStat
+	return
+}
+
+// RecursiveRepository is implemented by repositories that can list a folder
+// together with all of its subfolders, setting Dir on every book.
+type RecursiveRepository interface {
+	ListRecursive(ctx context.Context, path string) (books []Book, err error)
+}
+
+// WatchRepository is implemented by repositories that can report what
+// changed below a folder since an earlier listing of it.
+type WatchRepository interface {
+	// Watch lists path and its subfolders if cursor is empty, and otherwise
+	// waits a while for changes since the listing that returned cursor. It
+	// returns ErrCursorReset if cursor can not be used anymore.
+	Watch(ctx context.Context, path string, cursor string) (changes []Change, next string, err error)
+}
+
+// Change is a book that was added, modified or deleted.
+type Change struct {
+	// Path identifies the changed entry. Deleting a folder deletes every
+	// entry below its path.
+	Path string
+	// Book is nil if the entry was deleted.
+	Book *Book
+}
+
+// checkHistoryID reports an ID that can not name a file of its own in a
+// history folder, as it would reach outside of it.
+func checkHistoryID(ID string) error {
+	if ID == "" || strings.Contains(ID, "/") || ID == "." || ID == ".." {
+		return wrap(ErrNotFound, fmt.Errorf("invalid book id %s", ID))
+	}
+
+	return nil
 }
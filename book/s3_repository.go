@@ -0,0 +1,602 @@
+package book
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Repository serves books and history from a bucket on any S3 compatible
+// object store (AWS S3, MinIO, ...). Objects are addressed path style, so the
+// endpoint is used as is and the bucket becomes the first path segment.
+type S3Repository struct {
+	client        *http.Client
+	endpoint      *url.URL
+	region        string
+	bucket        string
+	accessKey     string
+	secretKey     string
+	historyPrefix string
+}
+
+func NewS3Repository(
+	endpoint string, region string, bucket string,
+	accessKey string, secretKey string, historyPrefix string,
+) (repo *S3Repository, err error) {
+	repo = new(S3Repository)
+	repo.client = http.DefaultClient
+
+	if repo.endpoint, err = url.Parse(endpoint); err != nil {
+		return
+	}
+
+	if repo.endpoint.Scheme == "" || repo.endpoint.Host == "" {
+		err = fmt.Errorf("invalid s3 endpoint %s", endpoint)
+		return
+	}
+
+	repo.region = region
+	if repo.region == "" {
+		repo.region = "us-east-1"
+	}
+
+	repo.bucket = bucket
+	repo.accessKey = accessKey
+	repo.secretKey = secretKey
+
+	repo.historyPrefix = historyPrefix
+	if repo.historyPrefix == "" {
+		repo.historyPrefix = "/history"
+	}
+
+	return
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		ETag string `xml:"ETag"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (repo *S3Repository) List(ctx context.Context, path string) (books []Book, err error) {
+	return repo.list(ctx, path, false)
+}
+
+// ListRecursive lists every key below path, as S3 folders are nothing more
+// than a shared key prefix.
+func (repo *S3Repository) ListRecursive(ctx context.Context, path string) (books []Book, err error) {
+	return repo.list(ctx, path, true)
+}
+
+func (repo *S3Repository) list(ctx context.Context, path string, recursive bool) (books []Book, err error) {
+	prefix := s3Key(path)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+	if !recursive {
+		query.Set("delimiter", "/")
+	}
+
+	for {
+		var res *http.Response
+		if res, err = repo.do(ctx, http.MethodGet, "", query, nil, nil); err != nil {
+			return
+		}
+
+		var result s3ListBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			err = transportError(ctx, err)
+			return
+		}
+
+		for _, item := range result.Contents {
+			name := item.Key[strings.LastIndex(item.Key, "/")+1:]
+			if isBookName(name) {
+				books = append(books, Book{
+					ID:       base64.RawURLEncoding.EncodeToString([]byte(item.Key)),
+					Name:     name,
+					IsPDF:    strings.Contains(name, ".pdf"),
+					IsComic:  isComicName(name),
+					IsAudio:  isAudioName(name),
+					Revision: item.ETag,
+					Dir:      relativeDir(prefix, item.Key),
+				})
+			}
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+
+	return
+}
+
+func (repo *S3Repository) Download(ctx context.Context, ID string) (
+	book Book, data io.ReadCloser, err error,
+) {
+	var key []byte
+	if key, err = base64.RawURLEncoding.DecodeString(ID); err != nil {
+		err = wrap(ErrNotFound, fmt.Errorf("invalid book id %s: %v", ID, err))
+		return
+	}
+
+	var res *http.Response
+	if res, err = repo.do(ctx, http.MethodGet, string(key), nil, nil, nil); err != nil {
+		return
+	}
+
+	book = s3Book(ID, string(key), res.Header.Get("ETag"))
+	data = res.Body
+
+	return
+}
+
+// Stat asks for the ETag of the book with a HEAD request.
+func (repo *S3Repository) Stat(ctx context.Context, ID string) (book Book, err error) {
+	var key []byte
+	if key, err = base64.RawURLEncoding.DecodeString(ID); err != nil {
+		err = wrap(ErrNotFound, fmt.Errorf("invalid book id %s: %v", ID, err))
+		return
+	}
+
+	var res *http.Response
+	if res, err = repo.do(ctx, http.MethodHead, string(key), nil, nil, nil); err != nil {
+		return
+	}
+	res.Body.Close()
+
+	return s3Book(ID, string(key), res.Header.Get("ETag")), nil
+}
+
+func s3Book(ID string, key string, etag string) Book {
+	name := path.Base(key)
+	return Book{
+		ID:       ID,
+		Name:     name,
+		IsPDF:    strings.Contains(name, ".pdf"),
+		IsComic:  isComicName(name),
+		IsAudio:  isAudioName(name),
+		Revision: etag,
+	}
+}
+
+// Upload looks for the first free key and puts the book there. Books larger
+// than a chunk are sent as a multipart upload, one part per chunk. Both are
+// conditional on the key not existing, so nothing is overwritten.
+func (repo *S3Repository) Upload(
+	ctx context.Context, dir string, name string, data io.Reader,
+) (book Book, err error) {
+	var (
+		key string
+		res *http.Response
+	)
+	for attempt := 0; attempt < uploadAttempts && key == ""; attempt++ {
+		candidate := s3Key(dir + "/" + uploadName(name, attempt))
+		if res, err = repo.do(ctx, http.MethodHead, candidate, nil, nil, nil); err == nil {
+			res.Body.Close()
+			continue
+		} else if !errors.Is(err, ErrNotFound) {
+			return
+		}
+
+		key = candidate
+	}
+
+	if key == "" {
+		err = wrap(ErrConflict, fmt.Errorf("no free name for %s in %s", name, dir))
+		return
+	}
+
+	header := http.Header{}
+	header.Set("If-None-Match", "*")
+
+	buf := make([]byte, uploadChunkSize)
+	n, last, err := readChunk(data, buf)
+	if err != nil {
+		err = transportError(ctx, err)
+		return
+	}
+
+	if last {
+		if res, err = repo.do(ctx, http.MethodPut, key, nil, header, buf[:n]); err != nil {
+			return
+		}
+	} else if res, err = repo.multipartUpload(ctx, key, header, data, buf, n); err != nil {
+		return
+	}
+	res.Body.Close()
+
+	if res, err = repo.do(ctx, http.MethodHead, key, nil, nil, nil); err != nil {
+		return
+	}
+	res.Body.Close()
+
+	name = path.Base(key)
+	book = Book{
+		ID:       base64.RawURLEncoding.EncodeToString([]byte(key)),
+		Name:     name,
+		IsPDF:    strings.Contains(name, ".pdf"),
+		IsComic:  isComicName(name),
+		IsAudio:  isAudioName(name),
+		Revision: res.Header.Get("ETag"),
+	}
+
+	return
+}
+
+// multipartUpload sends the first n bytes of buf, and the rest of data, as
+// the parts of a multipart upload to key. The upload is aborted if anything
+// goes wrong, so that no parts are left behind.
+func (repo *S3Repository) multipartUpload(
+	ctx context.Context, key string, header http.Header, data io.Reader, buf []byte, n int,
+) (res *http.Response, err error) {
+	if res, err = repo.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil); err != nil {
+		return
+	}
+
+	var initiated s3InitiateMultipartUploadResult
+	err = xml.NewDecoder(res.Body).Decode(&initiated)
+	res.Body.Close()
+	if err != nil {
+		err = transportError(ctx, err)
+		return
+	}
+
+	uploadID := url.Values{"uploadId": {initiated.UploadID}}
+	defer func() {
+		if err != nil {
+			if res, abortErr := repo.do(
+				context.Background(), http.MethodDelete, key, uploadID, nil, nil,
+			); abortErr == nil {
+				res.Body.Close()
+			}
+		}
+	}()
+
+	var complete s3CompleteMultipartUpload
+	for last := false; n > 0 || !last; {
+		if n > 0 {
+			query := url.Values{
+				"partNumber": {strconv.Itoa(len(complete.Parts) + 1)},
+				"uploadId":   {initiated.UploadID},
+			}
+			if res, err = repo.do(ctx, http.MethodPut, key, query, nil, buf[:n]); err != nil {
+				return
+			}
+			res.Body.Close()
+
+			complete.Parts = append(complete.Parts, s3Part{
+				PartNumber: len(complete.Parts) + 1,
+				ETag:       res.Header.Get("ETag"),
+			})
+		}
+
+		if last {
+			break
+		}
+
+		if n, last, err = readChunk(data, buf); err != nil {
+			err = transportError(ctx, err)
+			return
+		}
+	}
+
+	var body []byte
+	if body, err = xml.Marshal(complete); err != nil {
+		return
+	}
+
+	return repo.do(ctx, http.MethodPost, key, uploadID, header, body)
+}
+
+// Move copies the object to its new key and deletes the old one, as S3 has
+// no rename.
+func (repo *S3Repository) Move(
+	ctx context.Context, ID string, dir string, name string,
+) (book Book, err error) {
+	var from []byte
+	if from, err = base64.RawURLEncoding.DecodeString(ID); err != nil {
+		err = wrap(ErrNotFound, fmt.Errorf("invalid book id %s: %v", ID, err))
+		return
+	}
+
+	to := s3Key(dir + "/" + name)
+
+	var res *http.Response
+	if res, err = repo.do(ctx, http.MethodHead, to, nil, nil, nil); err == nil {
+		res.Body.Close()
+		err = wrap(ErrConflict, fmt.Errorf("%s already exists in %s", name, dir))
+		return
+	} else if !errors.Is(err, ErrNotFound) {
+		return
+	}
+
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", s3Escape("/"+repo.bucket+"/"+string(from), false))
+	if res, err = repo.do(ctx, http.MethodPut, to, nil, header, nil); err != nil {
+		return
+	}
+	res.Body.Close()
+
+	if res, err = repo.do(ctx, http.MethodDelete, string(from), nil, nil, nil); err != nil {
+		return
+	}
+	res.Body.Close()
+
+	if res, err = repo.do(ctx, http.MethodHead, to, nil, nil, nil); err != nil {
+		return
+	}
+	res.Body.Close()
+
+	book = Book{
+		ID:       base64.RawURLEncoding.EncodeToString([]byte(to)),
+		Name:     name,
+		IsPDF:    strings.Contains(name, ".pdf"),
+		IsComic:  isComicName(name),
+		IsAudio:  isAudioName(name),
+		Revision: res.Header.Get("ETag"),
+	}
+
+	return
+}
+
+func (repo *S3Repository) GetHistory(ctx context.Context, ID string) (history History, err error) {
+	var key string
+	if key, err = repo.historyKey(ID); err != nil {
+		return
+	}
+
+	var res *http.Response
+	if res, err = repo.do(ctx, http.MethodGet, key, nil, nil, nil); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			err = nil
+		}
+		return
+	}
+
+	defer res.Body.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err = buf.ReadFrom(res.Body); err != nil {
+		err = transportError(ctx, err)
+		return
+	}
+
+	history.Data = buf.String()
+	history.Version = res.Header.Get("ETag")
+	return
+}
+
+// WriteHistory uses conditional PUTs to get the same semantics as the strict
+// conflict uploads of the Dropbox repository: a new history must not exist
+// yet, and an update must match the ETag that the client last saw.
+func (repo *S3Repository) WriteHistory(
+	ctx context.Context, ID string, history History,
+) (updated History, err error) {
+	var key string
+	if key, err = repo.historyKey(ID); err != nil {
+		return
+	}
+
+	header := http.Header{}
+	if history.Version == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", history.Version)
+	}
+
+	var res *http.Response
+	if res, err = repo.do(ctx, http.MethodPut, key, nil, header, []byte(history.Data)); err != nil {
+		return
+	}
+
+	res.Body.Close()
+
+	updated.Data = history.Data
+	updated.Version = res.Header.Get("ETag")
+	return
+}
+
+// historyKey returns the key of the history of ID, which may not leave
+// historyPrefix.
+func (repo *S3Repository) historyKey(ID string) (key string, err error) {
+	if err = checkHistoryID(ID); err != nil {
+		return
+	}
+
+	return s3Key(repo.historyPrefix + "/" + ID), nil
+}
+
+// do sends a signed request for key (or the bucket itself if key is empty)
+// and turns any non 2xx response into an error.
+func (repo *S3Repository) do(
+	ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte,
+) (res *http.Response, err error) {
+	target := *repo.endpoint
+	target.Path = strings.TrimRight(target.Path, "/") + "/" + repo.bucket
+	if key != "" {
+		target.Path += "/" + key
+	}
+	target.RawPath = s3Escape(target.Path, false)
+	target.RawQuery = s3Query(query)
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(
+		ctx, method, target.String(), bytes.NewReader(body),
+	); err != nil {
+		return
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	repo.sign(req, body, time.Now().UTC())
+
+	if res, err = repo.client.Do(req); err != nil {
+		err = transportError(ctx, err)
+		return
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+
+		var s3Err s3Error
+		raw, _ := ioutil.ReadAll(res.Body)
+		if xml.Unmarshal(raw, &s3Err) != nil || s3Err.Code == "" {
+			s3Err.Code = res.Status
+		}
+
+		err = statusError(res.StatusCode, fmt.Errorf(
+			"s3 %s %s failed with %s: %s", method, target.Path, s3Err.Code, s3Err.Message,
+		))
+		res = nil
+	}
+
+	return
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (repo *S3Repository) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	signed := []string{"host"}
+	canonicalHeaders := "host:" + req.URL.Host + "\n"
+	var names []string
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "if-match" || lower == "if-none-match" {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		signed = append(signed, name)
+		canonicalHeaders += name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n"
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := day + "/" + repo.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+repo.secretKey), day)
+	key = hmacSHA256(key, repo.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		repo.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Key turns a repository path like /books/ into an object key like books.
+func s3Key(path string) string {
+	return strings.Trim(path, "/")
+}
+
+// s3Query encodes query in the canonical form required by the signature:
+// sorted by key with every reserved character percent encoded.
+func s3Query(query url.Values) string {
+	var keys []string
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent encodes everything except the unreserved characters, and
+// the slash too unless encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			buf.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,231 @@
+package book
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+)
+
+// sampleBook is a book built into the binary for MemoryRepository.SeedSamples.
+// It is generated rather than shipped as a file so that it stays small and
+// is obviously free to use.
+type sampleBook struct {
+	path     string
+	title    string
+	author   string
+	chapters []sampleChapter
+}
+
+type sampleChapter struct {
+	title      string
+	paragraphs []string
+}
+
+// sampleRepeat is how often the paragraphs of a chapter are repeated, so
+// that chapters span several pages.
+const sampleRepeat = 6
+
+// sampleModified is the modification time of every file in the samples, so
+// that they are the same on every build.
+var sampleModified = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var sampleBooks = []sampleBook{
+	{
+		path:   "A Field Guide to Clouds.epub",
+		title:  "A Field Guide to Clouds",
+		author: "Book Browser",
+		chapters: []sampleChapter{
+			{"Looking Up", []string{
+				"Clouds are water made visible. Every one of them is a crowd of droplets or ice crystals, each far too small to fall, held up by the air moving beneath it.",
+				"This guide is a sample book. It exists so that the reader has something to show while you work on it, take screenshots or try things out without connecting any storage.",
+			}},
+			{"Cumulus", []string{
+				"Cumulus clouds are the heaps of a fine afternoon: flat bases, bright rounded tops, and plenty of blue sky between them.",
+				"They grow where warm air rises in columns. When the columns are strong the clouds tower, and a tower that freezes at the top becomes a storm.",
+			}},
+			{"Stratus", []string{
+				"Stratus is a grey sheet without features, the cloud of drizzle and of days that never quite get light.",
+				"Fog is stratus that has settled on the ground. Walking through it is walking inside a cloud.",
+			}},
+			{"Cirrus", []string{
+				"Cirrus clouds are wisps of ice high above everything else, combed out by fast winds into hooks and streaks.",
+				"They are often the first sign of a change in the weather, a day or two before it arrives.",
+			}},
+		},
+	},
+	{
+		path:   "Fiction/The Lighthouse Keeper.epub",
+		title:  "The Lighthouse Keeper",
+		author: "Book Browser",
+		chapters: []sampleChapter{
+			{"The Lamp", []string{
+				"Every evening at dusk the keeper climbed the hundred and twelve steps, trimmed the wick and lit the lamp, and every morning he climbed them again to put it out.",
+				"In between he wrote in the log: the wind, the sea, the ships that passed, and sometimes nothing at all, because nothing at all had happened.",
+			}},
+			{"The Storm", []string{
+				"The storm came in the third week of November. The keeper did not sleep; he sat by the lamp and listened to the tower hum like a struck bell.",
+				"By morning the sea had taken the boat, the garden and half of the wall, and left a ship's figurehead on the rocks below, smiling.",
+			}},
+			{"The Relief", []string{
+				"The relief boat came a week late. The new keeper was young and asked a great many questions, and the old one answered all of them.",
+				"He left the figurehead where it was. Someone, he said, ought to keep the lamp company.",
+			}},
+		},
+	},
+	{
+		path:   "Fiction/Short Stories/Three Small Tales.epub",
+		title:  "Three Small Tales",
+		author: "Book Browser",
+		chapters: []sampleChapter{
+			{"The Clockmaker's Cat", []string{
+				"The clockmaker's cat slept on a different clock every day, and the clock it slept on always ran a little slow.",
+			}},
+			{"The Borrowed Umbrella", []string{
+				"An umbrella was borrowed in April and returned in October, by which time it had been to four countries and was no longer on speaking terms with its owner.",
+			}},
+			{"The Last Page", []string{
+				"She always read the last page first. It was not that she could not wait; it was that she liked to know who to worry about.",
+			}},
+		},
+	},
+	{
+		path:   "Reference/Reading Notes.pdf",
+		title:  "Reading Notes",
+		author: "Book Browser",
+		chapters: []sampleChapter{
+			{"Reading Notes", []string{
+				"This is a sample PDF.",
+				"The reader remembers the page you are on and picks up there next time, on any device.",
+			}},
+			{"Page Two", []string{
+				"Use the arrows or swipe to turn pages.",
+			}},
+			{"Page Three", []string{
+				"That is all there is to it.",
+			}},
+		},
+	},
+}
+
+func (sample sampleBook) build() (data []byte, err error) {
+	if strings.HasSuffix(sample.path, ".pdf") {
+		return sample.buildPDF(), nil
+	}
+
+	return sample.buildEPUB()
+}
+
+// buildEPUB writes the sample as an EPUB.
+func (sample sampleBook) buildEPUB() (data []byte, err error) {
+	book := epubBook{
+		Identifier: "urn:bookbrowser:sample:" + strings.ToLower(strings.Replace(sample.title, " ", "-", -1)),
+		Title:      sample.title,
+		Authors:    []string{sample.author},
+		Language:   "en",
+	}
+
+	for _, chapter := range sample.chapters {
+		var body strings.Builder
+		fmt.Fprintf(&body, "<h1>%s</h1>\n", html.EscapeString(chapter.title))
+		for r := 0; r < sampleRepeat; r++ {
+			for _, paragraph := range chapter.paragraphs {
+				fmt.Fprintf(&body, "<p>%s</p>\n", html.EscapeString(paragraph))
+			}
+		}
+
+		book.Chapters = append(book.Chapters, epubChapter{Title: chapter.title, Body: body.String()})
+	}
+
+	var buf bytes.Buffer
+	if err = book.write(&buf, sampleModified); err != nil {
+		return
+	}
+
+	return buf.Bytes(), nil
+}
+
+// buildPDF writes the sample as a PDF with a page per chapter.
+func (sample sampleBook) buildPDF() []byte {
+	var objects []string
+	add := func(object string) int {
+		objects = append(objects, object)
+		return len(objects)
+	}
+
+	catalog := add("")
+	pages := add("")
+	font := add("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>")
+
+	var kids []string
+	for _, chapter := range sample.chapters {
+		var content strings.Builder
+		fmt.Fprintf(&content, "BT /F1 24 Tf 72 720 Td (%s) Tj ET\n", pdfEscape(chapter.title))
+
+		y := 680
+		for _, paragraph := range chapter.paragraphs {
+			for _, line := range wrapText(paragraph, 80) {
+				fmt.Fprintf(&content, "BT /F1 12 Tf 72 %d Td (%s) Tj ET\n", y, pdfEscape(line))
+				y -= 16
+			}
+			y -= 8
+		}
+
+		stream := add(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()))
+		page := add(fmt.Sprintf(
+			"<< /Type /Page /Parent %d 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 %d 0 R >> >> /Contents %d 0 R >>",
+			pages, font, stream,
+		))
+		kids = append(kids, fmt.Sprintf("%d 0 R", page))
+	}
+
+	objects[catalog-1] = fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages)
+	objects[pages-1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids))
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root %d 0 R /Info << /Title (%s) /Author (%s) >> >>\nstartxref\n%d\n%%%%EOF\n",
+		len(objects)+1, catalog, pdfEscape(sample.title), pdfEscape(sample.author), xref)
+
+	return buf.Bytes()
+}
+
+// pdfEscape escapes s for a PDF string literal.
+func pdfEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`).Replace(s)
+}
+
+// wrapText breaks s into lines of at most width characters at spaces.
+func wrapText(s string, width int) (lines []string) {
+	line := ""
+	for _, word := range strings.Fields(s) {
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+
+	if line != "" {
+		lines = append(lines, line)
+	}
+
+	return
+}
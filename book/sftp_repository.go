@@ -0,0 +1,565 @@
+package book
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPRepository serves books and history from a remote host over SFTP. Book
+// IDs are the URL safe encoding of the remote path, and history versions are
+// derived from the modification time and size of the history file.
+type SFTPRepository struct {
+	addr          string
+	config        *ssh.ClientConfig
+	historyPrefix string
+
+	// lock guards client and serialises the version check in WriteHistory.
+	lock   sync.Mutex
+	client *sftp.Client
+}
+
+// NewSFTPRepository connects to addr as user. The host key is verified
+// against knownHostsFile and either the private key in keyFile or password
+// is used to authenticate.
+func NewSFTPRepository(
+	addr string, user string, password string, keyFile string, knownHostsFile string,
+	historyPrefix string,
+) (repo *SFTPRepository, err error) {
+	repo = new(SFTPRepository)
+	repo.addr = addr
+
+	var hostKeyCallback ssh.HostKeyCallback
+	if hostKeyCallback, err = knownhosts.New(knownHostsFile); err != nil {
+		return
+	}
+
+	var auth []ssh.AuthMethod
+	if keyFile != "" {
+		var key []byte
+		if key, err = ioutil.ReadFile(keyFile); err != nil {
+			return
+		}
+
+		var signer ssh.Signer
+		if signer, err = ssh.ParsePrivateKey(key); err != nil {
+			return
+		}
+
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	if len(auth) == 0 {
+		err = fmt.Errorf("sftp needs either a key file or a password")
+		return
+	}
+
+	repo.config = &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}
+
+	repo.historyPrefix = historyPrefix
+	if repo.historyPrefix == "" {
+		repo.historyPrefix = "/history"
+	}
+
+	if repo.client, err = repo.connect(); err != nil {
+		return
+	}
+
+	return
+}
+
+func (repo *SFTPRepository) connect() (client *sftp.Client, err error) {
+	var conn *ssh.Client
+	if conn, err = ssh.Dial("tcp", repo.addr, repo.config); err != nil {
+		return
+	}
+
+	if client, err = sftp.NewClient(conn); err != nil {
+		conn.Close()
+	}
+
+	return
+}
+
+// withClient runs fn with a connected client, reconnecting once if the
+// connection was dropped since it was last used. The caller must hold lock.
+// Errors are marked by sftpError.
+func (repo *SFTPRepository) withClient(
+	ctx context.Context, fn func(client *sftp.Client) error,
+) (err error) {
+	defer func() { err = sftpError(ctx, err) }()
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	if err = fn(repo.client); err == nil ||
+		(!errors.Is(err, sftp.ErrSSHFxConnectionLost) && err != io.EOF) {
+		return
+	}
+
+	repo.client.Close()
+
+	var client *sftp.Client
+	if client, err = repo.connect(); err != nil {
+		return
+	}
+
+	repo.client = client
+	return fn(repo.client)
+}
+
+func (repo *SFTPRepository) List(ctx context.Context, dir string) (books []Book, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	var infos []os.FileInfo
+	if err = repo.withClient(ctx, func(client *sftp.Client) (err error) {
+		infos, err = client.ReadDir(dir)
+		return
+	}); err != nil {
+		return
+	}
+
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		name := info.Name()
+		if isBookName(name) {
+			books = append(books, Book{
+				ID:       base64.RawURLEncoding.EncodeToString([]byte(path.Join(dir, name))),
+				Name:     name,
+				IsPDF:    strings.Contains(name, ".pdf"),
+				IsComic:  isComicName(name),
+				IsAudio:  isAudioName(name),
+				Revision: sftpVersion(info),
+			})
+		}
+	}
+
+	return
+}
+
+// ListRecursive walks dir and its subfolders, skipping hidden ones.
+func (repo *SFTPRepository) ListRecursive(ctx context.Context, dir string) (books []Book, err error) {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	err = repo.withClient(ctx, func(client *sftp.Client) (err error) {
+		books = nil
+
+		walker := client.Walk(dir)
+		for walker.Step() {
+			if err = walker.Err(); err != nil {
+				return
+			}
+
+			if err = ctx.Err(); err != nil {
+				return
+			}
+
+			info := walker.Stat()
+			name := info.Name()
+			if info.IsDir() {
+				if walker.Path() != dir && strings.HasPrefix(name, ".") {
+					walker.SkipDir()
+				}
+				continue
+			}
+
+			if !info.Mode().IsRegular() {
+				continue
+			}
+
+			if isBookName(name) {
+				books = append(books, Book{
+					ID:       base64.RawURLEncoding.EncodeToString([]byte(walker.Path())),
+					Name:     name,
+					IsPDF:    strings.Contains(name, ".pdf"),
+					IsComic:  isComicName(name),
+					IsAudio:  isAudioName(name),
+					Revision: sftpVersion(info),
+					Dir:      relativeDir(dir, walker.Path()),
+				})
+			}
+		}
+
+		return
+	})
+
+	return
+}
+
+func (repo *SFTPRepository) Download(ctx context.Context, ID string) (
+	book Book, data io.ReadCloser, err error,
+) {
+	var remote []byte
+	if remote, err = base64.RawURLEncoding.DecodeString(ID); err != nil {
+		err = wrap(ErrNotFound, fmt.Errorf("invalid book id %s: %v", ID, err))
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	var (
+		file *sftp.File
+		info os.FileInfo
+	)
+	if err = repo.withClient(ctx, func(client *sftp.Client) (err error) {
+		if file, err = client.Open(string(remote)); err != nil {
+			return
+		}
+
+		if info, err = file.Stat(); err != nil {
+			file.Close()
+		}
+		return
+	}); err != nil {
+		return
+	}
+
+	book = sftpBook(ID, string(remote), info)
+	data = file
+
+	return
+}
+
+func (repo *SFTPRepository) Stat(ctx context.Context, ID string) (book Book, err error) {
+	var remote []byte
+	if remote, err = base64.RawURLEncoding.DecodeString(ID); err != nil {
+		err = wrap(ErrNotFound, fmt.Errorf("invalid book id %s: %v", ID, err))
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	var info os.FileInfo
+	if err = repo.withClient(ctx, func(client *sftp.Client) (err error) {
+		info, err = client.Stat(string(remote))
+		return
+	}); err != nil {
+		return
+	}
+
+	return sftpBook(ID, string(remote), info), nil
+}
+
+func sftpBook(ID string, remote string, info os.FileInfo) Book {
+	name := path.Base(remote)
+	return Book{
+		ID:       ID,
+		Name:     name,
+		IsPDF:    strings.Contains(name, ".pdf"),
+		IsComic:  isComicName(name),
+		IsAudio:  isAudioName(name),
+		Revision: sftpVersion(info),
+	}
+}
+
+// Upload picks the first free name and creates the book exclusively. The
+// lock is only held while opening it, as the client can write concurrently.
+func (repo *SFTPRepository) Upload(
+	ctx context.Context, dir string, name string, data io.Reader,
+) (book Book, err error) {
+	var file *sftp.File
+
+	repo.lock.Lock()
+	err = repo.withClient(ctx, func(client *sftp.Client) (err error) {
+		if err = client.MkdirAll(dir); err != nil {
+			return
+		}
+
+		for attempt := 0; attempt < uploadAttempts; attempt++ {
+			target := path.Join(dir, uploadName(name, attempt))
+			if _, err = client.Stat(target); err == nil {
+				continue
+			} else if !os.IsNotExist(err) {
+				return
+			}
+
+			file, err = client.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+			return
+		}
+
+		return wrap(ErrConflict, fmt.Errorf("no free name for %s in %s", name, dir))
+	})
+	repo.lock.Unlock()
+	if err != nil {
+		return
+	}
+
+	remote := file.Name()
+	_, err = file.ReadFrom(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if err != nil {
+		repo.withClient(context.Background(), func(client *sftp.Client) error {
+			return client.Remove(remote)
+		})
+		err = sftpError(ctx, err)
+		return
+	}
+
+	var info os.FileInfo
+	if err = repo.withClient(ctx, func(client *sftp.Client) (err error) {
+		info, err = client.Stat(remote)
+		return
+	}); err != nil {
+		return
+	}
+
+	book = Book{
+		ID:       base64.RawURLEncoding.EncodeToString([]byte(remote)),
+		Name:     info.Name(),
+		IsPDF:    strings.Contains(info.Name(), ".pdf"),
+		IsComic:  isComicName(info.Name()),
+		IsAudio:  isAudioName(info.Name()),
+		Revision: sftpVersion(info),
+	}
+
+	return
+}
+
+// Move uses a plain SFTP rename, which unlike the posix-rename extension
+// refuses to replace an existing file.
+func (repo *SFTPRepository) Move(
+	ctx context.Context, ID string, dir string, name string,
+) (book Book, err error) {
+	var from []byte
+	if from, err = base64.RawURLEncoding.DecodeString(ID); err != nil {
+		err = wrap(ErrNotFound, fmt.Errorf("invalid book id %s: %v", ID, err))
+		return
+	}
+
+	to := path.Join(dir, name)
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	var info os.FileInfo
+	err = repo.withClient(ctx, func(client *sftp.Client) (err error) {
+		if _, err = client.Stat(string(from)); err != nil {
+			return
+		}
+
+		if _, err = client.Stat(to); err == nil {
+			return wrap(ErrConflict, fmt.Errorf("%s already exists in %s", name, dir))
+		} else if !os.IsNotExist(err) {
+			return
+		}
+
+		if err = client.MkdirAll(dir); err != nil {
+			return
+		}
+
+		if err = client.Rename(string(from), to); err != nil {
+			return
+		}
+
+		info, err = client.Stat(to)
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	book = Book{
+		ID:       base64.RawURLEncoding.EncodeToString([]byte(to)),
+		Name:     name,
+		IsPDF:    strings.Contains(name, ".pdf"),
+		IsComic:  isComicName(name),
+		IsAudio:  isAudioName(name),
+		Revision: sftpVersion(info),
+	}
+
+	return
+}
+
+func (repo *SFTPRepository) GetHistory(ctx context.Context, ID string) (history History, err error) {
+	var target string
+	if target, err = repo.historyPath(ID); err != nil {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if err = repo.withClient(ctx, func(client *sftp.Client) (err error) {
+		var file *sftp.File
+		if file, err = client.Open(target); err != nil {
+			return
+		}
+
+		defer file.Close()
+
+		var info os.FileInfo
+		if info, err = file.Stat(); err != nil {
+			return
+		}
+
+		buf := new(bytes.Buffer)
+		if _, err = buf.ReadFrom(file); err != nil {
+			return
+		}
+
+		history.Data = buf.String()
+		history.Version = sftpVersion(info)
+		return
+	}); errors.Is(err, ErrNotFound) {
+		err = nil
+	}
+
+	return
+}
+
+// WriteHistory checks the version of the remote file before replacing it
+// through a temporary file and a rename. The check is only atomic with
+// respect to this process, as SFTP has no conditional writes.
+func (repo *SFTPRepository) WriteHistory(
+	ctx context.Context, ID string, history History,
+) (updated History, err error) {
+	var target string
+	if target, err = repo.historyPath(ID); err != nil {
+		return
+	}
+
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	err = repo.withClient(ctx, func(client *sftp.Client) (err error) {
+		var (
+			current string
+			mtime   time.Time
+		)
+		if info, statErr := client.Stat(target); statErr == nil {
+			current = sftpVersion(info)
+			mtime = info.ModTime()
+		} else if !os.IsNotExist(statErr) {
+			return statErr
+		}
+
+		if current != history.Version {
+			return wrap(ErrConflict, fmt.Errorf(
+				"history conflict for %s: expected version %q, found %q",
+				ID, history.Version, current,
+			))
+		}
+
+		if err = client.MkdirAll(repo.historyPrefix); err != nil {
+			return
+		}
+
+		tmp := path.Join(repo.historyPrefix, "."+ID+".tmp")
+		var file *sftp.File
+		if file, err = client.Create(tmp); err != nil {
+			return
+		}
+
+		if _, err = file.Write([]byte(history.Data)); err != nil {
+			file.Close()
+			client.Remove(tmp)
+			return
+		}
+
+		if err = file.Close(); err != nil {
+			client.Remove(tmp)
+			return
+		}
+
+		// Most servers only keep mtime with a resolution of a second, so make
+		// sure that two quick writes of the same size still get new versions.
+		if now := time.Now(); !mtime.IsZero() && !now.After(mtime.Add(time.Second)) {
+			if err = client.Chtimes(tmp, now, mtime.Add(time.Second)); err != nil {
+				client.Remove(tmp)
+				return
+			}
+		}
+
+		if err = client.PosixRename(tmp, target); err != nil {
+			// Fall back for servers without the posix-rename extension.
+			client.Remove(target)
+			if err = client.Rename(tmp, target); err != nil {
+				client.Remove(tmp)
+				return
+			}
+		}
+
+		var info os.FileInfo
+		if info, err = client.Stat(target); err != nil {
+			return
+		}
+
+		updated.Data = history.Data
+		updated.Version = sftpVersion(info)
+		return
+	})
+
+	return
+}
+
+// historyPath returns the remote path of the history of ID, which may not
+// leave historyPrefix.
+func (repo *SFTPRepository) historyPath(ID string) (target string, err error) {
+	if err = checkHistoryID(ID); err != nil {
+		return
+	}
+
+	return path.Join(repo.historyPrefix, ID), nil
+}
+
+// sftpError marks err with the matching error from errors.go. The client
+// already reports missing files and denied access like the os package does.
+func sftpError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, sftp.ErrSSHFxConnectionLost) || err == io.EOF {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return wrap(ErrUnavailable, err)
+	}
+
+	if err = localError(err); errors.Is(err, ErrNotFound) || errors.Is(err, ErrUnauthorized) {
+		return err
+	}
+
+	return transportError(ctx, err)
+}
+
+func sftpVersion(info os.FileInfo) string {
+	return fmt.Sprintf("%x-%x", info.ModTime().Unix(), info.Size())
+}
@@ -0,0 +1,20 @@
+package book
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSFTPHistoryPathStaysInPrefix(t *testing.T) {
+	repo := &SFTPRepository{historyPrefix: "/history"}
+
+	for _, ID := range []string{"", ".", "..", "../books", "a/b"} {
+		if target, err := repo.historyPath(ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("historyPath(%q) = %q, %v, want ErrNotFound", ID, target, err)
+		}
+	}
+
+	if target, err := repo.historyPath("aWQ"); err != nil || target != "/history/aWQ" {
+		t.Errorf("historyPath(aWQ) = %q, %v", target, err)
+	}
+}
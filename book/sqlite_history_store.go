@@ -0,0 +1,126 @@
+package book
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+)
+
+// SQLiteHistoryStore keeps history in an embedded SQLite database, which
+// makes the frequent saves of the reader cheap compared to a remote write.
+// Versions are a counter per book that is bumped on every write.
+type SQLiteHistoryStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteHistoryStore(path string) (store *SQLiteHistoryStore, err error) {
+	store = new(SQLiteHistoryStore)
+
+	dsn := (&url.URL{
+		Scheme:   "file",
+		Opaque:   filepath.ToSlash(path),
+		RawQuery: "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)",
+	}).String()
+	if store.db, err = sql.Open("sqlite", dsn); err != nil {
+		return
+	}
+
+	if _, err = store.db.Exec(`CREATE TABLE IF NOT EXISTS history (
+		id      TEXT PRIMARY KEY,
+		data    TEXT NOT NULL,
+		version INTEGER NOT NULL
+	)`); err != nil {
+		store.db.Close()
+		return
+	}
+
+	return
+}
+
+func (store *SQLiteHistoryStore) GetHistory(ctx context.Context, ID string) (history History, err error) {
+	var version int64
+	if err = store.db.QueryRowContext(
+		ctx,
+		`SELECT data, version FROM history WHERE id = ?`, ID,
+	).Scan(&history.Data, &version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+		return
+	}
+
+	history.Version = strconv.FormatInt(version, 10)
+	return
+}
+
+func (store *SQLiteHistoryStore) WriteHistory(
+	ctx context.Context, ID string, history History,
+) (updated History, err error) {
+	var (
+		res     sql.Result
+		version int64
+	)
+	if history.Version == "" {
+		version = 1
+		res, err = store.db.ExecContext(
+			ctx,
+			`INSERT INTO history (id, data, version) VALUES (?, ?, ?)
+			ON CONFLICT (id) DO NOTHING`,
+			ID, history.Data, version,
+		)
+	} else {
+		var current int64
+		if current, err = strconv.ParseInt(history.Version, 10, 64); err != nil {
+			err = wrap(ErrConflict, fmt.Errorf("invalid history version %q for %s", history.Version, ID))
+			return
+		}
+
+		version = current + 1
+		res, err = store.db.ExecContext(
+			ctx,
+			`UPDATE history SET data = ?, version = ? WHERE id = ? AND version = ?`,
+			history.Data, version, ID, current,
+		)
+	}
+	if err != nil {
+		return
+	}
+
+	var affected int64
+	if affected, err = res.RowsAffected(); err != nil {
+		return
+	}
+
+	if affected == 0 {
+		err = wrap(ErrConflict, fmt.Errorf("history conflict for %s: version %q is not the latest", ID, history.Version))
+		return
+	}
+
+	updated.Data = history.Data
+	updated.Version = strconv.FormatInt(version, 10)
+	return
+}
+
+func (store *SQLiteHistoryStore) ListHistory(ctx context.Context) (IDs []string, err error) {
+	var rows *sql.Rows
+	if rows, err = store.db.QueryContext(ctx, `SELECT id FROM history ORDER BY id`); err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var ID string
+		if err = rows.Scan(&ID); err != nil {
+			return
+		}
+
+		IDs = append(IDs, ID)
+	}
+
+	return IDs, rows.Err()
+}
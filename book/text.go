@@ -0,0 +1,152 @@
+package book
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// textChapterParagraphs is how many paragraphs go in each chapter of text
+// that has no headings, as readers slow down on very long chapters.
+const textChapterParagraphs = 300
+
+var (
+	// textHeading matches the lines that start chapters in plain text.
+	textHeading = regexp.MustCompile(`^(?:(?:CHAPTER|Chapter|PART|Part|BOOK|Book|VOLUME|Volume|ГЛАВА|Глава|ЧАСТЬ|Часть)\s+(?:\d+|[IVXLCDM]+|[A-ZА-Я][\p{L}-]*)|PROLOGUE|Prologue|EPILOGUE|Epilogue)`)
+	// gutenbergStart and gutenbergEnd are the lines around the text of
+	// Project Gutenberg books, which have their licence before and after.
+	gutenbergStart = regexp.MustCompile(`(?m)^\*\*\* ?START OF (?:THE|THIS) PROJECT GUTENBERG.*$`)
+	gutenbergEnd   = regexp.MustCompile(`(?m)^\*\*\* ?END OF (?:THE|THIS) PROJECT GUTENBERG.*$`)
+	gutenbergField = regexp.MustCompile(`(?m)^(Title|Author):[ \t]*(.+)$`)
+)
+
+// sniffText reports whether head is the start of text rather than of a
+// binary file.
+func sniffText(head []byte) bool {
+	if bytes.HasPrefix(head, []byte("\xff\xfe")) || bytes.HasPrefix(head, []byte("\xfe\xff")) {
+		return true
+	}
+
+	for _, b := range head {
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != '\f' && b != 0x1a {
+			return false
+		}
+	}
+	return true
+}
+
+// readText reads the text in r, in whatever encoding it is, with its lines
+// ending in a newline only.
+func readText(r io.ReaderAt, size int64) (text string, err error) {
+	var data []byte
+	if data, err = ioutil.ReadAll(io.NewSectionReader(r, 0, size)); err != nil {
+		return
+	}
+
+	text = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(decodeText(data))
+	return
+}
+
+// convertText converts a plain text book to EPUB. Paragraphs are separated
+// by blank lines, or are lines of their own in text without blank lines, and
+// chapters start at short paragraphs that look like chapter headings. The
+// licence around Project Gutenberg books is left out and their title and
+// author taken from it.
+func convertText(r io.ReaderAt, size int64) (book epubBook, err error) {
+	var text string
+	if text, err = readText(r, size); err != nil {
+		return
+	}
+
+	if start := gutenbergStart.FindStringIndex(text); start != nil {
+		for _, field := range gutenbergField.FindAllStringSubmatch(text[:start[0]], -1) {
+			if value := strings.TrimSpace(field[2]); field[1] == "Title" && book.Title == "" {
+				book.Title = value
+			} else if field[1] == "Author" && len(book.Authors) == 0 {
+				book.Authors = []string{value}
+			}
+		}
+
+		text = text[start[1]:]
+		if end := gutenbergEnd.FindStringIndex(text); end != nil {
+			text = text[:end[0]]
+		}
+	}
+
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	blank := 0
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			blank++
+		}
+	}
+
+	var paragraphs [][]string
+	var paragraph []string
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\f\x1a")
+		if strings.TrimSpace(line) != "" {
+			paragraph = append(paragraph, strings.TrimSpace(line))
+		}
+		// Text with few blank lines has a paragraph on each line.
+		if len(paragraph) > 0 && (strings.TrimSpace(line) == "" || blank*10 < len(lines)) {
+			paragraphs = append(paragraphs, paragraph)
+			paragraph = nil
+		}
+	}
+	if len(paragraph) > 0 {
+		paragraphs = append(paragraphs, paragraph)
+	}
+
+	headings := make([]bool, len(paragraphs))
+	hasHeadings := false
+	for i, paragraph := range paragraphs {
+		headings[i] = len(paragraph) <= 2 && textHeading.MatchString(paragraph[0])
+		for _, line := range paragraph {
+			headings[i] = headings[i] && utf8.RuneCountInString(line) <= 80
+		}
+		hasHeadings = hasHeadings || headings[i]
+	}
+
+	var parts []string
+	var part strings.Builder
+	count := 0
+	for i, paragraph := range paragraphs {
+		if part.Len() > 0 && (headings[i] || !hasHeadings && count == textChapterParagraphs) {
+			parts = append(parts, part.String())
+			part.Reset()
+			count = 0
+		}
+
+		if headings[i] {
+			part.WriteString("<h1>" + html.EscapeString(strings.Join(paragraph, " ")) + "</h1>\n")
+			continue
+		}
+
+		// Short lines, as in verse and letters, are kept apart, and the
+		// lines of paragraphs wrapped to a width joined up.
+		separator := " "
+		for _, line := range paragraph[:len(paragraph)-1] {
+			if utf8.RuneCountInString(line) < 45 {
+				separator = "<br/>"
+			}
+		}
+
+		escaped := make([]string, len(paragraph))
+		for j, line := range paragraph {
+			escaped[j] = html.EscapeString(line)
+		}
+		part.WriteString("<p>" + strings.Join(escaped, separator) + "</p>\n")
+		count++
+	}
+	if part.Len() > 0 || len(parts) == 0 {
+		parts = append(parts, part.String())
+	}
+
+	book.Chapters = chaptersFromHTML(parts, nil)
+	return
+}
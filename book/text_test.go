@@ -0,0 +1,102 @@
+package book
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeText(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data string
+		want string
+	}{
+		{"UTF-8", "crème brûlée", "crème brûlée"},
+		{"UTF-8 with a byte order mark", "\xef\xbb\xbfcrème", "crème"},
+		{"UTF-16LE", "\xff\xfeh\x00i\x00", "hi"},
+		{"UTF-16BE", "\xfe\xff\x00h\x00i", "hi"},
+		{"Windows-1252", "caf\xe9 cr\xe8me", "café crème"},
+		{"Windows-1251", "\xcf\xf0\xe8\xe2\xe5\xf2, \xec\xe8\xf0", "Привет, мир"},
+		{"KOI8-R", "\xd0\xd2\xc9\xd7\xc5\xd4, \xcd\xc9\xd2", "привет, мир"},
+	} {
+		if got := decodeText([]byte(test.data)); got != test.want {
+			t.Errorf("decodeText of %s = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestConvertText(t *testing.T) {
+	text := "The Project Gutenberg eBook of Tales\r\n\r\nTitle: Tales\r\n\r\nAuthor: Jane Roe\r\n\r\n" +
+		"*** START OF THE PROJECT GUTENBERG EBOOK TALES ***\r\n\r\n" +
+		"CHAPTER I\r\n\r\nIt began\r\nat night.\r\n\r\nStill going.\r\n\r\nCHAPTER II\r\n\r\nIt ended.\r\n\r\n" +
+		"*** END OF THE PROJECT GUTENBERG EBOOK TALES ***\r\n\r\nLicence text.\r\n"
+
+	book, err := convertText(strings.NewReader(text), int64(len(text)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if book.Title != "Tales" || strings.Join(book.Authors, ", ") != "Jane Roe" {
+		t.Errorf("metadata = %q by %q, want it from the Gutenberg header", book.Title, book.Authors)
+	}
+	if len(book.Chapters) != 2 || book.Chapters[0].Title != "CHAPTER I" || book.Chapters[1].Title != "CHAPTER II" {
+		t.Fatalf("chapters = %+v, want CHAPTER I and CHAPTER II", book.Chapters)
+	}
+	if !strings.Contains(book.Chapters[0].Body, "<p>It began<br/>at night.</p>") {
+		t.Errorf("lines of a paragraph are not kept together: %s", book.Chapters[0].Body)
+	}
+	for _, chapter := range book.Chapters {
+		if strings.Contains(chapter.Body, "Gutenberg") || strings.Contains(chapter.Body, "Licence") {
+			t.Errorf("the Gutenberg licence is left in: %s", chapter.Body)
+		}
+	}
+}
+
+func TestConvertMarkdown(t *testing.T) {
+	text := "---\ntitle: Notes\nauthor: Jane Roe\nlang: en\n---\n\n" +
+		"# One\n\nSome *em* and **strong** and `<code>`.\n\n- a\n- b\n\n" +
+		"# Two\n\n> quoted\n\n[link](http://example.com)\n"
+
+	book, err := convertMarkdown(strings.NewReader(text), int64(len(text)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if book.Title != "Notes" || strings.Join(book.Authors, ", ") != "Jane Roe" || book.Language != "en" {
+		t.Errorf("metadata = %q by %q in %q, want it from the front matter", book.Title, book.Authors, book.Language)
+	}
+	if len(book.Chapters) != 2 || book.Chapters[0].Title != "One" || book.Chapters[1].Title != "Two" {
+		t.Fatalf("chapters = %+v, want One and Two", book.Chapters)
+	}
+
+	for _, want := range []string{
+		`<h1 id="one">One</h1>`,
+		"<em>em</em>", "<strong>strong</strong>", "<code>&lt;code&gt;</code>",
+		"<ul>\n<li>a</li>\n<li>b</li>\n</ul>",
+	} {
+		if !strings.Contains(book.Chapters[0].Body, want) {
+			t.Errorf("first chapter has no %s: %s", want, book.Chapters[0].Body)
+		}
+	}
+	for _, want := range []string{"<blockquote>\n<p>quoted</p>\n</blockquote>", `<a href="http://example.com">link</a>`} {
+		if !strings.Contains(book.Chapters[1].Body, want) {
+			t.Errorf("second chapter has no %s: %s", want, book.Chapters[1].Body)
+		}
+	}
+}
+
+func TestConvertMarkdownSingleTitle(t *testing.T) {
+	text := "# The Book\n\n## Start\n\nFirst.\n\n## End\n\nLast.\n"
+
+	book, err := convertMarkdown(strings.NewReader(text), int64(len(text)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if book.Title != "The Book" {
+		t.Errorf("title = %q, want the single first level heading", book.Title)
+	}
+	if n := len(book.Chapters); n < 2 || book.Chapters[n-2].Title != "Start" || book.Chapters[n-1].Title != "End" {
+		t.Errorf("chapters = %+v, want them split at the second level", book.Chapters)
+	}
+}
@@ -0,0 +1,120 @@
+package book
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// uploadChunkSize is the size of the pieces large uploads are sent in, for
+// backends that can not take a file of unknown length in one request.
+const uploadChunkSize = 8 << 20
+
+// uploadAttempts is how many names are tried before giving up on finding
+// one that is not taken.
+const uploadAttempts = 100
+
+// epubMagic is how every EPUB starts: a zip whose first, uncompressed entry
+// is named mimetype and holds the EPUB media type.
+var epubMagic = []byte("PK\x03\x04")
+
+const (
+	epubMimetypeName = "mimetype"
+	epubMediaType    = "application/epub+zip"
+)
+
+// Validate checks that data is the book, comic archive or audio file its
+// name says it is. The returned reader yields all of data, including what
+// was read to check it.
+func Validate(name string, data io.Reader) (checked io.Reader, isPDF bool, err error) {
+	if name == "" || name != path.Base(name) || strings.HasPrefix(name, ".") {
+		err = wrap(ErrInvalid, fmt.Errorf("invalid file name %q", name))
+		return
+	}
+
+	buffered := bufio.NewReaderSize(data, validateLength)
+	head, _ := buffered.Peek(validateLength)
+	checked = buffered
+
+	switch strings.ToLower(path.Ext(name)) {
+	case ".pdf":
+		isPDF = true
+		if sniff(head) != ".pdf" {
+			err = wrap(ErrInvalid, fmt.Errorf("%s is not a PDF", name))
+		}
+	case ".epub":
+		if sniff(head) != ".epub" {
+			err = wrap(ErrInvalid, fmt.Errorf("%s is not an EPUB", name))
+		}
+	case ".cbz", ".cbr", ".cb7":
+		// Comics are often packed with another archiver than their
+		// extension says, which Comics copes with, so any will do.
+		if comicFormat(head) == "" {
+			err = wrap(ErrInvalid, fmt.Errorf("%s is not a comic archive", name))
+		}
+	case ".m4b", ".mp3":
+		if !sniffAudio(strings.ToLower(path.Ext(name)), head) {
+			err = wrap(ErrInvalid, fmt.Errorf("%s is not a valid %s file", name, strings.ToUpper(path.Ext(name)[1:])))
+		}
+	default:
+		ext := convertedExt(name)
+		if ext == "" {
+			err = wrap(ErrInvalid, fmt.Errorf("%s is not a book the reader can open", name))
+			break
+		}
+
+		for _, c := range converters {
+			if c.ext == ext && !c.sniff(head) {
+				err = wrap(ErrInvalid, fmt.Errorf("%s is not a valid %s book", name, strings.ToUpper(ext[1:])))
+			}
+		}
+	}
+
+	return
+}
+
+// validateLength is how much of a file Validate looks at.
+const validateLength = 512
+
+// sniffLength is how much of a file sniff needs to see.
+const sniffLength = 30 + len(epubMimetypeName) + len(epubMediaType)
+
+// sniff returns the extension of the format of a file starting with head,
+// or an empty string if it is neither an EPUB nor a PDF.
+func sniff(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("%PDF-")):
+		return ".pdf"
+	// The name and content of the first entry follow its 30 byte header.
+	case bytes.HasPrefix(head, epubMagic) && len(head) >= sniffLength &&
+		string(head[30:sniffLength]) == epubMimetypeName+epubMediaType:
+		return ".epub"
+	}
+
+	return ""
+}
+
+// uploadName returns the name to try for the given attempt at uploading a
+// file called name: name itself first, then "name (1).ext" and so on.
+func uploadName(name string, attempt int) string {
+	if attempt == 0 {
+		return name
+	}
+
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), attempt, ext)
+}
+
+// readChunk reads up to uploadChunkSize bytes of data into buf, reporting
+// whether data ended.
+func readChunk(data io.Reader, buf []byte) (n int, last bool, err error) {
+	n, err = io.ReadFull(data, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, true, nil
+	}
+
+	return n, false, err
+}
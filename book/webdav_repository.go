@@ -0,0 +1,539 @@
+package book
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// webDAVPageSize is the number of entries requested per PROPFIND page from
+// servers that support Nextcloud's pagination extension.
+const webDAVPageSize = 500
+
+const webDAVPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:">
+	<d:prop>
+		<d:resourcetype/>
+		<d:getetag/>
+	</d:prop>
+</d:propfind>`
+
+// WebDAVRepository serves books and history from a WebDAV server such as
+// Nextcloud or ownCloud. Paths are resolved against the base URL, e.g.
+// https://cloud.example.com/remote.php/dav/files/alice.
+type WebDAVRepository struct {
+	client        *http.Client
+	base          *url.URL
+	username      string
+	password      string
+	historyPrefix string
+}
+
+func NewWebDAVRepository(
+	baseURL string, username string, password string, historyPrefix string,
+) (repo *WebDAVRepository, err error) {
+	repo = new(WebDAVRepository)
+	repo.client = http.DefaultClient
+
+	if repo.base, err = url.Parse(baseURL); err != nil {
+		return
+	}
+
+	if repo.base.Scheme == "" || repo.base.Host == "" {
+		err = fmt.Errorf("invalid webdav url %s", baseURL)
+		return
+	}
+
+	repo.base.Path = strings.TrimRight(repo.base.Path, "/")
+	repo.username = username
+	repo.password = password
+
+	repo.historyPrefix = historyPrefix
+	if repo.historyPrefix == "" {
+		repo.historyPrefix = "/history"
+	}
+
+	return
+}
+
+type webDAVResponse struct {
+	Href     string `xml:"href"`
+	Propstat []struct {
+		Status string `xml:"status"`
+		Prop   struct {
+			ResourceType struct {
+				Collection *struct{} `xml:"collection"`
+			} `xml:"resourcetype"`
+			ETag string `xml:"getetag"`
+		} `xml:"prop"`
+	} `xml:"propstat"`
+}
+
+func (repo *WebDAVRepository) List(ctx context.Context, dir string) (books []Book, err error) {
+	err = repo.propfind(ctx, dir, func(href string, etag string, isCollection bool) {
+		if !isCollection {
+			books = repo.appendBook(books, href, etag, "")
+		}
+	})
+
+	return
+}
+
+// ListRecursive walks the subfolders one PROPFIND at a time, as many servers
+// refuse a Depth of infinity.
+func (repo *WebDAVRepository) ListRecursive(ctx context.Context, dir string) (books []Book, err error) {
+	root := "/" + strings.Trim(dir, "/")
+
+	queue := []string{root}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		if err = repo.propfind(ctx, current, func(href string, etag string, isCollection bool) {
+			if !isCollection {
+				books = repo.appendBook(books, href, etag, relativeDir(root, href))
+			} else if href != current {
+				queue = append(queue, href)
+			}
+		}); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (repo *WebDAVRepository) appendBook(books []Book, href string, etag string, dir string) []Book {
+	name := path.Base(href)
+	if isBookName(name) {
+		books = append(books, Book{
+			ID:       base64.RawURLEncoding.EncodeToString([]byte(href)),
+			Name:     name,
+			IsPDF:    strings.Contains(name, ".pdf"),
+			IsComic:  isComicName(name),
+			IsAudio:  isAudioName(name),
+			Revision: etag,
+			Dir:      dir,
+		})
+	}
+
+	return books
+}
+
+// propfind lists the direct children of dir, along with dir itself, paging
+// through the listing on servers that support it.
+func (repo *WebDAVRepository) propfind(
+	ctx context.Context, dir string, found func(href string, etag string, isCollection bool),
+) (err error) {
+	dir = "/" + strings.Trim(dir, "/")
+
+	var (
+		token  string
+		offset int
+		total  int
+	)
+
+	for {
+		header := http.Header{}
+		header.Set("Depth", "1")
+		header.Set("Content-Type", "application/xml; charset=utf-8")
+		header.Set("X-NC-Paginate", "true")
+		header.Set("X-NC-Paginate-Count", strconv.Itoa(webDAVPageSize))
+		if token != "" {
+			header.Set("X-NC-Paginate-Token", token)
+			header.Set("X-NC-Paginate-Offset", strconv.Itoa(offset))
+		}
+
+		var res *http.Response
+		if res, err = repo.do(ctx, "PROPFIND", dir+"/", header, strings.NewReader(webDAVPropfind)); err != nil {
+			return
+		}
+
+		var count int
+		count, err = repo.decodeMultistatus(res.Body, found)
+		res.Body.Close()
+		if err != nil {
+			err = transportError(ctx, err)
+			return
+		}
+
+		// Servers without pagination support ignore the headers above and
+		// return the whole folder in one go. Those that do only give the
+		// total along with the token, on the first page.
+		if token == "" {
+			if token = res.Header.Get("X-NC-Paginate-Token"); token == "" {
+				break
+			}
+			total, _ = strconv.Atoi(res.Header.Get("X-NC-Paginate-Total"))
+		}
+
+		offset += count
+		if count == 0 || offset >= total {
+			break
+		}
+	}
+
+	return
+}
+
+// decodeMultistatus streams a PROPFIND response, calling found for every
+// entry with its path relative to the base URL and its ETag. It returns the
+// number of entries seen so that pagination can advance.
+func (repo *WebDAVRepository) decodeMultistatus(
+	body io.Reader, found func(href string, etag string, isCollection bool),
+) (count int, err error) {
+	decoder := xml.NewDecoder(body)
+	for {
+		var token xml.Token
+		if token, err = decoder.Token(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Space != "DAV:" || start.Name.Local != "response" {
+			continue
+		}
+
+		var res webDAVResponse
+		if err = decoder.DecodeElement(&res, &start); err != nil {
+			return
+		}
+
+		count++
+
+		var href string
+		if href, err = repo.relative(res.Href); err != nil {
+			return
+		}
+
+		var etag string
+		isCollection := false
+		for _, propstat := range res.Propstat {
+			if propstat.Prop.ResourceType.Collection != nil {
+				isCollection = true
+			}
+			if propstat.Prop.ETag != "" {
+				etag = propstat.Prop.ETag
+			}
+		}
+
+		found(href, etag, isCollection)
+	}
+}
+
+func (repo *WebDAVRepository) Download(ctx context.Context, ID string) (
+	book Book, data io.ReadCloser, err error,
+) {
+	var href []byte
+	if href, err = base64.RawURLEncoding.DecodeString(ID); err != nil {
+		err = wrap(ErrNotFound, fmt.Errorf("invalid book id %s: %v", ID, err))
+		return
+	}
+
+	var res *http.Response
+	if res, err = repo.do(ctx, http.MethodGet, string(href), nil, nil); err != nil {
+		return
+	}
+
+	book = webDAVBook(ID, string(href), res.Header.Get("ETag"))
+	data = res.Body
+
+	return
+}
+
+// Stat asks for the ETag of the book with a HEAD request.
+func (repo *WebDAVRepository) Stat(ctx context.Context, ID string) (book Book, err error) {
+	var href []byte
+	if href, err = base64.RawURLEncoding.DecodeString(ID); err != nil {
+		err = wrap(ErrNotFound, fmt.Errorf("invalid book id %s: %v", ID, err))
+		return
+	}
+
+	var res *http.Response
+	if res, err = repo.do(ctx, http.MethodHead, string(href), nil, nil); err != nil {
+		return
+	}
+	res.Body.Close()
+
+	return webDAVBook(ID, string(href), res.Header.Get("ETag")), nil
+}
+
+func webDAVBook(ID string, href string, etag string) Book {
+	name := path.Base(href)
+	return Book{
+		ID:       ID,
+		Name:     name,
+		IsPDF:    strings.Contains(name, ".pdf"),
+		IsComic:  isComicName(name),
+		IsAudio:  isAudioName(name),
+		Revision: etag,
+	}
+}
+
+// Upload looks for the first free name and streams the book there, with
+// If-None-Match so that a file created in the meantime is not overwritten.
+func (repo *WebDAVRepository) Upload(
+	ctx context.Context, dir string, name string, data io.Reader,
+) (book Book, err error) {
+	dir = "/" + strings.Trim(dir, "/")
+
+	var (
+		target string
+		res    *http.Response
+	)
+	for attempt := 0; attempt < uploadAttempts && target == ""; attempt++ {
+		candidate := path.Join(dir, uploadName(name, attempt))
+		if res, err = repo.do(ctx, http.MethodHead, candidate, nil, nil); err == nil {
+			res.Body.Close()
+			continue
+		} else if !errors.Is(err, ErrNotFound) {
+			return
+		}
+
+		target = candidate
+	}
+
+	if target == "" {
+		err = wrap(ErrConflict, fmt.Errorf("no free name for %s in %s", name, dir))
+		return
+	}
+
+	header := http.Header{}
+	header.Set("If-None-Match", "*")
+	if res, err = repo.do(ctx, http.MethodPut, target, header, data); err != nil {
+		return
+	}
+	res.Body.Close()
+
+	// Not every server returns an ETag when creating a file.
+	if res, err = repo.do(ctx, http.MethodHead, target, nil, nil); err != nil {
+		return
+	}
+	res.Body.Close()
+
+	name = path.Base(target)
+	book = Book{
+		ID:       base64.RawURLEncoding.EncodeToString([]byte(target)),
+		Name:     name,
+		IsPDF:    strings.Contains(name, ".pdf"),
+		IsComic:  isComicName(name),
+		IsAudio:  isAudioName(name),
+		Revision: res.Header.Get("ETag"),
+	}
+
+	return
+}
+
+// Move uses MOVE with Overwrite set to F, which servers refuse with 412 if
+// the destination exists.
+func (repo *WebDAVRepository) Move(
+	ctx context.Context, ID string, dir string, name string,
+) (book Book, err error) {
+	var href []byte
+	if href, err = base64.RawURLEncoding.DecodeString(ID); err != nil {
+		err = wrap(ErrNotFound, fmt.Errorf("invalid book id %s: %v", ID, err))
+		return
+	}
+
+	to := path.Join("/"+strings.Trim(dir, "/"), name)
+	destination := repo.url(to)
+
+	header := http.Header{}
+	header.Set("Destination", destination.String())
+	header.Set("Overwrite", "F")
+
+	var res *http.Response
+	if res, err = repo.do(ctx, "MOVE", string(href), header, nil); err != nil {
+		return
+	}
+	res.Body.Close()
+
+	if res, err = repo.do(ctx, http.MethodHead, to, nil, nil); err != nil {
+		return
+	}
+	res.Body.Close()
+
+	book = Book{
+		ID:       base64.RawURLEncoding.EncodeToString([]byte(to)),
+		Name:     name,
+		IsPDF:    strings.Contains(name, ".pdf"),
+		IsComic:  isComicName(name),
+		IsAudio:  isAudioName(name),
+		Revision: res.Header.Get("ETag"),
+	}
+
+	return
+}
+
+func (repo *WebDAVRepository) GetHistory(ctx context.Context, ID string) (history History, err error) {
+	var target string
+	if target, err = repo.historyPath(ID); err != nil {
+		return
+	}
+
+	var res *http.Response
+	if res, err = repo.do(ctx, http.MethodGet, target, nil, nil); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			err = nil
+		}
+		return
+	}
+
+	defer res.Body.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err = buf.ReadFrom(res.Body); err != nil {
+		err = transportError(ctx, err)
+		return
+	}
+
+	history.Data = buf.String()
+	history.Version = res.Header.Get("ETag")
+	return
+}
+
+// WriteHistory relies on If-Match / If-None-Match so that two devices
+// writing the same history conflict in the same way as they would with a
+// Dropbox revision check.
+func (repo *WebDAVRepository) WriteHistory(
+	ctx context.Context, ID string, history History,
+) (updated History, err error) {
+	var target string
+	if target, err = repo.historyPath(ID); err != nil {
+		return
+	}
+
+	header := http.Header{}
+	if history.Version == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", history.Version)
+	}
+
+	var res *http.Response
+	res, err = repo.do(ctx, http.MethodPut, target, header, strings.NewReader(history.Data))
+	var statusErr *webDAVStatusError
+	if errors.As(err, &statusErr) &&
+		(statusErr.Code == http.StatusConflict || statusErr.Code == http.StatusNotFound) {
+		// The history collection does not exist yet.
+		if res, err = repo.do(ctx, "MKCOL", repo.historyPrefix, nil, nil); err != nil {
+			return
+		}
+		res.Body.Close()
+
+		res, err = repo.do(ctx, http.MethodPut, target, header, strings.NewReader(history.Data))
+	}
+	if err != nil {
+		return
+	}
+
+	res.Body.Close()
+
+	updated.Data = history.Data
+	if updated.Version = res.Header.Get("ETag"); updated.Version == "" {
+		// Not every server returns the new ETag from a PUT.
+		if res, err = repo.do(ctx, http.MethodHead, target, nil, nil); err != nil {
+			return
+		}
+		res.Body.Close()
+		updated.Version = res.Header.Get("ETag")
+	}
+
+	return
+}
+
+// historyPath returns the path of the history of ID, which may not leave
+// historyPrefix.
+func (repo *WebDAVRepository) historyPath(ID string) (target string, err error) {
+	if err = checkHistoryID(ID); err != nil {
+		return
+	}
+
+	return repo.historyPrefix + "/" + ID, nil
+}
+
+// relative turns an href from a multistatus response into a path relative
+// to the base URL.
+func (repo *WebDAVRepository) relative(href string) (rel string, err error) {
+	var parsed *url.URL
+	if parsed, err = url.Parse(href); err != nil {
+		return
+	}
+
+	rel = strings.TrimPrefix(parsed.Path, repo.base.Path)
+	rel = "/" + strings.Trim(rel, "/")
+	return
+}
+
+type webDAVStatusError struct {
+	Method string
+	Path   string
+	Code   int
+	Status string
+}
+
+func (e *webDAVStatusError) Error() string {
+	return fmt.Sprintf("webdav %s %s failed with %s", e.Method, e.Path, e.Status)
+}
+
+// url returns the absolute URL of a path relative to the base URL.
+func (repo *WebDAVRepository) url(p string) url.URL {
+	target := *repo.base
+	target.Path = repo.base.Path + "/" + strings.TrimLeft(p, "/")
+	target.RawPath = ""
+	return target
+}
+
+// do sends an authenticated request for a path relative to the base URL and
+// turns any non 2xx response into a *webDAVStatusError.
+func (repo *WebDAVRepository) do(
+	ctx context.Context, method string, p string, header http.Header, body io.Reader,
+) (res *http.Response, err error) {
+	target := repo.url(p)
+
+	var req *http.Request
+	if req, err = http.NewRequestWithContext(ctx, method, target.String(), body); err != nil {
+		return
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	if repo.username != "" {
+		req.SetBasicAuth(repo.username, repo.password)
+	}
+
+	if res, err = repo.client.Do(req); err != nil {
+		err = transportError(ctx, err)
+		return
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+
+		err = statusError(res.StatusCode, &webDAVStatusError{
+			Method: method,
+			Path:   p,
+			Code:   res.StatusCode,
+			Status: res.Status,
+		})
+		res = nil
+	}
+
+	return
+}
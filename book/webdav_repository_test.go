@@ -0,0 +1,263 @@
+package book
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const fakeDAVBase = "/remote.php/dav/files/alice"
+
+// fakeDAV is enough of a Nextcloud WebDAV server for the repository: files
+// with ETags, collections, paginated PROPFIND and conditional PUTs.
+type fakeDAV struct {
+	lock        sync.Mutex
+	files       map[string]string
+	collections map[string]bool
+	// pageSize is how many entries a paginated PROPFIND returns at once.
+	pageSize  int
+	propfinds int
+	mkcols    int
+	writes    int
+}
+
+func (d *fakeDAV) etag(p string) string {
+	return fmt.Sprintf(`"%x"`, len(d.files[p])*1000+len(p))
+}
+
+func (d *fakeDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if user, password, _ := r.BasicAuth(); user != "alice" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	p := "/" + strings.Trim(strings.TrimPrefix(r.URL.Path, fakeDAVBase), "/")
+	content, exists := d.files[p]
+
+	switch r.Method {
+	case "PROPFIND":
+		d.propfind(w, r, p)
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", d.etag(p))
+		fmt.Fprint(w, content)
+	case http.MethodPut:
+		if !d.collections[path.Dir(p)] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || match != d.etag(p)) ||
+			r.Header.Get("If-None-Match") == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		d.writes++
+		// Each write makes a new ETag, as the counter is part of the data.
+		d.files[p] = string(body) + strings.Repeat(" ", d.writes)
+		w.WriteHeader(http.StatusCreated)
+	case "MKCOL":
+		d.mkcols++
+		d.collections[p] = true
+		w.WriteHeader(http.StatusCreated)
+	case "MOVE":
+		destination, _ := url.Parse(r.Header.Get("Destination"))
+		to := "/" + strings.Trim(strings.TrimPrefix(destination.Path, fakeDAVBase), "/")
+		if _, taken := d.files[to]; taken && r.Header.Get("Overwrite") == "F" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		d.files[to] = content
+		delete(d.files, p)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *fakeDAV) propfind(w http.ResponseWriter, r *http.Request, dir string) {
+	d.propfinds++
+	if !d.collections[dir] {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var children []string
+	for p := range d.files {
+		if path.Dir(p) == dir {
+			children = append(children, p)
+		}
+	}
+	for p := range d.collections {
+		if p != "/" && path.Dir(p) == dir {
+			children = append(children, p+"/")
+		}
+	}
+	sort.Strings(children)
+	entries := append([]string{dir + "/"}, children...)
+
+	if r.Header.Get("X-NC-Paginate") == "true" {
+		offset, _ := strconv.Atoi(r.Header.Get("X-NC-Paginate-Offset"))
+		if r.Header.Get("X-NC-Paginate-Token") == "" {
+			offset = 0
+			w.Header().Set("X-NC-Paginate-Token", "token")
+			w.Header().Set("X-NC-Paginate-Total", strconv.Itoa(len(entries)))
+		}
+		end := offset + d.pageSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		entries = entries[offset:end]
+	}
+
+	w.WriteHeader(207)
+	fmt.Fprint(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">`)
+	for _, entry := range entries {
+		href := (&url.URL{Path: fakeDAVBase + entry}).EscapedPath()
+		if strings.HasSuffix(entry, "/") {
+			fmt.Fprintf(w, `<d:response><d:href>%s</d:href><d:propstat><d:prop>`+
+				`<d:resourcetype><d:collection/></d:resourcetype></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>`+
+				`<d:propstat><d:prop><d:getetag/></d:prop><d:status>HTTP/1.1 404 Not Found</d:status></d:propstat></d:response>`, href)
+		} else {
+			fmt.Fprintf(w, `<d:response><d:href>%s</d:href><d:propstat><d:prop><d:resourcetype/>`+
+				`<d:getetag>%s</d:getetag></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`,
+				href, strings.ReplaceAll(d.etag(entry), `"`, "&quot;"))
+		}
+	}
+	fmt.Fprint(w, `</d:multistatus>`)
+}
+
+func newTestWebDAVRepository(t *testing.T) (*WebDAVRepository, *fakeDAV) {
+	t.Helper()
+
+	d := &fakeDAV{files: map[string]string{}, collections: map[string]bool{"/": true}, pageSize: 2}
+	server := httptest.NewServer(d)
+	t.Cleanup(server.Close)
+
+	repo, err := NewWebDAVRepository(server.URL+fakeDAVBase+"/", "alice", "secret", "/history")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return repo, d
+}
+
+func TestWebDAVListPaginates(t *testing.T) {
+	repo, d := newTestWebDAVRepository(t)
+	d.collections["/books"] = true
+	d.collections["/books/Sub Folder"] = true
+	for _, p := range []string{"/books/A Tale.epub", "/books/b.pdf", "/books/c.txt", "/books/notes.json", "/books/Sub Folder/d.epub"} {
+		d.files[p] = p
+	}
+
+	books, err := repo.List(context.Background(), "/books")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, b := range books {
+		names = append(names, b.Name)
+		if b.Revision != d.etag("/books/"+b.Name) {
+			t.Errorf("revision of %s = %s, want its ETag", b.Name, b.Revision)
+		}
+	}
+	if got := strings.Join(names, ", "); got != "A Tale.epub, b.pdf, c.txt" {
+		t.Errorf("List = %s, want the books directly in /books", got)
+	}
+	// The folder itself, four files and a subfolder, two at a time.
+	if d.propfinds != 3 {
+		t.Errorf("%d PROPFIND requests, want 3 pages", d.propfinds)
+	}
+
+	books, err = repo.ListRecursive(context.Background(), "/books")
+	if err != nil || len(books) != 4 || books[3].Name != "d.epub" || books[3].Dir != "Sub Folder" {
+		t.Errorf("ListRecursive = %+v, %v, want d.epub in Sub Folder as well", books, err)
+	}
+}
+
+func TestWebDAVHistoryConflicts(t *testing.T) {
+	repo, d := newTestWebDAVRepository(t)
+	ctx := context.Background()
+
+	first, err := repo.WriteHistory(ctx, "book", History{Data: "page1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.mkcols != 1 || !d.collections["/history"] {
+		t.Errorf("the history folder was not created on the first write")
+	}
+	if first.Version == "" {
+		t.Errorf("first write has no version, though HEAD reports one")
+	}
+
+	if _, err := repo.WriteHistory(ctx, "book", History{Data: "again"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("creating a history that exists: %v, want ErrConflict", err)
+	}
+
+	second, err := repo.WriteHistory(ctx, "book", History{Data: "page2", Version: first.Version})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.WriteHistory(ctx, "book", History{Data: "page9", Version: first.Version}); !errors.Is(err, ErrConflict) {
+		t.Errorf("write based on an outdated version: %v, want ErrConflict", err)
+	}
+	if d.mkcols != 1 {
+		t.Errorf("%d MKCOL requests, want only the first write to create the folder", d.mkcols)
+	}
+
+	read, err := repo.GetHistory(ctx, "book")
+	if err != nil || strings.TrimSpace(read.Data) != "page2" || read.Version != second.Version {
+		t.Errorf("GetHistory = %+v, %v, want the second write", read, err)
+	}
+
+	for _, ID := range []string{"", ".", "..", "../books/a.epub", "a/b"} {
+		if _, err := repo.GetHistory(ctx, ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("reading the history of %q: %v, want ErrNotFound", ID, err)
+		}
+	}
+}
+
+func TestWebDAVUploadAndMove(t *testing.T) {
+	repo, d := newTestWebDAVRepository(t)
+	ctx := context.Background()
+	d.collections["/books"] = true
+	d.files["/books/a.epub"] = "taken"
+
+	uploaded, err := repo.Upload(ctx, "/books", "a.epub", strings.NewReader("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploaded.Name != "a (1).epub" || d.files["/books/a.epub"] != "taken" {
+		t.Errorf("upload over a taken name = %+v", uploaded)
+	}
+
+	if _, err := repo.Move(ctx, uploaded.ID, "/books", "a.epub"); !errors.Is(err, ErrConflict) {
+		t.Errorf("moving onto a taken name: %v, want ErrConflict", err)
+	}
+
+	moved, err := repo.Move(ctx, uploaded.ID, "/books", "b.epub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.files["/books/a (1).epub"]; ok || moved.Name != "b.epub" {
+		t.Errorf("move left files %v", d.files)
+	}
+}
@@ -0,0 +1,182 @@
+package book
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// xhtmlElements are the elements kept by cleanHTML. The values are what
+// they are renamed to, for elements long gone from HTML.
+var xhtmlElements = map[string]string{
+	"a": "a", "abbr": "abbr", "article": "article", "aside": "aside",
+	"b": "b", "big": "span", "blockquote": "blockquote", "br": "br",
+	"caption": "caption", "center": "div", "cite": "cite", "code": "code",
+	"col": "col", "colgroup": "colgroup", "dd": "dd", "del": "del",
+	"div": "div", "dl": "dl", "dt": "dt", "em": "em",
+	"figcaption": "figcaption", "figure": "figure", "font": "span",
+	"footer": "footer", "h1": "h1", "h2": "h2", "h3": "h3", "h4": "h4",
+	"h5": "h5", "h6": "h6", "header": "header", "hr": "hr", "i": "i",
+	"img": "img", "ins": "ins", "li": "li", "mark": "mark", "ol": "ol",
+	"p": "p", "pre": "pre", "q": "q", "s": "s", "section": "section",
+	"small": "small", "span": "span", "strike": "s", "strong": "strong",
+	"sub": "sub", "sup": "sup", "table": "table", "tbody": "tbody",
+	"td": "td", "tfoot": "tfoot", "th": "th", "thead": "thead", "tr": "tr",
+	"tt": "code", "u": "u", "ul": "ul",
+}
+
+// xhtmlDropped are the elements cleanHTML drops along with what is in them.
+var xhtmlDropped = map[string]bool{
+	"head": true, "script": true, "style": true, "title": true,
+	"noscript": true, "iframe": true, "object": true, "embed": true,
+	"template": true, "svg": true, "math": true, "button": true,
+	"input": true, "select": true, "textarea": true,
+}
+
+// xhtmlAttributes are the attributes cleanHTML keeps. epub:type marks notes
+// and the links to them, for readers that show notes in place.
+var xhtmlAttributes = map[string]bool{
+	"id": true, "class": true, "style": true, "title": true, "alt": true,
+	"colspan": true, "rowspan": true, "width": true, "height": true, "epub:type": true,
+}
+
+// cleanHTML parses the markup of the body of an HTML document, however
+// broken, and returns it as well-formed XHTML with only the elements and
+// attributes of xhtmlElements and xhtmlAttributes. The links and image
+// sources are passed through link and src, which return the value to use or
+// an empty string to drop the link or image. Either may be nil to keep them
+// as they are.
+func cleanHTML(markup string, link func(href string) string, src func(src string) string) string {
+	nodes, err := html.ParseFragment(strings.NewReader(markup), &html.Node{
+		Type: html.ElementNode, Data: "body", DataAtom: atom.Body,
+	})
+	if err != nil {
+		// The parser only fails when reading fails, which a string does not.
+		return ""
+	}
+
+	var out strings.Builder
+	for _, n := range nodes {
+		for _, cleaned := range cleanNode(n, link, src) {
+			html.Render(&out, cleaned)
+		}
+	}
+
+	return out.String()
+}
+
+// cleanNode returns the clean copy of n, which is several nodes if n itself
+// is dropped but not what is in it.
+func cleanNode(n *html.Node, link func(string) string, src func(string) string) (nodes []*html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		if text := xmlText(n.Data); text != "" {
+			nodes = append(nodes, &html.Node{Type: html.TextNode, Data: text})
+		}
+		return
+	case html.ElementNode, html.DocumentNode:
+	default:
+		return
+	}
+
+	var children []*html.Node
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		children = append(children, cleanNode(child, link, src)...)
+	}
+
+	name, ok := xhtmlElements[n.Data]
+	if n.Type == html.DocumentNode || n.Namespace != "" || !ok {
+		if xhtmlDropped[n.Data] {
+			return nil
+		}
+		return children
+	}
+
+	clean := &html.Node{Type: html.ElementNode, Data: name, DataAtom: atom.Lookup([]byte(name))}
+	var style string
+	for _, attr := range n.Attr {
+		if attr.Namespace != "" {
+			continue
+		}
+
+		value := xmlText(attr.Val)
+		switch {
+		case attr.Key == "href" && name == "a":
+			if link != nil {
+				value = link(value)
+			} else if !safeLink(value) {
+				value = ""
+			}
+		case attr.Key == "src" && name == "img":
+			if src != nil {
+				value = src(value)
+			}
+			if value == "" {
+				return children
+			}
+		case attr.Key == "align":
+			style += "text-align: " + value + ";"
+			continue
+		case attr.Key == "style":
+			style += value
+			continue
+		case !xhtmlAttributes[attr.Key]:
+			continue
+		}
+
+		if value != "" {
+			clean.Attr = append(clean.Attr, html.Attribute{Key: attr.Key, Val: value})
+		}
+	}
+
+	if n.Data == "center" {
+		style += "text-align: center;"
+	}
+	if style != "" {
+		clean.Attr = append(clean.Attr, html.Attribute{Key: "style", Val: style})
+	}
+
+	if name == "img" {
+		hasAlt := false
+		for _, attr := range clean.Attr {
+			hasAlt = hasAlt || attr.Key == "alt"
+		}
+		if !hasAlt {
+			clean.Attr = append(clean.Attr, html.Attribute{Key: "alt", Val: ""})
+		}
+	}
+
+	for _, child := range children {
+		clean.AppendChild(child)
+	}
+
+	return []*html.Node{clean}
+}
+
+// safeLink reports whether href is a link to the web, to an email address or
+// within the book.
+func safeLink(href string) bool {
+	lower := strings.ToLower(strings.TrimSpace(href))
+	if i := strings.IndexAny(lower, ":/?#"); i < 0 || lower[i] != ':' {
+		return true
+	}
+
+	return strings.HasPrefix(lower, "http:") || strings.HasPrefix(lower, "https:") || strings.HasPrefix(lower, "mailto:")
+}
+
+// xmlText drops the characters that may not appear in XML.
+func xmlText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' || r == 0xfffe || r == 0xffff ||
+			r >= 0xd800 && r <= 0xdfff {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// xhtmlEscape escapes s for text or an attribute value in XHTML.
+func xhtmlEscape(s string) string {
+	return html.EscapeString(xmlText(s))
+}
@@ -0,0 +1,120 @@
+package book
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// xmlBlocks are the elements whose text is separated from what follows by a
+// space when the text of an element is taken: the paragraphs, verses and
+// titles of FB2 and the paragraphs of Word documents.
+var xmlBlocks = map[string]bool{
+	"p": true, "v": true, "subtitle": true, "text-author": true, "title": true, "empty-line": true,
+}
+
+// xmlNode is an element of an XML document, or a piece of text if Name is
+// empty. Elements and attributes are kept by their names without namespace.
+type xmlNode struct {
+	Name     string
+	Attrs    map[string]string
+	Text     string
+	Children []*xmlNode
+}
+
+// parseXML reads the XML document in r into a tree and returns the node
+// holding its root element. The documents of books are often not quite valid
+// XML, and in other encodings than UTF-8, so the parser is lenient.
+func parseXML(r io.Reader) (document *xmlNode, err error) {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	decoder.CharsetReader = charsetReader
+
+	stack := []*xmlNode{{}}
+	for {
+		var token xml.Token
+		if token, err = decoder.Token(); err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+
+		top := stack[len(stack)-1]
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{Name: t.Name.Local, Attrs: map[string]string{}}
+			for _, attr := range t.Attr {
+				if attr.Name.Space != "xmlns" && attr.Name.Local != "xmlns" {
+					node.Attrs[attr.Name.Local] = attr.Value
+				}
+			}
+			top.Children = append(top.Children, node)
+			stack = append(stack, node)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			top.Children = append(top.Children, &xmlNode{Text: string(t)})
+		}
+	}
+
+	return stack[0], nil
+}
+
+// child returns the first child element of node with the given name, or nil
+// if there is none or node is nil.
+func (node *xmlNode) child(name string) *xmlNode {
+	if node == nil {
+		return nil
+	}
+
+	for _, child := range node.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+
+	return nil
+}
+
+// children returns the children of node, or nothing if node is nil.
+func (node *xmlNode) children() []*xmlNode {
+	if node == nil {
+		return nil
+	}
+
+	return node.Children
+}
+
+// text returns the text in node, with white space collapsed.
+func (node *xmlNode) text() string {
+	var text strings.Builder
+	var walk func(n *xmlNode)
+	walk = func(n *xmlNode) {
+		text.WriteString(n.Text)
+		for _, child := range n.Children {
+			walk(child)
+		}
+		if xmlBlocks[n.Name] {
+			text.WriteString(" ")
+		}
+	}
+	if node != nil {
+		walk(node)
+	}
+
+	return strings.Join(strings.Fields(text.String()), " ")
+}
+
+// attr returns the value of the attribute of node with the given name, or an
+// empty string if there is none or node is nil.
+func (node *xmlNode) attr(name string) string {
+	if node == nil {
+		return ""
+	}
+
+	return node.Attrs[name]
+}
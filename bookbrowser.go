@@ -1,26 +1,277 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/spf13/pflag"
+	"github.com/tushar9989/e-reader/book"
 	"github.com/tushar9989/e-reader/server"
+	"golang.org/x/oauth2"
 )
 
 func main() {
-	bookDir := pflag.StringP("bookdir", "b", "/books", "the dropbox directory to load books from")
-	history := pflag.StringP("historydir", "h", "/history", "the dropbox directory to save the history to")
-	token := pflag.StringP("token", "t", "DROPBOX_TOKEN", "the dropbox token")
+	backend := pflag.String("backend", "dropbox", "the storage backend to use (dropbox, local, s3, webdav, sftp, calibre, memory, composite)")
+	bookDir := pflag.StringP("bookdir", "b", "/books", "the directory to load books from")
+	history := pflag.StringP("historydir", "h", "/history", "the directory to save the history to")
+	trash := pflag.String("trashdir", "/trash", "the directory deleted books are moved to")
+	token := pflag.StringP("token", "t", "DROPBOX_TOKEN", "a long-lived dropbox token, if not connecting through /setup/dropbox")
+	dropboxAppKey := pflag.String("dropbox-app-key", "", "the key of the dropbox app to connect through /setup/dropbox, which replaces --token")
+	dropboxTokenFile := pflag.String("dropbox-token-file", "dropbox-token.json", "the file the dropbox refresh token is kept in")
+	root := pflag.StringP("root", "r", ".", "the local directory bookdir and historydir are resolved in (local and calibre backends)")
+	s3Endpoint := pflag.String("s3-endpoint", "http://localhost:9000", "the s3 compatible endpoint (s3 backend)")
+	s3Region := pflag.String("s3-region", "us-east-1", "the s3 region (s3 backend)")
+	s3Bucket := pflag.String("s3-bucket", "books", "the s3 bucket (s3 backend)")
+	s3AccessKey := pflag.String("s3-access-key", "S3_ACCESS_KEY", "the s3 access key (s3 backend)")
+	s3SecretKey := pflag.String("s3-secret-key", "S3_SECRET_KEY", "the s3 secret key (s3 backend)")
+	webDAVURL := pflag.String("webdav-url", "http://localhost/remote.php/dav/files/USER", "the webdav base url (webdav backend)")
+	webDAVUser := pflag.String("webdav-user", "", "the webdav username (webdav backend)")
+	webDAVPassword := pflag.String("webdav-password", "", "the webdav password or app password (webdav backend)")
+	sftpAddr := pflag.String("sftp-addr", "localhost:22", "the ssh host to connect to (sftp backend)")
+	sftpUser := pflag.String("sftp-user", "", "the ssh user (sftp backend)")
+	sftpPassword := pflag.String("sftp-password", "", "the ssh password, if not using a key (sftp backend)")
+	sftpKey := pflag.String("sftp-key", "", "the ssh private key file (sftp backend)")
+	sftpKnownHosts := pflag.String("sftp-known-hosts", filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts"), "the known_hosts file used to verify the host key (sftp backend)")
+	seedDir := pflag.String("seed-dir", "", "the local directory to copy books from into bookdir, the built-in samples if empty (memory backend)")
+	sourceSpecs := pflag.StringArray("source", nil, "a library to mount as name=backend[:path], may be repeated (composite backend)")
+	historySource := pflag.String("history-source", "", "the name of the source that stores the history (composite backend)")
+	historyBackend := pflag.String("history-store", "repository", "where to keep the reading history (repository, sqlite)")
+	historyDB := pflag.String("history-db", "history.db", "the database file of the sqlite history store")
+	historyPassphrase := pflag.String("history-passphrase", "", "encrypt the reading history with a key derived from this passphrase, disabled if empty")
+	historyOldPassphrases := pflag.StringArray("history-old-passphrase", nil, "a previous history passphrase, to read what it encrypted until it is written again, may be repeated")
+	historySaltFile := pflag.String("history-salt-file", "history-salt", "the file the salt of the history encryption key is kept in across restarts, a new salt on every start if empty")
+	historyAcceptPlain := pflag.Bool("history-accept-plaintext", false, "read unencrypted histories while --history-passphrase is set, to migrate those written before encryption was turned on")
+	dryRun := pflag.Bool("dry-run", false, "only show what the restore command would change")
+	index := pflag.Bool("index", true, "serve listings from a catalogue kept up to date in the background, if the backend reports changes (dropbox backend)")
+	indexFile := pflag.String("index-file", "index.json", "the file the catalogue is kept in across restarts, in memory only if empty")
+	identity := pflag.Bool("identity", true, "recognise books by content and metadata so that progress follows copies, moves and re-uploads")
+	identityFile := pflag.String("identity-file", "identities.json", "the file book identities are kept in across restarts, in memory only if empty")
+	convertDir := pflag.String("convert-dir", "converted", "the local directory books converted to EPUB, such as MOBI books, are kept in")
+	cacheDir := pflag.String("cache-dir", "", "the local directory to cache downloaded books in, disabled if empty")
+	cacheSize := pflag.Int64("cache-size", 1024, "the size budget of the download cache in MB")
 	addr := pflag.StringP("addr", "a", ":8090", "the address to bind the server to ([IP]:PORT)")
 	dictionaryToken := pflag.StringP("dicttoken", "d", "DICT_TOKEN", "the dictionary token")
+	adminToken := pflag.String("admin-token", "", "the bearer token required by /admin/backup and /admin/restore, which are disabled if empty")
 	pflag.Parse()
 
 	if !strings.Contains(*addr, ":") {
 		log.Fatalln("Error: invalid listening address")
 	}
 
-	s := server.NewServer(*addr, true, *token, *history, *bookDir, *dictionaryToken)
+	var dropboxAuth *book.DropboxAuth
+	newRepository := func(backend string) (repo book.Repository, err error) {
+		switch backend {
+		case "dropbox":
+			var tokens oauth2.TokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: *token})
+			if *dropboxAppKey != "" {
+				if dropboxAuth == nil {
+					if dropboxAuth, err = book.NewDropboxAuth(*dropboxAppKey, *dropboxTokenFile); err != nil {
+						return
+					}
+				}
+				tokens = dropboxAuth
+			}
+
+			repo = book.NewDropboxRepository(tokens, *history)
+		case "local":
+			repo = book.NewLocalRepository(*root, *history)
+		case "s3":
+			repo, err = book.NewS3Repository(
+				*s3Endpoint, *s3Region, *s3Bucket, *s3AccessKey, *s3SecretKey, *history,
+			)
+		case "webdav":
+			repo, err = book.NewWebDAVRepository(
+				*webDAVURL, *webDAVUser, *webDAVPassword, *history,
+			)
+		case "sftp":
+			repo, err = book.NewSFTPRepository(
+				*sftpAddr, *sftpUser, *sftpPassword, *sftpKey, *sftpKnownHosts, *history,
+			)
+		case "calibre":
+			repo, err = book.NewCalibreRepository(*root, *history)
+		case "memory":
+			memory := book.NewMemoryRepository()
+			if *seedDir != "" {
+				err = memory.SeedDirectory(*seedDir, *bookDir)
+			} else {
+				err = memory.SeedSamples(*bookDir)
+			}
+			repo = memory
+		default:
+			err = fmt.Errorf("unknown backend %s", backend)
+		}
+
+		return
+	}
+
+	var (
+		repo book.Repository
+		err  error
+	)
+	if *backend == "composite" {
+		var sources []book.Source
+		for _, spec := range *sourceSpecs {
+			// name=backend[:path]
+			parts := strings.SplitN(spec, "=", 2)
+			if len(parts) != 2 {
+				log.Fatalf("Error: invalid source %s\n", spec)
+			}
+
+			target := strings.SplitN(parts[1], ":", 2)
+			source := book.Source{Name: parts[0]}
+			if len(target) == 2 {
+				source.Path = target[1]
+			}
+
+			if source.Repo, err = newRepository(target[0]); err != nil {
+				log.Fatalf("Error: source %s: %s\n", source.Name, err)
+			}
+
+			sources = append(sources, source)
+		}
+
+		repo, err = book.NewCompositeRepository(sources, *historySource)
+	} else {
+		repo, err = newRepository(*backend)
+	}
+
+	if err != nil {
+		log.Fatalf("Error: %s\n", err)
+	}
+
+	var historyStore book.HistoryStore
+	switch *historyBackend {
+	case "repository":
+		var ok bool
+		if historyStore, ok = repo.(book.HistoryStore); !ok {
+			log.Fatalf("Error: backend %s can not store history\n", *backend)
+		}
+	case "sqlite":
+		if historyStore, err = book.NewSQLiteHistoryStore(*historyDB); err != nil {
+			log.Fatalf("Error: %s\n", err)
+		}
+	default:
+		log.Fatalf("Error: unknown history store %s\n", *historyBackend)
+	}
+
+	if *historyPassphrase != "" {
+		if historyStore, err = book.NewEncryptedHistoryStore(
+			historyStore, append([]string{*historyPassphrase}, *historyOldPassphrases...),
+			*historySaltFile, *historyAcceptPlain,
+		); err != nil {
+			log.Fatalf("Error: %s\n", err)
+		}
+	}
+
+	if pflag.Arg(0) == "migrate-history" {
+		from, ok := repo.(interface {
+			book.HistoryStore
+			book.HistoryLister
+		})
+		if !ok || *historyBackend == "repository" {
+			log.Fatalf("Error: can only migrate from the history of the %s backend to another history store\n", *backend)
+		}
+
+		imported, skipped, err := book.MigrateHistory(context.Background(), from, historyStore)
+		log.Printf("Imported %d histories, skipped %d\n", imported, skipped)
+		if err != nil {
+			log.Fatalf("Error: %s\n", err)
+		}
+		return
+	}
+
+	switch pflag.Arg(0) {
+	case "backup":
+		if pflag.Arg(1) == "" {
+			log.Fatalln("Error: usage: backup FILE")
+		}
+
+		file, err := os.Create(pflag.Arg(1))
+		if err != nil {
+			log.Fatalf("Error: %s\n", err)
+		}
+
+		manifest, err := book.WriteBackup(context.Background(), file, repo, historyStore, *bookDir)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(pflag.Arg(1))
+			log.Fatalf("Error: %s\n", err)
+		}
+
+		log.Printf("Saved %d books and %d histories to %s\n", manifest.Books, manifest.Histories, pflag.Arg(1))
+		return
+	case "restore":
+		if pflag.Arg(1) == "" {
+			log.Fatalln("Error: usage: restore FILE [--dry-run]")
+		}
+
+		data, err := ioutil.ReadFile(pflag.Arg(1))
+		if err != nil {
+			log.Fatalf("Error: %s\n", err)
+		}
+
+		backup, err := book.ReadBackup(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			log.Fatalf("Error: %s\n", err)
+		}
+
+		changes, err := book.RestoreBackup(context.Background(), backup, repo, historyStore, *bookDir, *dryRun)
+		for _, change := range changes {
+			name := change.Path
+			if name == "" {
+				name = change.ID
+			}
+			fmt.Printf("%-9s %s: %q -> %q\n", change.Action, name, change.Old, change.New)
+		}
+		if err != nil {
+			log.Fatalf("Error: %s\n", err)
+		}
+		return
+	}
+
+	if _, ok := repo.(book.WatchRepository); ok && *index {
+		var indexed *book.IndexedRepository
+		if indexed, err = book.NewIndexedRepository(repo, *bookDir, *indexFile); err != nil {
+			log.Fatalf("Error: %s\n", err)
+		}
+
+		go indexed.Run(context.Background())
+		repo = indexed
+	}
+
+	if *cacheDir != "" {
+		if repo, err = book.NewCachedRepository(repo, *cacheDir, *cacheSize<<20); err != nil {
+			log.Fatalf("Error: %s\n", err)
+		}
+	}
+
+	if *identity {
+		var identified *book.IdentityRepository
+		if identified, err = book.NewIdentityRepository(repo, historyStore, *identityFile); err != nil {
+			log.Fatalf("Error: %s\n", err)
+		}
+
+		repo = identified
+		historyStore = identified
+	}
+
+	if repo, err = book.NewConvertingRepository(repo, *convertDir); err != nil {
+		log.Fatalf("Error: %s\n", err)
+	}
+
+	if dropboxAuth != nil && dropboxAuth.SetupToken() != "" {
+		log.Printf("To connect Dropbox, visit /setup/dropbox?token=%s\n", dropboxAuth.SetupToken())
+	}
+
+	s := server.NewServer(*addr, true, repo, historyStore, *bookDir, *trash, *history, dropboxAuth, *dictionaryToken, *adminToken)
 	if err := s.Serve(); err != nil {
 		log.Fatalf("Error starting server: %s\n", err)
 	}
@@ -0,0 +1,71 @@
+var manageBook = function(url, params) {
+    var data = new URLSearchParams();
+    for (var key in params) {
+        data.append(key, params[key]);
+    }
+
+    fetch(url, {
+        method: "POST",
+        body: data,
+        headers: { "Accept": "application/json" },
+        credentials: "same-origin"
+    }).then(function(res) {
+        if (res.ok) {
+            location.reload();
+            return;
+        }
+
+        return res.json().then(function(body) {
+            alert(body.message);
+        }, function() {
+            alert(res.statusText);
+        });
+    }, function(reason) {
+        alert(reason);
+    });
+};
+
+// extension returns the extension of name including the dot, so that renames
+// keep the format of the book.
+var extension = function(name) {
+    var i = name.lastIndexOf(".");
+    return i > 0 ? name.slice(i) : "";
+};
+
+document.addEventListener("click", function(e) {
+    var button = e.target.closest(".actions button");
+    if (!button) {
+        return;
+    }
+
+    var actions = button.parentNode;
+    var id = actions.dataset.id;
+    var name = actions.dataset.name;
+    var folder = actions.dataset.folder;
+
+    switch (button.dataset.action) {
+    case "rename":
+        var renamed = prompt("Rename " + name + " to", name);
+        if (renamed && renamed != name) {
+            if (extension(renamed).toLowerCase() != extension(name).toLowerCase()) {
+                renamed += extension(name);
+            }
+            manageBook("/move/" + id, { name: renamed, folder: folder });
+        }
+        break;
+    case "move":
+        var moved = prompt("Move " + name + " to folder (empty for the top of the library)", folder);
+        if (moved !== null && moved != folder) {
+            manageBook("/move/" + id, { name: name, folder: moved });
+        }
+        break;
+    case "delete":
+        if (confirm("Move " + name + " to the trash?")) {
+            manageBook("/delete/" + id, { name: name, folder: folder });
+        }
+        break;
+    case "restore":
+        manageBook("/restore/" + id, { name: name, folder: folder });
+        break;
+    }
+});
@@ -0,0 +1,290 @@
+'use strict';
+
+// How many seconds the skip buttons and arrow keys move by.
+var SKIP_SECONDS = 30;
+// How often, in seconds of listening, the position is saved.
+var SAVE_SECONDS = 5;
+// Going to the previous chapter within this many seconds of the start of
+// one goes to the one before it, as players do.
+var RESTART_SECONDS = 3;
+
+var id = findGetParameter("id");
+var bookHistory = new History(id || "");
+var audiobook = null;
+var currentTrack = -1;
+// pendingSeek is where to go once the track being loaded can be played.
+var pendingSeek = null;
+var savedPosition = "";
+
+var audio = document.getElementById("audio");
+var seek = document.getElementById("seek");
+var playButton = document.getElementById("play");
+var chapterList = document.getElementById("chapters");
+var snackbar = document.getElementById("snackbar");
+
+// formatTime formats seconds as h:mm:ss, or m:ss for less than an hour.
+function formatTime(seconds) {
+  seconds = Math.floor(seconds || 0);
+  var h = Math.floor(seconds / 3600);
+  var m = Math.floor(seconds / 60) % 60;
+  var s = seconds % 60;
+  var time = (s < 10 ? "0" : "") + s;
+  if (h > 0) {
+    return h + ":" + (m < 10 ? "0" : "") + m + ":" + time;
+  }
+  return m + ":" + time;
+}
+
+// playTrack goes to time seconds into track, playing it if play is set.
+function playTrack(track, time, play) {
+  track = Math.min(Math.max(track, 0), audiobook.tracks.length - 1);
+
+  if (track !== currentTrack) {
+    currentTrack = track;
+    pendingSeek = {time: time, play: play};
+    audio.src = "/audio/" + encodeURIComponent(audiobook.tracks[track].id);
+    audio.load();
+    return;
+  }
+
+  audio.currentTime = time;
+  if (play) {
+    audio.play();
+  }
+}
+
+// chapterIndex returns the index of the chapter being played.
+function chapterIndex() {
+  var index = 0;
+  audiobook.chapters.forEach(function(chapter, i) {
+    if (chapter.track < currentTrack || chapter.track === currentTrack && chapter.start <= audio.currentTime + 0.5) {
+      index = i;
+    }
+  });
+  return index;
+}
+
+function playChapter(index) {
+  if (index < 0 || index >= audiobook.chapters.length) {
+    return;
+  }
+
+  var chapter = audiobook.chapters[index];
+  playTrack(chapter.track, chapter.start, !audio.paused || (pendingSeek !== null && pendingSeek.play));
+}
+
+function showPosition() {
+  if (!audiobook) {
+    return;
+  }
+
+  var index = chapterIndex();
+  document.getElementById("chapter").textContent = audiobook.chapters[index].title;
+  Array.prototype.forEach.call(chapterList.children, function(item, i) {
+    item.classList.toggle("current", i === index);
+  });
+
+  document.getElementById("currentTime").textContent = formatTime(audio.currentTime);
+  document.getElementById("duration").textContent = formatTime(audio.duration);
+  seek.max = Math.floor(audio.duration || 0);
+  if (!seek.matches(":active")) {
+    seek.value = Math.floor(audio.currentTime);
+  }
+
+  document.getElementById("previous").disabled = (index === 0 && audio.currentTime < RESTART_SECONDS);
+  document.getElementById("next").disabled = (index >= audiobook.chapters.length - 1);
+
+  // The position is kept as the track and the second into it.
+  if (bookHistory && pendingSeek === null) {
+    var position = currentTrack + ":" + Math.floor(audio.currentTime / SAVE_SECONDS) * SAVE_SECONDS;
+    if (position !== savedPosition) {
+      savedPosition = position;
+      bookHistory.update(position);
+    }
+  }
+}
+
+function showError(message) {
+  snackbar.innerHTML = message;
+  snackbar.classList.add('show');
+}
+
+function showAudiobook() {
+  document.title = audiobook.title;
+  document.getElementById("title").textContent = audiobook.title;
+  document.getElementById("authors").textContent = (audiobook.authors || []).join(", ");
+
+  audiobook.chapters.forEach(function(chapter, i) {
+    var item = document.createElement("li");
+    item.textContent = chapter.title;
+    item.addEventListener('click', function() {
+      playChapter(i);
+    });
+    chapterList.appendChild(item);
+  });
+}
+
+audio.addEventListener('loadedmetadata', function() {
+  if (pendingSeek === null) {
+    return;
+  }
+
+  var seekTo = pendingSeek;
+  pendingSeek = null;
+  audio.currentTime = Math.min(seekTo.time, audio.duration || seekTo.time);
+  if (seekTo.play) {
+    audio.play();
+  }
+  showPosition();
+});
+
+audio.addEventListener('timeupdate', showPosition);
+
+audio.addEventListener('play', function() {
+  playButton.innerHTML = "&#x23F8;";
+  playButton.title = "Pause";
+});
+
+audio.addEventListener('pause', function() {
+  playButton.innerHTML = "&#x25B6;";
+  playButton.title = "Play";
+});
+
+audio.addEventListener('ended', function() {
+  if (currentTrack < audiobook.tracks.length - 1) {
+    playTrack(currentTrack + 1, 0, true);
+  }
+});
+
+audio.addEventListener('error', function() {
+  if (currentTrack >= 0) {
+    showError("track " + (currentTrack + 1) + " could not be played");
+  }
+});
+
+audio.addEventListener('canplay', function() {
+  snackbar.classList.remove('show');
+});
+
+playButton.addEventListener('click', function() {
+  if (audio.paused) {
+    audio.play();
+  } else {
+    audio.pause();
+  }
+});
+
+document.getElementById("back").addEventListener('click', function() {
+  audio.currentTime = Math.max(audio.currentTime - SKIP_SECONDS, 0);
+});
+
+document.getElementById("forward").addEventListener('click', function() {
+  audio.currentTime = Math.min(audio.currentTime + SKIP_SECONDS, audio.duration || 0);
+});
+
+document.getElementById("previous").addEventListener('click', function() {
+  var index = chapterIndex();
+  var chapter = audiobook.chapters[index];
+  if (chapter.track === currentTrack && audio.currentTime - chapter.start > RESTART_SECONDS) {
+    playChapter(index);
+  } else {
+    playChapter(index - 1);
+  }
+});
+
+document.getElementById("next").addEventListener('click', function() {
+  playChapter(chapterIndex() + 1);
+});
+
+seek.addEventListener('change', function() {
+  audio.currentTime = +this.value;
+});
+
+document.getElementById("speed").addEventListener('change', function() {
+  audio.playbackRate = +this.value;
+});
+
+document.addEventListener('keydown', function(evt) {
+  if (!audiobook || evt.target.tagName === "INPUT" || evt.target.tagName === "SELECT") {
+    return;
+  }
+
+  switch (evt.key) {
+    case " ":
+      playButton.click();
+      break;
+    case "ArrowLeft":
+      document.getElementById("back").click();
+      break;
+    case "ArrowRight":
+      document.getElementById("forward").click();
+      break;
+    case "PageUp":
+      document.getElementById("previous").click();
+      break;
+    case "PageDown":
+      document.getElementById("next").click();
+      break;
+    default:
+      return;
+  }
+  evt.preventDefault();
+});
+
+if (!id) {
+  showError("no audiobook given");
+} else {
+  var xhr = new XMLHttpRequest();
+  xhr.open("GET", "/audiobook/" + encodeURIComponent(id), true);
+  xhr.setRequestHeader("Accept", "application/json");
+  xhr.onload = function() {
+    var res;
+    try {
+      res = JSON.parse(xhr.response);
+    } catch (e) {
+      res = {message: xhr.response};
+    }
+
+    if (xhr.status !== 200) {
+      showError("opening the audiobook failed. message: " + res.message);
+      return;
+    }
+
+    audiobook = res;
+    showAudiobook();
+
+    bookHistory.get().then(
+      function(position) {
+        var parts = String(position).split(":");
+        var track = parseInt(parts[0], 10), time = parseFloat(parts[1]);
+        if (isNaN(track) || isNaN(time)) {
+          playTrack(0, 0, false);
+          return;
+        }
+        savedPosition = position;
+        playTrack(track, time, false);
+      },
+      function(response) {
+        console.error(response);
+        playTrack(0, 0, false);
+      }
+    );
+  };
+  xhr.onerror = function() {
+    showError("opening the audiobook failed. message: " + xhr.statusText);
+  };
+  xhr.send(null);
+}
+
+function findGetParameter(parameterName) {
+  var result = null,
+      tmp = [];
+  location.search
+      .substr(1)
+      .split("&")
+      .forEach(function (item) {
+        tmp = item.split("=");
+        if (tmp[0] === parameterName) result = decodeURIComponent(tmp[1]);
+      });
+  return result;
+}
@@ -0,0 +1,177 @@
+'use strict';
+
+// How many pages after the current one are fetched ahead of time.
+var PRELOAD_PAGES = 2;
+
+var id = findGetParameter("id");
+var bookHistory = new History(id || "");
+var pageCount = 0;
+var currentPage = 0;
+var preloaded = {};
+
+var image = document.getElementById("page");
+var footer = document.getElementsByTagName("footer")[0];
+var snackbar = document.getElementById("snackbar");
+
+function pageURL(page) {
+  return "/comic/" + encodeURIComponent(id) + "/" + page;
+}
+
+function showPage(page) {
+  page = Math.min(Math.max(page, 1), pageCount);
+  if (page === currentPage) {
+    return;
+  }
+
+  currentPage = page;
+  image.src = pageURL(page);
+
+  document.getElementById("pageNumber").value = page;
+  document.getElementById("previous").disabled = (page <= 1);
+  document.getElementById("next").disabled = (page >= pageCount);
+
+  for (var next = page + 1; next <= Math.min(page + PRELOAD_PAGES, pageCount); next++) {
+    if (!preloaded[next]) {
+      preloaded[next] = new Image();
+      preloaded[next].src = pageURL(next);
+    }
+  }
+
+  if (bookHistory) {
+    bookHistory.update(page);
+  }
+}
+
+function showError(message) {
+  snackbar.innerHTML = message;
+  snackbar.classList.add('show');
+}
+
+document.getElementById("previous").addEventListener('click', function() {
+  showPage(currentPage - 1);
+});
+
+document.getElementById("next").addEventListener('click', function() {
+  showPage(currentPage + 1);
+});
+
+document.getElementById("previousArea").addEventListener('click', function(evt) {
+  evt.stopPropagation();
+  showPage(currentPage - 1);
+});
+
+document.getElementById("nextArea").addEventListener('click', function(evt) {
+  evt.stopPropagation();
+  showPage(currentPage + 1);
+});
+
+document.getElementById("viewer").addEventListener('click', function() {
+  footer.classList.toggle('hidden');
+});
+
+document.getElementById("pageNumber").addEventListener('change', function() {
+  var page = parseInt(this.value, 10);
+  if (isNaN(page)) {
+    this.value = currentPage;
+    return;
+  }
+
+  showPage(page);
+  this.value = currentPage;
+});
+
+document.addEventListener('keydown', function(evt) {
+  if (evt.target.tagName === "INPUT") {
+    return;
+  }
+
+  switch (evt.key) {
+    case "ArrowLeft":
+    case "PageUp":
+      showPage(currentPage - 1);
+      break;
+    case "ArrowRight":
+    case "PageDown":
+    case " ":
+      showPage(currentPage + 1);
+      break;
+    case "Home":
+      showPage(1);
+      break;
+    case "End":
+      showPage(pageCount);
+      break;
+    default:
+      return;
+  }
+  evt.preventDefault();
+});
+
+image.addEventListener('error', function() {
+  showError("page " + currentPage + " could not be loaded");
+});
+
+image.addEventListener('load', function() {
+  snackbar.classList.remove('show');
+});
+
+if (!id) {
+  showError("no comic given");
+} else {
+  var xhr = new XMLHttpRequest();
+  xhr.open("GET", "/comic/" + encodeURIComponent(id), true);
+  xhr.setRequestHeader("Accept", "application/json");
+  xhr.onload = function() {
+    var res;
+    try {
+      res = JSON.parse(xhr.response);
+    } catch (e) {
+      res = {message: xhr.response};
+    }
+
+    if (xhr.status !== 200) {
+      showError("opening the comic failed. message: " + res.message);
+      return;
+    }
+
+    pageCount = res.pages;
+    document.getElementById("pageCount").textContent = "/ " + pageCount;
+    document.getElementById("pageNumber").max = pageCount;
+
+    if (pageCount === 0) {
+      showError("the comic has no pages");
+      return;
+    }
+
+    showPage(1);
+
+    bookHistory.get().then(
+      function(page) {
+        page = +page;
+        if (!isNaN(page) && page > 1) {
+          showPage(page);
+        }
+      },
+      function(response) {
+        console.error(response);
+      }
+    );
+  };
+  xhr.onerror = function() {
+    showError("opening the comic failed. message: " + xhr.statusText);
+  };
+  xhr.send(null);
+}
+
+function findGetParameter(parameterName) {
+  var result = null,
+      tmp = [];
+  location.search
+      .substr(1)
+      .split("&")
+      .forEach(function (item) {
+        tmp = item.split("=");
+        if (tmp[0] === parameterName) result = decodeURIComponent(tmp[1]);
+      });
+  return result;
+}
@@ -33,7 +33,7 @@ function History(BOOK_ID) {
 
                             var snackbar = document.getElementById("snackbar");
                             snackbar.classList.toggle('show');
-                            snackbar.innerHTML = "get history failed. message: " + xhr.response;
+                            snackbar.innerHTML = "get history failed. message: " + errorMessage(xhr);
                             setTimeout(function(){ 
                                 snackbar.classList.toggle('show');
                             }, 5000);
@@ -66,8 +66,19 @@ function History(BOOK_ID) {
             "/history/set/" + BOOK_ID,
             "POST",
             function(xhr) {
+                if (xhr.status === 409) {
+                    // Saved from somewhere else in the meantime, pick up the
+                    // latest version and overwrite it with this page.
+                    refreshVersion();
+                    return;
+                }
+
                 if (xhr.status !== 201) {
-                    showHistoryFailedMessage(xhr.response);
+                    if (xhr.status === 401) {
+                        showHistoryFailedMessage("not authorized to save history, check the storage credentials");
+                    } else {
+                        showHistoryFailedMessage(errorMessage(xhr));
+                    }
                     console.error("save history failed.", xhr.statusText);
                     return;
                 }
@@ -84,6 +95,34 @@ function History(BOOK_ID) {
         )
     }
 
+    function refreshVersion() {
+        makeRequest(
+            "/history/get/" + BOOK_ID,
+            "GET",
+            function(xhr) {
+                if (xhr.status !== 200) {
+                    showHistoryFailedMessage(errorMessage(xhr));
+                    return;
+                }
+
+                HISTORY_VERSION = JSON.parse(xhr.response).version;
+                save();
+            }, undefined, function(reason) {
+                showHistoryFailedMessage(reason);
+            }
+        );
+    }
+
+    // errorMessage returns the message of an error response of the server,
+    // falling back to the raw response.
+    function errorMessage(xhr) {
+        try {
+            return JSON.parse(xhr.response).message;
+        } catch (e) {
+            return xhr.response;
+        }
+    }
+
     function showHistoryFailedMessage(message) {
         var snackbar = document.getElementById("snackbar");
         snackbar.classList.toggle('show');
@@ -0,0 +1,79 @@
+var uf = document.querySelector("form.upload");
+var us = uf.querySelector(".status");
+var ui = uf.querySelector("input[type=file]");
+
+var uploadFiles = function(files) {
+    var queue = Array.prototype.slice.call(files);
+    var failed = [];
+
+    var next = function() {
+        var file = queue.shift();
+        if (!file) {
+            if (failed.length == 0) {
+                // The new books are listed right away.
+                location.reload();
+            } else {
+                us.textContent = failed.join(", ");
+                uf.classList.remove("busy");
+            }
+            return;
+        }
+
+        us.textContent = "Uploading " + file.name + "...";
+
+        var data = new FormData();
+        data.append("file", file, file.name);
+
+        fetch(uf.action, {
+            method: "POST",
+            body: data,
+            headers: { "Accept": "application/json" },
+            credentials: "same-origin"
+        }).then(function(res) {
+            if (res.ok) {
+                return;
+            }
+
+            return res.json().then(function(body) {
+                failed.push(file.name + ": " + body.message);
+            }, function() {
+                failed.push(file.name + ": " + res.statusText);
+            });
+        }, function(reason) {
+            failed.push(file.name + ": " + reason);
+        }).then(next);
+    };
+
+    uf.classList.add("busy");
+    next();
+};
+
+uf.addEventListener("submit", function(e) {
+    e.preventDefault();
+    if (ui.files.length > 0) {
+        uploadFiles(ui.files);
+    }
+});
+
+ui.addEventListener("change", function() {
+    uploadFiles(ui.files);
+});
+
+document.addEventListener("dragover", function(e) {
+    e.preventDefault();
+    uf.classList.add("dragging");
+});
+
+document.addEventListener("dragleave", function(e) {
+    if (!e.relatedTarget) {
+        uf.classList.remove("dragging");
+    }
+});
+
+document.addEventListener("drop", function(e) {
+    e.preventDefault();
+    uf.classList.remove("dragging");
+    if (e.dataTransfer && e.dataTransfer.files.length > 0) {
+        uploadFiles(e.dataTransfer.files);
+    }
+});
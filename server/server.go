@@ -1,15 +1,24 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/tushar9989/e-reader/book"
@@ -17,6 +26,13 @@ import (
 	"github.com/unrolled/render"
 )
 
+// errInvalidRequest is returned for requests that are missing parameters or
+// have a malformed body.
+var errInvalidRequest = errors.New("invalid request")
+
+// maxBackupSize is the largest backup archive that can be restored.
+const maxBackupSize = 64 << 20
+
 // Server is a BookBrowser server.
 type Server struct {
 	Addr            string
@@ -24,25 +40,40 @@ type Server struct {
 	router          *httprouter.Router
 	render          *render.Render
 	repo            book.Repository
+	history         book.HistoryStore
 	bookPath        string
+	trashPath       string
+	dropbox         *book.DropboxAuth
+	comics          *book.Comics
+	audiobooks      *book.Audiobooks
 	dictionaryToken string
+	// adminToken is required as a bearer token by the /admin routes, which
+	// are not served if it is empty.
+	adminToken string
 }
 
 // NewServer creates a new BookBrowser server.
 func NewServer(
-	addr string, verbose bool, token string, historyPrefix string, bookPath string, dictionaryToken string,
+	addr string, verbose bool, repo book.Repository, history book.HistoryStore, bookPath string,
+	trashPath string, historyPath string, dropbox *book.DropboxAuth, dictionaryToken string, adminToken string,
 ) *Server {
 	if verbose {
-		log.Printf("Supported formats: %s", ".pdf")
+		log.Printf("Supported formats: %s", ".epub, .pdf, .mobi, .azw, .azw3, .fb2, .fb2.zip, .docx, .txt, .md, .markdown, .cbz, .cbr, .cb7, .m4b, .mp3")
 	}
 
 	s := &Server{
 		Addr:            addr,
 		Verbose:         verbose,
 		router:          httprouter.New(),
-		repo:            book.NewDropboxRepository(token, historyPrefix),
+		repo:            repo,
+		history:         history,
 		bookPath:        bookPath,
+		trashPath:       trashPath,
+		dropbox:         dropbox,
+		comics:          book.NewComics(repo),
+		audiobooks:      book.NewAudiobooks(repo, bookPath, trashPath, historyPath),
 		dictionaryToken: dictionaryToken,
+		adminToken:      adminToken,
 	}
 
 	s.initRender()
@@ -80,6 +111,9 @@ func (s *Server) initRender() {
 				"raw": func(s string) template.HTML {
 					return template.HTML(s)
 				},
+				"join":      strings.Join,
+				"folderURL": folderURL,
+				"joinPath":  path.Join,
 			},
 		},
 		IsDevelopment: false,
@@ -95,11 +129,35 @@ func (s *Server) initRouter() {
 	})
 
 	s.router.GET("/books", s.handleBooks)
+	s.router.GET("/books/*path", s.handleBooks)
+	s.router.POST("/books", s.handleUpload)
+	s.router.POST("/books/*path", s.handleUpload)
+	s.router.POST("/import", s.handleImport)
+	s.router.POST("/move/:id", s.handleMove)
+	s.router.POST("/delete/:id", s.handleDelete)
+	s.router.POST("/restore/:id", s.handleRestore)
+	s.router.GET("/trash", s.handleTrash)
 	s.router.GET("/download/:id", s.handleDownload)
+	s.router.GET("/cover/:id", s.handleCover)
+	s.router.GET("/comic/:id", s.handleComic)
+	s.router.GET("/comic/:id/:page", s.handleComicPage)
+	s.router.GET("/audiobook/:id", s.handleAudiobook)
+	s.router.GET("/audio/:id", s.handleAudio)
 	s.router.GET("/history/get/:id", s.handleHistoryGet)
 	s.router.POST("/history/set/:id", s.handleHistoryUpdate)
 	s.router.GET("/dictionary/:word", s.handleDictionary)
 
+	if s.adminToken != "" {
+		s.router.GET("/admin/backup", s.requireAdmin(s.handleBackup))
+		s.router.POST("/admin/restore", s.requireAdmin(s.handleRestoreBackup))
+	}
+
+	if s.dropbox != nil {
+		s.router.GET("/setup/dropbox", s.handleDropboxSetup)
+		s.router.GET("/setup/dropbox/connect", s.handleDropboxConnect)
+		s.router.GET("/setup/dropbox/callback", s.handleDropboxCallback)
+	}
+
 	s.router.GET("/static/*filepath", func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 		http.FileServer(public.Box).ServeHTTP(w, req)
 	})
@@ -122,16 +180,17 @@ func (s *Server) handleHistoryUpdate(w http.ResponseWriter, req *http.Request, p
 
 	decoder := json.NewDecoder(req.Body)
 	if err = decoder.Decode(&history); err != nil {
+		err = fmt.Errorf("%w: %v", errInvalidRequest, err)
 		return
 	}
 
 	if id = ps.ByName("id"); id == "" || history.Data == "" {
-		err = fmt.Errorf("invalid request")
+		err = errInvalidRequest
 		return
 	}
 
 	var updated book.History
-	if updated, err = s.repo.WriteHistory(id, history); err != nil {
+	if updated, err = s.history.WriteHistory(req.Context(), id, history); err != nil {
 		return
 	}
 
@@ -156,12 +215,12 @@ func (s *Server) handleHistoryGet(w http.ResponseWriter, req *http.Request, ps h
 
 	id := ps.ByName("id")
 	if id == "" {
-		err = fmt.Errorf("invalid request")
+		err = errInvalidRequest
 		return
 	}
 
 	var history book.History
-	if history, err = s.repo.GetHistory(id); err != nil {
+	if history, err = s.history.GetHistory(req.Context(), id); err != nil {
 		return
 	}
 
@@ -177,8 +236,8 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request, p httpro
 	// TODO: move this to a phased download that can be cached at the client side
 	// TODO: have more book metadata such as the number of pages so that we can show current progress at the client side
 	id := p.ByName("id")
-	id = strings.TrimRight(id, ".epub")
-	book, data, err := s.repo.Download(id)
+	id = strings.TrimSuffix(id, ".epub")
+	book, data, err := s.repo.Download(r.Context(), id)
 	if err != nil {
 		handleError(w, r, err)
 		return
@@ -192,6 +251,8 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request, p httpro
 
 	if book.IsPDF {
 		w.Header().Set("Content-Type", "application/pdf")
+	} else if book.IsComic || book.IsAudio {
+		w.Header().Set("Content-Type", "application/octet-stream")
 	} else {
 		w.Header().Set("Content-Type", "application/epub")
 	}
@@ -205,6 +266,105 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request, p httpro
 	return
 }
 
+func (s *Server) handleCover(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	covers, ok := s.repo.(book.CoverRepository)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := covers.Cover(r.Context(), p.ByName("id"))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	defer data.Close()
+
+	// Covers of converted books are often PNG or GIF rather than JPEG.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(data, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		handleError(w, r, err)
+		return
+	}
+	head = head[:n]
+
+	w.Header().Set("Cache-Control", "max-age=2592000")
+	w.Header().Set("Content-Type", http.DetectContentType(head))
+	w.Write(head)
+
+	if _, err = io.Copy(w, data); err != nil {
+		log.Printf("error writing data for request for %s: %v\n", r.URL.Path, err)
+	}
+}
+
+// handleComic returns the number of pages of a comic archive.
+func (s *Server) handleComic(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	pages, err := s.comics.Pages(r.Context(), p.ByName("id"))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"pages": pages})
+}
+
+// handleComicPage streams a page of a comic archive, numbered from 1.
+func (s *Server) handleComicPage(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	page, err := strconv.Atoi(p.ByName("page"))
+	if err != nil {
+		handleError(w, r, fmt.Errorf("%w: invalid page %q", errInvalidRequest, p.ByName("page")))
+		return
+	}
+
+	data, contentType, err := s.comics.Page(r.Context(), p.ByName("id"), page)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	defer data.Close()
+
+	// Pages change along with the revision of the archive, so they are only
+	// cached for a while.
+	w.Header().Set("Cache-Control", "max-age=3600")
+	w.Header().Set("Content-Type", contentType)
+
+	if _, err = io.Copy(w, data); err != nil {
+		log.Printf("error writing data for request for %s: %v\n", r.URL.Path, err)
+	}
+}
+
+// handleAudiobook returns the tracks and chapters of an audiobook.
+func (s *Server) handleAudiobook(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	audiobook, err := s.audiobooks.Describe(r.Context(), p.ByName("id"))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(audiobook)
+}
+
+// handleAudio streams a track of an audiobook, with support for range
+// requests so that players can seek in it.
+func (s *Server) handleAudio(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	track, data, err := s.audiobooks.Open(r.Context(), p.ByName("id"))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	defer data.Close()
+
+	// Tracks change along with their revision, so they are only cached for
+	// a while.
+	w.Header().Set("Cache-Control", "max-age=3600")
+	w.Header().Set("Content-Type", book.AudioType(track.Name))
+
+	http.ServeContent(w, r, track.Name, time.Time{}, data)
+}
+
 type dictionaryResponse struct {
 	ShortDef []string `json:"shortdef"`
 }
@@ -219,7 +379,13 @@ func (s *Server) handleDictionary(w http.ResponseWriter, r *http.Request, ps htt
 
 	url := fmt.Sprintf("https://dictionaryapi.com/api/v3/references/collegiate/json/%s?key=%s", word, s.dictionaryToken)
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		handleError(w, r, err)
 		return
@@ -256,23 +422,538 @@ func (s *Server) handleDictionary(w http.ResponseWriter, r *http.Request, ps htt
 	io.WriteString(w, string(jsonBytes))
 }
 
-func (s *Server) handleBooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	bl, err := s.repo.List(s.bookPath)
+// handleBooks shows a folder of the library, relative to bookPath, with its
+// subfolders and the books directly in it. With ?recursive=1 it shows every
+// book below the folder instead.
+func (s *Server) handleBooks(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	sub := strings.Trim(path.Clean("/"+ps.ByName("path")), "/")
+	dir := s.libraryPath(sub)
+
+	bl, err := book.ListRecursive(r.Context(), s.repo, dir)
 	if err != nil {
+		if errors.Is(err, book.ErrUnauthorized) && s.dropbox != nil && !s.dropbox.Connected() {
+			http.Redirect(w, r, "/setup/dropbox", http.StatusSeeOther)
+			return
+		}
+
 		handleError(w, r, err)
 		return
 	}
 
+	recursive := r.URL.Query().Get("recursive") != ""
+
+	bl = book.GroupAudiobooks(dir, bl)
+
+	var folders []book.Folder
+	if !recursive {
+		folders, bl = book.Split(bl)
+	}
+
+	var breadcrumbs []book.Folder
+	title := ""
+	if sub != "" {
+		parts := strings.Split(sub, "/")
+		for i, part := range parts {
+			breadcrumbs = append(breadcrumbs, book.Folder{
+				Name: part,
+				Path: strings.Join(parts[:i+1], "/"),
+			})
+		}
+		title = parts[len(parts)-1]
+	}
+
 	s.render.HTML(w, http.StatusOK, "books", map[string]interface{}{
 		"PageTitle":        "Books",
 		"ShowViewSelector": true,
-		"Title":            "",
+		"Title":            title,
+		"Path":             sub,
+		"Breadcrumbs":      breadcrumbs,
+		"Recursive":        recursive,
+		"Folders":          folders,
 		"Books":            bl,
 	})
 }
 
+// handleUpload adds the book in the "file" field of a multipart form to the
+// folder of the library the request was posted to. Scripts asking for JSON
+// get the new book back, plain forms are redirected to the folder.
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var err error
+
+	defer func() {
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+	}()
+
+	sub := strings.Trim(path.Clean("/"+ps.ByName("path")), "/")
+	dir := s.libraryPath(sub)
+
+	var reader *multipart.Reader
+	if reader, err = r.MultipartReader(); err != nil {
+		err = fmt.Errorf("%w: %v", errInvalidRequest, err)
+		return
+	}
+
+	// Stream the file straight from the request instead of buffering the
+	// whole form.
+	var part *multipart.Part
+	for {
+		if part, err = reader.NextPart(); err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("%w: no file uploaded", errInvalidRequest)
+			}
+			return
+		}
+
+		if part.FormName() == "file" && part.FileName() != "" {
+			break
+		}
+		part.Close()
+	}
+	defer part.Close()
+
+	name := path.Base(strings.ReplaceAll(part.FileName(), "\\", "/"))
+
+	var data io.Reader
+	if data, _, err = book.Validate(name, part); err != nil {
+		return
+	}
+
+	var uploaded book.Book
+	if uploaded, err = s.repo.Upload(r.Context(), dir, name, data); err != nil {
+		return
+	}
+
+	s.printLog("Uploaded %s to %s\n", uploaded.Name, dir)
+
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		http.Redirect(w, r, folderURL(sub), http.StatusSeeOther)
+		return
+	}
+
+	var jsonBytes []byte
+	if jsonBytes, err = json.Marshal(uploaded); err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonBytes)
+}
+
+// handleImport fetches the book at the address in the "url" field into the
+// folder of the library in the "folder" field.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var err error
+
+	defer func() {
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+	}()
+
+	source := r.FormValue("url")
+	if source == "" {
+		err = fmt.Errorf("%w: no url given", errInvalidRequest)
+		return
+	}
+
+	sub := strings.Trim(path.Clean("/"+r.FormValue("folder")), "/")
+	dir := s.libraryPath(sub)
+
+	var imported book.Book
+	if imported, err = book.Import(r.Context(), s.repo, source, dir); err != nil {
+		return
+	}
+
+	s.printLog("Imported %s from %s to %s\n", imported.Name, source, dir)
+
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		http.Redirect(w, r, folderURL(sub), http.StatusSeeOther)
+		return
+	}
+
+	var jsonBytes []byte
+	if jsonBytes, err = json.Marshal(imported); err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(jsonBytes)
+}
+
+// handleMove renames a book of the library to the "name" field and moves it
+// to the folder of the library in the "folder" field, along with its history.
+func (s *Server) handleMove(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.moveBook(w, r, ps.ByName("id"), false, s.libraryPath(r.FormValue("folder")), false)
+}
+
+// handleDelete moves a book of the library to the trash, into the same folder
+// it had in the library so that it can be restored there.
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.moveBook(w, r, ps.ByName("id"), false, subPath(s.trashPath, r.FormValue("folder")), true)
+}
+
+// handleRestore moves a book from the trash back to the library.
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.moveBook(w, r, ps.ByName("id"), true, s.libraryPath(r.FormValue("folder")), true)
+}
+
+// moveBook moves the book with the given ID, which must be in the trash if
+// fromTrash is set and in the library otherwise, so that nothing else the
+// repository holds, such as the history, can be moved. The book keeps its
+// extension, as it would not be listed without it.
+func (s *Server) moveBook(
+	w http.ResponseWriter, r *http.Request, id string, fromTrash bool, dir string, keepBoth bool,
+) {
+	var err error
+
+	defer func() {
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+	}()
+
+	name := r.FormValue("name")
+	if id == "" || name == "" {
+		err = errInvalidRequest
+		return
+	}
+
+	var books []book.Book
+	from := "library"
+	if fromTrash {
+		from = "trash"
+		books, err = s.trash(r.Context())
+	} else {
+		books, err = book.ListRecursive(r.Context(), s.repo, s.bookPath)
+	}
+	if err != nil {
+		return
+	}
+
+	var current *book.Book
+	for i := range books {
+		if books[i].ID == id {
+			current = &books[i]
+			break
+		}
+	}
+	if current == nil {
+		err = fmt.Errorf("%w: %s is not a book in the %s", book.ErrNotFound, id, from)
+		return
+	}
+
+	if ext := path.Ext(current.Name); !strings.EqualFold(path.Ext(name), ext) {
+		name += ext
+	}
+
+	var moved book.Book
+	if moved, err = book.MoveBook(r.Context(), s.repo, s.history, id, dir, name, keepBoth); err != nil {
+		return
+	}
+
+	s.printLog("Moved %s to %s/%s\n", id, dir, moved.Name)
+
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		back := r.Referer()
+		if back == "" {
+			back = folderURL()
+		}
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	var jsonBytes []byte
+	if jsonBytes, err = json.Marshal(moved); err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
+
+// handleTrash lists the books in the trash along with the folder they were
+// deleted from.
+func (s *Server) handleTrash(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	bl, err := s.trash(r.Context())
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	s.render.HTML(w, http.StatusOK, "trash", map[string]interface{}{
+		"PageTitle": "Trash",
+		"Title":     "Trash",
+		"Books":     bl,
+	})
+}
+
+// trash lists the books in the trash. Books that are listed in the library
+// as well are left out, as backends without folders of their own, such as a
+// Calibre library, list every book wherever they are asked to, and can not
+// move books to the trash anyway.
+func (s *Server) trash(ctx context.Context) (books []book.Book, err error) {
+	var trashed []book.Book
+	if trashed, err = book.ListRecursive(ctx, s.repo, s.trashPath); err != nil {
+		if errors.Is(err, book.ErrNotFound) {
+			err = nil
+		}
+		return
+	}
+
+	var library []book.Book
+	if library, err = book.ListRecursive(ctx, s.repo, s.bookPath); err != nil && !errors.Is(err, book.ErrNotFound) {
+		return
+	}
+	err = nil
+
+	inLibrary := map[string]bool{}
+	for _, b := range library {
+		inLibrary[b.ID] = true
+	}
+
+	for _, b := range trashed {
+		if !inLibrary[b.ID] {
+			books = append(books, b)
+		}
+	}
+
+	return
+}
+
+// requireAdmin only passes on requests carrying the admin token as a bearer
+// token.
+func (s *Server) requireAdmin(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		authorization := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(authorization[len("Bearer "):]), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			handleError(w, r, fmt.Errorf("%w: missing or wrong admin token", book.ErrUnauthorized))
+			return
+		}
+
+		handle(w, r, ps)
+	}
+}
+
+// handleBackup downloads a backup archive of the library and its history.
+// The archive is streamed as it is written, so a failure can only be
+// reported if nothing has been sent yet, and otherwise aborts the response.
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(
+		"attachment; filename=\"bookbrowser-backup-%s.zip\"", time.Now().UTC().Format("20060102-150405"),
+	))
+
+	out := &countingWriter{Writer: w}
+	manifest, err := book.WriteBackup(r.Context(), out, s.repo, s.history, s.bookPath)
+	if err != nil {
+		if out.n == 0 {
+			w.Header().Del("Content-Disposition")
+			handleError(w, r, err)
+			return
+		}
+
+		log.Printf("error writing backup after %d bytes: %v\n", out.n, err)
+		panic(http.ErrAbortHandler)
+	}
+
+	s.printLog("Backed up %d books and %d histories\n", manifest.Books, manifest.Histories)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = w.Writer.Write(p)
+	w.n += int64(n)
+	return
+}
+
+// handleRestoreBackup restores the backup archive in the "file" field, or
+// only reports what it would change if the "dry_run" field is set.
+func (s *Server) handleRestoreBackup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var err error
+
+	defer func() {
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+	}()
+
+	var file multipart.File
+	if file, _, err = r.FormFile("file"); err != nil {
+		err = fmt.Errorf("%w: %v", errInvalidRequest, err)
+		return
+	}
+	defer file.Close()
+
+	var data []byte
+	if data, err = ioutil.ReadAll(io.LimitReader(file, maxBackupSize+1)); err != nil {
+		return
+	}
+	if len(data) > maxBackupSize {
+		err = fmt.Errorf("%w: backup is larger than %d MB", errInvalidRequest, maxBackupSize>>20)
+		return
+	}
+
+	var backup book.Backup
+	if backup, err = book.ReadBackup(bytes.NewReader(data), int64(len(data))); err != nil {
+		return
+	}
+
+	dryRun := r.FormValue("dry_run") != ""
+
+	var changes []book.RestoreChange
+	if changes, err = book.RestoreBackup(r.Context(), backup, s.repo, s.history, s.bookPath, dryRun); err != nil {
+		return
+	}
+
+	if !dryRun {
+		s.printLog("Restored %d histories\n", len(changes))
+	}
+
+	var jsonBytes []byte
+	if jsonBytes, err = json.Marshal(map[string]interface{}{
+		"dry_run": dryRun,
+		"changes": changes,
+	}); err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
+
+// handleDropboxSetup shows whether Dropbox is connected and, given the setup
+// token in the "token" parameter, offers to connect it.
+func (s *Server) handleDropboxSetup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	token := r.URL.Query().Get("token")
+	if !s.dropbox.ValidSetupToken(token) {
+		token = ""
+	}
+
+	s.render.HTML(w, http.StatusOK, "setup", map[string]interface{}{
+		"PageTitle":   "Dropbox",
+		"Title":       "Dropbox",
+		"Connected":   s.dropbox.Connected(),
+		"Token":       token,
+		"RedirectURL": dropboxRedirectURL(r),
+	})
+}
+
+// handleDropboxConnect sends the user to Dropbox to allow access, if the
+// "token" parameter is the setup token.
+func (s *Server) handleDropboxConnect(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	authURL, err := s.dropbox.AuthCodeURL(r.URL.Query().Get("token"), dropboxRedirectURL(r))
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// handleDropboxCallback is where Dropbox sends the user back to once they
+// allowed or refused access.
+func (s *Server) handleDropboxCallback(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		handleError(w, r, fmt.Errorf("%w: dropbox refused access: %s %s", errInvalidRequest, reason, query.Get("error_description")))
+		return
+	}
+
+	if err := s.dropbox.Complete(r.Context(), query.Get("state"), query.Get("code")); err != nil {
+		handleError(w, r, err)
+		return
+	}
+
+	s.printLog("Connected to Dropbox\n")
+	http.Redirect(w, r, "/setup/dropbox", http.StatusSeeOther)
+}
+
+// dropboxRedirectURL returns the URL Dropbox sends users back to, which has
+// to be registered with the Dropbox app.
+func dropboxRedirectURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host + "/setup/dropbox/callback"
+}
+
+// libraryPath returns the path in the repository of a folder of the library.
+func (s *Server) libraryPath(folder string) string {
+	return subPath(s.bookPath, folder)
+}
+
+// subPath returns the path of folder below root, where folder may not
+// escape root.
+func subPath(root string, folder string) string {
+	if folder = strings.Trim(path.Clean("/"+folder), "/"); folder == "" {
+		return root
+	}
+
+	return strings.TrimSuffix(root, "/") + "/" + folder
+}
+
+// folderURL returns the link to the folder made of the given path segments,
+// any of which may be empty.
+func folderURL(parts ...string) string {
+	return (&url.URL{Path: path.Join(append([]string{"/books"}, parts...)...)}).EscapedPath()
+}
+
+// errorResponse is the body sent along with a failed request. Code is one of
+// "invalid_request", "invalid_book", "not_found", "conflict", "unauthorized",
+// "unavailable" or "internal", so that clients can act on it without parsing
+// Message.
+type errorResponse struct {
+	Code    string `json:"error"`
+	Message string `json:"message"`
+}
+
 func handleError(w http.ResponseWriter, r *http.Request, err error) {
-	w.WriteHeader(http.StatusInternalServerError)
-	io.WriteString(w, fmt.Sprintf("error handling request. reason: %v", err))
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		// The client went away, there is no one left to answer.
+		log.Printf("request for %s cancelled: %v\n", r.URL.Path, err)
+		return
+	}
+
+	status, code := http.StatusInternalServerError, "internal"
+	switch {
+	case errors.Is(err, errInvalidRequest):
+		status, code = http.StatusBadRequest, "invalid_request"
+	case errors.Is(err, book.ErrInvalid):
+		status, code = http.StatusBadRequest, "invalid_book"
+	case errors.Is(err, book.ErrNotFound):
+		status, code = http.StatusNotFound, "not_found"
+	case errors.Is(err, book.ErrConflict):
+		status, code = http.StatusConflict, "conflict"
+	case errors.Is(err, book.ErrUnauthorized):
+		status, code = http.StatusUnauthorized, "unauthorized"
+	case errors.Is(err, book.ErrUnavailable), errors.Is(err, context.DeadlineExceeded):
+		status, code = http.StatusServiceUnavailable, "unavailable"
+	}
+
+	jsonBytes, _ := json.Marshal(errorResponse{
+		Code:    code,
+		Message: fmt.Sprintf("error handling request. reason: %v", err),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
 	log.Printf("error handling request for %s: %v\n", r.URL.Path, err)
 }
@@ -0,0 +1,379 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/tushar9989/e-reader/book"
+)
+
+const testAdminToken = "secret"
+
+func newTestServer(t *testing.T) (*httptest.Server, *book.MemoryRepository) {
+	t.Helper()
+
+	repo := book.NewMemoryRepository()
+	if err := repo.SeedSamples("/books"); err != nil {
+		t.Fatalf("SeedSamples: %v", err)
+	}
+
+	s := NewServer(":0", false, repo, repo, "/books", "/trash", "/history", nil, "", testAdminToken)
+	ts := httptest.NewServer(s.router)
+	t.Cleanup(ts.Close)
+
+	return ts, repo
+}
+
+// findBook returns the book called name below /books.
+func findBook(t *testing.T, repo book.Repository, name string) book.Book {
+	t.Helper()
+
+	books, err := book.ListRecursive(context.Background(), repo, "/books")
+	if err != nil {
+		t.Fatalf("listing /books: %v", err)
+	}
+
+	for _, b := range books {
+		if b.Name == name {
+			return b
+		}
+	}
+
+	t.Fatalf("%s is not in /books", name)
+	return book.Book{}
+}
+
+func get(t *testing.T, ts *httptest.Server, path string) (*http.Response, string) {
+	t.Helper()
+
+	res, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	return res, readBody(t, res)
+}
+
+func postForm(t *testing.T, ts *httptest.Server, path string, form url.Values) (*http.Response, string) {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s: %v", path, err)
+	}
+	return res, readBody(t, res)
+}
+
+func readBody(t *testing.T, res *http.Response) string {
+	t.Helper()
+
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	return string(body)
+}
+
+func TestBooksListsFolders(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	res, body := get(t, ts, "/books")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET /books: status %d", res.StatusCode)
+	}
+	for _, want := range []string{"A Field Guide to Clouds", "Fiction", "Reference"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("GET /books does not show %s", want)
+		}
+	}
+	if strings.Contains(body, "The Lighthouse Keeper") {
+		t.Errorf("GET /books shows a book of a subfolder")
+	}
+
+	_, body = get(t, ts, "/books/Fiction")
+	if !strings.Contains(body, "The Lighthouse Keeper") || !strings.Contains(body, "Short Stories") {
+		t.Errorf("GET /books/Fiction does not show its book and subfolder")
+	}
+
+	_, body = get(t, ts, "/books?recursive=1")
+	if !strings.Contains(body, "Three Small Tales") {
+		t.Errorf("GET /books?recursive=1 does not show books of subfolders")
+	}
+
+	if res, _ := get(t, ts, "/books/Missing"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /books/Missing: status %d, want 404", res.StatusCode)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	ts, repo := newTestServer(t)
+	b := findBook(t, repo, "Reading Notes.pdf")
+
+	res, body := get(t, ts, "/download/"+b.ID)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("download: status %d", res.StatusCode)
+	}
+	if got := res.Header.Get("Content-Type"); got != "application/pdf" {
+		t.Errorf("download: Content-Type %s, want application/pdf", got)
+	}
+	if !strings.HasPrefix(body, "%PDF") {
+		t.Errorf("download: body is not a PDF")
+	}
+
+	if res, _ := get(t, ts, "/download/missing"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("download of a missing book: status %d, want 404", res.StatusCode)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	ts, repo := newTestServer(t)
+	b := findBook(t, repo, "A Field Guide to Clouds.epub")
+
+	set := func(history book.History) (*http.Response, book.History) {
+		data, _ := json.Marshal(history)
+		res, err := http.Post(ts.URL+"/history/set/"+b.ID, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var updated book.History
+		json.Unmarshal([]byte(readBody(t, res)), &updated)
+		return res, updated
+	}
+
+	res, first := set(book.History{Data: "chapter 1"})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("first write: status %d", res.StatusCode)
+	}
+
+	if res, _ := set(book.History{Data: "stale"}); res.StatusCode != http.StatusConflict {
+		t.Errorf("write with an outdated version: status %d, want 409", res.StatusCode)
+	}
+
+	if res, _ := set(book.History{Data: "chapter 2", Version: first.Version}); res.StatusCode != http.StatusCreated {
+		t.Errorf("second write: status %d", res.StatusCode)
+	}
+
+	_, body := get(t, ts, "/history/get/"+b.ID)
+	var got book.History
+	if err := json.Unmarshal([]byte(body), &got); err != nil || got.Data != "chapter 2" {
+		t.Errorf("history = %s, want chapter 2", body)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	ts, repo := newTestServer(t)
+	sample, data, err := repo.Download(context.Background(), findBook(t, repo, "Reading Notes.pdf").ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(data)
+	data.Close()
+
+	upload := func(name string, content []byte) *http.Response {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", name)
+		part.Write(content)
+		form.Close()
+
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/books/Reference", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("Accept", "application/json")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readBody(t, res)
+		return res
+	}
+
+	if res := upload(sample.Name, content); res.StatusCode != http.StatusCreated {
+		t.Fatalf("upload: status %d", res.StatusCode)
+	}
+	findBook(t, repo, "Reading Notes (1).pdf")
+
+	if res := upload("notes.pdf", []byte("not a pdf")); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("upload of an invalid book: status %d, want 400", res.StatusCode)
+	}
+}
+
+func TestMoveDeleteAndRestore(t *testing.T) {
+	ts, repo := newTestServer(t)
+	b := findBook(t, repo, "A Field Guide to Clouds.epub")
+	ctx := context.Background()
+
+	if _, err := repo.WriteHistory(ctx, b.ID, book.History{Data: "chapter 3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, body := postForm(t, ts, "/move/"+b.ID, url.Values{"name": {"Clouds"}, "folder": {"Reference"}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("move: status %d: %s", res.StatusCode, body)
+	}
+	moved := findBook(t, repo, "Clouds.epub")
+	if moved.Dir != "Reference" {
+		t.Errorf("moved book is in %q, want Reference", moved.Dir)
+	}
+	if history, _ := repo.GetHistory(ctx, moved.ID); history.Data != "chapter 3" {
+		t.Errorf("history of the moved book = %q, want chapter 3", history.Data)
+	}
+
+	res, body = postForm(t, ts, "/delete/"+moved.ID, url.Values{"name": {"Clouds.epub"}, "folder": {"Reference"}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("delete: status %d: %s", res.StatusCode, body)
+	}
+	var trashed book.Book
+	json.Unmarshal([]byte(body), &trashed)
+
+	_, body = get(t, ts, "/trash")
+	if !strings.Contains(body, "Clouds.epub") {
+		t.Errorf("trash does not show the deleted book")
+	}
+
+	res, body = postForm(t, ts, "/restore/"+trashed.ID, url.Values{"name": {"Clouds.epub"}, "folder": {""}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("restore: status %d: %s", res.StatusCode, body)
+	}
+	restored := findBook(t, repo, "Clouds.epub")
+	if history, _ := repo.GetHistory(ctx, restored.ID); history.Data != "chapter 3" {
+		t.Errorf("history of the restored book = %q, want chapter 3", history.Data)
+	}
+}
+
+func TestMoveRefusesWhatIsNotABook(t *testing.T) {
+	ts, repo := newTestServer(t)
+	b := findBook(t, repo, "A Field Guide to Clouds.epub")
+
+	if _, err := repo.WriteHistory(context.Background(), b.ID, book.History{Data: "chapter 3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Memory repository IDs are encoded paths, so any path can be crafted.
+	for _, p := range []string{"/history/" + b.ID, "/books", "/other/book.epub"} {
+		ID := base64.RawURLEncoding.EncodeToString([]byte(p))
+		res, _ := postForm(t, ts, "/delete/"+ID, url.Values{"name": {"x.epub"}, "folder": {""}})
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("deleting %s: status %d, want 404", p, res.StatusCode)
+		}
+	}
+
+	res, _ := postForm(t, ts, "/restore/"+b.ID, url.Values{"name": {b.Name}, "folder": {""}})
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("restoring a book that is not in the trash: status %d, want 404", res.StatusCode)
+	}
+}
+
+func TestMoveKeepsExtension(t *testing.T) {
+	ts, repo := newTestServer(t)
+	b := findBook(t, repo, "Reading Notes.pdf")
+
+	res, body := postForm(t, ts, "/move/"+b.ID, url.Values{"name": {"Notes.txt"}, "folder": {"Reference"}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("move: status %d: %s", res.StatusCode, body)
+	}
+	findBook(t, repo, "Notes.txt.pdf")
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	ts, _ := newTestServer(t)
+
+	backup := func(authorization string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/admin/backup", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	for _, authorization := range []string{"", "Bearer wrong", "Bearer ", testAdminToken, "Basic " + testAdminToken} {
+		res := backup(authorization)
+		readBody(t, res)
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("backup with authorization %q: status %d, want 401", authorization, res.StatusCode)
+		}
+	}
+
+	res := backup("Bearer " + testAdminToken)
+	body := readBody(t, res)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("backup: status %d", res.StatusCode)
+	}
+	if _, err := zip.NewReader(strings.NewReader(body), int64(len(body))); err != nil {
+		t.Errorf("backup is not a zip archive: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/admin/restore", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readBody(t, res)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("restore without token: status %d, want 401", res.StatusCode)
+	}
+}
+
+func TestAdminDisabledWithoutToken(t *testing.T) {
+	repo := book.NewMemoryRepository()
+	s := NewServer(":0", false, repo, repo, "/books", "/trash", "/history", nil, "", "")
+	ts := httptest.NewServer(s.router)
+	defer ts.Close()
+
+	res, _ := get(t, ts, "/admin/backup")
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("backup without an admin token configured: status %d, want 404", res.StatusCode)
+	}
+}
+
+// coverRepository serves the same cover for every book.
+type coverRepository struct {
+	*book.MemoryRepository
+	cover []byte
+}
+
+func (repo *coverRepository) Cover(ctx context.Context, ID string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(repo.cover)), nil
+}
+
+func TestCoverContentType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	gif := []byte("GIF89a\x01\x00\x01\x00")
+	jpeg := []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+
+	for want, cover := range map[string][]byte{"image/png": png, "image/gif": gif, "image/jpeg": jpeg} {
+		repo := &coverRepository{MemoryRepository: book.NewMemoryRepository(), cover: cover}
+		ts := httptest.NewServer(NewServer(":0", false, repo, repo, "/books", "/trash", "/history", nil, "", "").router)
+
+		res, body := get(t, ts, "/cover/any")
+		ts.Close()
+
+		if got := res.Header.Get("Content-Type"); got != want {
+			t.Errorf("Content-Type of a %s cover = %s", want, got)
+		}
+		if body != string(cover) {
+			t.Errorf("%s cover was not sent whole", want)
+		}
+	}
+}